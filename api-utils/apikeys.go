@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"golang.org/x/exp/slices"
+)
+
+// API key scopes. Keys only grant the scopes they were created with; the admin scope grants every scope.
+const (
+	API_KEY_SCOPE_LINKS_READ  = "links:read"
+	API_KEY_SCOPE_LINKS_WRITE = "links:write"
+	API_KEY_SCOPE_ADMIN       = "admin"
+	API_KEY_SCOPE_PAGEVIEWS   = "pageviews"
+)
+
+var apiKeyScopes = []string{API_KEY_SCOPE_LINKS_READ, API_KEY_SCOPE_LINKS_WRITE, API_KEY_SCOPE_ADMIN, API_KEY_SCOPE_PAGEVIEWS}
+
+// Scopes a session may grant to its own keys; the other scopes need an admin key.
+var sessionApiKeyScopes = []string{API_KEY_SCOPE_LINKS_READ, API_KEY_SCOPE_LINKS_WRITE}
+
+const API_KEY_PREFIX = "nlk_"
+
+// LEGACY_API_KEY_ID is the key id of NOLONGR_SERVER_API_KEY, which is still accepted as an admin key.
+const LEGACY_API_KEY_ID = "server"
+
+const apiKeyDisplayPrefixLength = len(API_KEY_PREFIX) + 6
+
+// lastUsed is only written again once it is this old, so that every request does not cost a write.
+const apiKeyLastUsedInterval = time.Minute
+
+// ApiKey is a stored API key. Only a hash of the key itself is stored; Prefix is its first characters,
+// to recognise it in listings. SessionToken is the session whose links the key manages, and UserID the account
+// when the key was created by a logged in user.
+type ApiKey struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Prefix       string   `json:"prefix"`
+	Scopes       []string `json:"scopes"`
+	SessionToken string   `json:"session_token"`
+	UserID       string   `json:"user_id"`
+	DateCreated  string   `json:"date_created"`
+	LastUsed     *string  `json:"last_used"`
+	RevokedAt    *string  `json:"revoked_at"`
+}
+
+// CreatedApiKey is the response of POST /api/api-keys, the only time the key is returned.
+type CreatedApiKey struct {
+	ApiKey
+	Key string `json:"key"`
+}
+
+func generateApiKey() (string, error) {
+	token, err := generateToken()
+	return API_KEY_PREFIX + token, err
+}
+
+// CreateApiKey stores a new key for the session and user and returns it with the key itself.
+func CreateApiKey(name string, scopes []string, sessionToken string, userID string) (CreatedApiKey, error) {
+	key, err := generateApiKey()
+	if err != nil {
+		log.Println("(CreateApiKey) generateApiKey error:", err)
+		return CreatedApiKey{}, err
+	}
+	apiKey := ApiKey{
+		ID:           ksuid.New().String(),
+		Name:         name,
+		Prefix:       key[:apiKeyDisplayPrefixLength],
+		Scopes:       scopes,
+		SessionToken: sessionToken,
+		UserID:       userID,
+		DateCreated:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := InsertApiKey(apiKey, hashToken(key)); err != nil {
+		return CreatedApiKey{}, err
+	}
+	return CreatedApiKey{ApiKey: apiKey, Key: key}, nil
+}
+
+var apiKeyLastUsed struct {
+	sync.Mutex
+	times map[string]time.Time
+}
+
+// touchApiKey records that the key was used, at most once per apiKeyLastUsedInterval per server instance.
+func touchApiKey(id string, now time.Time) {
+	apiKeyLastUsed.Lock()
+	if apiKeyLastUsed.times == nil {
+		apiKeyLastUsed.times = map[string]time.Time{}
+	}
+	if now.Sub(apiKeyLastUsed.times[id]) < apiKeyLastUsedInterval {
+		apiKeyLastUsed.Unlock()
+		return
+	}
+	apiKeyLastUsed.times[id] = now
+	apiKeyLastUsed.Unlock()
+
+	if err := UpdateApiKeyLastUsed(id, now.UTC().Format(time.RFC3339)); err != nil {
+		log.Println("(touchApiKey) error:", err)
+	}
+}
+
+// authenticateApiKey returns the owner of a key, or false when the key is unknown or revoked.
+func authenticateApiKey(key string) (Owner, bool) {
+	if isServerApiKey(key) {
+		return Owner{IsAdmin: true, ApiKeyID: LEGACY_API_KEY_ID, Scopes: apiKeyScopes}, true
+	}
+	if !strings.HasPrefix(key, API_KEY_PREFIX) {
+		return Owner{}, false
+	}
+
+	apiKey, err := GetApiKeyByHash(hashToken(key))
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Println("(authenticateApiKey) error:", err)
+		}
+		return Owner{}, false
+	}
+	if apiKey.RevokedAt != nil {
+		return Owner{}, false
+	}
+
+	touchApiKey(apiKey.ID, time.Now())
+	return Owner{
+		SessionToken: apiKey.SessionToken,
+		UserID:       apiKey.UserID,
+		IsAdmin:      slices.Contains(apiKey.Scopes, API_KEY_SCOPE_ADMIN),
+		ApiKeyID:     apiKey.ID,
+		Scopes:       apiKey.Scopes,
+	}, true
+}
+
+// canManageApiKeys reports whether the owner may create, list and revoke keys: a session, a user, or an admin key.
+// Keys that are not admin keys cannot manage keys, so that a leaked key cannot create others.
+func (owner Owner) canManageApiKeys() bool {
+	return owner.IsAdmin || (owner.ApiKeyID == "" && owner.isAuthenticated())
+}
+
+// canManageApiKey follows canManage: keys of an account are managed by the account, other keys by their session.
+func (owner Owner) canManageApiKey(apiKey ApiKey) bool {
+	if owner.IsAdmin {
+		return true
+	} else if !owner.canManageApiKeys() {
+		return false
+	} else if apiKey.UserID != "" {
+		return owner.UserID == apiKey.UserID
+	}
+	return owner.SessionToken != "" && owner.SessionToken == apiKey.SessionToken
+}
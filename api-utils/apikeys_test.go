@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGenerateApiKey(t *testing.T) {
+	key, err := generateApiKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := generateApiKey()
+	if !strings.HasPrefix(key, API_KEY_PREFIX) || len(key) <= apiKeyDisplayPrefixLength || key == other {
+		t.Errorf("generateApiKey() = %q, %q, want distinct keys starting with %s", key, other, API_KEY_PREFIX)
+	}
+	if hash := hashToken(key); len(hash) != 64 || hash != hashToken(key) || hash == hashToken(other) || strings.Contains(hash, key) {
+		t.Errorf("hashToken(%q) = %q, want a stable hex SHA-256 hash", key, hash)
+	}
+}
+
+func TestAuthenticateApiKey(t *testing.T) {
+	t.Setenv("NOLONGR_SERVER_API_KEY", "test-server-key")
+	owner, ok := authenticateApiKey("test-server-key")
+	if !ok || !owner.IsAdmin || owner.ApiKeyID != LEGACY_API_KEY_ID || len(owner.Scopes) != len(apiKeyScopes) {
+		t.Errorf("authenticateApiKey(server key) = %+v, %v, want an admin key with every scope", owner, ok)
+	}
+	// Keys without the prefix are rejected before the database is queried
+	for _, key := range []string{"wrong-key", "test-server-key ", ""} {
+		if owner, ok := authenticateApiKey(key); ok {
+			t.Errorf("authenticateApiKey(%q) = %+v, want no owner", key, owner)
+		}
+	}
+}
+
+func TestOwnerCanManageApiKey(t *testing.T) {
+	sessionKey := ApiKey{ID: "k1", SessionToken: "session-a"}
+	userKey := ApiKey{ID: "k2", SessionToken: "session-a", UserID: "user-a"}
+	tests := []struct {
+		name   string
+		owner  Owner
+		apiKey ApiKey
+		want   bool
+	}{
+		{name: "session of the key", owner: Owner{SessionToken: "session-a"}, apiKey: sessionKey, want: true},
+		{name: "another session", owner: Owner{SessionToken: "session-b"}, apiKey: sessionKey},
+		{name: "session of an account's key", owner: Owner{SessionToken: "session-a"}, apiKey: userKey},
+		{name: "account of the key", owner: Owner{UserID: "user-a"}, apiKey: userKey, want: true},
+		{name: "key of the same session", owner: Owner{ApiKeyID: "k3", SessionToken: "session-a", Scopes: []string{API_KEY_SCOPE_LINKS_WRITE}}, apiKey: sessionKey},
+		{name: "anonymous", owner: Owner{}, apiKey: ApiKey{}},
+		{name: "admin key", owner: Owner{ApiKeyID: "k3", IsAdmin: true}, apiKey: userKey, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.owner.canManageApiKey(test.apiKey); got != test.want {
+				t.Errorf("canManageApiKey() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApiKeyScopesAreEnforced(t *testing.T) {
+	readKey := Owner{ApiKeyID: "read", SessionToken: "session-a", Scopes: []string{API_KEY_SCOPE_LINKS_READ}}
+	writeKey := Owner{ApiKeyID: "write", SessionToken: "session-a", Scopes: []string{API_KEY_SCOPE_LINKS_WRITE}}
+	pageviewsKey := Owner{ApiKeyID: "pageviews", SessionToken: "session-a", Scopes: []string{API_KEY_SCOPE_PAGEVIEWS}}
+	tests := []struct {
+		name          string
+		owner         Owner
+		method        string
+		path          string
+		body          string
+		wantScope     string
+		wantNotDenied bool
+	}{
+		{name: "create with a read key", owner: readKey, method: http.MethodPost, path: "/api/v1/urls", body: `{"destination":"https://example.com"}`, wantScope: API_KEY_SCOPE_LINKS_WRITE},
+		{name: "bulk update with a read key", owner: readKey, method: http.MethodPatch, path: "/api/v1/urls/batch", body: `{"ids":["a"],"paused":true}`, wantScope: API_KEY_SCOPE_LINKS_WRITE},
+		{name: "search with a write key", owner: writeKey, method: http.MethodGet, path: "/api/v1/user-session-urls/search?q=docs", wantScope: API_KEY_SCOPE_LINKS_READ},
+		{name: "page view with a read key", owner: readKey, method: http.MethodGet, path: "/api/v1/urls/page-views/abc", wantScope: API_KEY_SCOPE_PAGEVIEWS},
+		{name: "list every link with a read key", owner: readKey, method: http.MethodGet, path: "/api/v1/urls", wantScope: API_KEY_SCOPE_ADMIN},
+		{name: "create a key with a write key", owner: writeKey, method: http.MethodPost, path: "/api/v1/api-keys", body: `{"name":"ci","scopes":["links:read"]}`, wantScope: API_KEY_SCOPE_ADMIN},
+		{name: "create with a write key", owner: writeKey, method: http.MethodPost, path: "/api/v1/urls", body: `{"destination":"not a url"}`, wantNotDenied: true},
+		{name: "search with a read key", owner: readKey, method: http.MethodGet, path: "/api/v1/user-session-urls/search?q=a", wantNotDenied: true},
+		{name: "page view with a pageviews key", owner: pageviewsKey, method: http.MethodGet, path: "/api/v1/urls/page-views/abc", wantNotDenied: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := performRequest(newTestRouterWithOwner(test.owner), test.method, test.path, test.body, nil, nil)
+			if test.wantNotDenied {
+				if response.Code == http.StatusUnauthorized || response.Code == http.StatusForbidden {
+					t.Errorf("response = %d %s, want the scope to be accepted", response.Code, response.Body.String())
+				}
+				return
+			}
+			wantMessage := "The API key does not have the " + test.wantScope + " scope"
+			if response.Code != http.StatusForbidden || !strings.Contains(response.Body.String(), ERROR_CODE_FORBIDDEN) || !strings.Contains(response.Body.String(), wantMessage) {
+				t.Errorf("response = %d %s, want %d %q", response.Code, response.Body.String(), http.StatusForbidden, wantMessage)
+			}
+		})
+	}
+}
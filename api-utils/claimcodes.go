@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// CLAIM_CODE_TTL is short, as a claim code hands over its session to whoever redeems it.
+const CLAIM_CODE_TTL = 10 * time.Minute
+const CLAIM_CODE_LENGTH = 8
+
+// claimCodeLetters leaves out 0, O, 1 and I, which are easily mistaken for each other when typed from another screen.
+var claimCodeLetters = []rune("ABCDEFGHJKLMNPQRSTUVWXYZ23456789")
+
+// ClaimCode is shown on the device that issued it, to be typed on another device.
+type ClaimCode struct {
+	Code      string `json:"code"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// ClaimResult is the response of redeeming a claim code. SessionToken is the session both devices now share and
+// MergedUrls counts the links of the redeeming session that were moved to it.
+type ClaimResult struct {
+	SessionToken string `json:"session_token"`
+	MergedUrls   int64  `json:"merged_urls"`
+}
+
+func generateClaimCode() string {
+	code := make([]rune, CLAIM_CODE_LENGTH)
+	for i := range code {
+		code[i] = claimCodeLetters[RandomInt64(int64(len(claimCodeLetters)))]
+	}
+	return string(code[:CLAIM_CODE_LENGTH/2]) + "-" + string(code[CLAIM_CODE_LENGTH/2:])
+}
+
+// normalizeClaimCode accepts codes typed in lower case, with spaces or without the dash.
+func normalizeClaimCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(code))
+}
+
+// IssueClaimCode returns a code that lets another session take over sessionToken.
+func IssueClaimCode(sessionToken string) (ClaimCode, error) {
+	code := generateClaimCode()
+	now := time.Now().UTC()
+	claimCode := ClaimCode{Code: code, ExpiresAt: now.Add(CLAIM_CODE_TTL).Format(time.RFC3339)}
+	err := InsertClaimCode(hashToken(normalizeClaimCode(code)), sessionToken, now.Format(time.RFC3339), claimCode.ExpiresAt)
+	return claimCode, err
+}
+
+// RedeemClaimCode merges the redeeming session into the session that issued the code: its links and API keys are
+// moved to the issuing session, which the redeeming device then uses. Each code can only be redeemed once.
+func RedeemClaimCode(code string, sessionToken string) (ClaimResult, error) {
+	issuingSession, merged, err := MergeSessionWithClaimCode(hashToken(normalizeClaimCode(code)), sessionToken, time.Now().UTC().Format(time.RFC3339))
+	if errors.Is(err, ErrNotFound) {
+		return ClaimResult{}, ErrInvalidToken
+	} else if err != nil {
+		return ClaimResult{}, err
+	}
+	return ClaimResult{SessionToken: issuingSession, MergedUrls: merged}, nil
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateClaimCode(t *testing.T) {
+	format := regexp.MustCompile("^[ABCDEFGHJKLMNPQRSTUVWXYZ23456789]{4}-[ABCDEFGHJKLMNPQRSTUVWXYZ23456789]{4}$")
+	for i := 0; i < 100; i++ {
+		code := generateClaimCode()
+		if !format.MatchString(code) {
+			t.Fatalf("generateClaimCode() = %q", code)
+		}
+		if len(normalizeClaimCode(code)) != CLAIM_CODE_LENGTH {
+			t.Fatalf("normalizeClaimCode(%q) = %q", code, normalizeClaimCode(code))
+		}
+	}
+}
+
+func TestValidateClaimCode(t *testing.T) {
+	tests := []struct {
+		code  string
+		valid bool
+	}{
+		{code: "ABCD-EFGH", valid: true},
+		{code: "abcd efgh", valid: true},
+		{code: "ABCDEFGH", valid: true},
+		{code: "", valid: false},
+		{code: "   ", valid: false},
+		{code: "ABCD-EFG", valid: false},
+		{code: "ABCD-EFGHJ", valid: false},
+	}
+	for _, test := range tests {
+		fieldErrors := FieldErrors{}
+		validateClaimCode(test.code, fieldErrors)
+		if _, rejected := fieldErrors["code"]; rejected == test.valid {
+			t.Errorf("validateClaimCode(%q) errors = %v, want valid %v", test.code, fieldErrors, test.valid)
+		}
+	}
+	if normalizeClaimCode("abcd efgh") != normalizeClaimCode("ABCD-EFGH") {
+		t.Error("codes typed differently normalize differently")
+	}
+}
+
+func TestMergeSessionWithClaimCodeNeedsSession(t *testing.T) {
+	_, _, err := MergeSessionWithClaimCode(hashToken("ABCDEFGH"), "", time.Now().UTC().Format(time.RFC3339))
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("MergeSessionWithClaimCode() error = %v, want %v", err, ErrInvalidRequest)
+	}
+	if _, err := RedeemClaimCode("ABCD-EFGH", ""); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("RedeemClaimCode() error = %v, want %v", err, ErrInvalidRequest)
+	}
+}
+
+func TestRedeemClaimCodeRoute(t *testing.T) {
+	t.Setenv("NOLONGR_SERVER_API_KEY", "test-server-key")
+	tests := []struct {
+		name       string
+		body       string
+		header     map[string]string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "no session", body: `{"code":"ABCD-EFGH"}`, wantStatus: http.StatusUnauthorized, wantCode: ERROR_CODE_UNAUTHORIZED},
+		{name: "API key", body: `{"code":"ABCD-EFGH"}`, header: map[string]string{"Authorization": "Bearer test-server-key"}, wantStatus: http.StatusForbidden, wantCode: ERROR_CODE_FORBIDDEN},
+		{name: "malformed code", body: `{"code":"ABC"}`, wantStatus: http.StatusBadRequest, wantCode: ERROR_CODE_VALIDATION_FAILED},
+		{name: "no code", body: `{}`, wantStatus: http.StatusBadRequest, wantCode: ERROR_CODE_VALIDATION_FAILED},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := performRequest(newTestRouter(), http.MethodPost, "/api/v1/claim-codes/redeem", test.body, nil, test.header)
+			if response.Code != test.wantStatus || !strings.Contains(response.Body.String(), test.wantCode) {
+				t.Errorf("response = %d %s, want %d %s", response.Code, response.Body.String(), test.wantStatus, test.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+)
+
+// Requests authenticated by cookie that change state must send the csrf_token cookie back in the X-CSRF-Token
+// header. Another site can make the browser send the cookie, but cannot read it to set the header.
+const CSRF_COOKIE = "csrf_token"
+const CSRF_HEADER = "X-CSRF-Token"
+const CSRF_COOKIE_MAX_AGE = 60 * 60 * 1440
+
+// CsrfToken is the response of GET /csrf-token, and the value of the csrf_token cookie.
+type CsrfToken struct {
+	Token string `json:"token"`
+}
+
+var csrfSafeMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// signCsrfNonce binds the nonce to the session and login of the caller, so that a token is only accepted with
+// the cookies it was issued to.
+func signCsrfNonce(secret string, sessionToken string, userSession string, nonce string) string {
+	mac := hmac.New(sha256.New, deriveSessionKey(secret, "csrf"))
+	for _, value := range []string{sessionToken, userSession, nonce} {
+		mac.Write([]byte(value))
+		mac.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newCsrfToken returns a random nonce signed with the newest session secret for the session and login. Someone
+// able to plant cookies on the site cannot use a token of their own, as it is bound to their session.
+func newCsrfToken(sessionToken string, userSession string) (string, error) {
+	nonce, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	return nonce + "." + signCsrfNonce(loadSessionSecrets()[0], sessionToken, userSession, nonce), nil
+}
+
+// isValidCsrfToken checks the signature against every session secret, so tokens survive a secret rotation as
+// long as sessions do.
+func isValidCsrfToken(token string, sessionToken string, userSession string) bool {
+	nonce, signature, ok := strings.Cut(token, ".")
+	if !ok || nonce == "" {
+		return false
+	}
+	for _, secret := range loadSessionSecrets() {
+		if hmac.Equal([]byte(signature), []byte(signCsrfNonce(secret, sessionToken, userSession, nonce))) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestUserSession returns the login cookie the request was sent with.
+func requestUserSession(context *gin.Context) string {
+	userSession, _ := context.Cookie(USER_SESSION_COOKIE)
+	return userSession
+}
+
+func setCsrfCookie(context *gin.Context, token string) {
+	context.SetSameSite(http.SameSiteLaxMode)
+	// Not HttpOnly: the frontend reads it to send it back in the header
+	context.SetCookie(CSRF_COOKIE, token, CSRF_COOKIE_MAX_AGE, "/", "", true, false)
+}
+
+// reissueCsrfToken replaces the CSRF cookie when the session or login of the caller changes, as the token of the
+// previous ones is no longer accepted.
+func reissueCsrfToken(context *gin.Context, sessionToken string, userSession string) {
+	token, err := newCsrfToken(sessionToken, userSession)
+	if err != nil {
+		log.Println("(reissueCsrfToken) newCsrfToken error:", err)
+		return
+	}
+	setCsrfCookie(context, token)
+}
+
+// hasCookieAuthentication reports whether the request carries a session or login cookie.
+func hasCookieAuthentication(context *gin.Context) bool {
+	for _, name := range []string{SESSION_TOKEN_KEY, USER_SESSION_COOKIE} {
+		if value, err := context.Cookie(name); err == nil && value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// csrfMiddleware rejects state-changing requests authenticated by cookie whose X-CSRF-Token header does not
+// match a csrf_token cookie issued to the same session and login. Requests with a valid API key and Vercel cron jobs are exempt: they do not
+// rely on cookies, and a browser never adds their Authorization header on its own.
+func csrfMiddleware() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if slices.Contains(csrfSafeMethods, context.Request.Method) || !hasCookieAuthentication(context) || isCronRequest(context) {
+			context.Next()
+			return
+		}
+		if requestApiKey(context) != "" {
+			if owner, _ := resolveOwner(context); owner.ApiKeyID != "" {
+				context.Next()
+				return
+			}
+		}
+
+		cookie, _ := context.Cookie(CSRF_COOKIE)
+		header := context.GetHeader(CSRF_HEADER)
+		if cookie == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie)) != 1 ||
+			!isValidCsrfToken(cookie, requestSessionToken(context), requestUserSession(context)) {
+			RespondWithError(context, http.StatusForbidden, ErrorResponse{
+				Message: "Missing or invalid CSRF token: send the value of the csrf_token cookie, from GET /csrf-token, in the X-CSRF-Token header",
+				Code:    ERROR_CODE_CSRF_FAILED,
+			})
+			return
+		}
+		context.Next()
+	}
+}
+
+// handleRouteGetCsrfToken returns the caller's CSRF token, setting the cookie when it is missing or not valid for
+// the caller's session and login. A valid token is kept, so that pages open in other tabs keep working.
+func handleRouteGetCsrfToken(context *gin.Context) {
+	sessionToken, userSession := requestSessionToken(context), requestUserSession(context)
+	token, err := context.Cookie(CSRF_COOKIE)
+	if err != nil || !isValidCsrfToken(token, sessionToken, userSession) {
+		token, err = newCsrfToken(sessionToken, userSession)
+		if err != nil {
+			log.Println("(handleRouteGetCsrfToken) newCsrfToken error:", err)
+			RespondWithError(context, http.StatusInternalServerError, ErrorResponse{
+				Message: "Server error",
+				Error:   err.Error(),
+				Code:    ERROR_CODE_INTERNAL,
+			})
+			return
+		}
+		setCsrfCookie(context, token)
+	}
+	context.Header("Cache-Control", "no-store")
+	RespondWithResult(context, http.StatusOK, CsrfToken{Token: token})
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func newTestCsrfToken(t *testing.T, sessionToken string, userSession string) string {
+	t.Helper()
+	token, err := newCsrfToken(sessionToken, userSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestIsValidCsrfToken(t *testing.T) {
+	token := newTestCsrfToken(t, "session-a", "login-a")
+	tests := []struct {
+		name         string
+		token        string
+		sessionToken string
+		userSession  string
+		want         bool
+	}{
+		{name: "issued to the caller", token: token, sessionToken: "session-a", userSession: "login-a", want: true},
+		{name: "another session", token: token, sessionToken: "session-b", userSession: "login-a"},
+		{name: "another login", token: token, sessionToken: "session-a", userSession: "login-b"},
+		{name: "logged out", token: token, sessionToken: "session-a"},
+		{name: "forged signature", token: "nonce.c2lnbmF0dXJl", sessionToken: "session-a", userSession: "login-a"},
+		{name: "no signature", token: "nonce", sessionToken: "session-a", userSession: "login-a"},
+		{name: "empty", sessionToken: "session-a", userSession: "login-a"},
+		{name: "fields shifted", token: newTestCsrfToken(t, "session-", "alogin-a"), sessionToken: "session-a", userSession: "login-a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isValidCsrfToken(test.token, test.sessionToken, test.userSession); got != test.want {
+				t.Errorf("isValidCsrfToken() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCsrfMiddleware(t *testing.T) {
+	t.Setenv("NOLONGR_SERVER_API_KEY", "test-server-key")
+	sessionCookie := newSessionCookie(t, "session-a")
+	otherSessionCookie := newSessionCookie(t, "session-b")
+	userSessionCookie := &http.Cookie{Name: USER_SESSION_COOKIE, Value: "login-a"}
+	csrfCookie := func(token string) *http.Cookie {
+		return &http.Cookie{Name: CSRF_COOKIE, Value: token}
+	}
+	token := newTestCsrfToken(t, "session-a", "")
+	loginToken := newTestCsrfToken(t, "session-a", "login-a")
+	otherToken := newTestCsrfToken(t, "session-b", "")
+	anonymousToken := newTestCsrfToken(t, "", "")
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		cookies    []*http.Cookie
+		header     map[string]string
+		wantStatus int
+	}{
+		{name: "no cookies", wantStatus: http.StatusBadRequest},
+		{name: "session without token", cookies: []*http.Cookie{sessionCookie}, wantStatus: http.StatusForbidden},
+		{name: "cookie without header", cookies: []*http.Cookie{sessionCookie, csrfCookie(token)}, wantStatus: http.StatusForbidden},
+		{name: "header without cookie", cookies: []*http.Cookie{sessionCookie}, header: map[string]string{CSRF_HEADER: token}, wantStatus: http.StatusForbidden},
+		{name: "header differs from cookie", cookies: []*http.Cookie{sessionCookie, csrfCookie(token)}, header: map[string]string{CSRF_HEADER: otherToken}, wantStatus: http.StatusForbidden},
+		{name: "forged token", cookies: []*http.Cookie{sessionCookie, csrfCookie("nonce.forged")}, header: map[string]string{CSRF_HEADER: "nonce.forged"}, wantStatus: http.StatusForbidden},
+		{name: "token of another session", cookies: []*http.Cookie{sessionCookie, csrfCookie(otherToken)}, header: map[string]string{CSRF_HEADER: otherToken}, wantStatus: http.StatusForbidden},
+		{name: "token of no session", cookies: []*http.Cookie{sessionCookie, csrfCookie(anonymousToken)}, header: map[string]string{CSRF_HEADER: anonymousToken}, wantStatus: http.StatusForbidden},
+		{name: "token of the session", cookies: []*http.Cookie{sessionCookie, csrfCookie(token)}, header: map[string]string{CSRF_HEADER: token}, wantStatus: http.StatusBadRequest},
+		{name: "token of the session after login", cookies: []*http.Cookie{sessionCookie, userSessionCookie, csrfCookie(token)}, header: map[string]string{CSRF_HEADER: token}, wantStatus: http.StatusForbidden},
+		{name: "token of the login", cookies: []*http.Cookie{sessionCookie, userSessionCookie, csrfCookie(loginToken)}, header: map[string]string{CSRF_HEADER: loginToken}, wantStatus: http.StatusBadRequest},
+		{name: "token of the session used by another", cookies: []*http.Cookie{otherSessionCookie, csrfCookie(token)}, header: map[string]string{CSRF_HEADER: token}, wantStatus: http.StatusForbidden},
+		{name: "API key", cookies: []*http.Cookie{sessionCookie}, header: map[string]string{"Authorization": "Bearer test-server-key"}, wantStatus: http.StatusBadRequest},
+		{name: "invalid API key", cookies: []*http.Cookie{sessionCookie}, header: map[string]string{"Authorization": "Bearer wrong-key"}, wantStatus: http.StatusForbidden},
+		{name: "GET", method: http.MethodGet, path: "/api/v1/csrf-token", cookies: []*http.Cookie{sessionCookie}, wantStatus: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method, path := http.MethodPost, "/api/v1/claim-codes/redeem"
+			if test.method != "" {
+				method, path = test.method, test.path
+			}
+			response := performRequest(newTestRouter(), method, path, `{}`, test.cookies, test.header)
+			if response.Code != test.wantStatus {
+				t.Errorf("response = %d %s, want %d", response.Code, response.Body.String(), test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestGetCsrfToken(t *testing.T) {
+	sessionCookie := newSessionCookie(t, "session-a")
+	validToken := newTestCsrfToken(t, "session-a", "")
+	tests := []struct {
+		name      string
+		csrfToken string
+		wantKept  bool
+	}{
+		{name: "no token"},
+		{name: "valid token", csrfToken: validToken, wantKept: true},
+		{name: "token of another session", csrfToken: newTestCsrfToken(t, "session-b", "")},
+		{name: "forged token", csrfToken: "nonce.forged"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cookies := []*http.Cookie{sessionCookie}
+			if test.csrfToken != "" {
+				cookies = append(cookies, &http.Cookie{Name: CSRF_COOKIE, Value: test.csrfToken})
+			}
+			response := performRequest(newTestRouter(), http.MethodGet, "/api/v1/csrf-token", "", cookies, nil)
+			body := struct {
+				Result CsrfToken `json:"result"`
+			}{}
+			if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || response.Code != http.StatusOK {
+				t.Fatalf("response = %d %s", response.Code, response.Body.String())
+			}
+			cookie := responseCookie(response, CSRF_COOKIE)
+			if test.wantKept {
+				if body.Result.Token != test.csrfToken || cookie != nil {
+					t.Errorf("token = %q, cookie = %v, want %q kept", body.Result.Token, cookie, test.csrfToken)
+				}
+				return
+			}
+			if cookie == nil || cookie.Value != body.Result.Token || !isValidCsrfToken(body.Result.Token, "session-a", "") {
+				t.Errorf("token = %q, cookie = %v, want a new token of the session", body.Result.Token, cookie)
+			}
+		})
+	}
+}
+
+func TestSetRequestSessionTokenReissuesCsrfToken(t *testing.T) {
+	cookies := []*http.Cookie{{Name: USER_SESSION_COOKIE, Value: "login-a"}}
+	response := performRequest(newTestRouter(), http.MethodGet, "/api/v1/set-cookie", "", cookies, nil)
+	body := struct {
+		Result struct {
+			Value string `json:"value"`
+		} `json:"result"`
+	}{}
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || body.Result.Value == "" {
+		t.Fatalf("response = %d %s", response.Code, response.Body.String())
+	}
+	cookie := responseCookie(response, CSRF_COOKIE)
+	if cookie == nil || !isValidCsrfToken(cookie.Value, body.Result.Value, "login-a") {
+		t.Errorf("CSRF cookie = %v, want a token of the new session", cookie)
+	}
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Errors returned by the storage layer. Database failures other than these are wrapped in ErrDatabaseUnavailable.
+var (
+	ErrNotFound               = errors.New("url not found")
+	ErrExpired                = errors.New("url has expired")
+	ErrMaxHitsReached         = errors.New("url has reached its maximum page hits")
+	ErrPaused                 = errors.New("url is paused")
+	ErrIDConflict             = errors.New("url id already exists")
+	ErrInvalidCursor          = errors.New("invalid pagination cursor")
+	ErrIdempotencyKeyExists   = errors.New("idempotency key already used")
+	ErrWrongPassword          = errors.New("wrong password")
+	ErrInvalidRequest         = errors.New("invalid request")
+	ErrForbiddenDestination   = errors.New("urls pointing to this site cannot be shortened")
+	ErrQuotaExceeded          = errors.New("quota exceeded")
+	ErrEmailTaken             = errors.New("email already registered")
+	ErrInvalidCredentials     = errors.New("invalid email or password")
+	ErrInvalidToken           = errors.New("invalid or expired token")
+	ErrSsoFailed              = errors.New("single sign-on failed")
+	ErrSsoProviderUnavailable = errors.New("identity provider unavailable")
+	ErrIdentityLinked         = errors.New("identity is linked to another user")
+	ErrLastWorkspaceOwner     = errors.New("a workspace needs at least one owner")
+	ErrDatabaseUnavailable    = errors.New("database unavailable")
+)
+
+const mysqlErrDuplicateEntry = 1062
+
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry
+}
+
+// storageError translates driver errors into the storage layer's errors.
+func storageError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNotFound
+	case isDuplicateEntry(err):
+		return fmt.Errorf("%w: %w", ErrIDConflict, err)
+	default:
+		return fmt.Errorf("%w: %w", ErrDatabaseUnavailable, err)
+	}
+}
+
+// storageErrorStatus maps a storage layer error to the HTTP status and error code sent to the caller.
+func storageErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, ERROR_CODE_NOT_FOUND
+	case errors.Is(err, ErrExpired):
+		return http.StatusGone, ERROR_CODE_EXPIRED
+	case errors.Is(err, ErrMaxHitsReached):
+		return http.StatusGone, ERROR_CODE_MAX_HITS_REACHED
+	case errors.Is(err, ErrPaused):
+		return http.StatusLocked, ERROR_CODE_PAUSED
+	case errors.Is(err, ErrWrongPassword):
+		return http.StatusUnauthorized, ERROR_CODE_WRONG_PASSWORD
+	case errors.Is(err, ErrIDConflict):
+		return http.StatusConflict, ERROR_CODE_ID_CONFLICT
+	case errors.Is(err, ErrInvalidCursor), errors.Is(err, ErrInvalidRequest):
+		return http.StatusBadRequest, ERROR_CODE_VALIDATION_FAILED
+	case errors.Is(err, ErrForbiddenDestination):
+		return http.StatusForbidden, ERROR_CODE_FORBIDDEN_DOMAIN
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusTooManyRequests, ERROR_CODE_QUOTA_EXCEEDED
+	case errors.Is(err, ErrEmailTaken):
+		return http.StatusConflict, ERROR_CODE_EMAIL_TAKEN
+	case errors.Is(err, ErrInvalidCredentials):
+		return http.StatusUnauthorized, ERROR_CODE_INVALID_CREDENTIALS
+	case errors.Is(err, ErrInvalidToken):
+		return http.StatusBadRequest, ERROR_CODE_INVALID_TOKEN
+	case errors.Is(err, ErrSsoFailed):
+		return http.StatusUnauthorized, ERROR_CODE_SSO_FAILED
+	case errors.Is(err, ErrSsoProviderUnavailable):
+		return http.StatusBadGateway, ERROR_CODE_SSO_PROVIDER_UNAVAILABLE
+	case errors.Is(err, ErrIdentityLinked):
+		return http.StatusConflict, ERROR_CODE_IDENTITY_LINKED
+	case errors.Is(err, ErrLastWorkspaceOwner):
+		return http.StatusConflict, ERROR_CODE_LAST_WORKSPACE_OWNER
+	case errors.Is(err, ErrDatabaseUnavailable):
+		return http.StatusServiceUnavailable, ERROR_CODE_DATABASE_UNAVAILABLE
+	default:
+		return http.StatusInternalServerError, ERROR_CODE_INTERNAL
+	}
+}
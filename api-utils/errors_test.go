@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestStorageError(t *testing.T) {
+	duplicate := &mysql.MySQLError{Number: mysqlErrDuplicateEntry, Message: "Duplicate entry 'abc' for key 'PRIMARY'"}
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "no rows", err: sql.ErrNoRows, want: ErrNotFound},
+		{name: "wrapped no rows", err: fmt.Errorf("scan: %w", sql.ErrNoRows), want: ErrNotFound},
+		{name: "duplicate entry", err: duplicate, want: ErrIDConflict},
+		{name: "other mysql error", err: &mysql.MySQLError{Number: 1146, Message: "Table 'urls' doesn't exist"}, want: ErrDatabaseUnavailable},
+		{name: "connection refused", err: errors.New("dial tcp 127.0.0.1:3306: connect: connection refused"), want: ErrDatabaseUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := storageError(test.err); !errors.Is(got, test.want) {
+				t.Errorf("storageError() = %v, want %v", got, test.want)
+			}
+		})
+	}
+	if err := storageError(nil); err != nil {
+		t.Errorf("storageError(nil) = %v, want nil", err)
+	}
+	if err := storageError(duplicate); !errors.Is(err, duplicate) {
+		t.Errorf("storageError() = %v, which does not wrap the driver error", err)
+	}
+}
+
+func TestStorageErrorStatus(t *testing.T) {
+	tests := []struct {
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{err: ErrNotFound, wantStatus: http.StatusNotFound, wantCode: ERROR_CODE_NOT_FOUND},
+		{err: ErrExpired, wantStatus: http.StatusGone, wantCode: ERROR_CODE_EXPIRED},
+		{err: ErrMaxHitsReached, wantStatus: http.StatusGone, wantCode: ERROR_CODE_MAX_HITS_REACHED},
+		{err: ErrPaused, wantStatus: http.StatusLocked, wantCode: ERROR_CODE_PAUSED},
+		{err: ErrInvalidCursor, wantStatus: http.StatusBadRequest, wantCode: ERROR_CODE_VALIDATION_FAILED},
+		{err: storageError(&mysql.MySQLError{Number: mysqlErrDuplicateEntry}), wantStatus: http.StatusConflict, wantCode: ERROR_CODE_ID_CONFLICT},
+		{err: storageError(errors.New("connection refused")), wantStatus: http.StatusServiceUnavailable, wantCode: ERROR_CODE_DATABASE_UNAVAILABLE},
+		{err: errors.New("unexpected"), wantStatus: http.StatusInternalServerError, wantCode: ERROR_CODE_INTERNAL},
+	}
+	for _, test := range tests {
+		if status, code := storageErrorStatus(test.err); status != test.wantStatus || code != test.wantCode {
+			t.Errorf("storageErrorStatus(%v) = %d, %s, want %d, %s", test.err, status, code, test.wantStatus, test.wantCode)
+		}
+	}
+}
+
+func TestCheckUrlUnexpired(t *testing.T) {
+	past := time.Now().UTC().Add(-time.Minute).Format(time.RFC3339)
+	future := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+	unparsable := "tomorrow"
+	tests := []struct {
+		name    string
+		urlData URLData
+		want    error
+	}{
+		{name: "active", urlData: URLData{MaxPageHits: 5, PageHits: 4, SelfDestruct: &future}},
+		{name: "no limits", urlData: URLData{PageHits: 1000}},
+		{name: "self destructed", urlData: URLData{SelfDestruct: &past}, want: ErrExpired},
+		{name: "unparsable self destruct", urlData: URLData{SelfDestruct: &unparsable}},
+		{name: "max page hits reached", urlData: URLData{MaxPageHits: 5, PageHits: 5}, want: ErrMaxHitsReached},
+		{name: "paused", urlData: URLData{Paused: true, SelfDestruct: &past}, want: ErrPaused},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := checkUrlUnexpired(test.urlData); got != test.want {
+				t.Errorf("checkUrlUnexpired() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
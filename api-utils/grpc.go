@@ -0,0 +1,428 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"main.go/linkpb"
+)
+
+// linkServer implements the gRPC LinkService on top of the same storage layer as the REST routes.
+type linkServer struct {
+	linkpb.UnimplementedLinkServiceServer
+}
+
+// grpcMethodScopes lists the API key scope each method needs. Get and Resolve can be called without a key,
+// like their REST counterparts.
+var grpcMethodScopes = map[string]string{
+	linkpb.LinkService_Create_FullMethodName: API_KEY_SCOPE_LINKS_WRITE,
+	linkpb.LinkService_Update_FullMethodName: API_KEY_SCOPE_LINKS_WRITE,
+	linkpb.LinkService_Delete_FullMethodName: API_KEY_SCOPE_LINKS_WRITE,
+	linkpb.LinkService_List_FullMethodName:   API_KEY_SCOPE_LINKS_READ,
+	linkpb.LinkService_Stats_FullMethodName:  API_KEY_SCOPE_LINKS_READ,
+}
+
+type grpcOwnerKey struct{}
+
+// NewGrpcServer returns the gRPC server of the LinkService. It is served over HTTP/2 by the same
+// handler as the REST API, see IsGrpcRequest.
+func NewGrpcServer() *grpc.Server {
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(grpcAuthInterceptor, grpcRateLimitInterceptor))
+	linkpb.RegisterLinkServiceServer(server, &linkServer{})
+	return server
+}
+
+// IsGrpcRequest reports whether an HTTP request is a gRPC call rather than a REST request.
+func IsGrpcRequest(request *http.Request) bool {
+	return request.ProtoMajor == 2 && strings.HasPrefix(request.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcApiKey reads the API key from the "authorization: Bearer <key>" metadata.
+func grpcApiKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if apiKey, ok := strings.CutPrefix(value, "Bearer "); ok {
+			return strings.TrimSpace(apiKey)
+		}
+	}
+	return ""
+}
+
+// grpcOwner returns the owner of the API key of the call, as authenticated by grpcAuthInterceptor.
+func grpcOwner(ctx context.Context) (Owner, bool) {
+	owner, ok := ctx.Value(grpcOwnerKey{}).(Owner)
+	return owner, ok
+}
+
+func grpcAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	owner, authenticated := Owner{}, false
+	if apiKey := grpcApiKey(ctx); apiKey != "" {
+		owner, authenticated = authenticateApiKey(apiKey)
+	}
+	if authenticated && owner.UserID != "" {
+		owner.WorkspaceRoles = loadWorkspaceRoles(owner.UserID)
+	}
+	if authenticated {
+		ctx = context.WithValue(ctx, grpcOwnerKey{}, owner)
+	}
+
+	if scope, ok := grpcMethodScopes[info.FullMethod]; ok {
+		if !authenticated {
+			return nil, status.Error(codes.Unauthenticated, "an API key is required")
+		} else if !owner.can(scope) {
+			return nil, status.Errorf(codes.PermissionDenied, "the API key does not have the %s scope", scope)
+		}
+	}
+	return handler(ctx, req)
+}
+
+// grpcAuthorizeUrl returns the link when the owner of the call may manage it.
+func grpcAuthorizeUrl(ctx context.Context, id string, message string) (URLData, error) {
+	return grpcAuthorizeUrlFor(ctx, id, message, Owner.canManage)
+}
+
+// grpcAuthorizeViewUrl returns the link when the owner of the call may view it, as workspace viewers may.
+func grpcAuthorizeViewUrl(ctx context.Context, id string, message string) (URLData, error) {
+	return grpcAuthorizeUrlFor(ctx, id, message, Owner.canView)
+}
+
+func grpcAuthorizeUrlFor(ctx context.Context, id string, message string, allowed func(Owner, URLData) bool) (URLData, error) {
+	urlData, err := GetSingleUrl(id)
+	if err != nil {
+		return urlData, grpcStorageError(err, message)
+	}
+	if owner, _ := grpcOwner(ctx); !allowed(owner, urlData) {
+		return urlData, status.Error(codes.PermissionDenied, "You do not own this URL")
+	}
+	return urlData, nil
+}
+
+// grpcRateLimitScopes lists the rate limited methods, with the scopes of their REST routes.
+var grpcRateLimitScopes = map[string]string{
+	linkpb.LinkService_Create_FullMethodName:  RATE_LIMIT_SCOPE_CREATE,
+	linkpb.LinkService_Get_FullMethodName:     RATE_LIMIT_SCOPE_LOOKUP,
+	linkpb.LinkService_Resolve_FullMethodName: RATE_LIMIT_SCOPE_LOOKUP,
+}
+
+func grpcPeerIP(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// grpcVisitorIP follows requestVisitorIP: only keys with the pageviews scope may forward the visitor IP in
+// "x-visitor-ip" metadata, other calls are recorded against the peer IP.
+func grpcVisitorIP(ctx context.Context) string {
+	if owner, ok := grpcOwner(ctx); ok && owner.can(API_KEY_SCOPE_PAGEVIEWS) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if visitorIP := md.Get("x-visitor-ip"); len(visitorIP) > 0 && visitorIP[0] != "" {
+			return visitorIP[0]
+		}
+	}
+	return grpcPeerIP(ctx)
+}
+
+// grpcRateLimitIdentities follows rateLimitIdentities: calls with an API key count against the key, or against the
+// visitor IP forwarded in "x-visitor-ip" metadata by keys with the pageviews scope, and other calls against the peer IP.
+func grpcRateLimitIdentities(ctx context.Context) []string {
+	if owner, ok := grpcOwner(ctx); ok {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if visitorIP := md.Get("x-visitor-ip"); len(visitorIP) > 0 && visitorIP[0] != "" && owner.can(API_KEY_SCOPE_PAGEVIEWS) {
+			return []string{"ip:" + visitorIP[0]}
+		}
+		return []string{"key:" + owner.ApiKeyID}
+	}
+	return []string{"ip:" + grpcPeerIP(ctx)}
+}
+
+// grpcRateLimitError returns ResourceExhausted with the wait as RetryInfo details.
+func grpcRateLimitError(retryAfter time.Duration) error {
+	grpcStatus, err := status.New(codes.ResourceExhausted, "Too many requests").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, "Too many requests")
+	}
+	return grpcStatus.Err()
+}
+
+func grpcRateLimitInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if scope, ok := grpcRateLimitScopes[info.FullMethod]; ok {
+		if allowed, retryAfter := takeRateLimitTokens(scope, grpcRateLimitIdentities(ctx)); !allowed {
+			return nil, grpcRateLimitError(retryAfter)
+		}
+	}
+	return handler(ctx, req)
+}
+
+// grpcStorageError maps a storage layer error to a gRPC status, like storageErrorStatus does for HTTP.
+func grpcStorageError(err error, message string) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, ErrExpired), errors.Is(err, ErrMaxHitsReached), errors.Is(err, ErrPaused):
+		code = codes.FailedPrecondition
+	case errors.Is(err, ErrWrongPassword):
+		code = codes.PermissionDenied
+	case errors.Is(err, ErrIDConflict):
+		code = codes.AlreadyExists
+	case errors.Is(err, ErrInvalidCursor), errors.Is(err, ErrInvalidRequest):
+		code = codes.InvalidArgument
+	case errors.Is(err, ErrForbiddenDestination):
+		code = codes.PermissionDenied
+	case errors.Is(err, ErrQuotaExceeded):
+		code = codes.ResourceExhausted
+	case errors.Is(err, ErrDatabaseUnavailable):
+		code = codes.Unavailable
+	}
+	return status.Errorf(code, "%s: %v", message, err)
+}
+
+// grpcValidationError returns InvalidArgument with the rejected fields as BadRequest details.
+func grpcValidationError(fieldErrors FieldErrors) error {
+	fields := make([]string, 0, len(fieldErrors))
+	for field := range fieldErrors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	badRequest := &errdetails.BadRequest{}
+	for _, field := range fields {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: fieldErrors[field],
+		})
+	}
+	grpcStatus, err := status.New(codes.InvalidArgument, "The request contains invalid fields").WithDetails(badRequest)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "The request contains invalid fields")
+	}
+	return grpcStatus.Err()
+}
+
+// toLinkProto converts a link for the caller. The session of the link is only returned to admins, and its user and
+// workspace to callers who may view the link, since Get and Resolve are public. So is the destination of a link with
+// a password, which other callers get from Resolve.
+func toLinkProto(ctx context.Context, urlData URLData) *linkpb.Link {
+	owner, _ := grpcOwner(ctx)
+	link := &linkpb.Link{
+		Id:           urlData.ID,
+		DateCreated:  urlData.DateCreated,
+		Destination:  urlData.Destination,
+		MaxPageHits:  urlData.MaxPageHits,
+		PageHits:     urlData.PageHits,
+		HasPassword:  urlData.Password != nil && *urlData.Password != "",
+		SelfDestruct: urlData.SelfDestruct,
+		Url:          urlData.URL,
+		Paused:       urlData.Paused,
+		Title:        urlData.Title,
+		Tags:         urlData.Tags,
+	}
+	if owner.IsAdmin {
+		link.SessionToken = urlData.SessionToken
+	}
+	if owner.canView(urlData) {
+		link.UserId, link.WorkspaceId = urlData.UserID, urlData.WorkspaceID
+	} else if link.HasPassword {
+		link.Destination = ""
+	}
+	return link
+}
+
+func (server *linkServer) Create(ctx context.Context, req *linkpb.CreateRequest) (*linkpb.Link, error) {
+	body := CreateShortUrlRequestBody{
+		Destination:  req.Destination,
+		MaxPageHits:  req.MaxPageHits,
+		Password:     req.Password,
+		SelfDestruct: req.SelfDestruct,
+		Title:        req.Title,
+		Tags:         req.Tags,
+	}
+	fieldErrors := FieldErrors{}
+	validateCreateShortUrlRequest(body, fieldErrors)
+	validateAlias(req.Alias, fieldErrors)
+	if len(fieldErrors) > 0 {
+		return nil, grpcValidationError(fieldErrors)
+	}
+	if isForbiddenDestination(body.Destination) {
+		return nil, status.Error(codes.PermissionDenied, "URLs pointing to this site cannot be shortened")
+	}
+
+	owner, _ := grpcOwner(ctx)
+	sessionToken, userID := owner.SessionToken, owner.UserID
+	if owner.IsAdmin {
+		sessionToken, userID = req.SessionToken, ""
+	}
+	quotaOwner := quotaOwnerOf(owner, grpcPeerIP(ctx))
+	if err := reserveCreationQuotas(quotaOwner, 1); err != nil {
+		return nil, grpcStorageError(err, "You cannot create more short URLs")
+	}
+
+	newUrl, err := newUrlFromRequest(body, req.Alias, sessionToken, userID)
+	if err != nil {
+		releaseQuota(quotaOwner, QUOTA_DAILY_CREATIONS, 1)
+		return nil, status.Errorf(codes.Internal, "Failed to hash the password: %v", err)
+	}
+	urlData, err := CreateNewUrl(newUrl)
+	if err != nil {
+		releaseQuota(quotaOwner, QUOTA_DAILY_CREATIONS, 1)
+		log.Println("(linkServer.Create) error:", err)
+		return nil, grpcStorageError(err, "Failed to create short URL")
+	}
+	return toLinkProto(ctx, urlData), nil
+}
+
+func (server *linkServer) Get(ctx context.Context, req *linkpb.GetRequest) (*linkpb.Link, error) {
+	urlData, err := GetSingleUrlUnexpired(req.Id)
+	if err != nil {
+		return nil, grpcStorageError(err, "This URL is invalid or a destination URL could not be found")
+	}
+	return toLinkProto(ctx, urlData), nil
+}
+
+func (server *linkServer) Update(ctx context.Context, req *linkpb.UpdateRequest) (*linkpb.Link, error) {
+	body := UpdateShortUrlRequestBody{
+		Destination:   req.Destination,
+		MaxPageHits:   req.MaxPageHits,
+		Password:      req.Password,
+		SelfDestruct:  req.SelfDestruct,
+		Paused:        req.Paused,
+		Title:         req.Title,
+		ResetPageHits: req.ResetPageHits,
+	}
+	if req.UpdateTags {
+		tags := append([]string{}, req.Tags...)
+		body.Tags = &tags
+	}
+	fieldErrors := FieldErrors{}
+	validateUpdateShortUrlRequest(body, fieldErrors)
+	if len(fieldErrors) > 0 {
+		return nil, grpcValidationError(fieldErrors)
+	}
+	if body.Destination != nil && isForbiddenDestination(*body.Destination) {
+		return nil, status.Error(codes.PermissionDenied, "URLs pointing to this site cannot be shortened")
+	}
+
+	urlData, err := grpcAuthorizeUrl(ctx, req.Id, "Failed to find the URL to edit")
+	if err != nil {
+		return nil, err
+	}
+	if err := applyUrlUpdate(&urlData, body); err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to hash the password: %v", err)
+	}
+	if err := UpdateUrl(urlData, body.ResetPageHits); err != nil {
+		log.Println("(linkServer.Update) error:", err)
+		return nil, grpcStorageError(err, "Failed to edit the URL")
+	}
+	return toLinkProto(ctx, urlData), nil
+}
+
+func (server *linkServer) Delete(ctx context.Context, req *linkpb.DeleteRequest) (*linkpb.DeleteResponse, error) {
+	if _, err := grpcAuthorizeUrl(ctx, req.Id, "Failed to delete from database"); err != nil {
+		return nil, err
+	}
+	if err := DeleteUrlsByIds([]string{req.Id}); err != nil {
+		return nil, grpcStorageError(err, "Failed to delete from database")
+	}
+	return &linkpb.DeleteResponse{Deleted: true}, nil
+}
+
+func (server *linkServer) List(ctx context.Context, req *linkpb.ListRequest) (*linkpb.ListResponse, error) {
+	values := url.Values{}
+	if req.Limit != 0 {
+		values.Set("limit", strconv.Itoa(int(req.Limit)))
+	}
+	if req.HasPassword != nil {
+		values.Set("has_password", strconv.FormatBool(*req.HasPassword))
+	}
+	values.Set("cursor", req.Cursor)
+	values.Set("sort", req.Sort)
+	values.Set("status", req.Status)
+	values.Set("domain", req.Domain)
+	values.Set("created_after", req.CreatedAfter)
+	values.Set("created_before", req.CreatedBefore)
+
+	options, fieldErrors := parseUrlListOptions(values.Get)
+	if len(fieldErrors) > 0 {
+		return nil, grpcValidationError(fieldErrors)
+	}
+	options.SessionToken = req.SessionToken
+	if owner, _ := grpcOwner(ctx); !owner.IsAdmin {
+		options.SessionToken, options.UserID = owner.SessionToken, owner.UserID
+	}
+
+	urls, nextCursor, err := ListUrls(options)
+	if err != nil {
+		log.Println("(linkServer.List) error:", err)
+		return nil, grpcStorageError(err, "Failed to get URLs")
+	}
+	response := &linkpb.ListResponse{NextCursor: nextCursor}
+	for _, urlData := range urls {
+		response.Links = append(response.Links, toLinkProto(ctx, urlData))
+	}
+	return response, nil
+}
+
+// Resolve records the visit from the "x-visitor-ip", "user-agent", "referer", "dnt" and "sec-gpc"
+// metadata, which the caller forwards from the visitor's request.
+func (server *linkServer) Resolve(ctx context.Context, req *linkpb.ResolveRequest) (*linkpb.ResolveResponse, error) {
+	if req.Password != "" {
+		if allowed, retryAfter := takeRateLimitTokens(RATE_LIMIT_SCOPE_PASSWORD, grpcRateLimitIdentities(ctx)); !allowed {
+			return nil, grpcRateLimitError(retryAfter)
+		}
+	}
+
+	urlData, err := ResolveUrl(req.Id, req.Password)
+	if err != nil {
+		return nil, grpcStorageError(err, "This URL is invalid or the password is wrong")
+	}
+
+	header := http.Header{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	if visit := newVisitFromHeaders(header, grpcVisitorIP(ctx), req.Id); visit != nil {
+		RecordVisit(*visit)
+	}
+
+	link := toLinkProto(ctx, urlData)
+	link.Destination = urlData.Destination
+	return &linkpb.ResolveResponse{Destination: urlData.Destination, Link: link}, nil
+}
+
+func (server *linkServer) Stats(ctx context.Context, req *linkpb.StatsRequest) (*linkpb.StatsResponse, error) {
+	if _, err := grpcAuthorizeViewUrl(ctx, req.Id, "Failed to find the URL"); err != nil {
+		return nil, err
+	}
+	stats, err := GetUrlStats(req.Id)
+	if err != nil {
+		log.Println("(linkServer.Stats) error:", err)
+		return nil, grpcStorageError(err, "Failed to get the statistics of the URL")
+	}
+	response := &linkpb.StatsResponse{Id: stats.ID, PageHits: stats.PageHits, MaxPageHits: stats.MaxPageHits}
+	for _, dailyVisits := range stats.DailyVisits {
+		response.DailyVisits = append(response.DailyVisits, &linkpb.DailyVisits{Day: dailyVisits.Day, Visits: dailyVisits.Visits})
+	}
+	return response, nil
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func newGrpcTestContext(owner *Owner, visitorIP string) context.Context {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}})
+	if visitorIP != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-visitor-ip", visitorIP))
+	}
+	if owner != nil {
+		ctx = context.WithValue(ctx, grpcOwnerKey{}, *owner)
+	}
+	return ctx
+}
+
+func TestGrpcVisitorIP(t *testing.T) {
+	tests := []struct {
+		name  string
+		owner *Owner
+		want  string
+	}{
+		{name: "anonymous caller", want: "192.0.2.1"},
+		{name: "key without pageviews scope", owner: &Owner{ApiKeyID: "k1", Scopes: []string{API_KEY_SCOPE_LINKS_READ}}, want: "192.0.2.1"},
+		{name: "key with pageviews scope", owner: &Owner{ApiKeyID: "k2", Scopes: []string{API_KEY_SCOPE_PAGEVIEWS}}, want: "198.51.100.9"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := grpcVisitorIP(newGrpcTestContext(test.owner, "198.51.100.9")); got != test.want {
+				t.Errorf("grpcVisitorIP() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestToLinkProtoHidesOwners(t *testing.T) {
+	urlData := URLData{ID: "abc", SessionToken: "session-1", UserID: "user-1"}
+	tests := []struct {
+		name             string
+		owner            *Owner
+		wantSessionToken string
+		wantUserID       string
+	}{
+		{name: "anonymous caller"},
+		{name: "other user", owner: &Owner{ApiKeyID: "k1", UserID: "user-2"}},
+		{name: "owning user", owner: &Owner{ApiKeyID: "k2", UserID: "user-1"}, wantUserID: "user-1"},
+		{name: "admin", owner: &Owner{ApiKeyID: LEGACY_API_KEY_ID, IsAdmin: true}, wantSessionToken: "session-1", wantUserID: "user-1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			link := toLinkProto(newGrpcTestContext(test.owner, ""), urlData)
+			if link.SessionToken != test.wantSessionToken || link.UserId != test.wantUserID {
+				t.Errorf("session_token = %q, user_id = %q, want %q and %q", link.SessionToken, link.UserId, test.wantSessionToken, test.wantUserID)
+			}
+		})
+	}
+}
+
+func TestToLinkProtoHidesPasswordProtectedDestinations(t *testing.T) {
+	hash := "$2a$14$hash"
+	tests := []struct {
+		name            string
+		owner           *Owner
+		password        *string
+		wantDestination string
+	}{
+		{name: "anonymous caller without a password", wantDestination: "https://example.com"},
+		{name: "anonymous caller", password: &hash},
+		{name: "other user", owner: &Owner{ApiKeyID: "k1", UserID: "user-2"}, password: &hash},
+		{name: "owning user", owner: &Owner{ApiKeyID: "k2", UserID: "user-1"}, password: &hash, wantDestination: "https://example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			urlData := URLData{ID: "abc", Destination: "https://example.com", Password: test.password, UserID: "user-1"}
+			link := toLinkProto(newGrpcTestContext(test.owner, ""), urlData)
+			if link.Destination != test.wantDestination || link.HasPassword != (test.password != nil) {
+				t.Errorf("destination = %q, has_password = %v, want %q", link.Destination, link.HasPassword, test.wantDestination)
+			}
+		})
+	}
+}
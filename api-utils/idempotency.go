@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+const IDEMPOTENCY_KEY_TTL = 24 * time.Hour
+
+// IDEMPOTENCY_PENDING_TTL is how long a request may hold its key before it is assumed to have crashed, which
+// frees the key for a retry. It is longer than any request may run.
+const IDEMPOTENCY_PENDING_TTL = 2 * time.Minute
+const MAX_IDEMPOTENCY_KEY_LENGTH = 255
+
+// IdempotencyRecord is the stored outcome of a request sent with an Idempotency-Key.
+// StatusCode is 0 while the original request is still being processed.
+type IdempotencyRecord struct {
+	Key          string
+	Owner        string
+	RequestHash  string
+	StatusCode   int
+	ResponseBody string
+	DateCreated  string
+}
+
+type capturingResponseWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (writer *capturingResponseWriter) Write(data []byte) (int, error) {
+	writer.body.Write(data)
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *capturingResponseWriter) WriteString(data string) (int, error) {
+	writer.body.WriteString(data)
+	return writer.ResponseWriter.WriteString(data)
+}
+
+// idempotencyOwner scopes keys to the caller so that two clients cannot replay each other's responses.
+func idempotencyOwner(context *gin.Context) string {
+	owner, _ := resolveOwner(context)
+	if owner.ApiKeyID != "" {
+		return "key:" + owner.ApiKeyID
+	} else if owner.UserID != "" {
+		return "user:" + owner.UserID
+	} else if owner.SessionToken != "" {
+		return "session:" + owner.SessionToken
+	}
+	return "ip:" + context.ClientIP()
+}
+
+// hashIdempotentRequest covers the query too, as links can still be created with the deprecated ?destination= form.
+func hashIdempotentRequest(request *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(request.Method + " " + request.URL.Path + "?" + request.URL.RawQuery + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// reserveIdempotencyKey stores a pending record for the key, replacing a record that is older than the TTL.
+// It returns the existing record when the key is already in use.
+func reserveIdempotencyKey(record IdempotencyRecord) (*IdempotencyRecord, error) {
+	err := InsertIdempotencyKey(record)
+	if !errors.Is(err, ErrIdempotencyKeyExists) {
+		return nil, err
+	}
+
+	existing, err := GetIdempotencyKey(record.Owner, record.Key)
+	if errors.Is(err, ErrNotFound) {
+		// Completed and purged between the two queries
+		return nil, InsertIdempotencyKey(record)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if isIdempotencyRecordStale(existing, time.Now()) {
+		err = DeleteIdempotencyKey(record.Owner, record.Key)
+		if err != nil {
+			return nil, err
+		}
+		return reserveIdempotencyKey(record)
+	}
+
+	return &existing, nil
+}
+
+// isIdempotencyRecordStale reports whether a record no longer holds its key: a stored response older than
+// IDEMPOTENCY_KEY_TTL, or a pending request older than IDEMPOTENCY_PENDING_TTL.
+func isIdempotencyRecordStale(record IdempotencyRecord, now time.Time) bool {
+	dateCreated, err := time.Parse(time.RFC3339, record.DateCreated)
+	if err != nil {
+		return false
+	}
+	if record.StatusCode == 0 {
+		return now.Sub(dateCreated) > IDEMPOTENCY_PENDING_TTL
+	}
+	return now.Sub(dateCreated) > IDEMPOTENCY_KEY_TTL
+}
+
+// isIdempotentResponseStored reports whether a response is replayed to retries. Server errors, timeouts and rate
+// limits, including exceeded quotas, may succeed later, so the key is freed for a retry instead.
+func isIdempotentResponseStored(statusCode int) bool {
+	return statusCode < http.StatusInternalServerError && statusCode != http.StatusRequestTimeout && statusCode != http.StatusTooManyRequests
+}
+
+// idempotencyMiddleware replays the stored response when a request is repeated with the same
+// Idempotency-Key within IDEMPOTENCY_KEY_TTL. Requests without the header are not affected.
+func idempotencyMiddleware() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		key := context.GetHeader(IDEMPOTENCY_KEY_HEADER)
+		if key == "" {
+			context.Next()
+			return
+		}
+		if len(key) > MAX_IDEMPOTENCY_KEY_LENGTH {
+			respondWithValidationErrors(context, FieldErrors{IDEMPOTENCY_KEY_HEADER: "must be at most 255 characters"})
+			return
+		}
+
+		body, err := io.ReadAll(context.Request.Body)
+		if err != nil {
+			RespondWithError(context, http.StatusBadRequest, ErrorResponse{
+				Message: "Failed to read the request body",
+				Error:   err.Error(),
+				Code:    ERROR_CODE_BAD_REQUEST,
+			})
+			return
+		}
+		context.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		record := IdempotencyRecord{
+			Key:         key,
+			Owner:       idempotencyOwner(context),
+			RequestHash: hashIdempotentRequest(context.Request, body),
+			DateCreated: time.Now().UTC().Format(time.RFC3339),
+		}
+		existing, err := reserveIdempotencyKey(record)
+		if err != nil {
+			RespondWithStorageError(context, err, "Failed to check the idempotency key", "")
+			log.Println("(idempotencyMiddleware) error:", err)
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.RequestHash != record.RequestHash:
+				RespondWithError(context, http.StatusUnprocessableEntity, ErrorResponse{
+					Message: "This Idempotency-Key was already used for a different request",
+					Code:    ERROR_CODE_IDEMPOTENCY_KEY_REUSED,
+				})
+			case existing.StatusCode == 0:
+				RespondWithError(context, http.StatusConflict, ErrorResponse{
+					Message: "A request with this Idempotency-Key is still being processed",
+					Code:    ERROR_CODE_IDEMPOTENCY_KEY_IN_PROGRESS,
+				})
+			default:
+				context.Header("Idempotent-Replayed", "true")
+				context.Data(existing.StatusCode, gin.MIMEJSON+"; charset=utf-8", []byte(existing.ResponseBody))
+				context.Abort()
+			}
+			return
+		}
+
+		writer := &capturingResponseWriter{ResponseWriter: context.Writer}
+		context.Writer = writer
+		context.Next()
+
+		if isIdempotentResponseStored(writer.Status()) {
+			err = CompleteIdempotencyKey(record.Owner, record.Key, writer.Status(), writer.body.String())
+		} else {
+			err = DeleteIdempotencyKey(record.Owner, record.Key)
+		}
+		if err != nil {
+			log.Println("(idempotencyMiddleware) error:", err)
+		}
+	}
+}
+
+func PurgeExpiredIdempotencyKeys() error {
+	return DeleteIdempotencyKeysBefore(time.Now().UTC().Add(-IDEMPOTENCY_KEY_TTL).Format(time.RFC3339))
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsIdempotentResponseStored(t *testing.T) {
+	tests := map[int]bool{
+		http.StatusOK:                  true,
+		http.StatusCreated:             true,
+		http.StatusBadRequest:          true,
+		http.StatusForbidden:           true,
+		http.StatusConflict:            true,
+		http.StatusRequestTimeout:      false,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: false,
+		http.StatusServiceUnavailable:  false,
+	}
+	for statusCode, want := range tests {
+		if got := isIdempotentResponseStored(statusCode); got != want {
+			t.Errorf("isIdempotentResponseStored(%d) = %v, want %v", statusCode, got, want)
+		}
+	}
+}
+
+func TestIsIdempotencyRecordStale(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		record IdempotencyRecord
+		want   bool
+	}{
+		{name: "fresh pending", record: IdempotencyRecord{DateCreated: now.Add(-time.Minute).Format(time.RFC3339)}, want: false},
+		{name: "crashed pending", record: IdempotencyRecord{DateCreated: now.Add(-IDEMPOTENCY_PENDING_TTL - time.Second).Format(time.RFC3339)}, want: true},
+		{name: "stored response", record: IdempotencyRecord{StatusCode: 200, DateCreated: now.Add(-time.Hour).Format(time.RFC3339)}, want: false},
+		{name: "expired response", record: IdempotencyRecord{StatusCode: 200, DateCreated: now.Add(-IDEMPOTENCY_KEY_TTL - time.Second).Format(time.RFC3339)}, want: true},
+		{name: "unparsable date", record: IdempotencyRecord{DateCreated: "yesterday"}, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isIdempotencyRecordStale(test.record, now); got != test.want {
+				t.Errorf("isIdempotencyRecordStale() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHashIdempotentRequest(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/urls", nil)
+	hash := hashIdempotentRequest(request, []byte(`{"destination":"https://example.com"}`))
+	if hash != hashIdempotentRequest(request, []byte(`{"destination":"https://example.com"}`)) {
+		t.Error("the same request hashed differently")
+	}
+	if hash == hashIdempotentRequest(request, []byte(`{"destination":"https://example.org"}`)) {
+		t.Error("different bodies hashed the same")
+	}
+	batchRequest := httptest.NewRequest(http.MethodPost, "/api/v1/urls/batch", nil)
+	if hash == hashIdempotentRequest(batchRequest, []byte(`{"destination":"https://example.com"}`)) {
+		t.Error("different paths hashed the same")
+	}
+	queryRequest := httptest.NewRequest(http.MethodPost, "/api/v1/urls?destination=https://example.org", nil)
+	if hashIdempotentRequest(queryRequest, nil) == hashIdempotentRequest(request, nil) {
+		t.Error("different queries hashed the same")
+	}
+}
+
+func TestIdempotencyOwner(t *testing.T) {
+	t.Setenv("NOLONGR_SERVER_API_KEY", "test-server-key")
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/urls", nil)
+	request.RemoteAddr = "192.0.2.1:1234"
+	if got := idempotencyOwner(newTestContext(request)); got != "ip:192.0.2.1" {
+		t.Errorf("anonymous owner = %q, want ip:192.0.2.1", got)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/api/v1/urls", nil)
+	request.Header.Set("Authorization", "Bearer test-server-key")
+	if got := idempotencyOwner(newTestContext(request)); got != "key:"+LEGACY_API_KEY_ID {
+		t.Errorf("API key owner = %q, want key:%s", got, LEGACY_API_KEY_ID)
+	}
+}
+
+func TestIdempotencyMiddlewareRejectsLongKeys(t *testing.T) {
+	response := performRequest(newTestRouter(), http.MethodPost, "/api/v1/urls", `{}`, nil, map[string]string{
+		IDEMPOTENCY_KEY_HEADER: strings.Repeat("k", MAX_IDEMPOTENCY_KEY_LENGTH+1),
+	})
+	if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), ERROR_CODE_VALIDATION_FAILED) {
+		t.Errorf("status = %d, body = %s, want a validation error", response.Code, response.Body.String())
+	}
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// The functions below are shared by the REST routes and the gRPC LinkService, so both apply the same rules.
+// Except for CreateLink, callers validate the request first.
+
+// newUrlFromRequest builds the link to insert for a create request, hashing its password.
+// userID is the account owning the link, if any.
+func newUrlFromRequest(body CreateShortUrlRequestBody, alias string, sessionToken string, userID string) (NewUrl, error) {
+	newUrl := NewUrl{
+		ID:           alias,
+		Destination:  body.Destination,
+		SessionToken: sessionToken,
+		UserID:       userID,
+		WorkspaceID:  body.WorkspaceID,
+		Title:        body.Title,
+		Tags:         body.Tags,
+	}
+	if body.MaxPageHits != nil {
+		newUrl.MaxPageHits = *body.MaxPageHits
+	}
+	if body.SelfDestruct != nil && *body.SelfDestruct > 0 {
+		newUrl.SelfDestruct = body.SelfDestruct
+	}
+	if body.Password != "" {
+		passwordHash, err := HashPassword(body.Password)
+		if err != nil {
+			return NewUrl{}, err
+		}
+		newUrl.Password = &passwordHash
+	}
+
+	return newUrl, nil
+}
+
+// applyUrlUpdate copies the fields set in an update request onto urlData, hashing a new password.
+func applyUrlUpdate(urlData *URLData, body UpdateShortUrlRequestBody) error {
+	if body.Destination != nil {
+		urlData.Destination = *body.Destination
+	}
+	if body.MaxPageHits != nil {
+		urlData.MaxPageHits = *body.MaxPageHits
+	}
+	if body.SelfDestruct != nil {
+		if *body.SelfDestruct == 0 {
+			urlData.SelfDestruct = nil
+		} else {
+			selfDestruct := time.Now().UTC().Add(time.Second * time.Duration(*body.SelfDestruct)).Format(time.RFC3339)
+			urlData.SelfDestruct = &selfDestruct
+		}
+	}
+	if body.Password != nil {
+		if *body.Password == "" {
+			urlData.Password = nil
+		} else {
+			passwordHash, err := HashPassword(*body.Password)
+			if err != nil {
+				return err
+			}
+			urlData.Password = &passwordHash
+		}
+	}
+	if body.Paused != nil {
+		urlData.Paused = *body.Paused
+	}
+	if body.Title != nil {
+		urlData.Title = *body.Title
+	}
+	if body.Tags != nil {
+		urlData.Tags = *body.Tags
+	}
+	if body.ResetPageHits {
+		urlData.PageHits = 0
+	}
+
+	return nil
+}
+
+// ResolveUrl checks the password of an unexpired link and counts a page view.
+// It returns ErrWrongPassword when the link has a password that does not match.
+func ResolveUrl(id string, password string) (URLData, error) {
+	urlData, err := GetSingleUrlUnexpired(id)
+	if err != nil {
+		return URLData{}, err
+	}
+	if urlData.Password != nil && *urlData.Password != "" && !CheckPasswordHash(password, *urlData.Password) {
+		return URLData{}, ErrWrongPassword
+	}
+
+	return countPageView(urlData)
+}
+
+// countPageView increments the page hits of a link, refusing the visit with ErrQuotaExceeded when the
+// link's owner has used up its redirects for the month.
+func countPageView(urlData URLData) (URLData, error) {
+	owner := quotaOwnerOfUrl(urlData)
+	if err := reserveQuota(owner, QUOTA_MONTHLY_REDIRECTS, 1); err != nil {
+		return URLData{}, err
+	}
+	urlData, err := IncrementSingleUrlPageHit(urlData.ID)
+	if err != nil {
+		releaseQuota(owner, QUOTA_MONTHLY_REDIRECTS, 1)
+		return URLData{}, err
+	}
+	return urlData, nil
+}
+
+// publicUrlData leaves out who owns a link, for the routes that return it to anyone who has its ID. The
+// destination and password hash of a link with a password are left out too, as visitors must send the password
+// to POST /urls/:id/resolve, where it is checked and rate limited.
+func publicUrlData(urlData URLData) URLData {
+	urlData.SessionToken, urlData.UserID, urlData.WorkspaceID = "", "", ""
+	urlData.HasPassword = urlData.Password != nil && *urlData.Password != ""
+	if urlData.HasPassword {
+		urlData.Destination = ""
+	}
+	urlData.Password = nil
+	return urlData
+}
+
+// resolvedUrlData is publicUrlData with the destination kept, for visitors who sent the password of the link.
+func resolvedUrlData(urlData URLData) URLData {
+	destination := urlData.Destination
+	urlData = publicUrlData(urlData)
+	urlData.Destination = destination
+	return urlData
+}
+
+// CreateLink validates and creates a link for callers other than the API handlers, such as the CLI.
+// Rejected fields are reported as ErrInvalidRequest.
+func CreateLink(body CreateShortUrlRequestBody, alias string, sessionToken string) (URLData, error) {
+	fieldErrors := FieldErrors{}
+	validateCreateShortUrlRequest(body, fieldErrors)
+	validateAlias(alias, fieldErrors)
+	if len(fieldErrors) > 0 {
+		return URLData{}, fmt.Errorf("%w: %s", ErrInvalidRequest, fieldErrors)
+	}
+	if isForbiddenDestination(body.Destination) {
+		return URLData{}, ErrForbiddenDestination
+	}
+
+	newUrl, err := newUrlFromRequest(body, alias, sessionToken, "")
+	if err != nil {
+		return URLData{}, err
+	}
+	return CreateNewUrl(newUrl)
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublicUrlDataLeavesOutOwners(t *testing.T) {
+	urlData := URLData{ID: "abc", Destination: "https://example.com", SessionToken: "session-1", UserID: "user-1", WorkspaceID: "workspace-1"}
+	encoded, err := json.Marshal(publicUrlData(urlData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, owner := range []string{"session-1", "user-1", "workspace-1", "user_id", "workspace_id"} {
+		if strings.Contains(string(encoded), owner) {
+			t.Errorf("%s contains %q", encoded, owner)
+		}
+	}
+	if urlData.UserID != "user-1" {
+		t.Error("publicUrlData changed its argument")
+	}
+}
+
+func TestPublicUrlDataHidesPasswordProtectedDestinations(t *testing.T) {
+	hash := "$2a$14$hash"
+	empty := ""
+	tests := []struct {
+		name            string
+		password        *string
+		wantDestination string
+		wantHasPassword bool
+	}{
+		{name: "no password", wantDestination: "https://example.com"},
+		{name: "empty password", password: &empty, wantDestination: "https://example.com"},
+		{name: "password", password: &hash, wantHasPassword: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			urlData := URLData{ID: "abc", Destination: "https://example.com", Password: test.password}
+			public := publicUrlData(urlData)
+			if public.Destination != test.wantDestination || public.HasPassword != test.wantHasPassword || public.Password != nil {
+				t.Errorf("publicUrlData() = %+v, want destination %q and has_password %v", public, test.wantDestination, test.wantHasPassword)
+			}
+			if resolved := resolvedUrlData(urlData); resolved.Destination != urlData.Destination || resolved.Password != nil {
+				t.Errorf("resolvedUrlData() = %+v, want destination %q without the password", resolved, urlData.Destination)
+			}
+		})
+	}
+}
+
+func TestApplyUrlUpdate(t *testing.T) {
+	hash := "$2a$14$hash"
+	selfDestruct := "2030-01-01T00:00:00Z"
+	urlData := URLData{ID: "abc", Destination: "https://example.com", MaxPageHits: 5, PageHits: 3, Password: &hash, SelfDestruct: &selfDestruct, Title: "Docs", Tags: []string{"a"}}
+	body := UpdateShortUrlRequestBody{
+		Destination:   stringPointer("https://example.org"),
+		Password:      stringPointer(""),
+		SelfDestruct:  int64Pointer(0),
+		Paused:        boolPointer(true),
+		ResetPageHits: true,
+	}
+	if err := applyUrlUpdate(&urlData, body); err != nil {
+		t.Fatal(err)
+	}
+	if urlData.Destination != "https://example.org" || urlData.Password != nil || urlData.SelfDestruct != nil || !urlData.Paused || urlData.PageHits != 0 {
+		t.Errorf("applyUrlUpdate() = %+v, want the destination changed, no password or expiry, paused and no page hits", urlData)
+	}
+	if urlData.MaxPageHits != 5 || urlData.Title != "Docs" || len(urlData.Tags) != 1 {
+		t.Errorf("applyUrlUpdate() = %+v, which changed fields missing from the request", urlData)
+	}
+
+	if err := applyUrlUpdate(&urlData, UpdateShortUrlRequestBody{SelfDestruct: int64Pointer(60)}); err != nil {
+		t.Fatal(err)
+	}
+	if urlData.SelfDestruct == nil {
+		t.Fatal("applyUrlUpdate() did not set the expiry")
+	}
+	if expiry, err := time.Parse(time.RFC3339, *urlData.SelfDestruct); err != nil || expiry.Before(time.Now()) || expiry.After(time.Now().Add(2*time.Minute)) {
+		t.Errorf("self_destruct = %s, want about a minute from now", *urlData.SelfDestruct)
+	}
+}
@@ -0,0 +1,480 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"golang.org/x/exp/slices"
+)
+
+// OIDC_FLOW_COOKIE carries the state, nonce and PKCE verifier of a single sign-on between the redirect to the
+// provider and the callback. It is only readable by the server and expires with OIDC_FLOW_TTL.
+const OIDC_FLOW_COOKIE = "oidc_flow"
+const OIDC_FLOW_TTL = 10 * time.Minute
+
+// oidcScopes are requested from the provider; the email is needed to create and link accounts.
+const oidcScopes = "openid email profile"
+
+// oidcClockSkew is the leeway given to the provider's clock when checking the expiry of ID tokens.
+const oidcClockSkew = time.Minute
+
+// oidcCacheTTL is how long the discovery document and signing keys are reused before being fetched again.
+const oidcCacheTTL = time.Hour
+
+// oidcKeysRefreshInterval limits refetching the signing keys when a token names an unknown key.
+const oidcKeysRefreshInterval = time.Minute
+
+var oidcHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// OidcConfig is the single sign-on configuration, read from NOLONGR_OIDC_ISSUER, NOLONGR_OIDC_CLIENT_ID,
+// NOLONGR_OIDC_CLIENT_SECRET and NOLONGR_OIDC_REDIRECT_URL. Public clients leave the secret empty and rely on PKCE.
+type OidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectUrl  string
+}
+
+// getOidcConfig returns false when single sign-on is not configured.
+func getOidcConfig() (OidcConfig, bool) {
+	config := OidcConfig{
+		Issuer:       strings.TrimSuffix(GoDotEnvVariable("NOLONGR_OIDC_ISSUER"), "/"),
+		ClientID:     GoDotEnvVariable("NOLONGR_OIDC_CLIENT_ID"),
+		ClientSecret: GoDotEnvVariable("NOLONGR_OIDC_CLIENT_SECRET"),
+		RedirectUrl:  GoDotEnvVariable("NOLONGR_OIDC_REDIRECT_URL"),
+	}
+	if config.RedirectUrl == "" {
+		config.RedirectUrl = GetBaseUrl() + "/api/v1/auth/oidc/callback"
+	}
+	return config, config.Issuer != "" && config.ClientID != ""
+}
+
+// UserIdentity links the account of an identity provider to a user. Subject is the provider's id of the account.
+type UserIdentity struct {
+	Issuer      string `json:"issuer"`
+	Subject     string `json:"subject"`
+	UserID      string `json:"user_id"`
+	Email       string `json:"email"`
+	DateCreated string `json:"date_created"`
+}
+
+// oidcProvider is the part of the discovery document that is used.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+var oidcCache struct {
+	sync.Mutex
+	issuer        string
+	provider      oidcProvider
+	providerTime  time.Time
+	keys          map[string]*rsa.PublicKey
+	keysFetchTime time.Time
+}
+
+func fetchOidcJson(url string, target interface{}) error {
+	response, err := oidcHttpClient.Get(url)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSsoProviderUnavailable, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s responded with %d", ErrSsoProviderUnavailable, url, response.StatusCode)
+	}
+	if err := json.NewDecoder(response.Body).Decode(target); err != nil {
+		return fmt.Errorf("%w: %w", ErrSsoProviderUnavailable, err)
+	}
+	return nil
+}
+
+// getOidcProvider returns the discovery document of the issuer, which must name the same issuer.
+func getOidcProvider(issuer string) (oidcProvider, error) {
+	oidcCache.Lock()
+	defer oidcCache.Unlock()
+	if oidcCache.issuer == issuer && time.Since(oidcCache.providerTime) < oidcCacheTTL {
+		return oidcCache.provider, nil
+	}
+
+	provider := oidcProvider{}
+	if err := fetchOidcJson(issuer+"/.well-known/openid-configuration", &provider); err != nil {
+		log.Println("(getOidcProvider) error:", err)
+		return provider, err
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != issuer {
+		return provider, fmt.Errorf("%w: the discovery document is for issuer %q", ErrSsoProviderUnavailable, provider.Issuer)
+	}
+	if oidcCache.issuer != issuer {
+		oidcCache.keys = nil
+		oidcCache.keysFetchTime = time.Time{}
+	}
+	oidcCache.issuer = issuer
+	oidcCache.provider = provider
+	oidcCache.providerTime = time.Now()
+	return provider, nil
+}
+
+func parseJsonWebKey(key jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(key.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(key.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+// getOidcSigningKey returns the RSA key the provider signs ID tokens with. Unknown key ids refetch the keys,
+// as providers rotate them, but at most once per oidcKeysRefreshInterval.
+func getOidcSigningKey(provider oidcProvider, kid string) (*rsa.PublicKey, error) {
+	oidcCache.Lock()
+	defer oidcCache.Unlock()
+	keysAge := time.Since(oidcCache.keysFetchTime)
+	if key, ok := oidcCache.keys[kid]; ok && keysAge < oidcCacheTTL {
+		return key, nil
+	}
+	if oidcCache.keys != nil && keysAge < oidcKeysRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrSsoFailed, kid)
+	}
+
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := fetchOidcJson(provider.JwksUri, &jwks); err != nil {
+		log.Println("(getOidcSigningKey) error:", err)
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := parseJsonWebKey(jwk)
+		if err != nil {
+			log.Printf("(getOidcSigningKey) skipping key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	oidcCache.keys = keys
+	oidcCache.keysFetchTime = time.Now()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown signing key %q", ErrSsoFailed, kid)
+}
+
+// oidcFlow is what the callback needs to know about the login it completes.
+type oidcFlow struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+func (flow oidcFlow) cookieValue() string {
+	return flow.State + "." + flow.Nonce + "." + flow.CodeVerifier
+}
+
+func parseOidcFlowCookie(value string) (oidcFlow, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return oidcFlow{}, false
+	}
+	return oidcFlow{State: parts[0], Nonce: parts[1], CodeVerifier: parts[2]}, true
+}
+
+func newOidcFlow() (oidcFlow, error) {
+	flow := oidcFlow{}
+	for _, value := range []*string{&flow.State, &flow.Nonce, &flow.CodeVerifier} {
+		token, err := generateToken()
+		if err != nil {
+			return flow, err
+		}
+		*value = token
+	}
+	return flow, nil
+}
+
+// pkceChallenge is the S256 code challenge of a PKCE verifier.
+func pkceChallenge(codeVerifier string) string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// StartOidcLogin returns the URL of the provider to send the browser to, and the flow to keep in OIDC_FLOW_COOKIE.
+func StartOidcLogin(config OidcConfig) (string, oidcFlow, error) {
+	provider, err := getOidcProvider(config.Issuer)
+	if err != nil {
+		return "", oidcFlow{}, err
+	}
+	flow, err := newOidcFlow()
+	if err != nil {
+		log.Println("(StartOidcLogin) newOidcFlow error:", err)
+		return "", flow, err
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", config.ClientID)
+	query.Set("redirect_uri", config.RedirectUrl)
+	query.Set("scope", oidcScopes)
+	query.Set("state", flow.State)
+	query.Set("nonce", flow.Nonce)
+	query.Set("code_challenge", pkceChallenge(flow.CodeVerifier))
+	query.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + query.Encode(), flow, nil
+}
+
+// IdTokenClaims are the validated claims of an ID token.
+type IdTokenClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"`
+	AuthorizedBy  string          `json:"azp"`
+	ExpiresAt     int64           `json:"exp"`
+	IssuedAt      int64           `json:"iat"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified bool            `json:"email_verified"`
+}
+
+// audiences reads aud, which is either a string or an array of strings.
+func (claims IdTokenClaims) audiences() []string {
+	var audience string
+	if err := json.Unmarshal(claims.Audience, &audience); err == nil {
+		return []string{audience}
+	}
+	var audiences []string
+	json.Unmarshal(claims.Audience, &audiences)
+	return audiences
+}
+
+// exchangeOidcCode trades the authorization code for the ID token, proving with the PKCE verifier that this
+// server started the login.
+func exchangeOidcCode(config OidcConfig, provider oidcProvider, code string, codeVerifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", config.RedirectUrl)
+	form.Set("client_id", config.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	request, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if config.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	}
+
+	response, err := oidcHttpClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrSsoProviderUnavailable, err)
+	}
+	defer response.Body.Close()
+	body := struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrSsoProviderUnavailable, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: the code was rejected: %s %s", ErrSsoFailed, body.Error, body.ErrorDescription)
+	}
+	if body.IdToken == "" {
+		return "", fmt.Errorf("%w: the token response has no id_token", ErrSsoFailed)
+	}
+	return body.IdToken, nil
+}
+
+// validateIdToken checks the RS256 signature of the token and that it was issued by the issuer to this client
+// for this login, and has not expired.
+func validateIdToken(config OidcConfig, provider oidcProvider, idToken string, nonce string, now time.Time) (IdTokenClaims, error) {
+	claims := IdTokenClaims{}
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("%w: the ID token is malformed", ErrSsoFailed)
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return claims, err
+	}
+	if header.Alg != "RS256" {
+		return claims, fmt.Errorf("%w: ID tokens signed with %q are not accepted", ErrSsoFailed, header.Alg)
+	}
+	key, err := getOidcSigningKey(provider, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("%w: the ID token signature is malformed", ErrSsoFailed)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return claims, fmt.Errorf("%w: the ID token signature is invalid", ErrSsoFailed)
+	}
+
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return claims, err
+	}
+	audiences := claims.audiences()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != config.Issuer:
+		return claims, fmt.Errorf("%w: the ID token was issued by %q", ErrSsoFailed, claims.Issuer)
+	case !slices.Contains(audiences, config.ClientID):
+		return claims, fmt.Errorf("%w: the ID token is not for this client", ErrSsoFailed)
+	case len(audiences) > 1 && claims.AuthorizedBy != config.ClientID:
+		return claims, fmt.Errorf("%w: the ID token was not authorized for this client", ErrSsoFailed)
+	case claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(oidcClockSkew)):
+		return claims, fmt.Errorf("%w: the ID token has expired", ErrSsoFailed)
+	case claims.IssuedAt == 0 || time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)):
+		return claims, fmt.Errorf("%w: the ID token is issued in the future", ErrSsoFailed)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return claims, fmt.Errorf("%w: the ID token is not for this login", ErrSsoFailed)
+	case claims.Subject == "":
+		return claims, fmt.Errorf("%w: the ID token has no subject", ErrSsoFailed)
+	}
+	return claims, nil
+}
+
+func decodeJwtPart(part string, target interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: the ID token is malformed", ErrSsoFailed)
+	}
+	if err := json.Unmarshal(decoded, target); err != nil {
+		return fmt.Errorf("%w: the ID token is malformed", ErrSsoFailed)
+	}
+	return nil
+}
+
+// CompleteOidcLogin exchanges the code of the callback and returns the user to log in. loggedInUserID is the
+// user already logged in, if any.
+func CompleteOidcLogin(config OidcConfig, flow oidcFlow, code string, loggedInUserID string) (User, error) {
+	provider, err := getOidcProvider(config.Issuer)
+	if err != nil {
+		return User{}, err
+	}
+	idToken, err := exchangeOidcCode(config, provider, code, flow.CodeVerifier)
+	if err != nil {
+		log.Println("(CompleteOidcLogin) exchangeOidcCode error:", err)
+		return User{}, err
+	}
+	claims, err := validateIdToken(config, provider, idToken, flow.Nonce, time.Now())
+	if err != nil {
+		log.Println("(CompleteOidcLogin) validateIdToken error:", err)
+		return User{}, err
+	}
+	return linkOidcIdentity(config.Issuer, claims, loggedInUserID)
+}
+
+// linkOidcIdentity returns the user of the identity, linking it the first time it is used:
+//   - to the logged in user, so that users can add single sign-on to their account;
+//   - else to the account with the same email, but only when the provider verified the email;
+//   - else to a new account, which has no password until one is set with a password reset.
+func linkOidcIdentity(issuer string, claims IdTokenClaims, loggedInUserID string) (User, error) {
+	identity, err := GetUserIdentity(issuer, claims.Subject)
+	if err == nil {
+		if loggedInUserID != "" && loggedInUserID != identity.UserID {
+			return User{}, ErrIdentityLinked
+		}
+		return GetUserById(identity.UserID)
+	} else if !errors.Is(err, ErrNotFound) {
+		return User{}, err
+	}
+
+	email := normalizeEmail(claims.Email)
+	var user User
+	switch {
+	case loggedInUserID != "":
+		user, err = GetUserById(loggedInUserID)
+	case email == "":
+		return User{}, fmt.Errorf("%w: the provider did not share an email address", ErrSsoFailed)
+	default:
+		existing, _, lookupErr := GetUserByEmail(email)
+		var isNew bool
+		if user, isNew, err = emailAccountToLink(claims, existing, lookupErr); isNew {
+			err = InsertUser(user, "")
+		}
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	identity = UserIdentity{
+		Issuer:      issuer,
+		Subject:     claims.Subject,
+		UserID:      user.ID,
+		Email:       email,
+		DateCreated: time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := InsertUserIdentity(identity); err != nil {
+		// Another login of the same identity linked it first
+		if errors.Is(err, ErrIDConflict) {
+			if linked, getErr := GetUserIdentity(issuer, claims.Subject); getErr == nil && linked.UserID == user.ID {
+				return user, nil
+			}
+			return User{}, ErrIdentityLinked
+		}
+		return User{}, err
+	}
+	return user, nil
+}
+
+// emailAccountToLink picks the account to link a new identity to from the lookup of its email: the account
+// found, but only when the provider verified the email, as anyone could otherwise take over an account by
+// signing up at the provider with its address; else a new account, reported by isNew, when none was found.
+func emailAccountToLink(claims IdTokenClaims, found User, lookupErr error) (user User, isNew bool, err error) {
+	switch {
+	case lookupErr == nil && !claims.EmailVerified:
+		return User{}, false, ErrEmailTaken
+	case lookupErr == nil:
+		return found, false, nil
+	case errors.Is(lookupErr, ErrNotFound):
+		email := normalizeEmail(claims.Email)
+		return User{ID: ksuid.New().String(), Email: email, DateCreated: time.Now().UTC().Format(time.RFC3339)}, true, nil
+	}
+	return User{}, false, lookupErr
+}
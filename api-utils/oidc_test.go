@@ -0,0 +1,332 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"main.go/mockoidc"
+)
+
+const testOidcClientID = "nolongr-test"
+const testOidcClientSecret = "test-client-secret"
+
+// startMockOidc runs the mock provider and configures single sign-on with it.
+func startMockOidc(t *testing.T) (*mockoidc.Provider, OidcConfig) {
+	t.Helper()
+	mock, err := mockoidc.New("", testOidcClientID, testOidcClientSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(mock.Handler())
+	t.Cleanup(server.Close)
+	mock.Issuer = server.URL
+
+	t.Setenv("NOLONGR_OIDC_ISSUER", server.URL)
+	t.Setenv("NOLONGR_OIDC_CLIENT_ID", testOidcClientID)
+	t.Setenv("NOLONGR_OIDC_CLIENT_SECRET", testOidcClientSecret)
+	t.Setenv("NOLONGR_OIDC_REDIRECT_URL", "https://nolongr.test/api/v1/auth/oidc/callback")
+	oidcCache.Lock()
+	oidcCache.issuer = ""
+	oidcCache.keys = nil
+	oidcCache.keysFetchTime = time.Time{}
+	oidcCache.Unlock()
+
+	config, ok := getOidcConfig()
+	if !ok {
+		t.Fatal("single sign-on is not configured")
+	}
+	return mock, config
+}
+
+// authorizeOidc starts a login and logs in at the provider as email, returning the flow and the query the
+// provider redirects back to the callback with.
+func authorizeOidc(t *testing.T, config OidcConfig, email string) (oidcFlow, url.Values) {
+	t.Helper()
+	authorizationUrl, flow, err := StartOidcLogin(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err := client.Get(authorizationUrl + "&login_hint=" + url.QueryEscape(email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	location, err := response.Location()
+	if err != nil {
+		t.Fatalf("the provider did not redirect back: %v", err)
+	}
+	return flow, location.Query()
+}
+
+func TestOidcLogin(t *testing.T) {
+	_, config := startMockOidc(t)
+	flow, callback := authorizeOidc(t, config, "Ada@Example.com")
+	if callback.Get("state") != flow.State {
+		t.Fatalf("state = %q, want %q", callback.Get("state"), flow.State)
+	}
+	provider, err := getOidcProvider(config.Issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idToken, err := exchangeOidcCode(config, provider, callback.Get("code"), flow.CodeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := validateIdToken(config, provider, idToken, flow.Nonce, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Email != "ada@example.com" || !claims.EmailVerified || claims.Subject == "" {
+		t.Errorf("claims = %+v", claims)
+	}
+}
+
+func TestExchangeOidcCodeChecksPkce(t *testing.T) {
+	_, config := startMockOidc(t)
+	provider, err := getOidcProvider(config.Issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherFlow, err := newOidcFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		verifier func(flow oidcFlow) string
+		config   func(config OidcConfig) OidcConfig
+	}{
+		{name: "verifier of another login", verifier: func(oidcFlow) string { return otherFlow.CodeVerifier }},
+		{name: "no verifier", verifier: func(oidcFlow) string { return "" }},
+		{name: "other redirect URL", verifier: func(flow oidcFlow) string { return flow.CodeVerifier }, config: func(config OidcConfig) OidcConfig {
+			config.RedirectUrl = "https://attacker.test/callback"
+			return config
+		}},
+		{name: "wrong client secret", verifier: func(flow oidcFlow) string { return flow.CodeVerifier }, config: func(config OidcConfig) OidcConfig {
+			config.ClientSecret = "wrong"
+			return config
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flow, callback := authorizeOidc(t, config, "ada@example.com")
+			exchangeConfig := config
+			if test.config != nil {
+				exchangeConfig = test.config(config)
+			}
+			_, err := exchangeOidcCode(exchangeConfig, provider, callback.Get("code"), test.verifier(flow))
+			if !errors.Is(err, ErrSsoFailed) {
+				t.Errorf("exchangeOidcCode() error = %v, want %v", err, ErrSsoFailed)
+			}
+		})
+	}
+
+	t.Run("code reused", func(t *testing.T) {
+		flow, callback := authorizeOidc(t, config, "ada@example.com")
+		if _, err := exchangeOidcCode(config, provider, callback.Get("code"), flow.CodeVerifier); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := exchangeOidcCode(config, provider, callback.Get("code"), flow.CodeVerifier); !errors.Is(err, ErrSsoFailed) {
+			t.Errorf("exchangeOidcCode() error = %v, want %v", err, ErrSsoFailed)
+		}
+	})
+}
+
+func TestOidcCallbackChecksState(t *testing.T) {
+	_, config := startMockOidc(t)
+	flow, callback := authorizeOidc(t, config, "ada@example.com")
+	otherFlow, err := newOidcFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cookie string
+		state  string
+	}{
+		{name: "no flow cookie", state: callback.Get("state")},
+		{name: "malformed flow cookie", cookie: "not-a-flow", state: callback.Get("state")},
+		{name: "state of another login", cookie: otherFlow.cookieValue(), state: callback.Get("state")},
+		{name: "no state", cookie: flow.cookieValue()},
+		{name: "forged state", cookie: flow.cookieValue(), state: "forged"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := url.Values{"code": {callback.Get("code")}, "state": {test.state}}
+			var cookies []*http.Cookie
+			if test.cookie != "" {
+				cookies = []*http.Cookie{{Name: OIDC_FLOW_COOKIE, Value: test.cookie}}
+			}
+			response := performRequest(newTestRouter(), http.MethodGet, "/api/v1/auth/oidc/callback?"+query.Encode(), "", cookies, nil)
+			if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), ERROR_CODE_SSO_FAILED) {
+				t.Errorf("response = %d %s, want 400 %s", response.Code, response.Body.String(), ERROR_CODE_SSO_FAILED)
+			}
+		})
+	}
+}
+
+func TestValidateIdToken(t *testing.T) {
+	mock, config := startMockOidc(t)
+	provider, err := getOidcProvider(config.Issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	const nonce = "test-nonce"
+
+	tests := []struct {
+		name    string
+		edit    func(header map[string]interface{}, claims map[string]interface{})
+		wantErr bool
+	}{
+		{name: "valid", edit: func(map[string]interface{}, map[string]interface{}) {}},
+		{name: "issuer with trailing slash", edit: func(header, claims map[string]interface{}) { claims["iss"] = config.Issuer + "/" }},
+		{name: "wrong issuer", edit: func(header, claims map[string]interface{}) { claims["iss"] = "https://attacker.test" }, wantErr: true},
+		{name: "wrong audience", edit: func(header, claims map[string]interface{}) { claims["aud"] = "another-client" }, wantErr: true},
+		{name: "audience list with client", edit: func(header, claims map[string]interface{}) {
+			claims["aud"] = []string{testOidcClientID, "another-client"}
+			claims["azp"] = testOidcClientID
+		}},
+		{name: "audience list without client", edit: func(header, claims map[string]interface{}) {
+			claims["aud"] = []string{"another-client", "third-client"}
+			claims["azp"] = testOidcClientID
+		}, wantErr: true},
+		{name: "audience list without azp", edit: func(header, claims map[string]interface{}) {
+			claims["aud"] = []string{testOidcClientID, "another-client"}
+		}, wantErr: true},
+		{name: "audience list authorized for another client", edit: func(header, claims map[string]interface{}) {
+			claims["aud"] = []string{testOidcClientID, "another-client"}
+			claims["azp"] = "another-client"
+		}, wantErr: true},
+		{name: "expired", edit: func(header, claims map[string]interface{}) {
+			claims["exp"] = now.Add(-oidcClockSkew - time.Second).Unix()
+		}, wantErr: true},
+		{name: "expired within clock skew", edit: func(header, claims map[string]interface{}) {
+			claims["exp"] = now.Add(-oidcClockSkew / 2).Unix()
+		}},
+		{name: "no expiry", edit: func(header, claims map[string]interface{}) { delete(claims, "exp") }, wantErr: true},
+		{name: "issued in the future", edit: func(header, claims map[string]interface{}) {
+			claims["iat"] = now.Add(oidcClockSkew + time.Minute).Unix()
+		}, wantErr: true},
+		{name: "nonce of another login", edit: func(header, claims map[string]interface{}) { claims["nonce"] = "other-nonce" }, wantErr: true},
+		{name: "no nonce", edit: func(header, claims map[string]interface{}) { delete(claims, "nonce") }, wantErr: true},
+		{name: "no subject", edit: func(header, claims map[string]interface{}) { delete(claims, "sub") }, wantErr: true},
+		{name: "HS256", edit: func(header, claims map[string]interface{}) { header["alg"] = "HS256" }, wantErr: true},
+		{name: "alg none", edit: func(header, claims map[string]interface{}) { header["alg"] = "none" }, wantErr: true},
+		{name: "unknown key", edit: func(header, claims map[string]interface{}) { header["kid"] = "another-key" }, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := map[string]interface{}{"alg": "RS256", "typ": "JWT", "kid": mockoidc.KeyID}
+			claims := map[string]interface{}{
+				"iss":            config.Issuer,
+				"sub":            "subject",
+				"aud":            testOidcClientID,
+				"exp":            now.Add(time.Minute).Unix(),
+				"iat":            now.Unix(),
+				"nonce":          nonce,
+				"email":          "ada@example.com",
+				"email_verified": true,
+			}
+			test.edit(header, claims)
+			idToken, err := mock.Sign(header, claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = validateIdToken(config, provider, idToken, nonce, now)
+			if test.wantErr && !errors.Is(err, ErrSsoFailed) {
+				t.Errorf("validateIdToken() error = %v, want %v", err, ErrSsoFailed)
+			} else if !test.wantErr && err != nil {
+				t.Errorf("validateIdToken() error = %v", err)
+			}
+		})
+	}
+
+	t.Run("tampered claims", func(t *testing.T) {
+		idToken, err := mock.Sign(map[string]interface{}{"alg": "RS256", "kid": mockoidc.KeyID}, map[string]interface{}{"sub": "subject"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.Split(idToken, ".")
+		forged, err := mock.Sign(map[string]interface{}{"alg": "RS256", "kid": mockoidc.KeyID}, map[string]interface{}{"sub": "admin"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tampered := parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2]
+		if _, err := validateIdToken(config, provider, tampered, nonce, now); !errors.Is(err, ErrSsoFailed) {
+			t.Errorf("validateIdToken() error = %v, want %v", err, ErrSsoFailed)
+		}
+	})
+}
+
+func TestEmailAccountToLink(t *testing.T) {
+	mock, config := startMockOidc(t)
+	mock.EditIdToken = func(header map[string]interface{}, claims map[string]interface{}) {
+		claims["email_verified"] = false
+	}
+	flow, callback := authorizeOidc(t, config, "ada@example.com")
+	provider, err := getOidcProvider(config.Issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idToken, err := exchangeOidcCode(config, provider, callback.Get("code"), flow.CodeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unverified, err := validateIdToken(config, provider, idToken, flow.Nonce, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unverified.EmailVerified {
+		t.Fatal("the provider verified the email")
+	}
+	verified := unverified
+	verified.EmailVerified = true
+
+	existing := User{ID: "existing-user", Email: "ada@example.com"}
+	tests := []struct {
+		name      string
+		claims    IdTokenClaims
+		lookupErr error
+		wantUser  string
+		wantNew   bool
+		wantErr   error
+	}{
+		{name: "verified email of an account", claims: verified, wantUser: existing.ID},
+		{name: "unverified email of an account", claims: unverified, wantErr: ErrEmailTaken},
+		{name: "unverified new email", claims: unverified, lookupErr: ErrNotFound, wantNew: true},
+		{name: "verified new email", claims: verified, lookupErr: ErrNotFound, wantNew: true},
+		{name: "lookup failed", claims: verified, lookupErr: ErrDatabaseUnavailable, wantErr: ErrDatabaseUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			found := existing
+			if test.lookupErr != nil {
+				found = User{}
+			}
+			user, isNew, err := emailAccountToLink(test.claims, found, test.lookupErr)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) || user.ID != "" {
+					t.Errorf("emailAccountToLink() = %+v, %v, want error %v", user, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || isNew != test.wantNew {
+				t.Fatalf("emailAccountToLink() = %+v, %v, %v, want isNew %v", user, isNew, err, test.wantNew)
+			}
+			if test.wantNew && (user.ID == "" || user.ID == existing.ID || user.Email != "ada@example.com") {
+				t.Errorf("new account = %+v", user)
+			} else if !test.wantNew && user.ID != test.wantUser {
+				t.Errorf("linked account = %q, want %q", user.ID, test.wantUser)
+			}
+		})
+	}
+}
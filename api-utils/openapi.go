@@ -0,0 +1,531 @@
+package utils
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const OPENAPI_VERSION = "3.0.3"
+const API_VERSION_PREFIX = "/api/v1"
+
+type queryParamDoc struct {
+	Name        string
+	Type        string
+	Description string
+	Required    bool
+}
+
+// routeDoc documents a route of registerApiRoutes. Body and Result are sample values whose types
+// are turned into JSON schemas, so the document follows the request and response structs.
+type routeDoc struct {
+	Summary string
+	Tag     string
+	Query   []queryParamDoc
+	Body    interface{}
+	Result  interface{}
+	Paged   bool
+	// Redirect routes answer with a 302 to a browser instead of a result
+	Redirect bool
+	// Scope is the API key scope the route needs; sessions may use links:read and links:write
+	Scope string
+}
+
+var urlListQueryDocs = []queryParamDoc{
+	{Name: "limit", Type: "integer", Description: "Page size, 1 to 200 (default 50)"},
+	{Name: "cursor", Type: "string", Description: "next_cursor of the previous page"},
+	{Name: "sort", Type: "string", Description: "created_desc (default), created_asc, hits_desc or hits_asc"},
+	{Name: "status", Type: "string", Description: "active, expired or paused"},
+	{Name: "has_password", Type: "boolean", Description: "Only links with (true) or without (false) a password"},
+	{Name: "domain", Type: "string", Description: "Only links whose destination is on this host"},
+	{Name: "created_after", Type: "string", Description: "RFC 3339 timestamp, inclusive"},
+	{Name: "created_before", Type: "string", Description: "RFC 3339 timestamp, exclusive"},
+}
+
+// routeDocs is keyed by method and path relative to /api/v1
+var routeDocs = map[string]routeDoc{
+	"GET /urls/:id": {
+		Summary: "Get an unexpired link, without its owners, or its destination when it has a password and the caller may not view it",
+		Tag:     "links",
+		Result:  URLData{},
+	},
+	"GET /user-session-urls": {
+		Summary: "List the links of the caller's session or account, or of a workspace the caller is a member of",
+		Tag:     "links",
+		Query: append([]queryParamDoc{
+			{Name: "workspace_id", Type: "string", Description: "List the links of a workspace the caller is a member of instead"},
+		}, urlListQueryDocs...),
+		Result: []URLData{},
+		Paged:  true,
+		Scope:  API_KEY_SCOPE_LINKS_READ,
+	},
+	"GET /user-session-urls/search": {
+		Summary: "Search the caller's links by destination, alias, title or tags",
+		Tag:     "links",
+		Query: []queryParamDoc{
+			{Name: "q", Type: "string", Description: "At least 2 characters", Required: true},
+			{Name: "limit", Type: "integer", Description: "1 to 200 (default 50)"},
+			{Name: "workspace_id", Type: "string", Description: "Search the links of a workspace the caller is a member of instead"},
+		},
+		Result: []URLData{},
+		Scope:  API_KEY_SCOPE_LINKS_READ,
+	},
+	"POST /urls": {
+		Summary: "Create a link with a session or API key; an Idempotency-Key header makes retries return the original response. Rate limited per IP, session and API key",
+		Tag:     "links",
+		Body:    CreateShortUrlRequestBody{},
+		Result:  URLData{},
+		Scope:   API_KEY_SCOPE_LINKS_WRITE,
+	},
+	"POST /urls/batch": {
+		Summary: "Create up to 500 links in one transaction",
+		Tag:     "links",
+		Body:    BatchCreateShortUrlRequestBody{},
+		Result:  []BatchItemResult{},
+		Scope:   API_KEY_SCOPE_LINKS_WRITE,
+	},
+	"POST /urls/batch/delete": {
+		Summary: "Delete owned links",
+		Tag:     "links",
+		Body:    BulkIdsRequestBody{},
+		Result:  BulkOperationResult{},
+		Scope:   API_KEY_SCOPE_LINKS_WRITE,
+	},
+	"PATCH /urls/batch": {
+		Summary: "Pause, resume or change the expiry of owned links",
+		Tag:     "links",
+		Body:    BulkUpdateRequestBody{},
+		Result:  BulkOperationResult{},
+		Scope:   API_KEY_SCOPE_LINKS_WRITE,
+	},
+	"PATCH /urls/:id": {
+		Summary: "Edit an owned link",
+		Tag:     "links",
+		Body:    UpdateShortUrlRequestBody{},
+		Result:  URLData{},
+		Scope:   API_KEY_SCOPE_LINKS_WRITE,
+	},
+	"POST /urls/:id/resolve": {
+		Summary: "Check the password of a link and count a page view",
+		Tag:     "links",
+		Body:    ResolveUrlRequestBody{},
+		Result:  URLData{},
+	},
+	"GET /urls/:id/stats": {
+		Summary: "Get the page views of an owned link per day",
+		Tag:     "links",
+		Result:  UrlStats{},
+		Scope:   API_KEY_SCOPE_LINKS_READ,
+	},
+	"DELETE /delete-url": {
+		Summary: "Delete a link of the caller's session, account or a workspace the caller is an editor of",
+		Tag:     "links",
+		Query: []queryParamDoc{
+			{Name: "id", Type: "string", Required: true},
+		},
+		Result: true,
+		Scope:  API_KEY_SCOPE_LINKS_WRITE,
+	},
+	"POST /claim-codes": {
+		Summary: "Issue a code, valid for 10 minutes, that lets another device share the caller's session",
+		Tag:     "session",
+		Result:  ClaimCode{},
+	},
+	"POST /claim-codes/redeem": {
+		Summary: "Redeem a claim code: the links of the caller's session move to the issuing session, which becomes the caller's session_token cookie",
+		Tag:     "session",
+		Body:    RedeemClaimCodeRequestBody{},
+		Result:  ClaimResult{},
+	},
+	"POST /workspaces": {
+		Summary: "Create a workspace, with the logged in user as its owner",
+		Tag:     "workspaces",
+		Body:    CreateWorkspaceRequestBody{},
+		Result:  Workspace{},
+		Scope:   API_KEY_SCOPE_LINKS_WRITE,
+	},
+	"GET /workspaces": {
+		Summary: "List the workspaces of the logged in user with the user's role",
+		Tag:     "workspaces",
+		Result:  []Workspace{},
+		Scope:   API_KEY_SCOPE_LINKS_READ,
+	},
+	"GET /workspaces/:id/members": {
+		Summary: "List the members of a workspace",
+		Tag:     "workspaces",
+		Result:  []WorkspaceMember{},
+		Scope:   API_KEY_SCOPE_LINKS_READ,
+	},
+	"PUT /workspaces/:id/members": {
+		Summary: "Add an account to a workspace or change its role (owner, editor or viewer); needs the owner role",
+		Tag:     "workspaces",
+		Body:    WorkspaceMemberRequestBody{},
+		Result:  WorkspaceMember{},
+		Scope:   API_KEY_SCOPE_LINKS_WRITE,
+	},
+	"DELETE /workspaces/:id/members/:user_id": {
+		Summary: "Remove a member from a workspace; needs the owner role unless members remove themselves",
+		Tag:     "workspaces",
+		Result:  true,
+		Scope:   API_KEY_SCOPE_LINKS_WRITE,
+	},
+	"GET /quota": {
+		Summary: "Get the caller's usage of the active link, daily creation and monthly redirect quotas",
+		Tag:     "session",
+		Result:  QuotaStatus{},
+	},
+	"POST /api-keys": {
+		Summary: "Create an API key for the caller's session; the key is only returned once. Sessions may grant links:read and links:write, admin keys any scope",
+		Tag:     "session",
+		Body:    CreateApiKeyRequestBody{},
+		Result:  CreatedApiKey{},
+	},
+	"GET /api-keys": {
+		Summary: "List the API keys of the caller's session, or every key with an admin key",
+		Tag:     "session",
+		Result:  []ApiKey{},
+	},
+	"DELETE /api-keys/:id": {
+		Summary: "Revoke an API key",
+		Tag:     "session",
+		Result:  ApiKey{},
+	},
+	"POST /auth/register": {
+		Summary: "Create an account and log in; the links of the current session are attached to the account",
+		Tag:     "auth",
+		Body:    UserCredentialsRequestBody{},
+		Result:  AuthResult{},
+	},
+	"POST /auth/login": {
+		Summary: "Log in, which sets the user_session cookie; the links of the current session are attached to the account",
+		Tag:     "auth",
+		Body:    UserCredentialsRequestBody{},
+		Result:  AuthResult{},
+	},
+	"POST /auth/logout": {
+		Summary: "End the login session",
+		Tag:     "auth",
+		Result:  true,
+	},
+	"GET /auth/me": {
+		Summary: "Get the logged in user",
+		Tag:     "auth",
+		Result:  User{},
+	},
+	"POST /auth/password-reset": {
+		Summary: "Send a password reset link if the email is registered",
+		Tag:     "auth",
+		Body:    PasswordResetRequestBody{},
+		Result:  true,
+	},
+	"POST /auth/password-reset/confirm": {
+		Summary: "Set a new password with a reset token and log out every session of the account",
+		Tag:     "auth",
+		Body:    PasswordResetConfirmRequestBody{},
+		Result:  User{},
+	},
+	"GET /auth/oidc/login": {
+		Summary:  "Redirect to the identity provider to log in with single sign-on; when logged in, the identity is linked to the account",
+		Tag:      "auth",
+		Redirect: true,
+	},
+	"GET /auth/oidc/callback": {
+		Summary: "Complete single sign-on, which sets the user_session cookie and redirects to the site",
+		Tag:     "auth",
+		Query: []queryParamDoc{
+			{Name: "code", Type: "string", Description: "Authorization code from the identity provider"},
+			{Name: "state", Type: "string", Required: true, Description: "State sent to the identity provider"},
+			{Name: "error", Type: "string", Description: "Set by the identity provider when the login failed"},
+		},
+		Redirect: true,
+	},
+	"GET /auth/identities": {
+		Summary: "List the identity provider accounts linked to the logged in user",
+		Tag:     "auth",
+		Result:  []UserIdentity{},
+	},
+	"GET /set-cookie": {
+		Summary: "Start a session",
+		Tag:     "session",
+		Result:  map[string]string{},
+	},
+	"GET /get-cookie": {
+		Summary: "Get the session cookie",
+		Tag:     "session",
+		Result:  "",
+	},
+	"GET /csrf-token": {
+		Summary: "Get the CSRF token, also set as the csrf_token cookie, to send in the X-CSRF-Token header",
+		Tag:     "session",
+		Result:  CsrfToken{},
+	},
+	"GET /urls/page-views/:id": {
+		Summary: "Count a page view of a link",
+		Tag:     "links",
+		Result:  URLData{},
+		Scope:   API_KEY_SCOPE_PAGEVIEWS,
+	},
+	"GET /urls": {
+		Summary: "List every link",
+		Tag:     "admin",
+		Query:   urlListQueryDocs,
+		Result:  []URLData{},
+		Paged:   true,
+		Scope:   API_KEY_SCOPE_ADMIN,
+	},
+	"GET /expired-urls": {
+		Summary: "List expired links",
+		Tag:     "admin",
+		Result:  []URLData{},
+		Scope:   API_KEY_SCOPE_ADMIN,
+	},
+	"GET /new-short-id": {
+		Summary: "Check whether an ID is taken and suggest a free one",
+		Tag:     "admin",
+		Query:   []queryParamDoc{{Name: "id", Type: "string"}},
+		Result:  map[string]interface{}{},
+		Scope:   API_KEY_SCOPE_ADMIN,
+	},
+	"DELETE /delete-expired-ids": {
+		Summary: "Delete expired links",
+		Tag:     "cron",
+		Result:  []string{},
+		Scope:   API_KEY_SCOPE_ADMIN,
+	},
+	"DELETE /delete-expired-visits": {
+		Summary: "Delete or roll up visits older than the retention window",
+		Tag:     "cron",
+		Result:  int64(0),
+		Scope:   API_KEY_SCOPE_ADMIN,
+	},
+	"DELETE /delete-expired-idempotency-keys": {
+		Summary: "Delete idempotency keys older than 24 hours",
+		Tag:     "cron",
+		Result:  true,
+		Scope:   API_KEY_SCOPE_ADMIN,
+	},
+	"DELETE /delete-idle-rate-limit-buckets": {
+		Summary: "Delete rate limit buckets unused for 24 hours",
+		Tag:     "cron",
+		Result:  true,
+		Scope:   API_KEY_SCOPE_ADMIN,
+	},
+	"DELETE /delete-expired-quota-usage": {
+		Summary: "Delete quota usage of past days and months",
+		Tag:     "cron",
+		Result:  true,
+		Scope:   API_KEY_SCOPE_ADMIN,
+	},
+	"DELETE /delete-expired-user-tokens": {
+		Summary: "Delete expired login sessions and password reset tokens",
+		Tag:     "cron",
+		Result:  true,
+		Scope:   API_KEY_SCOPE_ADMIN,
+	},
+	"DELETE /delete-expired-claim-codes": {
+		Summary: "Delete expired claim codes",
+		Tag:     "cron",
+		Result:  true,
+		Scope:   API_KEY_SCOPE_ADMIN,
+	},
+	"GET /openapi.json": {
+		Summary: "This document",
+		Tag:     "meta",
+	},
+}
+
+// Cron routes are also served on GET, which is what Vercel cron jobs send
+func init() {
+	cronDocs := map[string]routeDoc{}
+	for key, doc := range routeDocs {
+		if path, ok := strings.CutPrefix(key, http.MethodDelete+" "); ok && doc.Tag == "cron" {
+			cronDocs[http.MethodGet+" "+path] = doc
+		}
+	}
+	for key, doc := range cronDocs {
+		routeDocs[key] = doc
+	}
+}
+
+var pathParamRegex = regexp.MustCompile(`:([A-Za-z0-9_]+)`)
+
+// schemaFor builds a JSON schema from a Go type using its json tags.
+func schemaFor(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := schemaFor(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		addStructProperties(t, properties)
+		return map[string]interface{}{"type": "object", "properties": properties}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func addStructProperties(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			addStructProperties(field.Type, properties)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaFor(field.Type)
+	}
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+func newOperation(method string, path string, doc routeDoc) map[string]interface{} {
+	parameters := []interface{}{}
+	for _, match := range pathParamRegex.FindAllStringSubmatch(path, -1) {
+		parameters = append(parameters, map[string]interface{}{
+			"name": match[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, query := range doc.Query {
+		parameters = append(parameters, map[string]interface{}{
+			"name": query.Name, "in": "query", "required": query.Required, "description": query.Description,
+			"schema": map[string]interface{}{"type": query.Type},
+		})
+	}
+
+	successSchema := map[string]interface{}{"type": "object"}
+	if doc.Result != nil {
+		resultProperties := map[string]interface{}{"result": schemaFor(reflect.TypeOf(doc.Result))}
+		if doc.Paged {
+			resultProperties["next_cursor"] = map[string]interface{}{"type": "string"}
+		}
+		successSchema["properties"] = resultProperties
+	}
+
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "Success",
+			"content":     jsonContent(successSchema),
+		},
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content":     jsonContent(map[string]interface{}{"$ref": "#/components/schemas/ErrorEnvelope"}),
+		},
+	}
+	if doc.Redirect {
+		delete(responses, "200")
+		responses["302"] = map[string]interface{}{"description": "Redirect"}
+	}
+	operation := map[string]interface{}{
+		"summary":    doc.Summary,
+		"parameters": parameters,
+		"responses":  responses,
+	}
+	if doc.Tag != "" {
+		operation["tags"] = []string{doc.Tag}
+	}
+	if doc.Scope != "" {
+		operation["description"] = "API keys need the " + doc.Scope + " scope."
+		if doc.Tag == "cron" {
+			operation["description"] = "Needs an API key with the admin scope, or CRON_SECRET as a bearer token."
+		}
+		security := []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+		if doc.Scope == API_KEY_SCOPE_LINKS_READ || doc.Scope == API_KEY_SCOPE_LINKS_WRITE {
+			security = append(security, map[string]interface{}{"sessionCookie": []string{}})
+		}
+		operation["security"] = security
+	}
+	if doc.Body != nil && method != http.MethodGet {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  jsonContent(schemaFor(reflect.TypeOf(doc.Body))),
+		}
+	}
+	return operation
+}
+
+const apiDescription = "Every route is also served without the /v1 prefix for existing clients. " +
+	"POST, PUT, PATCH and DELETE requests authenticated by cookie rather than an API key must send the csrf_token cookie in the X-CSRF-Token header. " +
+	"The token is bound to the session and login, and replaced when they change."
+
+// NewOpenAPIDocument describes the /api/v1 routes among the registered routes.
+// The unversioned /api routes are aliases and are not listed separately.
+func NewOpenAPIDocument(routes gin.RoutesInfo) map[string]interface{} {
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+
+	paths := map[string]interface{}{}
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, API_VERSION_PREFIX+"/") {
+			continue
+		}
+		relativePath := strings.TrimPrefix(route.Path, API_VERSION_PREFIX)
+		doc, ok := routeDocs[route.Method+" "+relativePath]
+		if !ok {
+			doc = routeDoc{Summary: route.Method + " " + relativePath}
+		}
+
+		openApiPath := pathParamRegex.ReplaceAllString(route.Path, "{$1}")
+		pathItem, ok := paths[openApiPath].(map[string]interface{})
+		if !ok {
+			pathItem = map[string]interface{}{}
+			paths[openApiPath] = pathItem
+		}
+		pathItem[strings.ToLower(route.Method)] = newOperation(route.Method, route.Path, doc)
+	}
+
+	errorResponseSchema := schemaFor(reflect.TypeOf(ErrorResponse{}))
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":       "nolongr API",
+			"version":     "1",
+			"description": apiDescription,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": GetBaseUrl()}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth":    map[string]interface{}{"type": "http", "scheme": "bearer", "description": "API key"},
+				"sessionCookie": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "session_token"},
+			},
+			"schemas": map[string]interface{}{
+				"ErrorResponse": errorResponseSchema,
+				"ErrorEnvelope": map[string]interface{}{
+					"type":       "object",
+					"properties": map[string]interface{}{"error": map[string]interface{}{"$ref": "#/components/schemas/ErrorResponse"}},
+				},
+			},
+		},
+	}
+}
+
+// OpenAPIHandler serves the OpenAPI document of the routes returned by routes.
+func OpenAPIHandler(routes func() gin.RoutesInfo) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		context.JSON(http.StatusOK, NewOpenAPIDocument(routes()))
+	}
+}
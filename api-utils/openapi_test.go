@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newOpenAPITestRouter registers the routes and the OpenAPI document the way api/entrypoint.go does.
+func newOpenAPITestRouter() *gin.Engine {
+	router := newTestRouter()
+	router.GET("/api/openapi.json", OpenAPIHandler(router.Routes))
+	router.GET("/api/v1/openapi.json", OpenAPIHandler(router.Routes))
+	return router
+}
+
+func TestRouteDocsMatchTheRegisteredRoutes(t *testing.T) {
+	registered := map[string]bool{}
+	for _, route := range newOpenAPITestRouter().Routes() {
+		relativePath, ok := strings.CutPrefix(route.Path, API_VERSION_PREFIX+"/")
+		if !ok {
+			continue
+		}
+		key := route.Method + " /" + relativePath
+		registered[key] = true
+		if _, ok := routeDocs[key]; !ok {
+			t.Errorf("%s is registered but not documented", key)
+		}
+	}
+	for key := range routeDocs {
+		if !registered[key] {
+			t.Errorf("%s is documented but not registered", key)
+		}
+	}
+}
+
+func TestNewOpenAPIDocument(t *testing.T) {
+	document := NewOpenAPIDocument(newOpenAPITestRouter().Routes())
+	paths := document["paths"].(map[string]interface{})
+
+	if _, ok := paths["/api/urls/{id}"]; ok {
+		t.Error("the unversioned aliases are listed")
+	}
+	getUrl, ok := paths["/api/v1/urls/{id}"].(map[string]interface{})["get"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("GET /api/v1/urls/{id} is missing from %v", paths)
+	}
+	parameters := getUrl["parameters"].([]interface{})
+	if len(parameters) != 1 || parameters[0].(map[string]interface{})["name"] != "id" {
+		t.Errorf("parameters = %v, want the id path parameter", parameters)
+	}
+
+	stats := paths["/api/v1/urls/{id}/stats"].(map[string]interface{})["get"].(map[string]interface{})
+	if stats["description"] != "API keys need the "+API_KEY_SCOPE_LINKS_READ+" scope." || len(stats["security"].([]interface{})) != 2 {
+		t.Errorf("stats operation = %v, want the links:read scope with bearer and cookie security", stats)
+	}
+	cron := paths["/api/v1/delete-expired-ids"].(map[string]interface{})
+	if cron["get"] == nil || cron["delete"] == nil {
+		t.Errorf("cron operations = %v, want GET and DELETE", cron)
+	}
+	oidcLogin := paths["/api/v1/auth/oidc/login"].(map[string]interface{})["get"].(map[string]interface{})
+	if responses := oidcLogin["responses"].(map[string]interface{}); responses["302"] == nil || responses["200"] != nil {
+		t.Errorf("OIDC login responses = %v, want a redirect", responses)
+	}
+
+	schemas := document["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	errorResponse, ok := schemas["ErrorResponse"].(map[string]interface{})
+	if !ok {
+		t.Fatal("the ErrorResponse schema is missing")
+	}
+	for _, property := range []string{"message", "code", "errorCode", "fields"} {
+		if _, ok := errorResponse["properties"].(map[string]interface{})[property]; !ok {
+			t.Errorf("ErrorResponse schema = %v, want the %s property", errorResponse, property)
+		}
+	}
+}
+
+func TestSchemaFor(t *testing.T) {
+	type embedded struct {
+		Note string `json:"note"`
+	}
+	type sample struct {
+		embedded
+		ID       string          `json:"id"`
+		Count    *int64          `json:"count,omitempty"`
+		Tags     []string        `json:"tags"`
+		Labels   map[string]bool `json:"labels"`
+		Secret   string          `json:"-"`
+		internal string
+		Plain    float64
+	}
+	want := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"note":   map[string]interface{}{"type": "string"},
+			"id":     map[string]interface{}{"type": "string"},
+			"count":  map[string]interface{}{"type": "integer", "nullable": true},
+			"tags":   map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			"labels": map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "boolean"}},
+			"Plain":  map[string]interface{}{"type": "number"},
+		},
+	}
+	if got := schemaFor(reflect.TypeOf(sample{})); !reflect.DeepEqual(got, want) {
+		t.Errorf("schemaFor() = %v, want %v", got, want)
+	}
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	router := newOpenAPITestRouter()
+	for _, path := range []string{"/api/openapi.json", "/api/v1/openapi.json"} {
+		response := performRequest(router, http.MethodGet, path, "", nil, nil)
+		var document struct {
+			OpenAPI string                 `json:"openapi"`
+			Paths   map[string]interface{} `json:"paths"`
+		}
+		if err := json.Unmarshal(response.Body.Bytes(), &document); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if response.Code != http.StatusOK || document.OpenAPI != OPENAPI_VERSION || document.Paths["/api/v1/openapi.json"] == nil {
+			t.Errorf("%s = %d %s, want the OpenAPI document", path, response.Code, response.Body.String())
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+)
+
+// Owner identifies who is making a request: the browser session, the logged in user and/or an API key.
+type Owner struct {
+	SessionToken string
+	// UserID is the logged in account, or the account of the API key
+	UserID string
+	// IsAdmin is set for the server API key and keys with the admin scope, which may manage any link
+	IsAdmin bool
+	// ApiKeyID is set when the request carries an API key; it is LEGACY_API_KEY_ID for NOLONGR_SERVER_API_KEY
+	ApiKeyID string
+	Scopes   []string
+	// WorkspaceRoles maps the workspaces of the user to the user's role in them
+	WorkspaceRoles map[string]string
+}
+
+const ownerContextKey = "owner"
+
+// SESSION_TOKEN_KEY is the key of the session token in the signed session cookie, which is also named session_token.
+const SESSION_TOKEN_KEY = "session_token"
+
+// requestSessionToken reads the session token from the signed session cookie. A cookie that was not signed with
+// one of the session secrets, such as a bare token, gives no session.
+func requestSessionToken(context *gin.Context) string {
+	sessionToken, _ := sessions.Default(context).Get(SESSION_TOKEN_KEY).(string)
+	return sessionToken
+}
+
+// setRequestSessionToken switches the caller to another session by rewriting the signed session cookie, and
+// reissues the CSRF token for it.
+func setRequestSessionToken(context *gin.Context, sessionToken string) error {
+	session := sessions.Default(context)
+	session.Set(SESSION_TOKEN_KEY, sessionToken)
+	if err := session.Save(); err != nil {
+		return err
+	}
+	reissueCsrfToken(context, sessionToken, requestUserSession(context))
+	return nil
+}
+
+func isServerApiKey(apiKey string) bool {
+	serverApiKey := GetApiKey()
+	return serverApiKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(serverApiKey)) == 1
+}
+
+// requestApiKey reads the API key from the "Authorization: Bearer" header, or from the deprecated
+// api_key query parameter.
+func requestApiKey(context *gin.Context) string {
+	if apiKey, ok := strings.CutPrefix(context.GetHeader("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(apiKey)
+	}
+	if apiKey := context.Query("api_key"); apiKey != "" {
+		context.Header("Deprecation", "true")
+		context.Header("Warning", `299 - "The api_key query parameter is deprecated, send an Authorization: Bearer header instead"`)
+		return apiKey
+	}
+	return ""
+}
+
+func (owner Owner) isAuthenticated() bool {
+	return owner.IsAdmin || owner.SessionToken != "" || owner.UserID != ""
+}
+
+// resolveOwner returns false when the request carries neither a session, a login nor a valid API key.
+// Ownership only comes from the signed cookies or the API key, never from the request's parameters.
+// The session and user of an API key replace the cookies. The result is cached on the request.
+func resolveOwner(context *gin.Context) (Owner, bool) {
+	if cached, ok := context.Get(ownerContextKey); ok {
+		owner := cached.(Owner)
+		return owner, owner.isAuthenticated()
+	}
+
+	owner := Owner{SessionToken: requestSessionToken(context)}
+	if userSession, err := context.Cookie(USER_SESSION_COOKIE); err == nil && userSession != "" {
+		owner.UserID, _ = authenticateUserSession(userSession)
+	}
+	if apiKey := requestApiKey(context); apiKey != "" {
+		if keyOwner, ok := authenticateApiKey(apiKey); ok {
+			owner = keyOwner
+		}
+	}
+	if owner.UserID != "" {
+		owner.WorkspaceRoles = loadWorkspaceRoles(owner.UserID)
+	}
+
+	context.Set(ownerContextKey, owner)
+	return owner, owner.isAuthenticated()
+}
+
+// can reports whether the owner may use a scope. Sessions and users without an API key may read and write
+// their own links.
+func (owner Owner) can(scope string) bool {
+	if owner.IsAdmin {
+		return true
+	} else if owner.ApiKeyID == "" {
+		return owner.isAuthenticated() && (scope == API_KEY_SCOPE_LINKS_READ || scope == API_KEY_SCOPE_LINKS_WRITE)
+	}
+	return slices.Contains(owner.Scopes, scope)
+}
+
+// canManage reports whether the owner may edit the link. Links of a workspace are managed by its editors and
+// owners, links of an account only by that account, and other links by the session that created them.
+func (owner Owner) canManage(urlData URLData) bool {
+	if owner.IsAdmin {
+		return true
+	} else if urlData.WorkspaceID != "" {
+		return owner.hasWorkspaceRole(urlData.WorkspaceID, WORKSPACE_ROLE_EDITOR)
+	} else if urlData.UserID != "" {
+		return owner.UserID == urlData.UserID
+	}
+	return owner.SessionToken != "" && owner.SessionToken == urlData.SessionToken
+}
+
+// canView reports whether the owner may see the statistics of the link, which viewers of its workspace also may.
+func (owner Owner) canView(urlData URLData) bool {
+	return owner.canManage(urlData) || owner.hasWorkspaceRole(urlData.WorkspaceID, WORKSPACE_ROLE_VIEWER)
+}
+
+func respondMissingScope(context *gin.Context, owner Owner, scope string) {
+	message := "The API key does not have the " + scope + " scope"
+	if owner.ApiKeyID == "" {
+		message = "An API key with the " + scope + " scope is required"
+	}
+	RespondWithError(context, http.StatusForbidden, ErrorResponse{
+		Message: message,
+		Code:    ERROR_CODE_FORBIDDEN,
+		Id:      context.Param("id"),
+	})
+}
+
+// requireScope responds with 401 when the request has no owner and with 403 when the owner lacks scope.
+func requireScope(context *gin.Context, scope string, unauthorizedMessage string) (Owner, bool) {
+	owner, ok := resolveOwner(context)
+	if !ok {
+		respondUnauthorizedOwner(context, unauthorizedMessage)
+		return owner, false
+	}
+	if !owner.can(scope) {
+		respondMissingScope(context, owner, scope)
+		return owner, false
+	}
+	return owner, true
+}
+
+// isCronRequest reports whether the request carries CRON_SECRET, which Vercel sends to cron jobs as a bearer token.
+func isCronRequest(context *gin.Context) bool {
+	cronSecret := GoDotEnvVariable("CRON_SECRET")
+	secret, ok := strings.CutPrefix(context.GetHeader("Authorization"), "Bearer ")
+	return cronSecret != "" && ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(secret)), []byte(cronSecret)) == 1
+}
+
+// adminMiddleware only lets through API keys with the admin scope and, when allowCron is set, Vercel cron jobs.
+func adminMiddleware(allowCron bool) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if allowCron && isCronRequest(context) {
+			context.Next()
+			return
+		}
+		if _, ok := requireScope(context, API_KEY_SCOPE_ADMIN, "An admin API key is required"); ok {
+			context.Next()
+		}
+	}
+}
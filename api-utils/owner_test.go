@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveOwner(t *testing.T) {
+	t.Setenv("NOLONGR_SERVER_API_KEY", "test-server-key")
+	sessionCookie := newSessionCookie(t, "session-a")
+	tests := []struct {
+		name              string
+		path              string
+		cookies           []*http.Cookie
+		header            map[string]string
+		wantSession       string
+		wantApiKey        string
+		wantAdmin         bool
+		wantAuthenticated bool
+	}{
+		{name: "anonymous"},
+		{name: "signed session", cookies: []*http.Cookie{sessionCookie}, wantSession: "session-a", wantAuthenticated: true},
+		{name: "bare session token", cookies: []*http.Cookie{{Name: SESSION_TOKEN_KEY, Value: "session-a"}}},
+		{name: "tampered session", cookies: []*http.Cookie{{Name: SESSION_TOKEN_KEY, Value: sessionCookie.Value + "x"}}},
+		{name: "session token in the query", path: "/?session_token=session-a"},
+		{name: "server key", header: map[string]string{"Authorization": "Bearer test-server-key"}, wantApiKey: LEGACY_API_KEY_ID, wantAdmin: true, wantAuthenticated: true},
+		{name: "server key replaces the session", cookies: []*http.Cookie{sessionCookie}, header: map[string]string{"Authorization": "Bearer test-server-key"}, wantApiKey: LEGACY_API_KEY_ID, wantAdmin: true, wantAuthenticated: true},
+		{name: "invalid key keeps the session", cookies: []*http.Cookie{sessionCookie}, header: map[string]string{"Authorization": "Bearer wrong-key"}, wantSession: "session-a", wantAuthenticated: true},
+		{name: "invalid key alone", header: map[string]string{"Authorization": "Bearer wrong-key"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := test.path
+			if path == "" {
+				path = "/"
+			}
+			request := httptest.NewRequest(http.MethodGet, path, nil)
+			for _, cookie := range test.cookies {
+				request.AddCookie(cookie)
+			}
+			for key, value := range test.header {
+				request.Header.Set(key, value)
+			}
+			owner, authenticated := resolveOwner(newTestContext(request))
+			if authenticated != test.wantAuthenticated || owner.SessionToken != test.wantSession || owner.ApiKeyID != test.wantApiKey || owner.IsAdmin != test.wantAdmin {
+				t.Errorf("resolveOwner() = %+v, %v", owner, authenticated)
+			}
+		})
+	}
+}
+
+func TestOwnerCan(t *testing.T) {
+	tests := []struct {
+		name  string
+		owner Owner
+		scope string
+		want  bool
+	}{
+		{name: "anonymous reads", scope: API_KEY_SCOPE_LINKS_READ},
+		{name: "session reads", owner: Owner{SessionToken: "s"}, scope: API_KEY_SCOPE_LINKS_READ, want: true},
+		{name: "user writes", owner: Owner{UserID: "u"}, scope: API_KEY_SCOPE_LINKS_WRITE, want: true},
+		{name: "session forwards visitors", owner: Owner{SessionToken: "s"}, scope: API_KEY_SCOPE_PAGEVIEWS},
+		{name: "session administers", owner: Owner{SessionToken: "s"}, scope: API_KEY_SCOPE_ADMIN},
+		{name: "key with the scope", owner: Owner{ApiKeyID: "k", Scopes: []string{API_KEY_SCOPE_PAGEVIEWS}}, scope: API_KEY_SCOPE_PAGEVIEWS, want: true},
+		{name: "key without the scope", owner: Owner{ApiKeyID: "k", SessionToken: "s", Scopes: []string{API_KEY_SCOPE_LINKS_READ}}, scope: API_KEY_SCOPE_LINKS_WRITE},
+		{name: "admin", owner: Owner{ApiKeyID: "k", IsAdmin: true}, scope: API_KEY_SCOPE_PAGEVIEWS, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.owner.can(test.scope); got != test.want {
+				t.Errorf("can(%s) = %v, want %v", test.scope, got, test.want)
+			}
+		})
+	}
+}
+
+func TestOwnerCanManage(t *testing.T) {
+	sessionLink := URLData{SessionToken: "session-a"}
+	userLink := URLData{SessionToken: "session-a", UserID: "user-a"}
+	workspaceLink := URLData{SessionToken: "session-a", UserID: "user-a", WorkspaceID: "workspace-a"}
+	tests := []struct {
+		name       string
+		owner      Owner
+		urlData    URLData
+		wantManage bool
+		wantView   bool
+	}{
+		{name: "session of the link", owner: Owner{SessionToken: "session-a"}, urlData: sessionLink, wantManage: true, wantView: true},
+		{name: "another session", owner: Owner{SessionToken: "session-b"}, urlData: sessionLink},
+		{name: "no session", owner: Owner{}, urlData: URLData{}},
+		{name: "session of an account's link", owner: Owner{SessionToken: "session-a"}, urlData: userLink},
+		{name: "account of the link", owner: Owner{UserID: "user-a"}, urlData: userLink, wantManage: true, wantView: true},
+		{name: "another account", owner: Owner{SessionToken: "session-a", UserID: "user-b"}, urlData: userLink},
+		{name: "workspace editor", owner: Owner{UserID: "user-b", WorkspaceRoles: map[string]string{"workspace-a": WORKSPACE_ROLE_EDITOR}}, urlData: workspaceLink, wantManage: true, wantView: true},
+		{name: "workspace viewer", owner: Owner{UserID: "user-b", WorkspaceRoles: map[string]string{"workspace-a": WORKSPACE_ROLE_VIEWER}}, urlData: workspaceLink, wantView: true},
+		{name: "creator outside the workspace", owner: Owner{SessionToken: "session-a", UserID: "user-a"}, urlData: workspaceLink},
+		{name: "member of another workspace", owner: Owner{UserID: "user-b", WorkspaceRoles: map[string]string{"workspace-b": WORKSPACE_ROLE_OWNER}}, urlData: workspaceLink},
+		{name: "admin", owner: Owner{IsAdmin: true}, urlData: workspaceLink, wantManage: true, wantView: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.owner.canManage(test.urlData); got != test.wantManage {
+				t.Errorf("canManage() = %v, want %v", got, test.wantManage)
+			}
+			if got := test.owner.canView(test.urlData); got != test.wantView {
+				t.Errorf("canView() = %v, want %v", got, test.wantView)
+			}
+		})
+	}
+}
+
+func TestIsCronRequest(t *testing.T) {
+	tests := []struct {
+		name          string
+		cronSecret    string
+		authorization string
+		want          bool
+	}{
+		{name: "cron secret", cronSecret: "cron-secret", authorization: "Bearer cron-secret", want: true},
+		{name: "wrong secret", cronSecret: "cron-secret", authorization: "Bearer other-secret"},
+		{name: "secret without bearer", cronSecret: "cron-secret", authorization: "cron-secret"},
+		{name: "no header", cronSecret: "cron-secret"},
+		{name: "no cron secret configured", authorization: "Bearer "},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("CRON_SECRET", test.cronSecret)
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			if got := isCronRequest(newTestContext(request)); got != test.want {
+				t.Errorf("isCronRequest() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	t.Setenv("NOLONGR_SERVER_API_KEY", "test-server-key")
+	t.Setenv("CRON_SECRET", "cron-secret")
+	serverKey := map[string]string{"Authorization": "Bearer test-server-key"}
+	cronSecret := map[string]string{"Authorization": "Bearer cron-secret"}
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		owner    *Owner
+		cookies  []*http.Cookie
+		header   map[string]string
+		wantCode string
+	}{
+		// Requests let through reach the handler, which cannot connect to the database in tests
+		{name: "cron secret on a cron route", method: http.MethodGet, path: "/api/v1/delete-expired-ids", header: cronSecret, wantCode: ERROR_CODE_DATABASE_UNAVAILABLE},
+		{name: "cron secret on an unversioned cron route", method: http.MethodDelete, path: "/api/delete-expired-visits", header: cronSecret, wantCode: ERROR_CODE_DATABASE_UNAVAILABLE},
+		{name: "server key on a cron route", method: http.MethodDelete, path: "/api/v1/delete-expired-ids", header: serverKey, wantCode: ERROR_CODE_DATABASE_UNAVAILABLE},
+		{name: "server key on an admin route", method: http.MethodGet, path: "/api/v1/expired-urls", header: serverKey, wantCode: ERROR_CODE_DATABASE_UNAVAILABLE},
+		{name: "admin scope on an admin route", method: http.MethodGet, path: "/api/v1/expired-urls", owner: &Owner{ApiKeyID: "k", IsAdmin: true, Scopes: []string{API_KEY_SCOPE_ADMIN}}, wantCode: ERROR_CODE_DATABASE_UNAVAILABLE},
+		{name: "cron secret on an admin route", method: http.MethodGet, path: "/api/v1/expired-urls", header: cronSecret, wantCode: ERROR_CODE_UNAUTHORIZED},
+		{name: "wrong secret on a cron route", method: http.MethodGet, path: "/api/v1/delete-expired-ids", header: map[string]string{"Authorization": "Bearer wrong-secret"}, wantCode: ERROR_CODE_UNAUTHORIZED},
+		{name: "anonymous on a cron route", method: http.MethodDelete, path: "/api/v1/delete-expired-ids", wantCode: ERROR_CODE_UNAUTHORIZED},
+		{name: "anonymous on an admin route", method: http.MethodGet, path: "/api/v1/new-short-id", wantCode: ERROR_CODE_UNAUTHORIZED},
+		{name: "session on an admin route", method: http.MethodGet, path: "/api/v1/new-short-id", cookies: []*http.Cookie{newSessionCookie(t, "session-a")}, wantCode: ERROR_CODE_FORBIDDEN},
+		{name: "key without the admin scope on a cron route", method: http.MethodGet, path: "/api/v1/delete-expired-ids", owner: &Owner{ApiKeyID: "k", SessionToken: "session-a", Scopes: []string{API_KEY_SCOPE_LINKS_READ, API_KEY_SCOPE_LINKS_WRITE}}, wantCode: ERROR_CODE_FORBIDDEN},
+	}
+	wantStatus := map[string]int{
+		ERROR_CODE_DATABASE_UNAVAILABLE: http.StatusServiceUnavailable,
+		ERROR_CODE_UNAUTHORIZED:         http.StatusUnauthorized,
+		ERROR_CODE_FORBIDDEN:            http.StatusForbidden,
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := newTestRouter()
+			if test.owner != nil {
+				router = newTestRouterWithOwner(*test.owner)
+			}
+			response := performRequest(router, test.method, test.path, "", test.cookies, test.header)
+			if response.Code != wantStatus[test.wantCode] || !strings.Contains(response.Body.String(), `"code":"`+test.wantCode+`"`) {
+				t.Errorf("response = %d %s, want %d %s", response.Code, response.Body.String(), wantStatus[test.wantCode], test.wantCode)
+			}
+		})
+	}
+}
@@ -2,12 +2,17 @@ package utils
 
 import (
 	"bufio"
+	crand "crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
-	"strconv"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"database/sql"
@@ -26,21 +31,99 @@ func getNewPlanetScaleClient() (*sql.DB, error) {
 }
 
 type URLData struct {
-	ID           string  `json:"id"`
-	DateCreated  string  `json:"date_created"`
-	Destination  string  `json:"destination"`
-	MaxPageHits  int64   `json:"max_page_hits"`
-	PageHits     int64   `json:"page_hits"`
-	Password     *string `json:"password"`
-	SelfDestruct *string `json:"self_destruct"`
-	SessionToken string  `json:"session_token"`
-	URL          string  `json:"url"`
+	ID           string   `json:"id"`
+	DateCreated  string   `json:"date_created"`
+	Destination  string   `json:"destination"`
+	MaxPageHits  int64    `json:"max_page_hits"`
+	PageHits     int64    `json:"page_hits"`
+	Password     *string  `json:"password"`
+	SelfDestruct *string  `json:"self_destruct"`
+	SessionToken string   `json:"session_token"`
+	URL          string   `json:"url"`
+	Paused       bool     `json:"paused"`
+	Title        string   `json:"title"`
+	Tags         []string `json:"tags"`
+	// UserID is the account owning the link, if any; only that account may then manage it
+	UserID string `json:"user_id,omitempty"`
+	// WorkspaceID is the workspace sharing the link, if any; its members then manage it according to their role
+	WorkspaceID string `json:"workspace_id,omitempty"`
+	// HasPassword replaces the password hash in the responses of publicUrlData
+	HasPassword bool `json:"has_password,omitempty"`
 }
 
-func CreateUrl(url string, selfDestruct *int64, sessionToken string, password *string, maxPageHits int64) (URLData, error) {
+const urlColumns = "id, date_created, destination, max_page_hits, page_hits, password, self_destruct, session_token, url, paused, title, tags, user_id, workspace_id"
+
+// Tags are stored as a single comma-separated column so they are covered by the search index.
+func joinTags(tags []string) string {
+	return strings.Join(tags, ",")
+}
+
+func splitTags(tags string) []string {
+	if tags == "" {
+		return []string{}
+	}
+	return strings.Split(tags, ",")
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUrlData(row rowScanner) (URLData, error) {
+	var urlData URLData
+	var tags string
+	err := row.Scan(
+		&urlData.ID,
+		&urlData.DateCreated,
+		&urlData.Destination,
+		&urlData.MaxPageHits,
+		&urlData.PageHits,
+		&urlData.Password,
+		&urlData.SelfDestruct,
+		&urlData.SessionToken,
+		&urlData.URL,
+		&urlData.Paused,
+		&urlData.Title,
+		&tags,
+		&urlData.UserID,
+		&urlData.WorkspaceID,
+	)
+	urlData.Tags = splitTags(tags)
+	return urlData, err
+}
+
+func queryUrls(caller string, query string, args ...any) ([]URLData, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return nil, storageError(err)
+	}
+	res, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("(%s) db.Query %v", caller, err)
+		return nil, storageError(err)
+	}
+	defer res.Close()
+
+	urls := []URLData{}
+	for res.Next() {
+		urlData, err := scanUrlData(res)
+		if err != nil {
+			log.Printf("(%s) res.Scan %v", caller, err)
+			return nil, storageError(err)
+		}
+		urls = append(urls, urlData)
+	}
+
+	return urls, storageError(res.Err())
+}
+
+func getUrlIdLength() int {
+	defaultIdLength := 2
+
 	resp, err := http.Get("https://nolongr.vercel.app/api/url-id-length")
 	if err != nil {
-		log.Print("(CreateUrl) /api/url-id-length", err)
+		log.Print("(getUrlIdLength) /api/url-id-length", err)
+		return defaultIdLength
 	}
 	defer resp.Body.Close()
 
@@ -50,55 +133,96 @@ func CreateUrl(url string, selfDestruct *int64, sessionToken string, password *s
 	for i := 0; scanner.Scan() && i < 5; i++ {
 		byt := []byte(scanner.Text())
 		if err := json.Unmarshal(byt, &urlIdLengthResponse); err != nil {
-			panic(err)
+			log.Print("(getUrlIdLength) json.Unmarshal", err)
+			return defaultIdLength
 		}
 	}
 
-	defaultIdLength := 2
-	urlIdLength := int(urlIdLengthResponse["result"].(float64))
-
-	if urlIdLength != defaultIdLength {
-		urlIdLength = int(math.Max(float64(defaultIdLength), float64(urlIdLength)))
+	urlIdLength, ok := urlIdLengthResponse["result"].(float64)
+	if !ok {
+		return defaultIdLength
 	}
 
-	newURLID := randomSequence(urlIdLength)
+	return int(math.Max(float64(defaultIdLength), urlIdLength))
+}
+
+// NewUrl describes a link to be created. ID is a custom alias; a random ID is generated when it is empty.
+type NewUrl struct {
+	ID           string
+	Destination  string
+	SelfDestruct *int64
+	SessionToken string
+	Password     *string
+	MaxPageHits  int64
+	Title        string
+	Tags         []string
+	UserID       string
+	WorkspaceID  string
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
 
-	doesUrlIdExist := checkIfUrlIdExists(newURLID)
+// generateUrlId returns a random ID that is neither in the database nor in reserved.
+func generateUrlId(urlIdLength int, reserved map[string]bool) (string, error) {
+	newURLID := randomSequence(urlIdLength)
 
 	doesUrlIdExistCounter := 0
-	for doesUrlIdExist {
-		newURLID = randomSequence(urlIdLength)
-		if doesUrlIdExistCounter > 10 {
-			log.Print("(CreateUrl) POTENTIALLY CRITICAL - URL ID LENGTH NEEDS TO BE INCREMENTED")
+	for {
+		doesUrlIdExist := reserved[newURLID]
+		if !doesUrlIdExist {
+			exists, err := checkIfUrlIdExists(newURLID)
+			if err != nil {
+				return "", err
+			}
+			doesUrlIdExist = exists
+		}
+		if !doesUrlIdExist {
+			return newURLID, nil
+		}
+
+		if doesUrlIdExistCounter > 20 {
+			return "", ErrIDConflict
+		} else if doesUrlIdExistCounter > 10 {
+			log.Print("(generateUrlId) POTENTIALLY CRITICAL - URL ID LENGTH NEEDS TO BE INCREMENTED")
 			newURLID = randomSequence(urlIdLength + 1)
 		} else {
-			doesUrlIdExistCounter = doesUrlIdExistCounter + 1
+			newURLID = randomSequence(urlIdLength)
 		}
+		doesUrlIdExistCounter = doesUrlIdExistCounter + 1
 	}
+}
 
+func buildUrlData(newUrl NewUrl) URLData {
 	var selfDestructString *string = nil
 
-	if selfDestruct != nil {
-		selfDestructDuration := time.Second * time.Duration(*selfDestruct)
+	if newUrl.SelfDestruct != nil {
+		selfDestructDuration := time.Second * time.Duration(*newUrl.SelfDestruct)
 		selfDestruct := time.Now().UTC().Add(selfDestructDuration).Format(time.RFC3339)
 		selfDestructString = &selfDestruct
 	}
 
-	newUrlData := URLData{
-		ID:           newURLID,
+	return URLData{
+		ID:           newUrl.ID,
 		DateCreated:  time.Now().UTC().Format(time.RFC3339),
-		Destination:  url,
-		MaxPageHits:  maxPageHits,
-		Password:     password,
+		Destination:  newUrl.Destination,
+		MaxPageHits:  newUrl.MaxPageHits,
+		Password:     newUrl.Password,
 		PageHits:     0,
-		SessionToken: sessionToken,
+		SessionToken: newUrl.SessionToken,
 		SelfDestruct: selfDestructString,
-		URL:          PRODUCTION_SITE_URL + "/" + newURLID,
+		URL:          PRODUCTION_SITE_URL + "/" + newUrl.ID,
+		Title:        newUrl.Title,
+		Tags:         append([]string{}, newUrl.Tags...),
+		UserID:       newUrl.UserID,
+		WorkspaceID:  newUrl.WorkspaceID,
 	}
+}
 
-	query := "INSERT INTO urls (id, date_created, destination, max_page_hits, page_hits, password, self_destruct, session_token, url) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
-	db, err := getNewPlanetScaleClient()
-	_, err = db.Exec(query,
+func insertUrl(db execer, newUrlData URLData) error {
+	query := "INSERT INTO urls (" + urlColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := db.Exec(query,
 		newUrlData.ID,
 		newUrlData.DateCreated,
 		newUrlData.Destination,
@@ -108,245 +232,1752 @@ func CreateUrl(url string, selfDestruct *int64, sessionToken string, password *s
 		newUrlData.SelfDestruct,
 		newUrlData.SessionToken,
 		newUrlData.URL,
+		newUrlData.Paused,
+		newUrlData.Title,
+		joinTags(newUrlData.Tags),
+		newUrlData.UserID,
+		newUrlData.WorkspaceID,
 	)
+	return storageError(err)
+}
+
+func CreateUrl(url string, selfDestruct *int64, sessionToken string, password *string, maxPageHits int64) (URLData, error) {
+	return CreateNewUrl(NewUrl{
+		Destination:  url,
+		SelfDestruct: selfDestruct,
+		SessionToken: sessionToken,
+		Password:     password,
+		MaxPageHits:  maxPageHits,
+	})
+}
+
+// CreateNewUrl inserts a single link, generating a random ID when newUrl.ID is empty.
+func CreateNewUrl(newUrl NewUrl) (URLData, error) {
+	if newUrl.ID == "" {
+		newURLID, err := generateUrlId(getUrlIdLength(), nil)
+		if err != nil {
+			return URLData{}, err
+		}
+		newUrl.ID = newURLID
+	}
 
+	newUrlData := buildUrlData(newUrl)
+
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return URLData{}, storageError(err)
+	}
+	err = insertUrl(db, newUrlData)
 	if err != nil {
-		log.Print("(CreateUrl) db.Exec", err)
+		log.Print("(CreateNewUrl) db.Exec", err)
+		return URLData{}, err
 	}
 
-	return newUrlData, err
+	return newUrlData, nil
 }
 
-func GetUrls() ([]URLData, error) {
+// CreateUrls inserts all links in a single transaction. Failures of individual links, such as a taken alias,
+// are returned in itemErrors at the link's index; err is only set when the transaction itself failed.
+func CreateUrls(newUrls []NewUrl) ([]URLData, []error, error) {
 	db, err := getNewPlanetScaleClient()
-	query := "SELECT * FROM urls"
-	res, err := db.Query(query)
-	defer res.Close()
 	if err != nil {
-		log.Print("(GetUrls) db.Query", err)
+		return nil, nil, storageError(err)
 	}
+	return createUrls(db, newUrls)
+}
 
-	urls := []URLData{}
-	for res.Next() {
-		var urlData URLData
-		err := res.Scan(
-			&urlData.ID,
-			&urlData.DateCreated,
-			&urlData.Destination,
-			&urlData.MaxPageHits,
-			&urlData.PageHits,
-			&urlData.Password,
-			&urlData.SelfDestruct,
-			&urlData.SessionToken,
-			&urlData.URL,
-		)
-		if err != nil {
-			log.Print("(GetUrls) res.Scan", err)
+func createUrls(db *sql.DB, newUrls []NewUrl) (urls []URLData, itemErrors []error, err error) {
+	urls = make([]URLData, len(newUrls))
+	itemErrors = make([]error, len(newUrls))
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Print("(CreateUrls) db.Begin", err)
+		return nil, nil, storageError(err)
+	}
+	defer tx.Rollback()
+
+	urlIdLength := 0
+	reserved := map[string]bool{}
+	for i, newUrl := range newUrls {
+		if newUrl.ID == "" {
+			if urlIdLength == 0 {
+				urlIdLength = getUrlIdLength()
+			}
+			newUrl.ID, err = generateUrlId(urlIdLength, reserved)
+			if errors.Is(err, ErrDatabaseUnavailable) {
+				return nil, nil, err
+			} else if err != nil {
+				itemErrors[i] = err
+				continue
+			}
+		} else if reserved[newUrl.ID] {
+			itemErrors[i] = ErrIDConflict
+			continue
 		}
-		urls = append(urls, urlData)
+		reserved[newUrl.ID] = true
+
+		urls[i] = buildUrlData(newUrl)
+		// A failed INSERT does not abort a MySQL transaction, so the remaining links are still created
+		err = insertUrl(tx, urls[i])
+		if errors.Is(err, ErrIDConflict) {
+			itemErrors[i] = err
+		} else if err != nil {
+			log.Print("(CreateUrls) tx.Exec", err)
+			return nil, nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print("(CreateUrls) tx.Commit", err)
+		return nil, nil, storageError(err)
 	}
 
-	return urls, err
+	return urls, itemErrors, nil
+}
+
+func GetUrls() ([]URLData, error) {
+	query := "SELECT " + urlColumns + " FROM urls"
+	return queryUrls("GetUrls", query)
 }
 
 func GetSingleUrl(id string) (URLData, error) {
-	urlData := URLData{}
-	query := "SELECT * FROM urls WHERE id = ?"
+	query := "SELECT " + urlColumns + " FROM urls WHERE id = ?"
 	db, err := getNewPlanetScaleClient()
-	err = db.QueryRow(query, id).Scan(
-		&urlData.ID,
-		&urlData.DateCreated,
-		&urlData.Destination,
-		&urlData.MaxPageHits,
-		&urlData.PageHits,
-		&urlData.Password,
-		&urlData.SelfDestruct,
-		&urlData.SessionToken,
-		&urlData.URL,
-	)
 	if err != nil {
-		log.Println("(GetSingleUrl) db.Exec", err)
+		return URLData{}, storageError(err)
+	}
+	urlData, err := scanUrlData(db.QueryRow(query, id))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("(GetSingleUrl) db.QueryRow", err)
+		}
+		return URLData{}, storageError(err)
 	}
 
-	return urlData, err
+	return urlData, nil
 }
 
 func IncrementSingleUrlPageHit(id string) (URLData, error) {
 	urlData, err := GetSingleUrl(id)
+	if err != nil {
+		return urlData, err
+	}
 
-	previousPageHitCountString := strconv.Itoa(int(urlData.PageHits))
 	db, err := getNewPlanetScaleClient()
-	query := fmt.Sprintf("UPDATE %s SET %s = %s + 1 WHERE id = ?", "urls", "page_hits", previousPageHitCountString)
+	if err != nil {
+		return urlData, storageError(err)
+	}
+	query := "UPDATE urls SET page_hits = page_hits + 1 WHERE id = ?"
 	_, err = db.Exec(query, id)
 
 	if err != nil {
 		log.Println("IncrementSingleUrlPageHit() --> Failed to increment the page_hits field:", err)
-	} else {
-		urlData.PageHits = urlData.PageHits + 1
+		return urlData, storageError(err)
 	}
+	urlData.PageHits = urlData.PageHits + 1
 
-	return urlData, err
+	return urlData, nil
 }
 
-func GetSingleUrlUnexpired(id string) (URLData, error) {
-	urlData := URLData{}
-	query := "SELECT * FROM urls WHERE id = ? AND (self_destruct IS NULL OR self_destruct > ?) AND (max_page_hits = 0 OR max_page_hits > page_hits)"
-	db, err := getNewPlanetScaleClient()
-	timeNow := time.Now().UTC().Format(time.RFC3339)
+// checkUrlUnexpired returns ErrPaused, ErrExpired or ErrMaxHitsReached when the link can no longer be visited.
+func checkUrlUnexpired(urlData URLData) error {
+	if urlData.Paused {
+		return ErrPaused
+	}
+	if urlData.SelfDestruct != nil && *urlData.SelfDestruct != "" {
+		selfDestruct, err := time.Parse(time.RFC3339, *urlData.SelfDestruct)
+		if err == nil && !selfDestruct.After(time.Now().UTC()) {
+			return ErrExpired
+		}
+	}
+	if urlData.MaxPageHits != 0 && urlData.PageHits >= urlData.MaxPageHits {
+		return ErrMaxHitsReached
+	}
+	return nil
+}
 
-	err = db.QueryRow(query, id, timeNow).Scan(
-		&urlData.ID,
-		&urlData.DateCreated,
-		&urlData.Destination,
-		&urlData.MaxPageHits,
-		&urlData.PageHits,
-		&urlData.Password,
-		&urlData.SelfDestruct,
-		&urlData.SessionToken,
-		&urlData.URL,
+// UpdateUrl writes the editable fields of urlData. page_hits is only written when resetPageHits is set,
+// so concurrent page views are not lost.
+func UpdateUrl(urlData URLData, resetPageHits bool) error {
+	query := "UPDATE urls SET destination = ?, max_page_hits = ?, password = ?, self_destruct = ?, paused = ?, title = ?, tags = ? WHERE id = ?"
+	if resetPageHits {
+		query = "UPDATE urls SET destination = ?, max_page_hits = ?, password = ?, self_destruct = ?, paused = ?, title = ?, tags = ?, page_hits = 0 WHERE id = ?"
+	}
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec(query,
+		urlData.Destination,
+		urlData.MaxPageHits,
+		urlData.Password,
+		urlData.SelfDestruct,
+		urlData.Paused,
+		urlData.Title,
+		joinTags(urlData.Tags),
+		urlData.ID,
 	)
 	if err != nil {
-		log.Println("(GetSingleUrlUnexpired) db.Exec", err)
+		log.Println("(UpdateUrl) db.Exec", err)
 	}
 
-	return urlData, err
+	return storageError(err)
 }
 
-func GetAllUrlsBasedOnSessionToken(sessionToken string) ([]URLData, error) {
-	db, err := getNewPlanetScaleClient()
-	query := "SELECT * FROM urls WHERE session_token = ?"
-	res, err := db.Query(query, sessionToken)
-	defer res.Close()
+func GetSingleUrlUnexpired(id string) (URLData, error) {
+	urlData, err := GetSingleUrl(id)
 	if err != nil {
-		log.Print("(GetAllUrlsBasedOnSessionToken) db.Query", err)
+		return URLData{}, err
 	}
-
-	urls := []URLData{}
-	for res.Next() {
-		var urlData URLData
-		err := res.Scan(
-			&urlData.ID,
-			&urlData.DateCreated,
-			&urlData.Destination,
-			&urlData.MaxPageHits,
-			&urlData.PageHits,
-			&urlData.Password,
-			&urlData.SelfDestruct,
-			&urlData.SessionToken,
-			&urlData.URL,
-		)
-		if err != nil {
-			log.Print("(GetAllUrlsBasedOnSessionToken) res.Scan", err)
-		}
-		urls = append(urls, urlData)
+	if err := checkUrlUnexpired(urlData); err != nil {
+		return URLData{}, err
 	}
 
-	return urls, err
+	return urlData, nil
+}
+
+func GetAllUrlsBasedOnSessionToken(sessionToken string) ([]URLData, error) {
+	query := "SELECT " + urlColumns + " FROM urls WHERE session_token = ?"
+	return queryUrls("GetAllUrlsBasedOnSessionToken", query, sessionToken)
 }
 
+const expiredUrlsCondition = "(self_destruct IS NOT NULL AND self_destruct <> '' AND self_destruct < ?) OR (max_page_hits > 0 AND page_hits >= max_page_hits)"
+
 func GetAllExpiredUrls() ([]URLData, error) {
-	db, err := getNewPlanetScaleClient()
-	query := "SELECT * FROM urls WHERE self_destruct <> '' AND self_destruct < ?"
+	query := "SELECT " + urlColumns + " FROM urls WHERE " + expiredUrlsCondition
 	timeNow := time.Now().UTC().Format(time.RFC3339)
-	res, err := db.Query(query, timeNow)
-	defer res.Close()
-	if err != nil {
-		log.Print("(GetAllExpiredUrls) db.Query", err)
+	return queryUrls("GetAllExpiredUrls", query, timeNow)
+}
+
+const (
+	URL_SORT_CREATED_DESC = "created_desc"
+	URL_SORT_CREATED_ASC  = "created_asc"
+	URL_SORT_HITS_DESC    = "hits_desc"
+	URL_SORT_HITS_ASC     = "hits_asc"
+)
+
+const (
+	URL_STATUS_ACTIVE  = "active"
+	URL_STATUS_EXPIRED = "expired"
+	URL_STATUS_PAUSED  = "paused"
+)
+
+// UrlListOptions filters and orders ListUrls. Zero values disable a filter.
+type UrlListOptions struct {
+	// SessionToken limits the listing to one owner; empty lists every link
+	SessionToken string
+	// UserID limits the listing to the links of an account instead of a session
+	UserID string
+	// WorkspaceID limits the listing to the links of a workspace instead. The links of an account or session
+	// do not include the links they created in workspaces.
+	WorkspaceID   string
+	Status        string
+	HasPassword   *bool
+	Domain        string
+	CreatedAfter  string
+	CreatedBefore string
+	Sort          string
+	Limit         int
+	Cursor        string
+}
+
+// urlListCursor is the position after the last link of a page, for the sort order the page was listed with.
+type urlListCursor struct {
+	Sort        string `json:"s"`
+	DateCreated string `json:"d,omitempty"`
+	PageHits    int64  `json:"h,omitempty"`
+	ID          string `json:"i"`
+}
+
+func encodeUrlListCursor(sort string, urlData URLData) string {
+	cursor := urlListCursor{Sort: sort, ID: urlData.ID}
+	if sort == URL_SORT_HITS_ASC || sort == URL_SORT_HITS_DESC {
+		cursor.PageHits = urlData.PageHits
+	} else {
+		cursor.DateCreated = urlData.DateCreated
+	}
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeUrlListCursor(encoded string, sort string) (urlListCursor, error) {
+	cursor := urlListCursor{}
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil {
+		err = json.Unmarshal(decoded, &cursor)
 	}
+	if err != nil || cursor.Sort != sort || cursor.ID == "" {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
 
-	urls := []URLData{}
-	for res.Next() {
-		var urlData URLData
-		err := res.Scan(
-			&urlData.ID,
-			&urlData.DateCreated,
-			&urlData.Destination,
-			&urlData.MaxPageHits,
-			&urlData.PageHits,
-			&urlData.Password,
-			&urlData.SelfDestruct,
-			&urlData.SessionToken,
-			&urlData.URL,
-		)
+// ListUrls returns one page of links and the cursor of the next page, which is empty on the last page.
+func ListUrls(options UrlListOptions) ([]URLData, string, error) {
+	conditions := []string{}
+	args := []any{}
+	timeNow := time.Now().UTC().Format(time.RFC3339)
+
+	if options.WorkspaceID != "" {
+		conditions = append(conditions, "workspace_id = ?")
+		args = append(args, options.WorkspaceID)
+	} else if options.UserID != "" {
+		conditions = append(conditions, "user_id = ? AND workspace_id = ''")
+		args = append(args, options.UserID)
+	} else if options.SessionToken != "" {
+		conditions = append(conditions, "session_token = ? AND workspace_id = ''")
+		args = append(args, options.SessionToken)
+	}
+	switch options.Status {
+	case URL_STATUS_EXPIRED:
+		conditions = append(conditions, "("+expiredUrlsCondition+")")
+		args = append(args, timeNow)
+	case URL_STATUS_ACTIVE:
+		conditions = append(conditions, "NOT ("+expiredUrlsCondition+") AND paused = FALSE")
+		args = append(args, timeNow)
+	case URL_STATUS_PAUSED:
+		conditions = append(conditions, "paused = TRUE")
+	}
+	if options.HasPassword != nil {
+		if *options.HasPassword {
+			conditions = append(conditions, "(password IS NOT NULL AND password <> '')")
+		} else {
+			conditions = append(conditions, "(password IS NULL OR password = '')")
+		}
+	}
+	if options.Domain != "" {
+		conditions = append(conditions, "destination REGEXP ?")
+		args = append(args, "^([a-z]+://)?(www\\.)?"+regexp.QuoteMeta(strings.ToLower(options.Domain))+"([:/?#]|$)")
+	}
+	if options.CreatedAfter != "" {
+		conditions = append(conditions, "date_created >= ?")
+		args = append(args, options.CreatedAfter)
+	}
+	if options.CreatedBefore != "" {
+		conditions = append(conditions, "date_created < ?")
+		args = append(args, options.CreatedBefore)
+	}
+
+	sortColumn, direction, comparison := "date_created", "DESC", "<"
+	switch options.Sort {
+	case URL_SORT_CREATED_ASC:
+		direction, comparison = "ASC", ">"
+	case URL_SORT_HITS_DESC:
+		sortColumn = "page_hits"
+	case URL_SORT_HITS_ASC:
+		sortColumn, direction, comparison = "page_hits", "ASC", ">"
+	default:
+		options.Sort = URL_SORT_CREATED_DESC
+	}
+
+	if options.Cursor != "" {
+		cursor, err := decodeUrlListCursor(options.Cursor, options.Sort)
 		if err != nil {
-			log.Print("(GetAllExpiredUrls) res.Scan", err)
+			return nil, "", err
 		}
-		urls = append(urls, urlData)
+		var cursorValue any = cursor.DateCreated
+		if sortColumn == "page_hits" {
+			cursorValue = cursor.PageHits
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", sortColumn, comparison, sortColumn, comparison))
+		args = append(args, cursorValue, cursorValue, cursor.ID)
+	}
+
+	query := "SELECT " + urlColumns + " FROM urls"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	// One extra row tells whether there is a next page
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %d", sortColumn, direction, direction, options.Limit+1)
+
+	urls, err := queryUrls("ListUrls", query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if len(urls) > options.Limit {
+		urls = urls[:options.Limit]
+		nextCursor = encodeUrlListCursor(options.Sort, urls[len(urls)-1])
+	}
+
+	return urls, nextCursor, nil
+}
+
+const MIN_SEARCH_QUERY_LENGTH = 2 // the ngram parser indexes 2-character tokens
+
+// SearchUrls finds links whose destination, alias, title or tags contain query, most relevant first.
+// The full-text index uses the ngram parser, so a quoted phrase matches any substring of the indexed columns.
+// The search is limited to the links of workspaceID, else of userID or, without one, of sessionToken, as in
+// ListUrls; when all are empty it searches every owner's links.
+func SearchUrls(sessionToken string, userID string, workspaceID string, query string, limit int) ([]URLData, error) {
+	sqlQuery, args := searchUrlsQuery(sessionToken, userID, workspaceID, query, limit)
+	return queryUrls("SearchUrls", sqlQuery, args...)
+}
+
+func searchUrlsQuery(sessionToken string, userID string, workspaceID string, query string, limit int) (string, []any) {
+	phrase := `"` + strings.ReplaceAll(query, `"`, " ") + `"`
+	conditions := "(MATCH (destination, title, tags) AGAINST (? IN BOOLEAN MODE) OR id LIKE ?)"
+	args := []any{phrase, "%" + escapeLike(query) + "%"}
+	if workspaceID != "" {
+		conditions = "workspace_id = ? AND " + conditions
+		args = append([]any{workspaceID}, args...)
+	} else if userID != "" {
+		conditions = "user_id = ? AND workspace_id = '' AND " + conditions
+		args = append([]any{userID}, args...)
+	} else if sessionToken != "" {
+		conditions = "session_token = ? AND workspace_id = '' AND " + conditions
+		args = append([]any{sessionToken}, args...)
+	}
+
+	sqlQuery := "SELECT " + urlColumns + " FROM urls WHERE " + conditions +
+		fmt.Sprintf(" ORDER BY MATCH (destination, title, tags) AGAINST (? IN BOOLEAN MODE) DESC, date_created DESC LIMIT %d", limit)
+	args = append(args, phrase)
+
+	return sqlQuery, args
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(value)
+}
+
+// idPlaceholders returns the placeholders and arguments for an "id IN (...)" clause.
+func idPlaceholders(ids []string) (string, []any) {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", "), args
+}
+
+func GetUrlsByIds(ids []string) ([]URLData, error) {
+	if len(ids) == 0 {
+		return []URLData{}, nil
+	}
+	placeholders, args := idPlaceholders(ids)
+	query := "SELECT " + urlColumns + " FROM urls WHERE id IN (" + placeholders + ")"
+	return queryUrls("GetUrlsByIds", query, args...)
+}
+
+func DeleteUrlsByIds(ids []string) error {
+	if len(ids) == 0 {
+		return nil
 	}
+	placeholders, args := idPlaceholders(ids)
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("DELETE FROM urls WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		log.Println("(DeleteUrlsByIds) db.Exec", err)
+	}
+
+	return storageError(err)
+}
 
-	return urls, err
+// UrlsUpdate lists the fields changed by UpdateUrlsByIds; nil fields are left unchanged.
+// ClearSelfDestruct removes the expiry and takes precedence over SelfDestruct.
+type UrlsUpdate struct {
+	Paused            *bool
+	SelfDestruct      *string
+	ClearSelfDestruct bool
 }
 
-func DeleteFromDatabase(id string, sessionToken string) (bool, error) {
-	query := "DELETE FROM urls WHERE id = ? AND session_token = ?"
+func UpdateUrlsByIds(ids []string, update UrlsUpdate) error {
+	assignments := []string{}
+	args := []any{}
+	if update.Paused != nil {
+		assignments = append(assignments, "paused = ?")
+		args = append(args, *update.Paused)
+	}
+	if update.ClearSelfDestruct {
+		assignments = append(assignments, "self_destruct = NULL")
+	} else if update.SelfDestruct != nil {
+		assignments = append(assignments, "self_destruct = ?")
+		args = append(args, *update.SelfDestruct)
+	}
+	if len(ids) == 0 || len(assignments) == 0 {
+		return nil
+	}
+
+	placeholders, idArgs := idPlaceholders(ids)
 	db, err := getNewPlanetScaleClient()
-	err = db.QueryRow(query, id, sessionToken).Err()
 	if err != nil {
-		log.Println("(DeleteFromDatabase) db.Exec error:", id, err)
-		return false, err
+		return storageError(err)
+	}
+	query := "UPDATE urls SET " + strings.Join(assignments, ", ") + " WHERE id IN (" + placeholders + ")"
+	_, err = db.Exec(query, append(args, idArgs...)...)
+	if err != nil {
+		log.Println("(UpdateUrlsByIds) db.Exec", err)
 	}
 
-	return true, err
+	return storageError(err)
 }
 
 func DeleteAllExpiredDocuments() ([]string, error) {
+	expiredUrls, err := GetAllExpiredUrls()
+	if err != nil {
+		return nil, err
+	}
+
 	db, err := getNewPlanetScaleClient()
-	query := "DELETE FROM urls WHERE self_destruct < ? OR max_page_hits > page_hits"
-	timeNow := time.Now().UTC().Format(time.RFC3339)
-	res, err := db.Query(query, timeNow)
-	defer res.Close()
 	if err != nil {
-		log.Print("(DeleteAllExpiredDocuments) db.Query", err)
+		return nil, storageError(err)
 	}
 
-	urls := []string{}
-	for res.Next() {
-		var urlData URLData
-		err := res.Scan(
-			&urlData.ID,
-			&urlData.DateCreated,
-			&urlData.Destination,
-			&urlData.MaxPageHits,
-			&urlData.PageHits,
-			&urlData.Password,
-			&urlData.SelfDestruct,
-			&urlData.SessionToken,
-			&urlData.URL,
-		)
+	ids := []string{}
+	for _, urlData := range expiredUrls {
+		_, err := db.Exec("DELETE FROM urls WHERE id = ?", urlData.ID)
 		if err != nil {
-			log.Print("(DeleteAllExpiredDocuments) res.Scan", err)
+			log.Print("(DeleteAllExpiredDocuments) db.Exec", err)
+			return ids, storageError(err)
 		}
-		urls = append(urls, urlData.ID)
+		ids = append(ids, urlData.ID)
 	}
 
-	return urls, err
+	return ids, nil
 }
 
-func checkIfUrlIdExists(urlId string) bool {
-	_, err := GetSingleUrl(urlId)
+func RecordVisit(visit VisitData) error {
+	query := "INSERT INTO visits (url_id, date_created, ip_address, user_agent, referrer) VALUES (?, ?, ?, ?, ?)"
+	db, err := getNewPlanetScaleClient()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return false
-		} else {
-			log.Println("(checkIfUrlIdExists) error:", err)
-			return true
-		}
-	} else {
-		return true
+		return storageError(err)
+	}
+	_, err = db.Exec(query,
+		visit.UrlID,
+		visit.DateCreated,
+		visit.IPAddress,
+		visit.UserAgent,
+		visit.Referrer,
+	)
+	if err != nil {
+		log.Print("(RecordVisit) db.Exec", err)
 	}
+
+	return storageError(err)
 }
 
-// SELECT * FROM urls; --DELETE FROM urls;
+// DailyVisits is the number of recorded visits of a link on one day (YYYY-MM-DD, UTC).
+type DailyVisits struct {
+	Day    string `json:"day"`
+	Visits int64  `json:"visits"`
+}
 
-// CREATE TABLE IF NOT EXISTS urls (
-//     id VARCHAR(36) NOT NULL,
-//     date_created VARCHAR(20) NOT NULL,
-//     destination VARCHAR(2048) NOT NULL,
-//     max_page_hits INT,
-//     page_hits INT,
-//     password VARCHAR(255),
-//     self_destruct VARCHAR(255),
+// UrlStats counts page views of a link. DailyVisits only covers visitors who did not opt out of tracking,
+// including days whose visits have been rolled up.
+type UrlStats struct {
+	ID          string        `json:"id"`
+	PageHits    int64         `json:"page_hits"`
+	MaxPageHits int64         `json:"max_page_hits"`
+	DailyVisits []DailyVisits `json:"daily_visits"`
+}
+
+func GetUrlStats(id string) (UrlStats, error) {
+	urlData, err := GetSingleUrl(id)
+	if err != nil {
+		return UrlStats{}, err
+	}
+	stats := UrlStats{ID: id, PageHits: urlData.PageHits, MaxPageHits: urlData.MaxPageHits, DailyVisits: []DailyVisits{}}
+
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return UrlStats{}, storageError(err)
+	}
+	query := "SELECT day, SUM(visits) FROM (SELECT day, visits FROM visit_rollups WHERE url_id = ? UNION ALL SELECT LEFT(date_created, 10) AS day, COUNT(*) AS visits FROM visits WHERE url_id = ? GROUP BY LEFT(date_created, 10)) AS days GROUP BY day ORDER BY day"
+	res, err := db.Query(query, id, id)
+	if err != nil {
+		log.Println("(GetUrlStats) db.Query", err)
+		return UrlStats{}, storageError(err)
+	}
+	defer res.Close()
+
+	for res.Next() {
+		var dailyVisits DailyVisits
+		if err := res.Scan(&dailyVisits.Day, &dailyVisits.Visits); err != nil {
+			log.Println("(GetUrlStats) res.Scan", err)
+			return UrlStats{}, storageError(err)
+		}
+		stats.DailyVisits = append(stats.DailyVisits, dailyVisits)
+	}
+
+	return stats, storageError(res.Err())
+}
+
+func DeleteVisitsBefore(before string, rollup bool) (int64, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return 0, storageError(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Print("(DeleteVisitsBefore) db.Begin", err)
+		return 0, storageError(err)
+	}
+	defer tx.Rollback()
+
+	if rollup {
+		rollupQuery := "INSERT INTO visit_rollups (url_id, day, visits) SELECT url_id, LEFT(date_created, 10), COUNT(*) FROM visits WHERE date_created < ? GROUP BY url_id, LEFT(date_created, 10) ON DUPLICATE KEY UPDATE visits = visits + VALUES(visits)"
+		_, err = tx.Exec(rollupQuery, before)
+		if err != nil {
+			log.Print("(DeleteVisitsBefore) tx.Exec rollup", err)
+			return 0, storageError(err)
+		}
+	}
+
+	res, err := tx.Exec("DELETE FROM visits WHERE date_created < ?", before)
+	if err != nil {
+		log.Print("(DeleteVisitsBefore) tx.Exec delete", err)
+		return 0, storageError(err)
+	}
+	count, _ := res.RowsAffected()
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print("(DeleteVisitsBefore) tx.Commit", err)
+		return 0, storageError(err)
+	}
+
+	return count, nil
+}
+
+func GetOrCreateIpSalt(day string) ([]byte, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return nil, storageError(err)
+	}
+	newSalt := make([]byte, 32)
+	_, err = crand.Read(newSalt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("INSERT IGNORE INTO ip_salts (day, salt) VALUES (?, ?)", day, newSalt)
+	if err != nil {
+		log.Print("(GetOrCreateIpSalt) db.Exec", err)
+		return nil, storageError(err)
+	}
+
+	var salt []byte
+	err = db.QueryRow("SELECT salt FROM ip_salts WHERE day = ?", day).Scan(&salt)
+	if err != nil {
+		log.Print("(GetOrCreateIpSalt) db.QueryRow", err)
+	}
+
+	return salt, storageError(err)
+}
+
+func DeleteIpSaltsBefore(day string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("DELETE FROM ip_salts WHERE day < ?", day)
+	if err != nil {
+		log.Print("(DeleteIpSaltsBefore) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+// InsertIdempotencyKey returns ErrIdempotencyKeyExists when the owner already used the key.
+func InsertIdempotencyKey(record IdempotencyRecord) error {
+	query := "INSERT INTO idempotency_keys (idempotency_key, owner, request_hash, date_created) VALUES (?, ?, ?, ?)"
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec(query, record.Key, record.Owner, record.RequestHash, record.DateCreated)
+	if isDuplicateEntry(err) {
+		return ErrIdempotencyKeyExists
+	} else if err != nil {
+		log.Print("(InsertIdempotencyKey) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+func GetIdempotencyKey(owner string, key string) (IdempotencyRecord, error) {
+	record := IdempotencyRecord{}
+	var statusCode sql.NullInt64
+	var responseBody sql.NullString
+	query := "SELECT idempotency_key, owner, request_hash, status_code, response_body, date_created FROM idempotency_keys WHERE owner = ? AND idempotency_key = ?"
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return record, storageError(err)
+	}
+	err = db.QueryRow(query, owner, key).Scan(
+		&record.Key,
+		&record.Owner,
+		&record.RequestHash,
+		&statusCode,
+		&responseBody,
+		&record.DateCreated,
+	)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Print("(GetIdempotencyKey) db.QueryRow", err)
+	}
+	record.StatusCode = int(statusCode.Int64)
+	record.ResponseBody = responseBody.String
+
+	return record, storageError(err)
+}
+
+func CompleteIdempotencyKey(owner string, key string, statusCode int, responseBody string) error {
+	query := "UPDATE idempotency_keys SET status_code = ?, response_body = ? WHERE owner = ? AND idempotency_key = ?"
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec(query, statusCode, responseBody, owner, key)
+	if err != nil {
+		log.Print("(CompleteIdempotencyKey) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+func DeleteIdempotencyKey(owner string, key string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("DELETE FROM idempotency_keys WHERE owner = ? AND idempotency_key = ?", owner, key)
+	if err != nil {
+		log.Print("(DeleteIdempotencyKey) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+func DeleteIdempotencyKeysBefore(before string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("DELETE FROM idempotency_keys WHERE date_created < ?", before)
+	if err != nil {
+		log.Print("(DeleteIdempotencyKeysBefore) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+// TakeRateLimitTokens takes a token from the rate_limit_buckets row of every key, or from none when one of them is
+// empty, locking the rows so that concurrent instances see each other's requests. Rows are locked in key order, so
+// that two requests sharing buckets cannot deadlock. Buckets that do not exist yet start full.
+func TakeRateLimitTokens(keys []string, limit RateLimit, now time.Time) (bool, time.Duration, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return true, 0, storageError(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Print("(TakeRateLimitTokens) db.Begin", err)
+		return true, 0, storageError(err)
+	}
+	defer tx.Rollback()
+
+	keys = append([]string{}, keys...)
+	sort.Strings(keys)
+	buckets := make([]*tokenBucket, 0, len(keys))
+	for _, key := range keys {
+		bucket := &tokenBucket{tokens: limit.Burst, updatedAt: now}
+		var updatedAt int64
+		err = tx.QueryRow("SELECT tokens, updated_at FROM rate_limit_buckets WHERE bucket_key = ? FOR UPDATE", key).Scan(&bucket.tokens, &updatedAt)
+		if err == nil {
+			bucket.updatedAt = time.UnixMilli(updatedAt)
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			log.Print("(TakeRateLimitTokens) tx.QueryRow", err)
+			return true, 0, storageError(err)
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	allowed, retryAfter := takeFromBuckets(buckets, limit, now)
+	query := "INSERT INTO rate_limit_buckets (bucket_key, tokens, updated_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE tokens = VALUES(tokens), updated_at = VALUES(updated_at)"
+	for i, bucket := range buckets {
+		_, err = tx.Exec(query, keys[i], bucket.tokens, bucket.updatedAt.UnixMilli())
+		if err != nil {
+			log.Print("(TakeRateLimitTokens) tx.Exec", err)
+			return true, 0, storageError(err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print("(TakeRateLimitTokens) tx.Commit", err)
+		return true, 0, storageError(err)
+	}
+	return allowed, retryAfter, nil
+}
+
+func DeleteRateLimitBucketsBefore(before time.Time) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("DELETE FROM rate_limit_buckets WHERE updated_at < ?", before.UnixMilli())
+	if err != nil {
+		log.Print("(DeleteRateLimitBucketsBefore) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+// CountActiveUrls counts the unexpired links of userID or, without one, of sessionToken. Paused links are counted.
+func CountActiveUrls(sessionToken string, userID string) (int64, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return 0, storageError(err)
+	}
+	var count int64
+	ownerCondition, owner := "session_token = ?", sessionToken
+	if userID != "" {
+		ownerCondition, owner = "user_id = ?", userID
+	}
+	query := "SELECT COUNT(*) FROM urls WHERE " + ownerCondition + " AND NOT (" + expiredUrlsCondition + ")"
+	err = db.QueryRow(query, owner, time.Now().UTC().Format(time.RFC3339)).Scan(&count)
+	if err != nil {
+		log.Print("(CountActiveUrls) db.QueryRow", err)
+	}
+
+	return count, storageError(err)
+}
+
+func GetQuotaUsageCount(owner string, quota string, period string) (int64, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return 0, storageError(err)
+	}
+	var count int64
+	err = db.QueryRow("SELECT count FROM quota_usage WHERE owner = ? AND quota = ? AND period = ?", owner, quota, period).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		log.Print("(GetQuotaUsageCount) db.QueryRow", err)
+	}
+
+	return count, storageError(err)
+}
+
+func AddQuotaUsageCount(owner string, quota string, period string, count int64) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	query := "INSERT INTO quota_usage (owner, quota, period, count) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE count = count + VALUES(count)"
+	_, err = db.Exec(query, owner, quota, period, count)
+	if err != nil {
+		log.Print("(AddQuotaUsageCount) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+// ReserveQuotaUsageCount adds count to the usage unless it would exceed limit, and reports whether it did. The
+// conditional update is atomic, so concurrent reservations cannot exceed the limit together.
+func ReserveQuotaUsageCount(owner string, quota string, period string, count int64, limit int64) (bool, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return false, storageError(err)
+	}
+	_, err = db.Exec("INSERT INTO quota_usage (owner, quota, period, count) VALUES (?, ?, ?, 0) ON DUPLICATE KEY UPDATE count = count", owner, quota, period)
+	if err != nil {
+		log.Print("(ReserveQuotaUsageCount) db.Exec", err)
+		return false, storageError(err)
+	}
+	query := "UPDATE quota_usage SET count = count + ? WHERE owner = ? AND quota = ? AND period = ? AND count + ? <= ?"
+	result, err := db.Exec(query, count, owner, quota, period, count, limit)
+	if err != nil {
+		log.Print("(ReserveQuotaUsageCount) db.Exec", err)
+		return false, storageError(err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		log.Print("(ReserveQuotaUsageCount) result.RowsAffected", err)
+		return false, storageError(err)
+	}
+
+	return updated == 1, nil
+}
+
+func DeleteQuotaUsageBefore(quota string, period string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("DELETE FROM quota_usage WHERE quota = ? AND period < ?", quota, period)
+	if err != nil {
+		log.Print("(DeleteQuotaUsageBefore) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+const apiKeyColumns = "id, name, prefix, scopes, session_token, user_id, date_created, last_used, revoked_at"
+
+func scanApiKey(row rowScanner) (ApiKey, error) {
+	apiKey := ApiKey{}
+	var scopes string
+	var lastUsed, revokedAt sql.NullString
+	err := row.Scan(&apiKey.ID, &apiKey.Name, &apiKey.Prefix, &scopes, &apiKey.SessionToken, &apiKey.UserID, &apiKey.DateCreated, &lastUsed, &revokedAt)
+	apiKey.Scopes = strings.Split(scopes, ",")
+	if lastUsed.Valid {
+		apiKey.LastUsed = &lastUsed.String
+	}
+	if revokedAt.Valid {
+		apiKey.RevokedAt = &revokedAt.String
+	}
+	return apiKey, err
+}
+
+func InsertApiKey(apiKey ApiKey, keyHash string) error {
+	query := "INSERT INTO api_keys (id, name, prefix, key_hash, scopes, session_token, user_id, date_created) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec(query, apiKey.ID, apiKey.Name, apiKey.Prefix, keyHash, strings.Join(apiKey.Scopes, ","), apiKey.SessionToken, apiKey.UserID, apiKey.DateCreated)
+	if err != nil {
+		log.Print("(InsertApiKey) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+func GetApiKeyByHash(keyHash string) (ApiKey, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return ApiKey{}, storageError(err)
+	}
+	apiKey, err := scanApiKey(db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?", keyHash))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Print("(GetApiKeyByHash) db.QueryRow", err)
+	}
+
+	return apiKey, storageError(err)
+}
+
+func GetApiKeyById(id string) (ApiKey, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return ApiKey{}, storageError(err)
+	}
+	apiKey, err := scanApiKey(db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?", id))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Print("(GetApiKeyById) db.QueryRow", err)
+	}
+
+	return apiKey, storageError(err)
+}
+
+// ListApiKeys returns the keys of a user or, without one, of a session, newest first. It returns every key when
+// both are empty.
+func ListApiKeys(sessionToken string, userID string) ([]ApiKey, error) {
+	apiKeys := []ApiKey{}
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return apiKeys, storageError(err)
+	}
+	query := "SELECT " + apiKeyColumns + " FROM api_keys"
+	args := []any{}
+	if userID != "" {
+		query += " WHERE user_id = ?"
+		args = append(args, userID)
+	} else if sessionToken != "" {
+		query += " WHERE session_token = ?"
+		args = append(args, sessionToken)
+	}
+	rows, err := db.Query(query+" ORDER BY date_created DESC, id DESC", args...)
+	if err != nil {
+		log.Print("(ListApiKeys) db.Query", err)
+		return apiKeys, storageError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		apiKey, err := scanApiKey(rows)
+		if err != nil {
+			log.Print("(ListApiKeys) rows.Scan", err)
+			return apiKeys, storageError(err)
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, storageError(rows.Err())
+}
+
+func RevokeApiKey(id string, revokedAt string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", revokedAt, id)
+	if err != nil {
+		log.Print("(RevokeApiKey) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+func UpdateApiKeyLastUsed(id string, lastUsed string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("UPDATE api_keys SET last_used = ? WHERE id = ?", lastUsed, id)
+	if err != nil {
+		log.Print("(UpdateApiKeyLastUsed) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+// AttachSessionToUser gives the user the links and API keys of a session that no account owns yet,
+// and returns the number of links attached.
+func AttachSessionToUser(sessionToken string, userID string) (int64, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return 0, storageError(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Print("(AttachSessionToUser) db.Begin", err)
+		return 0, storageError(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE urls SET user_id = ? WHERE session_token = ? AND user_id = ''", userID, sessionToken)
+	if err != nil {
+		log.Print("(AttachSessionToUser) tx.Exec urls", err)
+		return 0, storageError(err)
+	}
+	_, err = tx.Exec("UPDATE api_keys SET user_id = ? WHERE session_token = ? AND user_id = ''", userID, sessionToken)
+	if err != nil {
+		log.Print("(AttachSessionToUser) tx.Exec api_keys", err)
+		return 0, storageError(err)
+	}
+	if err = tx.Commit(); err != nil {
+		log.Print("(AttachSessionToUser) tx.Commit", err)
+		return 0, storageError(err)
+	}
+
+	attached, _ := result.RowsAffected()
+	return attached, nil
+}
+
+// InsertUser returns ErrEmailTaken when the email is already registered.
+func InsertUser(user User, passwordHash string) error {
+	query := "INSERT INTO users (id, email, password_hash, date_created) VALUES (?, ?, ?, ?)"
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec(query, user.ID, user.Email, passwordHash, user.DateCreated)
+	if isDuplicateEntry(err) {
+		return ErrEmailTaken
+	} else if err != nil {
+		log.Print("(InsertUser) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+// GetUserByEmail returns the user with the password hash.
+func GetUserByEmail(email string) (User, string, error) {
+	user := User{}
+	var passwordHash string
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return user, "", storageError(err)
+	}
+	err = db.QueryRow("SELECT id, email, date_created, password_hash FROM users WHERE email = ?", email).Scan(
+		&user.ID,
+		&user.Email,
+		&user.DateCreated,
+		&passwordHash,
+	)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Print("(GetUserByEmail) db.QueryRow", err)
+	}
+
+	return user, passwordHash, storageError(err)
+}
+
+func GetUserById(id string) (User, error) {
+	user := User{}
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return user, storageError(err)
+	}
+	err = db.QueryRow("SELECT id, email, date_created FROM users WHERE id = ?", id).Scan(&user.ID, &user.Email, &user.DateCreated)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Print("(GetUserById) db.QueryRow", err)
+	}
+
+	return user, storageError(err)
+}
+
+func UpdateUserPassword(id string, passwordHash string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", passwordHash, id)
+	if err != nil {
+		log.Print("(UpdateUserPassword) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+func InsertUserSession(tokenHash string, userID string, dateCreated string, expiresAt string) error {
+	query := "INSERT INTO user_sessions (token_hash, user_id, date_created, expires_at) VALUES (?, ?, ?, ?)"
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec(query, tokenHash, userID, dateCreated, expiresAt)
+	if err != nil {
+		log.Print("(InsertUserSession) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+// GetUserSessionUser returns the user of a login session that has not expired at now.
+func GetUserSessionUser(tokenHash string, now string) (string, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return "", storageError(err)
+	}
+	var userID string
+	err = db.QueryRow("SELECT user_id FROM user_sessions WHERE token_hash = ? AND expires_at > ?", tokenHash, now).Scan(&userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Print("(GetUserSessionUser) db.QueryRow", err)
+	}
+
+	return userID, storageError(err)
+}
+
+func DeleteUserSession(tokenHash string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("DELETE FROM user_sessions WHERE token_hash = ?", tokenHash)
+	if err != nil {
+		log.Print("(DeleteUserSession) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+func DeleteUserSessions(userID string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("DELETE FROM user_sessions WHERE user_id = ?", userID)
+	if err != nil {
+		log.Print("(DeleteUserSessions) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+func DeleteUserSessionsBefore(before string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("DELETE FROM user_sessions WHERE expires_at < ?", before)
+	if err != nil {
+		log.Print("(DeleteUserSessionsBefore) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+func InsertPasswordResetToken(tokenHash string, userID string, dateCreated string, expiresAt string) error {
+	query := "INSERT INTO password_reset_tokens (token_hash, user_id, date_created, expires_at) VALUES (?, ?, ?, ?)"
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec(query, tokenHash, userID, dateCreated, expiresAt)
+	if err != nil {
+		log.Print("(InsertPasswordResetToken) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+// UsePasswordResetToken deletes a reset token that has not expired at now and returns its user,
+// or ErrNotFound when there is no such token.
+func UsePasswordResetToken(tokenHash string, now string) (string, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return "", storageError(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Print("(UsePasswordResetToken) db.Begin", err)
+		return "", storageError(err)
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRow("SELECT user_id FROM password_reset_tokens WHERE token_hash = ? AND expires_at > ? FOR UPDATE", tokenHash, now).Scan(&userID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Print("(UsePasswordResetToken) tx.QueryRow", err)
+		}
+		return "", storageError(err)
+	}
+	if _, err = tx.Exec("DELETE FROM password_reset_tokens WHERE token_hash = ?", tokenHash); err != nil {
+		log.Print("(UsePasswordResetToken) tx.Exec", err)
+		return "", storageError(err)
+	}
+	if err = tx.Commit(); err != nil {
+		log.Print("(UsePasswordResetToken) tx.Commit", err)
+		return "", storageError(err)
+	}
+
+	return userID, nil
+}
+
+func DeletePasswordResetTokensBefore(before string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("DELETE FROM password_reset_tokens WHERE expires_at < ?", before)
+	if err != nil {
+		log.Print("(DeletePasswordResetTokensBefore) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+func InsertClaimCode(codeHash string, sessionToken string, dateCreated string, expiresAt string) error {
+	query := "INSERT INTO claim_codes (code_hash, session_token, date_created, expires_at) VALUES (?, ?, ?, ?)"
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec(query, codeHash, sessionToken, dateCreated, expiresAt)
+	if err != nil {
+		log.Print("(InsertClaimCode) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+// MergeSessionWithClaimCode consumes a claim code that has not expired at now and moves the links and API keys of
+// sessionToken to the session that issued it, which is returned with the number of links moved. sessionToken
+// must not be empty, as the links and keys of no session would otherwise all be moved.
+func MergeSessionWithClaimCode(codeHash string, sessionToken string, now string) (string, int64, error) {
+	if sessionToken == "" {
+		return "", 0, fmt.Errorf("%w: a session is required to redeem a claim code", ErrInvalidRequest)
+	}
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return "", 0, storageError(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Print("(MergeSessionWithClaimCode) db.Begin", err)
+		return "", 0, storageError(err)
+	}
+	defer tx.Rollback()
+
+	var issuingSession string
+	err = tx.QueryRow("SELECT session_token FROM claim_codes WHERE code_hash = ? AND expires_at > ? FOR UPDATE", codeHash, now).Scan(&issuingSession)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Print("(MergeSessionWithClaimCode) tx.QueryRow", err)
+		}
+		return "", 0, storageError(err)
+	}
+	if _, err = tx.Exec("DELETE FROM claim_codes WHERE code_hash = ?", codeHash); err != nil {
+		log.Print("(MergeSessionWithClaimCode) tx.Exec claim_codes", err)
+		return "", 0, storageError(err)
+	}
+
+	merged := int64(0)
+	if sessionToken != issuingSession {
+		result, err := tx.Exec("UPDATE urls SET session_token = ? WHERE session_token = ?", issuingSession, sessionToken)
+		if err != nil {
+			log.Print("(MergeSessionWithClaimCode) tx.Exec urls", err)
+			return "", 0, storageError(err)
+		}
+		merged, _ = result.RowsAffected()
+		if _, err = tx.Exec("UPDATE api_keys SET session_token = ? WHERE session_token = ?", issuingSession, sessionToken); err != nil {
+			log.Print("(MergeSessionWithClaimCode) tx.Exec api_keys", err)
+			return "", 0, storageError(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.Print("(MergeSessionWithClaimCode) tx.Commit", err)
+		return "", 0, storageError(err)
+	}
+
+	return issuingSession, merged, nil
+}
+
+func DeleteClaimCodesBefore(before string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec("DELETE FROM claim_codes WHERE expires_at < ?", before)
+	if err != nil {
+		log.Print("(DeleteClaimCodesBefore) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+func InsertUserIdentity(identity UserIdentity) error {
+	query := "INSERT INTO user_identities (issuer, subject, user_id, email, date_created) VALUES (?, ?, ?, ?, ?)"
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	_, err = db.Exec(query, identity.Issuer, identity.Subject, identity.UserID, identity.Email, identity.DateCreated)
+	if err != nil && !isDuplicateEntry(err) {
+		log.Print("(InsertUserIdentity) db.Exec", err)
+	}
+
+	return storageError(err)
+}
+
+const userIdentityColumns = "issuer, subject, user_id, email, date_created"
+
+func scanUserIdentity(row rowScanner) (UserIdentity, error) {
+	identity := UserIdentity{}
+	err := row.Scan(&identity.Issuer, &identity.Subject, &identity.UserID, &identity.Email, &identity.DateCreated)
+	return identity, err
+}
+
+func GetUserIdentity(issuer string, subject string) (UserIdentity, error) {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return UserIdentity{}, storageError(err)
+	}
+	row := db.QueryRow("SELECT "+userIdentityColumns+" FROM user_identities WHERE issuer = ? AND subject = ?", issuer, subject)
+	identity, err := scanUserIdentity(row)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Print("(GetUserIdentity) db.QueryRow", err)
+	}
+
+	return identity, storageError(err)
+}
+
+func ListUserIdentities(userID string) ([]UserIdentity, error) {
+	identities := []UserIdentity{}
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return identities, storageError(err)
+	}
+	rows, err := db.Query("SELECT "+userIdentityColumns+" FROM user_identities WHERE user_id = ? ORDER BY date_created", userID)
+	if err != nil {
+		log.Print("(ListUserIdentities) db.Query", err)
+		return identities, storageError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		identity, err := scanUserIdentity(rows)
+		if err != nil {
+			log.Print("(ListUserIdentities) rows.Scan", err)
+			return identities, storageError(err)
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, storageError(rows.Err())
+}
+
+// InsertWorkspace creates the workspace with ownerUserID as its first owner.
+func InsertWorkspace(workspace Workspace, ownerUserID string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Print("(InsertWorkspace) db.Begin", err)
+		return storageError(err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO workspaces (id, name, date_created) VALUES (?, ?, ?)", workspace.ID, workspace.Name, workspace.DateCreated)
+	if err != nil {
+		log.Print("(InsertWorkspace) tx.Exec workspaces", err)
+		return storageError(err)
+	}
+	_, err = tx.Exec("INSERT INTO workspace_members (workspace_id, user_id, role, date_created) VALUES (?, ?, ?, ?)",
+		workspace.ID, ownerUserID, WORKSPACE_ROLE_OWNER, workspace.DateCreated)
+	if err != nil {
+		log.Print("(InsertWorkspace) tx.Exec workspace_members", err)
+		return storageError(err)
+	}
+	if err = tx.Commit(); err != nil {
+		log.Print("(InsertWorkspace) tx.Commit", err)
+	}
+
+	return storageError(err)
+}
+
+// ListUserWorkspaces returns the workspaces of a user with the user's role in each.
+func ListUserWorkspaces(userID string) ([]Workspace, error) {
+	workspaces := []Workspace{}
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return workspaces, storageError(err)
+	}
+	rows, err := db.Query("SELECT w.id, w.name, w.date_created, m.role FROM workspace_members m "+
+		"JOIN workspaces w ON w.id = m.workspace_id WHERE m.user_id = ? ORDER BY w.date_created", userID)
+	if err != nil {
+		log.Print("(ListUserWorkspaces) db.Query", err)
+		return workspaces, storageError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		workspace := Workspace{}
+		if err := rows.Scan(&workspace.ID, &workspace.Name, &workspace.DateCreated, &workspace.Role); err != nil {
+			log.Print("(ListUserWorkspaces) rows.Scan", err)
+			return workspaces, storageError(err)
+		}
+		workspaces = append(workspaces, workspace)
+	}
+
+	return workspaces, storageError(rows.Err())
+}
+
+// GetUserWorkspaceRoles maps the workspaces of a user to the user's role in them.
+func GetUserWorkspaceRoles(userID string) (map[string]string, error) {
+	roles := map[string]string{}
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return roles, storageError(err)
+	}
+	rows, err := db.Query("SELECT workspace_id, role FROM workspace_members WHERE user_id = ?", userID)
+	if err != nil {
+		log.Print("(GetUserWorkspaceRoles) db.Query", err)
+		return roles, storageError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var workspaceID, role string
+		if err := rows.Scan(&workspaceID, &role); err != nil {
+			log.Print("(GetUserWorkspaceRoles) rows.Scan", err)
+			return roles, storageError(err)
+		}
+		roles[workspaceID] = role
+	}
+
+	return roles, storageError(rows.Err())
+}
+
+func ListWorkspaceMembers(workspaceID string) ([]WorkspaceMember, error) {
+	members := []WorkspaceMember{}
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return members, storageError(err)
+	}
+	rows, err := db.Query("SELECT m.workspace_id, m.user_id, u.email, m.role, m.date_created FROM workspace_members m "+
+		"JOIN users u ON u.id = m.user_id WHERE m.workspace_id = ? ORDER BY m.date_created", workspaceID)
+	if err != nil {
+		log.Print("(ListWorkspaceMembers) db.Query", err)
+		return members, storageError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		member := WorkspaceMember{}
+		if err := rows.Scan(&member.WorkspaceID, &member.UserID, &member.Email, &member.Role, &member.DateCreated); err != nil {
+			log.Print("(ListWorkspaceMembers) rows.Scan", err)
+			return members, storageError(err)
+		}
+		members = append(members, member)
+	}
+
+	return members, storageError(rows.Err())
+}
+
+// checkOtherWorkspaceOwner returns ErrLastWorkspaceOwner when userID is the only owner of the workspace. The
+// owners are locked until the transaction ends, so that two owners cannot both leave at once.
+func checkOtherWorkspaceOwner(tx *sql.Tx, workspaceID string, userID string) error {
+	rows, err := tx.Query("SELECT user_id FROM workspace_members WHERE workspace_id = ? AND role = ? FOR UPDATE", workspaceID, WORKSPACE_ROLE_OWNER)
+	if err != nil {
+		log.Print("(checkOtherWorkspaceOwner) tx.Query", err)
+		return storageError(err)
+	}
+	defer rows.Close()
+	isOwner, otherOwners := false, 0
+	for rows.Next() {
+		var ownerID string
+		if err := rows.Scan(&ownerID); err != nil {
+			log.Print("(checkOtherWorkspaceOwner) rows.Scan", err)
+			return storageError(err)
+		}
+		if ownerID == userID {
+			isOwner = true
+		} else {
+			otherOwners++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return storageError(err)
+	}
+	if isOwner && otherOwners == 0 {
+		return ErrLastWorkspaceOwner
+	}
+	return nil
+}
+
+// SetWorkspaceMember adds the member or changes its role. The last owner cannot be demoted.
+func SetWorkspaceMember(member WorkspaceMember) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Print("(SetWorkspaceMember) db.Begin", err)
+		return storageError(err)
+	}
+	defer tx.Rollback()
+
+	if member.Role != WORKSPACE_ROLE_OWNER {
+		if err := checkOtherWorkspaceOwner(tx, member.WorkspaceID, member.UserID); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO workspace_members (workspace_id, user_id, role, date_created) VALUES (?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE role = VALUES(role)", member.WorkspaceID, member.UserID, member.Role, member.DateCreated)
+	if err != nil {
+		log.Print("(SetWorkspaceMember) tx.Exec", err)
+		return storageError(err)
+	}
+	if err = tx.Commit(); err != nil {
+		log.Print("(SetWorkspaceMember) tx.Commit", err)
+	}
+
+	return storageError(err)
+}
+
+// DeleteWorkspaceMember removes a member, returning ErrNotFound when the user is not a member. The last owner
+// cannot be removed.
+func DeleteWorkspaceMember(workspaceID string, userID string) error {
+	db, err := getNewPlanetScaleClient()
+	if err != nil {
+		return storageError(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Print("(DeleteWorkspaceMember) db.Begin", err)
+		return storageError(err)
+	}
+	defer tx.Rollback()
+
+	if err := checkOtherWorkspaceOwner(tx, workspaceID, userID); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM workspace_members WHERE workspace_id = ? AND user_id = ?", workspaceID, userID)
+	if err != nil {
+		log.Print("(DeleteWorkspaceMember) tx.Exec", err)
+		return storageError(err)
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return ErrNotFound
+	}
+	if err = tx.Commit(); err != nil {
+		log.Print("(DeleteWorkspaceMember) tx.Commit", err)
+	}
+
+	return storageError(err)
+}
+
+func checkIfUrlIdExists(urlId string) (bool, error) {
+	_, err := GetSingleUrl(urlId)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		} else {
+			log.Println("(checkIfUrlIdExists) error:", err)
+			return true, err
+		}
+	} else {
+		return true, nil
+	}
+}
+
+// SELECT * FROM urls; --DELETE FROM urls;
+
+// CREATE TABLE IF NOT EXISTS urls (
+//     id VARCHAR(36) NOT NULL,
+//     date_created VARCHAR(20) NOT NULL,
+//     destination VARCHAR(2048) NOT NULL,
+//     max_page_hits INT,
+//     page_hits INT,
+//     password VARCHAR(255),
+//     self_destruct VARCHAR(255),
 //     session_token VARCHAR(255),
 //     url VARCHAR(2048) NOT NULL,
+//     paused BOOLEAN NOT NULL DEFAULT FALSE,
+//     title VARCHAR(255) NOT NULL DEFAULT '',
+//     tags VARCHAR(1024) NOT NULL DEFAULT '',
+//     PRIMARY KEY (id)
+// );
+
+// ALTER TABLE urls ADD COLUMN paused BOOLEAN NOT NULL DEFAULT FALSE;
+
+// ALTER TABLE urls ADD COLUMN title VARCHAR(255) NOT NULL DEFAULT '', ADD COLUMN tags VARCHAR(1024) NOT NULL DEFAULT '';
+// CREATE FULLTEXT INDEX urls_search ON urls (destination, title, tags) WITH PARSER ngram;
+
+// CREATE INDEX session_token_date_created ON urls (session_token, date_created, id);
+// CREATE INDEX session_token_page_hits ON urls (session_token, page_hits, id);
+
+// CREATE TABLE IF NOT EXISTS visits (
+//     id BIGINT NOT NULL AUTO_INCREMENT,
+//     url_id VARCHAR(36) NOT NULL,
+//     date_created VARCHAR(20) NOT NULL,
+//     ip_address VARCHAR(64),
+//     user_agent VARCHAR(512),
+//     referrer VARCHAR(2048),
+//     PRIMARY KEY (id),
+//     KEY url_id_date_created (url_id, date_created),
+//     KEY date_created (date_created)
+// );
+
+// CREATE TABLE IF NOT EXISTS visit_rollups (
+//     url_id VARCHAR(36) NOT NULL,
+//     day VARCHAR(10) NOT NULL,
+//     visits INT NOT NULL,
+//     PRIMARY KEY (url_id, day)
+// );
+
+// CREATE TABLE IF NOT EXISTS ip_salts (
+//     day VARCHAR(10) NOT NULL,
+//     salt VARBINARY(32) NOT NULL,
+//     PRIMARY KEY (day)
+// );
+
+// CREATE TABLE IF NOT EXISTS idempotency_keys (
+//     idempotency_key VARCHAR(255) NOT NULL,
+//     owner VARCHAR(255) NOT NULL,
+//     request_hash CHAR(64) NOT NULL,
+//     status_code INT,
+//     response_body MEDIUMTEXT,
+//     date_created VARCHAR(20) NOT NULL,
+//     PRIMARY KEY (owner, idempotency_key),
+//     KEY date_created (date_created)
+// );
+
+// CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+//     bucket_key VARCHAR(255) NOT NULL,
+//     tokens DOUBLE NOT NULL,
+//     updated_at BIGINT NOT NULL,
+//     PRIMARY KEY (bucket_key),
+//     KEY updated_at (updated_at)
+// );
+
+// CREATE TABLE IF NOT EXISTS quota_usage (
+//     owner VARCHAR(255) NOT NULL,
+//     quota VARCHAR(32) NOT NULL,
+//     period VARCHAR(10) NOT NULL,
+//     count INT NOT NULL,
+//     PRIMARY KEY (owner, quota, period),
+//     KEY quota_period (quota, period)
+// );
+
+// CREATE TABLE IF NOT EXISTS api_keys (
+//     id VARCHAR(36) NOT NULL,
+//     name VARCHAR(255) NOT NULL,
+//     prefix VARCHAR(16) NOT NULL,
+//     key_hash CHAR(64) NOT NULL,
+//     scopes VARCHAR(255) NOT NULL,
+//     session_token VARCHAR(255) NOT NULL,
+//     date_created VARCHAR(20) NOT NULL,
+//     last_used VARCHAR(20),
+//     revoked_at VARCHAR(20),
+//     PRIMARY KEY (id),
+//     UNIQUE KEY key_hash (key_hash),
+//     KEY session_token_date_created (session_token, date_created)
+// );
+
+// ALTER TABLE urls ADD COLUMN user_id VARCHAR(36) NOT NULL DEFAULT '';
+// CREATE INDEX user_id_date_created ON urls (user_id, date_created, id);
+// ALTER TABLE api_keys ADD COLUMN user_id VARCHAR(36) NOT NULL DEFAULT '';
+
+// CREATE TABLE IF NOT EXISTS users (
+//     id VARCHAR(36) NOT NULL,
+//     email VARCHAR(255) NOT NULL,
+//     password_hash VARCHAR(60) NOT NULL,
+//     date_created VARCHAR(20) NOT NULL,
+//     PRIMARY KEY (id),
+//     UNIQUE KEY email (email)
+// );
+
+// CREATE TABLE IF NOT EXISTS user_sessions (
+//     token_hash CHAR(64) NOT NULL,
+//     user_id VARCHAR(36) NOT NULL,
+//     date_created VARCHAR(20) NOT NULL,
+//     expires_at VARCHAR(20) NOT NULL,
+//     PRIMARY KEY (token_hash),
+//     KEY user_id (user_id),
+//     KEY expires_at (expires_at)
+// );
+
+// CREATE TABLE IF NOT EXISTS password_reset_tokens (
+//     token_hash CHAR(64) NOT NULL,
+//     user_id VARCHAR(36) NOT NULL,
+//     date_created VARCHAR(20) NOT NULL,
+//     expires_at VARCHAR(20) NOT NULL,
+//     PRIMARY KEY (token_hash),
+//     KEY expires_at (expires_at)
+// );
+
+// CREATE TABLE IF NOT EXISTS user_identities (
+//     issuer VARCHAR(255) NOT NULL,
+//     subject VARCHAR(255) NOT NULL,
+//     user_id VARCHAR(36) NOT NULL,
+//     email VARCHAR(255) NOT NULL,
+//     date_created VARCHAR(20) NOT NULL,
+//     PRIMARY KEY (issuer, subject),
+//     KEY user_id (user_id)
+// );
+
+// ALTER TABLE urls ADD COLUMN workspace_id VARCHAR(36) NOT NULL DEFAULT '';
+// CREATE INDEX workspace_id_date_created ON urls (workspace_id, date_created, id);
+
+// CREATE TABLE IF NOT EXISTS workspaces (
+//     id VARCHAR(36) NOT NULL,
+//     name VARCHAR(255) NOT NULL,
+//     date_created VARCHAR(20) NOT NULL,
 //     PRIMARY KEY (id)
 // );
+
+// CREATE TABLE IF NOT EXISTS workspace_members (
+//     workspace_id VARCHAR(36) NOT NULL,
+//     user_id VARCHAR(36) NOT NULL,
+//     role VARCHAR(16) NOT NULL,
+//     date_created VARCHAR(20) NOT NULL,
+//     PRIMARY KEY (workspace_id, user_id),
+//     KEY user_id (user_id)
+// );
+
+// CREATE TABLE IF NOT EXISTS claim_codes (
+//     code_hash CHAR(64) NOT NULL,
+//     session_token VARCHAR(255) NOT NULL,
+//     date_created VARCHAR(20) NOT NULL,
+//     expires_at VARCHAR(20) NOT NULL,
+//     PRIMARY KEY (code_hash),
+//     KEY expires_at (expires_at)
+// );
@@ -0,0 +1,247 @@
+package utils
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/exp/slices"
+)
+
+// fakeDatabase records what the fake database/sql driver is sent. Statements whose first argument is in
+// failures return that error instead.
+type fakeDatabase struct {
+	mutex      sync.Mutex
+	failures   map[string]error
+	inserted   []string
+	committed  bool
+	rolledBack bool
+}
+
+var fakeDatabases = struct {
+	sync.Mutex
+	byName map[string]*fakeDatabase
+}{byName: map[string]*fakeDatabase{}}
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+// openFakeDatabase returns a *sql.DB backed by a new fakeDatabase.
+func openFakeDatabase(t *testing.T, failures map[string]error) (*sql.DB, *fakeDatabase) {
+	t.Helper()
+	database := &fakeDatabase{failures: failures}
+	fakeDatabases.Lock()
+	fakeDatabases.byName[t.Name()] = database
+	fakeDatabases.Unlock()
+	db, err := sql.Open("fake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, database
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDatabases.Lock()
+	defer fakeDatabases.Unlock()
+	return &fakeConn{database: fakeDatabases.byName[name]}, nil
+}
+
+type fakeConn struct {
+	database *fakeDatabase
+	pending  []string
+}
+
+func (conn *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{conn: conn}, nil
+}
+
+func (conn *fakeConn) Close() error { return nil }
+
+func (conn *fakeConn) Begin() (driver.Tx, error) {
+	conn.pending = nil
+	return conn, nil
+}
+
+func (conn *fakeConn) Commit() error {
+	conn.database.mutex.Lock()
+	defer conn.database.mutex.Unlock()
+	conn.database.inserted = append(conn.database.inserted, conn.pending...)
+	conn.database.committed = true
+	return nil
+}
+
+func (conn *fakeConn) Rollback() error {
+	conn.database.mutex.Lock()
+	defer conn.database.mutex.Unlock()
+	conn.database.rolledBack = true
+	return nil
+}
+
+type fakeStmt struct {
+	conn *fakeConn
+}
+
+func (stmt fakeStmt) Close() error  { return nil }
+func (stmt fakeStmt) NumInput() int { return -1 }
+
+func (stmt fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	id, _ := args[0].(string)
+	if err := stmt.conn.database.failures[id]; err != nil {
+		return nil, err
+	}
+	stmt.conn.pending = append(stmt.conn.pending, id)
+	return driver.RowsAffected(1), nil
+}
+
+func (stmt fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("fake: queries are not supported")
+}
+
+func TestCreateUrls(t *testing.T) {
+	duplicate := &mysql.MySQLError{Number: mysqlErrDuplicateEntry, Message: "Duplicate entry 'taken' for key 'PRIMARY'"}
+	tests := []struct {
+		name           string
+		ids            []string
+		failures       map[string]error
+		wantItemErrors []error
+		wantErr        error
+		wantInserted   []string
+	}{
+		{name: "all created", ids: []string{"a", "b"}, wantItemErrors: []error{nil, nil}, wantInserted: []string{"a", "b"}},
+		{name: "taken alias", ids: []string{"a", "taken", "b"}, failures: map[string]error{"taken": duplicate}, wantItemErrors: []error{nil, ErrIDConflict, nil}, wantInserted: []string{"a", "b"}},
+		{name: "alias repeated in the batch", ids: []string{"a", "a"}, wantItemErrors: []error{nil, ErrIDConflict}, wantInserted: []string{"a"}},
+		{name: "database failure rolls back", ids: []string{"a", "b"}, failures: map[string]error{"b": errors.New("connection lost")}, wantErr: ErrDatabaseUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, database := openFakeDatabase(t, test.failures)
+			newUrls := []NewUrl{}
+			for _, id := range test.ids {
+				newUrls = append(newUrls, NewUrl{ID: id, Destination: "https://example.com/" + id})
+			}
+
+			urls, itemErrors, err := createUrls(db, newUrls)
+			if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+				t.Fatalf("createUrls() error = %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr != nil {
+				if database.committed || !database.rolledBack || len(database.inserted) != 0 {
+					t.Errorf("committed = %v, rolled back = %v, inserted = %v, want a rollback", database.committed, database.rolledBack, database.inserted)
+				}
+				return
+			}
+			if !database.committed {
+				t.Error("the transaction was not committed")
+			}
+			for i, want := range test.wantItemErrors {
+				if !errors.Is(itemErrors[i], want) || (want == nil && itemErrors[i] != nil) {
+					t.Errorf("item %d error = %v, want %v", i, itemErrors[i], want)
+				}
+				if want == nil && urls[i].ID != test.ids[i] {
+					t.Errorf("item %d = %+v, want ID %s", i, urls[i], test.ids[i])
+				}
+			}
+			if len(database.inserted) != len(test.wantInserted) {
+				t.Fatalf("inserted %v, want %v", database.inserted, test.wantInserted)
+			}
+			for i, id := range test.wantInserted {
+				if database.inserted[i] != id {
+					t.Errorf("inserted %v, want %v", database.inserted, test.wantInserted)
+				}
+			}
+		})
+	}
+}
+
+func TestUrlListCursorRoundTrip(t *testing.T) {
+	urlData := URLData{ID: "abc", DateCreated: "2024-05-01T12:00:00Z", PageHits: 42}
+	tests := []struct {
+		sort string
+		want urlListCursor
+	}{
+		{sort: URL_SORT_CREATED_DESC, want: urlListCursor{Sort: URL_SORT_CREATED_DESC, DateCreated: urlData.DateCreated, ID: "abc"}},
+		{sort: URL_SORT_CREATED_ASC, want: urlListCursor{Sort: URL_SORT_CREATED_ASC, DateCreated: urlData.DateCreated, ID: "abc"}},
+		{sort: URL_SORT_HITS_DESC, want: urlListCursor{Sort: URL_SORT_HITS_DESC, PageHits: 42, ID: "abc"}},
+		{sort: URL_SORT_HITS_ASC, want: urlListCursor{Sort: URL_SORT_HITS_ASC, PageHits: 42, ID: "abc"}},
+	}
+	for _, test := range tests {
+		t.Run(test.sort, func(t *testing.T) {
+			encoded := encodeUrlListCursor(test.sort, urlData)
+			cursor, err := decodeUrlListCursor(encoded, test.sort)
+			if err != nil || cursor != test.want {
+				t.Errorf("decodeUrlListCursor(%q) = %+v, %v, want %+v", encoded, cursor, err, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeUrlListCursorRejectsInvalidCursors(t *testing.T) {
+	tests := map[string]string{
+		"not base64":   "!!!",
+		"not json":     base64.RawURLEncoding.EncodeToString([]byte("abc")),
+		"other sort":   encodeUrlListCursor(URL_SORT_HITS_ASC, URLData{ID: "abc"}),
+		"no id":        base64.RawURLEncoding.EncodeToString([]byte(`{"s":"created_desc","d":"2024-05-01T12:00:00Z"}`)),
+		"padded":       base64.URLEncoding.EncodeToString([]byte(`{"s":"created_desc","i":"a"}`)),
+		"empty object": base64.RawURLEncoding.EncodeToString([]byte(`{}`)),
+	}
+	for name, encoded := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := decodeUrlListCursor(encoded, URL_SORT_CREATED_DESC); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("decodeUrlListCursor(%q) error = %v, want %v", encoded, err, ErrInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestListUrlsRejectsInvalidCursors(t *testing.T) {
+	// The cursor is checked before the query, so no database is needed
+	options := UrlListOptions{Sort: URL_SORT_HITS_DESC, Limit: DEFAULT_LIST_LIMIT, Cursor: encodeUrlListCursor(URL_SORT_CREATED_DESC, URLData{ID: "abc"})}
+	if _, _, err := ListUrls(options); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("ListUrls() error = %v, want %v", err, ErrInvalidCursor)
+	}
+}
+
+func TestSearchUrlsQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		owner       Owner
+		workspaceID string
+		query       string
+		wantScope   string
+		wantArgs    []any
+	}{
+		{name: "session", owner: Owner{SessionToken: "session-a"}, query: "docs", wantScope: "session_token = ? AND workspace_id = ''", wantArgs: []any{"session-a", `"docs"`, "%docs%", `"docs"`}},
+		{name: "user", owner: Owner{SessionToken: "session-a", UserID: "user-a"}, query: "docs", wantScope: "user_id = ? AND workspace_id = ''", wantArgs: []any{"user-a", `"docs"`, "%docs%", `"docs"`}},
+		{name: "workspace", owner: Owner{UserID: "user-a"}, workspaceID: "workspace-a", query: "docs", wantScope: "workspace_id = ? AND (", wantArgs: []any{"workspace-a", `"docs"`, "%docs%", `"docs"`}},
+		{name: "every owner", query: "docs", wantScope: "WHERE (MATCH", wantArgs: []any{`"docs"`, "%docs%", `"docs"`}},
+		{name: "quotes and wildcards", owner: Owner{SessionToken: "session-a"}, query: `50%_off "sale"\`, wantScope: "session_token = ?", wantArgs: []any{"session-a", `"50%_off  sale \"`, `%50\%\_off "sale"\\%`, `"50%_off  sale \"`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sqlQuery, args := searchUrlsQuery(test.owner.SessionToken, test.owner.UserID, test.workspaceID, test.query, 20)
+			if !strings.Contains(sqlQuery, test.wantScope) || !strings.HasSuffix(sqlQuery, "LIMIT 20") {
+				t.Errorf("query = %s, want it scoped by %q and limited to 20", sqlQuery, test.wantScope)
+			}
+			if !slices.Equal(args, test.wantArgs) {
+				t.Errorf("args = %q, want %q", args, test.wantArgs)
+			}
+		})
+	}
+}
+
+func TestTagsRoundTrip(t *testing.T) {
+	for _, tags := range [][]string{{}, {"a"}, {"news", "2024 q1"}} {
+		if got := splitTags(joinTags(tags)); !slices.Equal(got, tags) {
+			t.Errorf("splitTags(joinTags(%q)) = %q", tags, got)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IP_ANONYMIZATION_TRUNCATE keeps the network part of the address (/24 for IPv4, /48 for IPv6),
+// IP_ANONYMIZATION_HASH stores a salted hash where the salt rotates every day,
+// IP_ANONYMIZATION_NONE does not store the address at all.
+const (
+	IP_ANONYMIZATION_TRUNCATE = "truncate"
+	IP_ANONYMIZATION_HASH     = "hash"
+	IP_ANONYMIZATION_NONE     = "none"
+)
+
+const (
+	VISIT_RETENTION_ROLLUP = "rollup"
+	VISIT_RETENTION_DELETE = "delete"
+)
+
+const DEFAULT_VISIT_RETENTION_DAYS = 30
+
+// VISITOR_IP_HEADER carries the visitor IP when the redirect page, which is rendered server-side, reports a visit.
+const VISITOR_IP_HEADER = "X-Visitor-Ip"
+
+type VisitData struct {
+	UrlID       string `json:"url_id"`
+	DateCreated string `json:"date_created"`
+	IPAddress   string `json:"ip_address"`
+	UserAgent   string `json:"user_agent"`
+	Referrer    string `json:"referrer"`
+}
+
+func GetIpAnonymizationMode() string {
+	switch mode := GoDotEnvVariable("NOLONGR_IP_ANONYMIZATION"); mode {
+	case IP_ANONYMIZATION_HASH, IP_ANONYMIZATION_NONE:
+		return mode
+	default:
+		return IP_ANONYMIZATION_TRUNCATE
+	}
+}
+
+func GetVisitRetentionDays() int {
+	days, err := strconv.Atoi(GoDotEnvVariable("NOLONGR_VISIT_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		return DEFAULT_VISIT_RETENTION_DAYS
+	}
+	return days
+}
+
+func GetVisitRetentionMode() string {
+	if GoDotEnvVariable("NOLONGR_VISIT_RETENTION_MODE") == VISIT_RETENTION_DELETE {
+		return VISIT_RETENTION_DELETE
+	}
+	return VISIT_RETENTION_ROLLUP
+}
+
+// isTrackingOptedOut honors the Do-Not-Track and Global Privacy Control request headers.
+func isTrackingOptedOut(header http.Header) bool {
+	return header.Get("DNT") == "1" || header.Get("Sec-GPC") == "1"
+}
+
+func truncateIP(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+var ipSaltCache = struct {
+	sync.Mutex
+	day  string
+	salt []byte
+}{}
+
+func getDailyIpSalt(day string) ([]byte, error) {
+	ipSaltCache.Lock()
+	defer ipSaltCache.Unlock()
+
+	if ipSaltCache.day == day {
+		return ipSaltCache.salt, nil
+	}
+	salt, err := GetOrCreateIpSalt(day)
+	if err != nil {
+		return nil, err
+	}
+	ipSaltCache.day = day
+	ipSaltCache.salt = salt
+	return salt, nil
+}
+
+func AnonymizeIP(rawIP string) string {
+	ip := net.ParseIP(strings.TrimSpace(rawIP))
+	if ip == nil {
+		return ""
+	}
+
+	switch GetIpAnonymizationMode() {
+	case IP_ANONYMIZATION_NONE:
+		return ""
+	case IP_ANONYMIZATION_HASH:
+		salt, err := getDailyIpSalt(time.Now().UTC().Format(time.DateOnly))
+		if err != nil {
+			log.Println("(AnonymizeIP) falling back to truncation:", err)
+			return truncateIP(ip)
+		}
+		mac := hmac.New(sha256.New, salt)
+		mac.Write(ip)
+		return hex.EncodeToString(mac.Sum(nil))[:32]
+	default:
+		return truncateIP(ip)
+	}
+}
+
+// stripReferrer drops the query string and fragment, which commonly carry personal data.
+func stripReferrer(referrer string) string {
+	parsedReferrer, err := url.Parse(referrer)
+	if err != nil || parsedReferrer.Host == "" {
+		return ""
+	}
+	return parsedReferrer.Scheme + "://" + parsedReferrer.Host + parsedReferrer.Path
+}
+
+// truncateString cuts value to at most length bytes without splitting a UTF-8 character.
+func truncateString(value string, length int) string {
+	if len(value) <= length {
+		return value
+	}
+	for length > 0 && !utf8.RuneStart(value[length]) {
+		length--
+	}
+	return value[:length]
+}
+
+// requestVisitorIP returns the visitor IP forwarded in X-Visitor-Ip by an API key with the pageviews scope, and the
+// client IP otherwise, so that other callers cannot choose the IP recorded for a visit.
+func requestVisitorIP(context *gin.Context) string {
+	owner, _ := resolveOwner(context)
+	if visitorIP := context.GetHeader(VISITOR_IP_HEADER); visitorIP != "" && owner.ApiKeyID != "" && owner.can(API_KEY_SCOPE_PAGEVIEWS) {
+		return visitorIP
+	}
+	return context.ClientIP()
+}
+
+// newVisitFromHeaders returns nil when the visitor has opted out of tracking. visitorIP comes from
+// requestVisitorIP or grpcVisitorIP.
+func newVisitFromHeaders(header http.Header, visitorIP string, urlId string) *VisitData {
+	if isTrackingOptedOut(header) {
+		return nil
+	}
+
+	return &VisitData{
+		UrlID:       urlId,
+		DateCreated: time.Now().UTC().Format(time.RFC3339),
+		IPAddress:   AnonymizeIP(visitorIP),
+		UserAgent:   truncateString(header.Get("User-Agent"), 512),
+		Referrer:    truncateString(stripReferrer(header.Get("Referer")), 2048),
+	}
+}
+
+// PurgeExpiredVisits removes visit records older than the retention window,
+// rolling them up into daily per-link counts unless the retention mode is "delete".
+func PurgeExpiredVisits() (int64, error) {
+	cutoff := time.Now().UTC().AddDate(0, 0, -GetVisitRetentionDays())
+
+	count, err := DeleteVisitsBefore(cutoff.Format(time.RFC3339), GetVisitRetentionMode() == VISIT_RETENTION_ROLLUP)
+	if err != nil {
+		return count, err
+	}
+
+	// Salts are only needed for the current day; dropping older ones makes past hashes unlinkable.
+	err = DeleteIpSaltsBefore(time.Now().UTC().Format(time.DateOnly))
+	return count, err
+}
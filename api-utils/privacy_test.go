@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateString(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		length int
+		want   string
+	}{
+		{name: "shorter", value: "abc", length: 5, want: "abc"},
+		{name: "exact", value: "abcde", length: 5, want: "abcde"},
+		{name: "ascii", value: "abcdef", length: 3, want: "abc"},
+		{name: "before multibyte", value: "ab€", length: 2, want: "ab"},
+		{name: "inside multibyte", value: "ab€", length: 3, want: "ab"},
+		{name: "inside multibyte end", value: "ab€cd", length: 4, want: "ab"},
+		{name: "after multibyte", value: "ab€cd", length: 5, want: "ab€"},
+		{name: "zero", value: "€", length: 0, want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := truncateString(test.value, test.length)
+			if got != test.want {
+				t.Errorf("truncateString(%q, %d) = %q, want %q", test.value, test.length, got, test.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncateString(%q, %d) = %q is not valid UTF-8", test.value, test.length, got)
+			}
+		})
+	}
+}
+
+func TestStripReferrer(t *testing.T) {
+	tests := map[string]string{
+		"https://example.com/page?email=a@b.c#top": "https://example.com/page",
+		"https://example.com":                      "https://example.com",
+		"not a url":                                "",
+		"":                                         "",
+	}
+	for referrer, want := range tests {
+		if got := stripReferrer(referrer); got != want {
+			t.Errorf("stripReferrer(%q) = %q, want %q", referrer, got, want)
+		}
+	}
+}
+
+func TestNewVisitFromHeadersHonorsOptOut(t *testing.T) {
+	t.Setenv("NOLONGR_IP_ANONYMIZATION", IP_ANONYMIZATION_TRUNCATE)
+	for _, header := range []string{"DNT", "Sec-GPC"} {
+		headers := http.Header{}
+		headers.Set(header, "1")
+		if visit := newVisitFromHeaders(headers, "203.0.113.7", "abc"); visit != nil {
+			t.Errorf("%s: 1 recorded a visit", header)
+		}
+	}
+
+	visit := newVisitFromHeaders(http.Header{}, "203.0.113.7", "abc")
+	if visit == nil || visit.IPAddress != "203.0.113.0" {
+		t.Fatalf("visit = %+v, want the truncated IP 203.0.113.0", visit)
+	}
+}
+
+func TestRequestVisitorIP(t *testing.T) {
+	t.Setenv("NOLONGR_SERVER_API_KEY", "test-server-key")
+	tests := []struct {
+		name          string
+		authorization string
+		want          string
+	}{
+		{name: "anonymous caller", want: "192.0.2.1"},
+		{name: "invalid key", authorization: "Bearer wrong-key", want: "192.0.2.1"},
+		{name: "key with pageviews scope", authorization: "Bearer test-server-key", want: "198.51.100.9"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/urls/abc/resolve", nil)
+			request.RemoteAddr = "192.0.2.1:1234"
+			request.Header.Set(VISITOR_IP_HEADER, "198.51.100.9")
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			if got := requestVisitorIP(newTestContext(request)); got != test.want {
+				t.Errorf("requestVisitorIP() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
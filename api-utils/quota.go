@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Quotas limit what one owner may use. Each limit is read from NOLONGR_QUOTA_<NAME>; 0 means unlimited.
+const (
+	QUOTA_ACTIVE_LINKS      = "active_links"
+	QUOTA_DAILY_CREATIONS   = "daily_creations"
+	QUOTA_MONTHLY_REDIRECTS = "monthly_redirects"
+)
+
+var defaultQuotas = map[string]int64{
+	QUOTA_ACTIVE_LINKS:      100,
+	QUOTA_DAILY_CREATIONS:   50,
+	QUOTA_MONTHLY_REDIRECTS: 10000,
+}
+
+func GetQuota(name string) int64 {
+	value := GoDotEnvVariable("NOLONGR_QUOTA_" + strings.ToUpper(name))
+	if value == "" {
+		return defaultQuotas[name]
+	}
+	quota, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || quota < 0 {
+		log.Printf("(GetQuota) invalid NOLONGR_QUOTA_%s %q, using %d", strings.ToUpper(name), value, defaultQuotas[name])
+		return defaultQuotas[name]
+	}
+	return quota
+}
+
+// QuotaOwner is who usage is counted against: a user, a session, or the client IP for requests without either.
+// Requests with an admin key are not limited; other keys count against their user or session. Creating links
+// requires a session or key, so that every limited link has an owner to count its active links and redirects.
+type QuotaOwner struct {
+	Key          string
+	SessionToken string
+	UserID       string
+	Unlimited    bool
+}
+
+func quotaOwnerFromRequest(context *gin.Context) QuotaOwner {
+	owner, _ := resolveOwner(context)
+	return quotaOwnerOf(owner, context.ClientIP())
+}
+
+func quotaOwnerOf(owner Owner, clientIP string) QuotaOwner {
+	if owner.IsAdmin {
+		return QuotaOwner{Unlimited: true}
+	} else if owner.UserID != "" {
+		return QuotaOwner{Key: "user:" + owner.UserID, UserID: owner.UserID}
+	} else if owner.SessionToken != "" {
+		return QuotaOwner{Key: "session:" + owner.SessionToken, SessionToken: owner.SessionToken}
+	}
+	return QuotaOwner{Key: "ip:" + clientIP}
+}
+
+// quotaOwnerOfUrl is the owner whose redirects a page view of the link counts against.
+func quotaOwnerOfUrl(urlData URLData) QuotaOwner {
+	if urlData.UserID != "" {
+		return QuotaOwner{Key: "user:" + urlData.UserID, UserID: urlData.UserID}
+	} else if urlData.SessionToken == "" {
+		return QuotaOwner{Unlimited: true}
+	}
+	return QuotaOwner{Key: "session:" + urlData.SessionToken, SessionToken: urlData.SessionToken}
+}
+
+// quotaPeriod returns the usage period containing now for a counted quota, and when the next one starts.
+func quotaPeriod(name string, now time.Time) (string, time.Time) {
+	now = now.UTC()
+	if name == QUOTA_MONTHLY_REDIRECTS {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01"), start.AddDate(0, 1, 0)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start.Format(time.DateOnly), start.AddDate(0, 0, 1)
+}
+
+// QuotaUsage is the usage of one quota. Limit is 0 when unlimited; ResetsAt is empty for active links.
+type QuotaUsage struct {
+	Used     int64  `json:"used"`
+	Limit    int64  `json:"limit"`
+	ResetsAt string `json:"resets_at,omitempty"`
+}
+
+func getQuotaUsage(owner QuotaOwner, name string) (QuotaUsage, error) {
+	usage := QuotaUsage{Limit: GetQuota(name)}
+	if owner.Unlimited {
+		usage.Limit = 0
+	}
+
+	var err error
+	if name == QUOTA_ACTIVE_LINKS {
+		if owner.SessionToken != "" || owner.UserID != "" {
+			usage.Used, err = CountActiveUrls(owner.SessionToken, owner.UserID)
+		}
+		return usage, err
+	}
+	period, resetsAt := quotaPeriod(name, time.Now())
+	usage.ResetsAt = resetsAt.Format(time.RFC3339)
+	if owner.Key != "" {
+		usage.Used, err = GetQuotaUsageCount(owner.Key, name, period)
+	}
+	return usage, err
+}
+
+func quotaExceededError(name string, limit int64, resetsAt string) error {
+	detail := fmt.Sprintf("%s is limited to %d", name, limit)
+	if resetsAt != "" {
+		detail += ", resets at " + resetsAt
+	}
+	return fmt.Errorf("%w: %s", ErrQuotaExceeded, detail)
+}
+
+// checkQuota returns ErrQuotaExceeded when adding count would exceed the owner's quota. It is only used for active
+// links, which are counted rather than recorded; daily and monthly quotas are taken with reserveQuota.
+func checkQuota(owner QuotaOwner, name string, count int64) error {
+	if owner.Unlimited || GetQuota(name) == 0 {
+		return nil
+	}
+	usage, err := getQuotaUsage(owner, name)
+	if err != nil {
+		return err
+	}
+	if usage.Used+count > usage.Limit {
+		return quotaExceededError(name, usage.Limit, usage.ResetsAt)
+	}
+	return nil
+}
+
+// reserveQuota counts usage of a daily or monthly quota before the action, returning ErrQuotaExceeded instead when
+// it would exceed the owner's quota. The check and the count are one statement, so concurrent requests cannot
+// both take the last of a quota. Usage of an unlimited quota is still counted, for GET /quota.
+func reserveQuota(owner QuotaOwner, name string, count int64) error {
+	if owner.Unlimited || owner.Key == "" || count <= 0 {
+		return nil
+	}
+	period, resetsAt := quotaPeriod(name, time.Now())
+	limit := GetQuota(name)
+	if limit == 0 {
+		return AddQuotaUsageCount(owner.Key, name, period, count)
+	}
+	reserved, err := ReserveQuotaUsageCount(owner.Key, name, period, count, limit)
+	if err != nil {
+		return err
+	} else if !reserved {
+		return quotaExceededError(name, limit, resetsAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// releaseQuota gives back usage reserved for an action that did not happen. Failures are logged, as the action
+// already failed.
+func releaseQuota(owner QuotaOwner, name string, count int64) {
+	if owner.Unlimited || owner.Key == "" || count <= 0 {
+		return
+	}
+	period, _ := quotaPeriod(name, time.Now())
+	if err := AddQuotaUsageCount(owner.Key, name, period, -count); err != nil {
+		log.Println("(releaseQuota) error:", err)
+	}
+}
+
+// reserveCreationQuotas checks the active link quota and reserves the daily creation quota before creating count
+// links. The links that end up not being created are given back with releaseQuota.
+func reserveCreationQuotas(owner QuotaOwner, count int64) error {
+	if err := checkQuota(owner, QUOTA_ACTIVE_LINKS, count); err != nil {
+		return err
+	}
+	return reserveQuota(owner, QUOTA_DAILY_CREATIONS, count)
+}
+
+// QuotaStatus is the result of GET /api/quota.
+type QuotaStatus struct {
+	ActiveLinks      QuotaUsage `json:"active_links"`
+	DailyCreations   QuotaUsage `json:"daily_creations"`
+	MonthlyRedirects QuotaUsage `json:"monthly_redirects"`
+}
+
+// PurgeExpiredQuotaUsage deletes the usage of past days and months.
+func PurgeExpiredQuotaUsage() error {
+	for _, name := range []string{QUOTA_DAILY_CREATIONS, QUOTA_MONTHLY_REDIRECTS} {
+		period, _ := quotaPeriod(name, time.Now())
+		if err := DeleteQuotaUsageBefore(name, period); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetQuota(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  int64
+	}{
+		{name: "default", value: "", want: defaultQuotas[QUOTA_DAILY_CREATIONS]},
+		{name: "configured", value: "7", want: 7},
+		{name: "unlimited", value: "0", want: 0},
+		{name: "negative", value: "-1", want: defaultQuotas[QUOTA_DAILY_CREATIONS]},
+		{name: "not a number", value: "many", want: defaultQuotas[QUOTA_DAILY_CREATIONS]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("NOLONGR_QUOTA_DAILY_CREATIONS", test.value)
+			if got := GetQuota(QUOTA_DAILY_CREATIONS); got != test.want {
+				t.Errorf("GetQuota() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQuotaPeriod(t *testing.T) {
+	now := time.Date(2024, 12, 31, 23, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		wantPeriod string
+		wantResets time.Time
+	}{
+		{name: QUOTA_DAILY_CREATIONS, wantPeriod: "2024-12-31", wantResets: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: QUOTA_MONTHLY_REDIRECTS, wantPeriod: "2024-12", wantResets: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		period, resetsAt := quotaPeriod(test.name, now)
+		if period != test.wantPeriod || !resetsAt.Equal(test.wantResets) {
+			t.Errorf("quotaPeriod(%s) = %s, %s, want %s, %s", test.name, period, resetsAt, test.wantPeriod, test.wantResets)
+		}
+	}
+}
+
+func TestQuotaOwnerOf(t *testing.T) {
+	tests := []struct {
+		name  string
+		owner Owner
+		want  QuotaOwner
+	}{
+		{name: "admin", owner: Owner{IsAdmin: true, UserID: "user-1"}, want: QuotaOwner{Unlimited: true}},
+		{name: "user", owner: Owner{UserID: "user-1", SessionToken: "session-1"}, want: QuotaOwner{Key: "user:user-1", UserID: "user-1"}},
+		{name: "session", owner: Owner{SessionToken: "session-1"}, want: QuotaOwner{Key: "session:session-1", SessionToken: "session-1"}},
+		{name: "anonymous", owner: Owner{}, want: QuotaOwner{Key: "ip:192.0.2.1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := quotaOwnerOf(test.owner, "192.0.2.1"); got != test.want {
+				t.Errorf("quotaOwnerOf() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQuotaOwnerOfUrl(t *testing.T) {
+	if got := quotaOwnerOfUrl(URLData{}); !got.Unlimited {
+		t.Errorf("a link without owner counts against %+v, want unlimited", got)
+	}
+	if got := quotaOwnerOfUrl(URLData{UserID: "user-1", SessionToken: "session-1"}); got.Key != "user:user-1" {
+		t.Errorf("a user's link counts against %q, want user:user-1", got.Key)
+	}
+}
+
+func TestReserveQuotaSkipsUnlimitedOwners(t *testing.T) {
+	// Unlimited owners never reach the database, which is not available here
+	if err := reserveQuota(QuotaOwner{Unlimited: true}, QUOTA_DAILY_CREATIONS, 5); err != nil {
+		t.Errorf("reserveQuota() = %v, want nil", err)
+	}
+	if err := reserveCreationQuotas(QuotaOwner{Unlimited: true}, 5); err != nil {
+		t.Errorf("reserveCreationQuotas() = %v, want nil", err)
+	}
+}
+
+func TestQuotaExceededError(t *testing.T) {
+	err := quotaExceededError(QUOTA_DAILY_CREATIONS, 50, "2025-01-01T00:00:00Z")
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("quotaExceededError() = %v, want ErrQuotaExceeded", err)
+	}
+	if status, code := storageErrorStatus(err); status != 429 || code != ERROR_CODE_QUOTA_EXCEEDED {
+		t.Errorf("storageErrorStatus() = %d, %s, want 429, %s", status, code, ERROR_CODE_QUOTA_EXCEEDED)
+	}
+}
+
+func TestCreateShortUrlNeedsOwner(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{name: "single", path: "/api/v1/urls", body: `{"destination":"https://example.com"}`},
+		{name: "batch", path: "/api/v1/urls/batch", body: `{"urls":[{"destination":"https://example.com"}]}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := performRequest(newTestRouter(), http.MethodPost, test.path, test.body, nil, nil)
+			if response.Code != http.StatusUnauthorized || !strings.Contains(response.Body.String(), ERROR_CODE_UNAUTHORIZED) {
+				t.Errorf("response = %d %s, want %d %s", response.Code, response.Body.String(), http.StatusUnauthorized, ERROR_CODE_UNAUTHORIZED)
+			}
+		})
+	}
+}
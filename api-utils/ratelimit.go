@@ -0,0 +1,298 @@
+package utils
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rate limited operations. Each has its own buckets and its limit is read from NOLONGR_RATE_LIMIT_<SCOPE>.
+const (
+	RATE_LIMIT_SCOPE_CREATE   = "create"
+	RATE_LIMIT_SCOPE_PASSWORD = "password"
+	RATE_LIMIT_SCOPE_LOOKUP   = "lookup"
+)
+
+var defaultRateLimits = map[string]string{
+	RATE_LIMIT_SCOPE_CREATE:   "30/m",
+	RATE_LIMIT_SCOPE_PASSWORD: "10/m",
+	RATE_LIMIT_SCOPE_LOOKUP:   "300/m",
+}
+
+const (
+	RATE_LIMIT_STORE_MEMORY   = "memory"
+	RATE_LIMIT_STORE_DATABASE = "database"
+)
+
+// RateLimit is a token bucket holding up to Burst tokens and refilled with Rate tokens per second.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// RateLimitStore keeps the token buckets. Take removes a token from the bucket of every key when each of them has
+// one. Otherwise it takes none, so that a request refused by one bucket does not drain the others, and returns
+// false and the time until all of them have a token.
+type RateLimitStore interface {
+	Take(keys []string, limit RateLimit) (bool, time.Duration, error)
+}
+
+// parseRateLimit reads "N/unit", e.g. "30/m": bursts of N requests, refilled at N per second, minute, hour or day.
+// "off" and "0" disable the limit.
+func parseRateLimit(value string) (RateLimit, bool) {
+	value = strings.TrimSpace(value)
+	if value == "off" || value == "0" {
+		return RateLimit{}, false
+	}
+	count, unit, found := strings.Cut(value, "/")
+	requests, err := strconv.ParseFloat(count, 64)
+	if !found || err != nil || requests <= 0 {
+		return RateLimit{}, false
+	}
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}
+	period, ok := periods[unit]
+	if !ok {
+		return RateLimit{}, false
+	}
+	return RateLimit{Rate: requests / period.Seconds(), Burst: requests}, true
+}
+
+// GetRateLimit returns the limit of a scope; ok is false when the scope is not limited.
+func GetRateLimit(scope string) (RateLimit, bool) {
+	value := GoDotEnvVariable("NOLONGR_RATE_LIMIT_" + strings.ToUpper(scope))
+	if value == "" {
+		value = defaultRateLimits[scope]
+	}
+	limit, ok := parseRateLimit(value)
+	if !ok && value != "off" && value != "0" {
+		log.Printf("(GetRateLimit) invalid NOLONGR_RATE_LIMIT_%s %q, using %s", strings.ToUpper(scope), value, defaultRateLimits[scope])
+		return parseRateLimit(defaultRateLimits[scope])
+	}
+	return limit, ok
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// refill adds the tokens earned since updatedAt.
+func (bucket *tokenBucket) refill(limit RateLimit, now time.Time) {
+	elapsed := now.Sub(bucket.updatedAt).Seconds()
+	bucket.tokens = math.Min(limit.Burst, bucket.tokens+math.Max(elapsed, 0)*limit.Rate)
+	bucket.updatedAt = now
+}
+
+// wait returns the time until the bucket has a token, 0 when it has one.
+func (bucket *tokenBucket) wait(limit RateLimit) time.Duration {
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+}
+
+// take adds the tokens earned since updatedAt and takes one if available.
+func (bucket *tokenBucket) take(limit RateLimit, now time.Time) (bool, time.Duration) {
+	return takeFromBuckets([]*tokenBucket{bucket}, limit, now)
+}
+
+// takeFromBuckets refills the buckets and takes a token from each of them, or from none when one of them is empty.
+func takeFromBuckets(buckets []*tokenBucket, limit RateLimit, now time.Time) (bool, time.Duration) {
+	var retryAfter time.Duration
+	for _, bucket := range buckets {
+		bucket.refill(limit, now)
+		if wait := bucket.wait(limit); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true, 0
+}
+
+const maxMemoryBuckets = 100000
+
+type memoryBucket struct {
+	key    string
+	bucket tokenBucket
+}
+
+// MemoryRateLimitStore keeps buckets in the process, so each server instance limits on its own. Once it holds
+// maxBuckets buckets, the least recently used one is forgotten for each new one.
+type MemoryRateLimitStore struct {
+	mutex      sync.Mutex
+	maxBuckets int
+	buckets    map[string]*list.Element
+	// recent holds the *memoryBucket values, from the most to the least recently used
+	recent *list.List
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{maxBuckets: maxMemoryBuckets, buckets: map[string]*list.Element{}, recent: list.New()}
+}
+
+func (store *MemoryRateLimitStore) Take(keys []string, limit RateLimit) (bool, time.Duration, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	buckets := make([]*tokenBucket, 0, len(keys))
+	for _, key := range keys {
+		buckets = append(buckets, store.bucket(key, limit, now))
+	}
+	allowed, retryAfter := takeFromBuckets(buckets, limit, now)
+	return allowed, retryAfter, nil
+}
+
+// bucket returns the bucket of key, adding a full one when it is missing, and marks it as the most recently used.
+func (store *MemoryRateLimitStore) bucket(key string, limit RateLimit, now time.Time) *tokenBucket {
+	if element, ok := store.buckets[key]; ok {
+		store.recent.MoveToFront(element)
+		return &element.Value.(*memoryBucket).bucket
+	}
+
+	if len(store.buckets) >= store.maxBuckets {
+		store.pruneIdle(now)
+	}
+	for len(store.buckets) >= store.maxBuckets {
+		store.remove(store.recent.Back())
+	}
+	element := store.recent.PushFront(&memoryBucket{key: key, bucket: tokenBucket{tokens: limit.Burst, updatedAt: now}})
+	store.buckets[key] = element
+	return &element.Value.(*memoryBucket).bucket
+}
+
+func (store *MemoryRateLimitStore) remove(element *list.Element) {
+	store.recent.Remove(element)
+	delete(store.buckets, element.Value.(*memoryBucket).key)
+}
+
+// pruneIdle forgets buckets unused for an hour, which are full again for limits per second, minute or hour.
+func (store *MemoryRateLimitStore) pruneIdle(now time.Time) {
+	for element := store.recent.Back(); element != nil && now.Sub(element.Value.(*memoryBucket).bucket.updatedAt) > time.Hour; element = store.recent.Back() {
+		store.remove(element)
+	}
+}
+
+// DatabaseRateLimitStore keeps buckets in the rate_limit_buckets table, shared by every server instance.
+type DatabaseRateLimitStore struct{}
+
+func (store DatabaseRateLimitStore) Take(keys []string, limit RateLimit) (bool, time.Duration, error) {
+	return TakeRateLimitTokens(keys, limit, time.Now())
+}
+
+var rateLimitStore struct {
+	sync.Mutex
+	store RateLimitStore
+}
+
+// SetRateLimitStore replaces the store chosen by NOLONGR_RATE_LIMIT_STORE, e.g. with a Redis implementation.
+func SetRateLimitStore(store RateLimitStore) {
+	rateLimitStore.Lock()
+	defer rateLimitStore.Unlock()
+	rateLimitStore.store = store
+}
+
+func getRateLimitStore() RateLimitStore {
+	rateLimitStore.Lock()
+	defer rateLimitStore.Unlock()
+	if rateLimitStore.store == nil {
+		if GoDotEnvVariable("NOLONGR_RATE_LIMIT_STORE") == RATE_LIMIT_STORE_DATABASE {
+			rateLimitStore.store = DatabaseRateLimitStore{}
+		} else {
+			rateLimitStore.store = NewMemoryRateLimitStore()
+		}
+	}
+	return rateLimitStore.store
+}
+
+func hashRateLimitIdentity(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:8])
+}
+
+// rateLimitIdentities returns the buckets a request counts against. A request with an API key counts against the
+// key, or against the visitor when a key with the pageviews scope forwards the visitor IP in X-Visitor-Ip. Other
+// requests count against the client IP and, when they have them, the session and the logged in user.
+func rateLimitIdentities(context *gin.Context) []string {
+	owner, _ := resolveOwner(context)
+	if owner.ApiKeyID != "" {
+		if visitorIP := context.GetHeader(VISITOR_IP_HEADER); visitorIP != "" && owner.can(API_KEY_SCOPE_PAGEVIEWS) {
+			return []string{"ip:" + visitorIP}
+		}
+		return []string{"key:" + owner.ApiKeyID}
+	}
+
+	identities := []string{"ip:" + context.ClientIP()}
+	if owner.SessionToken != "" {
+		identities = append(identities, "session:"+hashRateLimitIdentity(owner.SessionToken))
+	}
+	if owner.UserID != "" {
+		identities = append(identities, "user:"+owner.UserID)
+	}
+	return identities
+}
+
+// takeRateLimitTokens takes a token for each identity, or none when one of them has run out. Storage errors let
+// the request through.
+func takeRateLimitTokens(scope string, identities []string) (bool, time.Duration) {
+	limit, ok := GetRateLimit(scope)
+	if !ok {
+		return true, 0
+	}
+	keys := make([]string, 0, len(identities))
+	for _, identity := range identities {
+		keys = append(keys, scope+":"+identity)
+	}
+	allowed, retryAfter, err := getRateLimitStore().Take(keys, limit)
+	if err != nil {
+		log.Println("(takeRateLimitTokens) error:", err)
+		return true, 0
+	}
+	return allowed, retryAfter
+}
+
+// allowRequest takes a token of scope for the request, or responds with 429 and returns false.
+func allowRequest(context *gin.Context, scope string) bool {
+	allowed, retryAfter := takeRateLimitTokens(scope, rateLimitIdentities(context))
+	if allowed {
+		return true
+	}
+
+	retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+	if retryAfterSeconds < 1 {
+		retryAfterSeconds = 1
+	}
+	context.Header("Retry-After", strconv.Itoa(retryAfterSeconds))
+	RespondWithError(context, http.StatusTooManyRequests, ErrorResponse{
+		Message: "Too many requests, retry in " + strconv.Itoa(retryAfterSeconds) + " seconds",
+		Code:    ERROR_CODE_RATE_LIMITED,
+		Id:      context.Param("id"),
+	})
+	return false
+}
+
+func rateLimitMiddleware(scope string) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if allowRequest(context, scope) {
+			context.Next()
+		}
+	}
+}
+
+func PurgeIdleRateLimitBuckets() error {
+	return DeleteRateLimitBucketsBefore(time.Now().Add(-24 * time.Hour))
+}
@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   RateLimit
+		wantOk bool
+	}{
+		{value: "30/m", want: RateLimit{Rate: 0.5, Burst: 30}, wantOk: true},
+		{value: " 10/s ", want: RateLimit{Rate: 10, Burst: 10}, wantOk: true},
+		{value: "3600/h", want: RateLimit{Rate: 1, Burst: 3600}, wantOk: true},
+		{value: "off"},
+		{value: "0"},
+		{value: "30"},
+		{value: "30/w"},
+		{value: "-1/m"},
+		{value: "many/m"},
+	}
+	for _, test := range tests {
+		limit, ok := parseRateLimit(test.value)
+		if ok != test.wantOk || limit != test.want {
+			t.Errorf("parseRateLimit(%q) = %+v, %v, want %+v, %v", test.value, limit, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestGetRateLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   RateLimit
+		wantOk bool
+	}{
+		{name: "default", want: RateLimit{Rate: 10.0 / 60, Burst: 10}, wantOk: true},
+		{name: "configured", value: "5/s", want: RateLimit{Rate: 5, Burst: 5}, wantOk: true},
+		{name: "disabled", value: "off"},
+		{name: "invalid", value: "lots", want: RateLimit{Rate: 10.0 / 60, Burst: 10}, wantOk: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("NOLONGR_RATE_LIMIT_PASSWORD", test.value)
+			limit, ok := GetRateLimit(RATE_LIMIT_SCOPE_PASSWORD)
+			if ok != test.wantOk || limit != test.want {
+				t.Errorf("GetRateLimit() = %+v, %v, want %+v, %v", limit, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestTokenBucketTake(t *testing.T) {
+	limit := RateLimit{Rate: 1, Burst: 2}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	bucket := &tokenBucket{tokens: limit.Burst, updatedAt: start}
+	steps := []struct {
+		at             time.Duration
+		wantAllowed    bool
+		wantRetryAfter time.Duration
+	}{
+		{at: 0, wantAllowed: true},
+		{at: 0, wantAllowed: true},
+		{at: 0, wantAllowed: false, wantRetryAfter: time.Second},
+		{at: 500 * time.Millisecond, wantAllowed: false, wantRetryAfter: 500 * time.Millisecond},
+		{at: time.Second, wantAllowed: true},
+		{at: time.Hour, wantAllowed: true},
+		{at: time.Hour, wantAllowed: true},
+		{at: time.Hour, wantAllowed: false, wantRetryAfter: time.Second},
+		// A clock going back earns no tokens
+		{at: 0, wantAllowed: false, wantRetryAfter: time.Second},
+	}
+	for i, step := range steps {
+		allowed, retryAfter := bucket.take(limit, start.Add(step.at))
+		if allowed != step.wantAllowed || retryAfter != step.wantRetryAfter {
+			t.Errorf("step %d: take() = %v, %v, want %v, %v", i, allowed, retryAfter, step.wantAllowed, step.wantRetryAfter)
+		}
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Rate: 1.0 / 60, Burst: 2}
+	store.bucket("idle", limit, time.Now().Add(-2*time.Hour))
+	for i, want := range []bool{true, true, false} {
+		allowed, retryAfter, err := store.Take([]string{"password:ip:192.0.2.1"}, limit)
+		if err != nil || allowed != want {
+			t.Fatalf("take %d = %v, %v, want %v", i, allowed, err, want)
+		}
+		if !allowed && (retryAfter <= 0 || retryAfter > time.Minute) {
+			t.Errorf("retry after %v, want at most a minute", retryAfter)
+		}
+	}
+	if allowed, _, _ := store.Take([]string{"password:ip:192.0.2.2"}, limit); !allowed {
+		t.Error("another key shares the bucket")
+	}
+
+	store.pruneIdle(time.Now())
+	if _, ok := store.buckets["idle"]; ok {
+		t.Error("pruneIdle() kept an idle bucket")
+	}
+	if _, ok := store.buckets["password:ip:192.0.2.1"]; !ok {
+		t.Error("pruneIdle() removed a bucket in use")
+	}
+}
+
+func TestMemoryRateLimitStoreTakesFromAllBucketsOrNone(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Rate: 1.0 / 60, Burst: 2}
+	steps := []struct {
+		keys []string
+		want bool
+	}{
+		{keys: []string{"ip:192.0.2.1"}, want: true},
+		{keys: []string{"ip:192.0.2.1", "session:a"}, want: true},
+		// The IP is out of tokens, so the session keeps its last one
+		{keys: []string{"ip:192.0.2.1", "session:a"}, want: false},
+		{keys: []string{"ip:192.0.2.2", "session:a"}, want: true},
+		{keys: []string{"ip:192.0.2.2", "session:a"}, want: false},
+	}
+	for i, step := range steps {
+		if allowed, _, err := store.Take(step.keys, limit); err != nil || allowed != step.want {
+			t.Errorf("step %d: Take(%v) = %v, %v, want %v", i, step.keys, allowed, err, step.want)
+		}
+	}
+}
+
+func TestMemoryRateLimitStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	store.maxBuckets = 2
+	limit := RateLimit{Rate: 1.0 / 60, Burst: 1}
+	for _, key := range []string{"a", "b", "a", "c"} {
+		store.Take([]string{key}, limit)
+	}
+	if len(store.buckets) != 2 || store.recent.Len() != 2 {
+		t.Fatalf("the store holds %d buckets, want 2", len(store.buckets))
+	}
+	if _, ok := store.buckets["b"]; ok {
+		t.Error("the least recently used bucket was kept")
+	}
+	// "a" is still empty: evicting it would have refilled it
+	if allowed, _, _ := store.Take([]string{"a"}, limit); allowed {
+		t.Error("a recently used bucket was evicted")
+	}
+}
+
+func TestRateLimitIdentities(t *testing.T) {
+	t.Setenv("NOLONGR_SERVER_API_KEY", "test-server-key")
+	sessionCookie := newSessionCookie(t, "session-a")
+	tests := []struct {
+		name    string
+		cookies []*http.Cookie
+		header  map[string]string
+		want    []string
+	}{
+		{name: "anonymous", want: []string{"ip:192.0.2.1"}},
+		{name: "session", cookies: []*http.Cookie{sessionCookie}, want: []string{"ip:192.0.2.1", "session:" + hashRateLimitIdentity("session-a")}},
+		{name: "API key", header: map[string]string{"Authorization": "Bearer test-server-key"}, want: []string{"key:" + LEGACY_API_KEY_ID}},
+		{name: "API key forwarding a visitor", header: map[string]string{"Authorization": "Bearer test-server-key", VISITOR_IP_HEADER: "198.51.100.7"}, want: []string{"ip:198.51.100.7"}},
+		{name: "visitor without an API key", header: map[string]string{VISITOR_IP_HEADER: "198.51.100.7"}, want: []string{"ip:192.0.2.1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.RemoteAddr = "192.0.2.1:1234"
+			for _, cookie := range test.cookies {
+				request.AddCookie(cookie)
+			}
+			for key, value := range test.header {
+				request.Header.Set(key, value)
+			}
+			if got := rateLimitIdentities(newTestContext(request)); !slices.Equal(got, test.want) {
+				t.Errorf("rateLimitIdentities() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	t.Setenv("NOLONGR_RATE_LIMIT_LOOKUP", "2/m")
+	SetRateLimitStore(NewMemoryRateLimitStore())
+	router := gin.New()
+	router.Use(sessions.Sessions(SESSION_TOKEN_KEY, newSessionStore()))
+	router.GET("/", rateLimitMiddleware(RATE_LIMIT_SCOPE_LOOKUP), func(context *gin.Context) {
+		context.Status(http.StatusNoContent)
+	})
+
+	for i, want := range []int{http.StatusNoContent, http.StatusNoContent, http.StatusTooManyRequests} {
+		response := performRequest(router, http.MethodGet, "/", "", nil, nil)
+		if response.Code != want {
+			t.Fatalf("request %d = %d, want %d", i, response.Code, want)
+		}
+		if want == http.StatusTooManyRequests && response.Header().Get("Retry-After") == "" {
+			t.Error("the 429 response has no Retry-After")
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Machine-readable error codes returned in ErrorResponse.Code
+const (
+	ERROR_CODE_BAD_REQUEST                 = "bad_request"
+	ERROR_CODE_VALIDATION_FAILED           = "validation_failed"
+	ERROR_CODE_FORBIDDEN_DOMAIN            = "forbidden_domain"
+	ERROR_CODE_UNAUTHORIZED                = "unauthorized"
+	ERROR_CODE_FORBIDDEN                   = "forbidden"
+	ERROR_CODE_NOT_FOUND                   = "not_found"
+	ERROR_CODE_EXPIRED                     = "expired"
+	ERROR_CODE_MAX_HITS_REACHED            = "max_hits_reached"
+	ERROR_CODE_PAUSED                      = "paused"
+	ERROR_CODE_WRONG_PASSWORD              = "wrong_password"
+	ERROR_CODE_ID_CONFLICT                 = "id_conflict"
+	ERROR_CODE_IDEMPOTENCY_KEY_REUSED      = "idempotency_key_reused"
+	ERROR_CODE_IDEMPOTENCY_KEY_IN_PROGRESS = "idempotency_key_in_progress"
+	ERROR_CODE_RATE_LIMITED                = "rate_limited"
+	ERROR_CODE_QUOTA_EXCEEDED              = "quota_exceeded"
+	ERROR_CODE_EMAIL_TAKEN                 = "email_taken"
+	ERROR_CODE_INVALID_CREDENTIALS         = "invalid_credentials"
+	ERROR_CODE_INVALID_TOKEN               = "invalid_token"
+	ERROR_CODE_SSO_FAILED                  = "sso_failed"
+	ERROR_CODE_SSO_PROVIDER_UNAVAILABLE    = "sso_provider_unavailable"
+	ERROR_CODE_IDENTITY_LINKED             = "identity_linked"
+	ERROR_CODE_LAST_WORKSPACE_OWNER        = "last_workspace_owner"
+	ERROR_CODE_CSRF_FAILED                 = "csrf_failed"
+	ERROR_CODE_NO_ROUTE                    = "no_route"
+	ERROR_CODE_INTERNAL                    = "internal_error"
+	ERROR_CODE_DATABASE_UNAVAILABLE        = "database_unavailable"
+)
+
+type ErrorResponse struct {
+	Message   string `json:"message"`
+	Error     string `json:"error"`
+	ErrorCode int    `json:"errorCode"`
+	Code      string `json:"code"`
+	Id        string `json:"id"`
+	// Fields lists the rejected request fields when Code is validation_failed
+	Fields FieldErrors `json:"fields,omitempty"`
+}
+
+// RespondWithResult writes the success envelope: {"result": ...}
+func RespondWithResult(context *gin.Context, status int, result interface{}) {
+	context.JSON(status, map[string]interface{}{"result": result})
+}
+
+// RespondWithPage writes the success envelope of a paginated listing: {"result": [...], "next_cursor": "..."}
+// next_cursor is empty on the last page.
+func RespondWithPage(context *gin.Context, result interface{}, nextCursor string) {
+	context.JSON(http.StatusOK, map[string]interface{}{"result": result, "next_cursor": nextCursor})
+}
+
+// RespondWithError writes the error envelope: {"error": ErrorResponse} and aborts the handler chain.
+// ErrorCode always mirrors the HTTP status that is sent.
+func RespondWithError(context *gin.Context, status int, errorResponse ErrorResponse) {
+	errorResponse.ErrorCode = status
+	context.AbortWithStatusJSON(status, map[string]ErrorResponse{"error": errorResponse})
+}
+
+// newStorageErrorResponse builds the ErrorResponse for an error returned by the storage layer,
+// choosing the status and code from the error's type.
+func newStorageErrorResponse(err error, message string, id string) (int, ErrorResponse) {
+	status, code := storageErrorStatus(err)
+	return status, ErrorResponse{
+		Message:   message,
+		Error:     err.Error(),
+		ErrorCode: status,
+		Code:      code,
+		Id:        id,
+	}
+}
+
+// RespondWithStorageError writes the error envelope for an error returned by the storage layer.
+func RespondWithStorageError(context *gin.Context, err error, message string, id string) {
+	status, errorResponse := newStorageErrorResponse(err, message, id)
+	RespondWithError(context, status, errorResponse)
+}
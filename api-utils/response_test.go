@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRespondWithError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	context, _ := gin.CreateTestContext(recorder)
+	RespondWithError(context, http.StatusGone, ErrorResponse{Message: "This URL has expired", Code: ERROR_CODE_EXPIRED, ErrorCode: http.StatusNotFound, Id: "abc"})
+
+	if recorder.Code != http.StatusGone || !context.IsAborted() {
+		t.Errorf("status = %d, aborted = %v, want %d and aborted", recorder.Code, context.IsAborted(), http.StatusGone)
+	}
+	var envelope struct {
+		Result interface{}   `json:"result"`
+		Error  ErrorResponse `json:"error"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	want := ErrorResponse{Message: "This URL has expired", Code: ERROR_CODE_EXPIRED, ErrorCode: http.StatusGone, Id: "abc"}
+	if envelope.Result != nil || envelope.Error.Message != want.Message || envelope.Error.Code != want.Code || envelope.Error.ErrorCode != want.ErrorCode || envelope.Error.Id != want.Id {
+		t.Errorf("body = %s, want the error %+v", recorder.Body.String(), want)
+	}
+}
+
+func TestRespondWithResult(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	context, _ := gin.CreateTestContext(recorder)
+	RespondWithResult(context, http.StatusCreated, map[string]string{"id": "abc"})
+
+	if got, want := recorder.Body.String(), `{"result":{"id":"abc"}}`; recorder.Code != http.StatusCreated || got != want {
+		t.Errorf("response = %d %s, want %d %s", recorder.Code, got, http.StatusCreated, want)
+	}
+}
+
+func TestApiRoutesAreVersioned(t *testing.T) {
+	router := newTestRouter()
+	for _, path := range []string{"/api/v1/get-cookie", "/api/get-cookie"} {
+		response := performRequest(router, http.MethodGet, path, "", nil, nil)
+		var envelope struct {
+			Error ErrorResponse `json:"error"`
+		}
+		if err := json.Unmarshal(response.Body.Bytes(), &envelope); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if response.Code != http.StatusBadRequest || envelope.Error.Code != ERROR_CODE_BAD_REQUEST || envelope.Error.ErrorCode != http.StatusBadRequest {
+			t.Errorf("%s = %d %s, want %d %s", path, response.Code, response.Body.String(), http.StatusBadRequest, ERROR_CODE_BAD_REQUEST)
+		}
+	}
+}
@@ -1,77 +1,112 @@
 package utils
 
 import (
-	"encoding/json"
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"net/url"
-	"regexp"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/segmentio/ksuid"
 	"golang.org/x/exp/slices"
 )
 
-type ErrorResponse struct {
-	Message   string `json:"message"`
-	Error     string `json:"error"`
-	ErrorCode int    `json:"errorCode"`
-	Id        string `json:"id"`
-}
-
 func setCookieHandler(context *gin.Context) {
-	session := sessions.Default(context)
-	key := "session_token"
-	sessionToken := session.Get(key)
-	if sessionToken == nil {
+	key := SESSION_TOKEN_KEY
+	sessionToken := requestSessionToken(context)
+	if sessionToken == "" {
 		sessionToken = ksuid.New().String()
 	}
-	session.Set(key, sessionToken)
-	session.Save()
+	if err := setRequestSessionToken(context, sessionToken); err != nil {
+		log.Println("(setCookieHandler) error:", err)
+	}
 	result := map[string]interface{}{"key": key, "value": sessionToken}
-	context.JSON(http.StatusOK, map[string]interface{}{"result": result})
+	RespondWithResult(context, http.StatusOK, result)
 }
 
 func getCookieHandler(context *gin.Context) {
-	cookie, err := context.Cookie("session_token")
-	if err != nil {
-		switch {
-		case errors.Is(err, http.ErrNoCookie):
-			context.JSON(http.StatusBadRequest, "Cookie not found")
-		default:
-			context.JSON(http.StatusInternalServerError, "Server error")
-		}
+	sessionToken := requestSessionToken(context)
+	if sessionToken == "" {
+		RespondWithError(context, http.StatusBadRequest, ErrorResponse{
+			Message: "Cookie not found",
+			Error:   http.ErrNoCookie.Error(),
+			Code:    ERROR_CODE_BAD_REQUEST,
+		})
 		return
 	}
-	context.JSON(http.StatusOK, cookie)
+	RespondWithResult(context, http.StatusOK, sessionToken)
 }
 
 func RegisterRouter(router *gin.RouterGroup) {
-	store := cookie.NewStore([]byte("secret"))
+	store := newSessionStore()
 	store.Options(sessions.Options{MaxAge: 60 * 60 * 1440, Path: "/", HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode}) // expire in 2 months
-	router.Use(sessions.Sessions("session_token", store))
+	router.Use(sessions.Sessions(SESSION_TOKEN_KEY, store))
+
+	registerApiRoutes(router.Group("/api/v1"))
+	// Unversioned routes are kept for existing clients and behave like /api/v1
+	registerApiRoutes(router.Group("/api"))
+}
 
+func registerApiRoutes(router *gin.RouterGroup) {
+	router.Use(csrfMiddleware())
 	//USER
-	router.GET("/api/urls/:id", handleRouteFindURLById)
-	router.GET("/api/user-session-urls", handleRouteGetAllUrlsBasedOnSessionToken)
-	router.POST("/api/urls", handleRouteCreateShortUrl)
-	router.DELETE("/api/delete-url", handleRouteDeleteId)
+	router.GET("/urls/:id", rateLimitMiddleware(RATE_LIMIT_SCOPE_LOOKUP), handleRouteFindURLById)
+	router.GET("/user-session-urls", handleRouteGetAllUrlsBasedOnSessionToken)
+	router.GET("/user-session-urls/search", handleRouteSearchUrls)
+	router.POST("/urls", rateLimitMiddleware(RATE_LIMIT_SCOPE_CREATE), idempotencyMiddleware(), handleRouteCreateShortUrl)
+	router.POST("/urls/batch", rateLimitMiddleware(RATE_LIMIT_SCOPE_CREATE), idempotencyMiddleware(), handleRouteBatchCreateShortUrls)
+	router.POST("/urls/batch/delete", handleRouteBulkDeleteUrls)
+	router.PATCH("/urls/batch", handleRouteBulkUpdateUrls)
+	router.PATCH("/urls/:id", handleRouteUpdateShortUrl)
+	router.POST("/urls/:id/resolve", rateLimitMiddleware(RATE_LIMIT_SCOPE_LOOKUP), handleRouteResolveUrl)
+	router.GET("/urls/:id/stats", handleRouteGetUrlStats)
+	router.DELETE("/delete-url", handleRouteDeleteId)
 	//OTHERS
-	router.GET("/api/set-cookie", setCookieHandler)
-	router.GET("/api/get-cookie", getCookieHandler)
-	router.GET("/api/urls/page-views/:id", handleRouteIncrementPageView)
+	router.GET("/quota", handleRouteGetQuota)
+	router.POST("/api-keys", handleRouteCreateApiKey)
+	router.GET("/api-keys", handleRouteGetApiKeys)
+	router.DELETE("/api-keys/:id", handleRouteRevokeApiKey)
+	router.POST("/claim-codes", handleRouteIssueClaimCode)
+	router.POST("/claim-codes/redeem", rateLimitMiddleware(RATE_LIMIT_SCOPE_PASSWORD), handleRouteRedeemClaimCode)
+	router.POST("/workspaces", handleRouteCreateWorkspace)
+	router.GET("/workspaces", handleRouteGetWorkspaces)
+	router.GET("/workspaces/:id/members", handleRouteGetWorkspaceMembers)
+	router.PUT("/workspaces/:id/members", handleRouteSetWorkspaceMember)
+	router.DELETE("/workspaces/:id/members/:user_id", handleRouteRemoveWorkspaceMember)
+	//AUTH
+	router.POST("/auth/register", rateLimitMiddleware(RATE_LIMIT_SCOPE_PASSWORD), handleRouteRegister)
+	router.POST("/auth/login", rateLimitMiddleware(RATE_LIMIT_SCOPE_PASSWORD), handleRouteLogin)
+	router.POST("/auth/logout", handleRouteLogout)
+	router.GET("/auth/me", handleRouteGetCurrentUser)
+	router.POST("/auth/password-reset", rateLimitMiddleware(RATE_LIMIT_SCOPE_PASSWORD), handleRouteRequestPasswordReset)
+	router.POST("/auth/password-reset/confirm", rateLimitMiddleware(RATE_LIMIT_SCOPE_PASSWORD), handleRouteConfirmPasswordReset)
+	router.GET("/auth/oidc/login", handleRouteStartOidcLogin)
+	router.GET("/auth/oidc/callback", rateLimitMiddleware(RATE_LIMIT_SCOPE_PASSWORD), handleRouteOidcCallback)
+	router.GET("/auth/identities", handleRouteGetUserIdentities)
+	router.GET("/set-cookie", setCookieHandler)
+	router.GET("/get-cookie", getCookieHandler)
+	router.GET("/csrf-token", handleRouteGetCsrfToken)
+	router.GET("/urls/page-views/:id", rateLimitMiddleware(RATE_LIMIT_SCOPE_LOOKUP), handleRouteIncrementPageView)
 	//ADMIN
-	router.GET("/api/urls", handleRouteGetAllUrls)
-	router.GET("/api/expired-urls", handleRouteGetAllExpiredUrls)
-	router.GET("/api/new-short-id", handleRouteGetNewShortId)
-	//CRON
-	router.DELETE("/api/delete-expired-ids", handleRouteDeleteExpiredIds)
+	admin := router.Group("", adminMiddleware(false))
+	admin.GET("/urls", handleRouteGetAllUrls)
+	admin.GET("/expired-urls", handleRouteGetAllExpiredUrls)
+	admin.GET("/new-short-id", handleRouteGetNewShortId)
+	//CRON, also served on GET, which is what Vercel cron jobs send
+	cron := router.Group("", adminMiddleware(true))
+	cronMethods := []string{http.MethodGet, http.MethodDelete}
+	cron.Match(cronMethods, "/delete-expired-ids", handleRouteDeleteExpiredIds)
+	cron.Match(cronMethods, "/delete-expired-visits", handleRouteDeleteExpiredVisits)
+	cron.Match(cronMethods, "/delete-expired-idempotency-keys", handleRouteDeleteExpiredIdempotencyKeys)
+	cron.Match(cronMethods, "/delete-idle-rate-limit-buckets", handleRouteDeleteIdleRateLimitBuckets)
+	cron.Match(cronMethods, "/delete-expired-quota-usage", handleRouteDeleteExpiredQuotaUsage)
+	cron.Match(cronMethods, "/delete-expired-user-tokens", handleRouteDeleteExpiredUserTokens)
+	cron.Match(cronMethods, "/delete-expired-claim-codes", handleRouteDeleteExpiredClaimCodes)
 }
 
 func RegisterCors(router *gin.Engine) {
@@ -82,9 +117,9 @@ func RegisterCors(router *gin.Engine) {
 
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     allowOrigins,
-		AllowMethods:     []string{"GET", "POST"},
-		AllowHeaders:     []string{"Origin"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", IDEMPOTENCY_KEY_HEADER, CSRF_HEADER},
+		ExposeHeaders:    []string{"Content-Length", "Retry-After"},
 		AllowCredentials: true,
 		AllowOriginFunc: func(origin string) bool {
 			if GetEnvironment() == "development" {
@@ -104,8 +139,13 @@ func handleRouteGetNewShortId(context *gin.Context) {
 	id := context.Query("id")
 
 	newID := id
-	doesUrlIdExist := checkIfUrlIdExists(newID)
+	exists, err := checkIfUrlIdExists(id)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to check if the ID exists", id)
+		return
+	}
 
+	doesUrlIdExist := exists
 	for doesUrlIdExist {
 		newID = randomSequence(6)
 		doesUrlIdExist = newID == id
@@ -114,188 +154,1222 @@ func handleRouteGetNewShortId(context *gin.Context) {
 	urlData := map[string]interface{}{
 		"id":     id,
 		"new_id": newID,
-		"exists": checkIfUrlIdExists(id),
+		"exists": exists,
 	}
-	context.JSON(http.StatusOK, urlData)
-}
-
-type CreateShortUrlRequestBody struct {
-	Destination  string `json:"destination"`
-	MaxPageHits  string `json:"max_page_hits"`
-	Password     string `json:"password"`
-	SelfDestruct string `json:"self_destruct"`
-	URL          string `json:"url"`
+	RespondWithResult(context, http.StatusOK, urlData)
 }
 
 func handleRouteFindURLById(context *gin.Context) {
 	id := context.Param("id")
 	urlData, err := GetSingleUrlUnexpired(id)
 	if err != nil {
-		errorMessage := ErrorResponse{
-			Message:   "This URL is invalid or a destination URL could not be found",
-			Error:     err.Error(),
-			ErrorCode: http.StatusNotFound,
-			Id:        id,
-		}
-		context.JSON(http.StatusNotFound, map[string]ErrorResponse{"error": errorMessage})
-	} else {
-		context.JSON(http.StatusOK, map[string]URLData{"result": urlData})
+		RespondWithStorageError(context, err, "This URL is invalid or a destination URL could not be found", id)
+		return
 	}
+	// The destination of a link with a password is kept for those who may view the link
+	if owner, _ := resolveOwner(context); owner.canView(urlData) {
+		RespondWithResult(context, http.StatusOK, resolvedUrlData(urlData))
+		return
+	}
+	RespondWithResult(context, http.StatusOK, publicUrlData(urlData))
 }
 
 func handleRouteCreateShortUrl(context *gin.Context) {
-	destination := context.Query("destination")
-	maxPageHitsString := (context.Query("max_page_hits"))
-	maxPageHits, _ := strconv.ParseInt(maxPageHitsString, 10, 64)
+	body, deprecated, fieldErrors := bindCreateShortUrlRequest(context)
+	if deprecated {
+		context.Header("Deprecation", "true")
+		context.Header("Warning", `299 - "Query parameters on POST /api/urls are deprecated, send a JSON or form body instead"`)
+	}
+
+	validateCreateShortUrlRequest(body, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	if isForbiddenDestination(body.Destination) {
+		RespondWithError(context, http.StatusForbidden, ErrorResponse{
+			Message: "URLs pointing to this site cannot be shortened",
+			Code:    ERROR_CODE_FORBIDDEN_DOMAIN,
+		})
+		return
+	}
+
+	// Anonymous links would have no owner to count their active links and redirects against
+	owner, ok := requireScope(context, API_KEY_SCOPE_LINKS_WRITE, "A session or API key is required to create URLs")
+	if !ok {
+		return
+	}
+	if body.WorkspaceID != "" && !owner.hasWorkspaceRole(body.WorkspaceID, WORKSPACE_ROLE_EDITOR) {
+		RespondWithError(context, http.StatusForbidden, workspaceForbiddenError(body.WorkspaceID))
+		return
+	}
 
-	creds := &CreateShortUrlRequestBody{}
-	err := json.NewDecoder(context.Request.Body).Decode(creds)
+	quotaOwner := quotaOwnerFromRequest(context)
+	if err := reserveCreationQuotas(quotaOwner, 1); err != nil {
+		RespondWithStorageError(context, err, "You cannot create more short URLs", "")
+		return
+	}
+
+	newUrl, err := newUrlFromRequest(body, "", owner.SessionToken, owner.UserID)
+	if err != nil {
+		releaseQuota(quotaOwner, QUOTA_DAILY_CREATIONS, 1)
+		RespondWithError(context, http.StatusInternalServerError, ErrorResponse{
+			Message: "Failed to hash the password",
+			Error:   err.Error(),
+			Code:    ERROR_CODE_INTERNAL,
+		})
+		return
+	}
+
+	urlData, err := CreateNewUrl(newUrl)
 	if err != nil {
-		log.Print("(handleRouteCreateShortUrl) decode error:", err)
+		releaseQuota(quotaOwner, QUOTA_DAILY_CREATIONS, 1)
+		RespondWithStorageError(context, err, "Failed to create short URL", "")
+		log.Println(err)
+	} else {
+		RespondWithResult(context, http.StatusOK, urlData)
+	}
+}
+
+// BatchItemResult is the outcome of one item of a batch request, at the same index as in the request.
+type BatchItemResult struct {
+	Index  int            `json:"index"`
+	Result *URLData       `json:"result,omitempty"`
+	Error  *ErrorResponse `json:"error,omitempty"`
+}
+
+func handleRouteBatchCreateShortUrls(context *gin.Context) {
+	body := BatchCreateShortUrlRequestBody{}
+	fieldErrors := FieldErrors{}
+	decodeJSONBody(context.Request, &body, fieldErrors)
+	validateBatchCreateShortUrlRequest(body, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	owner, ok := requireScope(context, API_KEY_SCOPE_LINKS_WRITE, "A session or API key is required to create URLs")
+	if !ok {
+		return
+	}
+
+	results := make([]BatchItemResult, len(body.Urls))
+	newUrls := []NewUrl{}
+	newUrlIndexes := []int{}
+	for i, item := range body.Urls {
+		results[i].Index = i
+
+		itemFieldErrors := FieldErrors{}
+		validateCreateShortUrlRequest(item.CreateShortUrlRequestBody, itemFieldErrors)
+		validateAlias(item.Alias, itemFieldErrors)
+		if len(itemFieldErrors) > 0 {
+			results[i].Error = &ErrorResponse{
+				Message:   "The URL contains invalid fields",
+				ErrorCode: http.StatusBadRequest,
+				Code:      ERROR_CODE_VALIDATION_FAILED,
+				Id:        item.Alias,
+				Fields:    itemFieldErrors,
+			}
+			continue
+		}
+		if isForbiddenDestination(item.Destination) {
+			results[i].Error = &ErrorResponse{
+				Message:   "URLs pointing to this site cannot be shortened",
+				ErrorCode: http.StatusForbidden,
+				Code:      ERROR_CODE_FORBIDDEN_DOMAIN,
+				Id:        item.Alias,
+			}
+			continue
+		}
+		if item.WorkspaceID != "" && !owner.hasWorkspaceRole(item.WorkspaceID, WORKSPACE_ROLE_EDITOR) {
+			errorResponse := workspaceForbiddenError(item.WorkspaceID)
+			errorResponse.ErrorCode = http.StatusForbidden
+			results[i].Error = &errorResponse
+			continue
+		}
+
+		newUrl, err := newUrlFromRequest(item.CreateShortUrlRequestBody, item.Alias, owner.SessionToken, owner.UserID)
+		if err != nil {
+			results[i].Error = &ErrorResponse{
+				Message:   "Failed to hash the password",
+				Error:     err.Error(),
+				ErrorCode: http.StatusInternalServerError,
+				Code:      ERROR_CODE_INTERNAL,
+				Id:        item.Alias,
+			}
+			continue
+		}
+
+		newUrls = append(newUrls, newUrl)
+		newUrlIndexes = append(newUrlIndexes, i)
 	}
 
-	var selfDestructPtr *int64 = nil
-	selfDestruct := selfDestructPtr
+	if len(newUrls) > 0 {
+		quotaOwner := quotaOwnerFromRequest(context)
+		if err := reserveCreationQuotas(quotaOwner, int64(len(newUrls))); err != nil {
+			RespondWithStorageError(context, err, "You cannot create this many short URLs", "")
+			return
+		}
 
-	selfDestructString := context.Query("self_destruct")
-	if selfDestructString != "" {
-		selfDestructResult, _ := strconv.ParseInt(selfDestructString, 10, 64)
-		selfDestruct = &selfDestructResult
+		urls, itemErrors, err := CreateUrls(newUrls)
+		if err != nil {
+			releaseQuota(quotaOwner, QUOTA_DAILY_CREATIONS, int64(len(newUrls)))
+			RespondWithStorageError(context, err, "Failed to create short URLs", "")
+			log.Println("(handleRouteBatchCreateShortUrls) error:", err)
+			return
+		}
+		created := int64(0)
+		for j, i := range newUrlIndexes {
+			if itemErrors[j] != nil {
+				_, errorResponse := newStorageErrorResponse(itemErrors[j], "Failed to create short URL", newUrls[j].ID)
+				results[i].Error = &errorResponse
+			} else {
+				results[i].Result = &urls[j]
+				created++
+			}
+		}
+		releaseQuota(quotaOwner, QUOTA_DAILY_CREATIONS, int64(len(newUrls))-created)
 	}
 
-	var passwordHashPtr *string = nil
-	passwordHash := passwordHashPtr
+	RespondWithResult(context, http.StatusOK, results)
+}
 
-	if creds.Password != "" {
-		passwordHashResult, _ := HashPassword(creds.Password)
-		passwordHash = &passwordHashResult
+// BulkOperationResult lists the IDs a bulk operation was applied to and why it was refused for the others.
+type BulkOperationResult struct {
+	Succeeded []string        `json:"succeeded"`
+	Failed    []ErrorResponse `json:"failed"`
+}
+
+// authorizeBulkIds splits ids into the ones the owner may manage and failures for the rest.
+func authorizeBulkIds(owner Owner, ids []string) ([]string, []ErrorResponse, error) {
+	urls, err := GetUrlsByIds(ids)
+	if err != nil {
+		return nil, nil, err
 	}
+	allowed, failed := splitBulkIds(owner, ids, urls)
+	return allowed, failed, nil
+}
 
-	destinationSiteUrled, _ := url.Parse(destination)
-	productionSiteUrled, err := url.Parse(PRODUCTION_SITE_URL)
-	errorMessageIncorrectUrl := ErrorResponse{
-		Message:   "A URL was not provided or the input was incorrect",
-		ErrorCode: http.StatusForbidden,
+// splitBulkIds is authorizeBulkIds once the links of ids are read. Repeated IDs are only returned once.
+func splitBulkIds(owner Owner, ids []string, urls []URLData) ([]string, []ErrorResponse) {
+	urlsById := map[string]URLData{}
+	for _, urlData := range urls {
+		urlsById[urlData.ID] = urlData
 	}
 
-	sessionToken, err := context.Cookie("session_token")
+	allowed := []string{}
+	failed := []ErrorResponse{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
 
+		urlData, ok := urlsById[id]
+		if !ok {
+			failed = append(failed, ErrorResponse{
+				Message:   "URL not found",
+				ErrorCode: http.StatusNotFound,
+				Code:      ERROR_CODE_NOT_FOUND,
+				Id:        id,
+			})
+		} else if !owner.canManage(urlData) {
+			failed = append(failed, ErrorResponse{
+				Message:   "You do not own this URL",
+				ErrorCode: http.StatusForbidden,
+				Code:      ERROR_CODE_FORBIDDEN,
+				Id:        id,
+			})
+		} else {
+			allowed = append(allowed, id)
+		}
+	}
+
+	return allowed, failed
+}
+
+func respondUnauthorizedOwner(context *gin.Context, message string) {
+	RespondWithError(context, http.StatusUnauthorized, ErrorResponse{
+		Message: message,
+		Code:    ERROR_CODE_UNAUTHORIZED,
+		Id:      context.Param("id"),
+	})
+}
+
+func handleRouteBulkDeleteUrls(context *gin.Context) {
+	owner, ok := requireScope(context, API_KEY_SCOPE_LINKS_WRITE, "A session or API key is required to delete URLs")
+	if !ok {
+		return
+	}
+
+	body := BulkIdsRequestBody{}
+	fieldErrors := FieldErrors{}
+	decodeJSONBody(context.Request, &body, fieldErrors)
+	validateBulkIds(body.Ids, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	allowed, failed, err := authorizeBulkIds(owner, body.Ids)
+	if err == nil {
+		err = DeleteUrlsByIds(allowed)
+	}
 	if err != nil {
-		log.Print("(handleRouteCreateShortUrl):", err)
-	} else if productionSiteUrled.Hostname() == destinationSiteUrled.Hostname() {
-		context.JSON(http.StatusForbidden, map[string]ErrorResponse{"error": errorMessageIncorrectUrl})
+		RespondWithStorageError(context, err, "Failed to delete URLs", "")
+		log.Println("(handleRouteBulkDeleteUrls) error:", err)
 		return
 	}
+	RespondWithResult(context, http.StatusOK, BulkOperationResult{Succeeded: allowed, Failed: failed})
+}
 
-	match, _ := regexp.MatchString("^(http:\\/\\/www\\.|https:\\/\\/www\\.|http:\\/\\/|https:\\/\\/|\\/|\\/\\/)?[A-z0-9_-]*?[:]?[A-z0-9_-]*?[@]?[A-z0-9]+([\\-\\.]{1}[a-z0-9]+)*\\.[a-z]{2,5}(:[0-9]{1,5})?(\\/.*)?$", destination)
+func handleRouteBulkUpdateUrls(context *gin.Context) {
+	owner, ok := requireScope(context, API_KEY_SCOPE_LINKS_WRITE, "A session or API key is required to edit URLs")
+	if !ok {
+		return
+	}
 
-	if !match {
-		context.JSON(http.StatusForbidden, map[string]ErrorResponse{"error": errorMessageIncorrectUrl})
+	body := BulkUpdateRequestBody{}
+	fieldErrors := FieldErrors{}
+	decodeJSONBody(context.Request, &body, fieldErrors)
+	validateBulkUpdateRequest(body, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
 		return
 	}
 
-	urlData, err := CreateUrl(destination, selfDestruct, sessionToken, passwordHash, maxPageHits)
+	update := UrlsUpdate{Paused: body.Paused}
+	if body.SelfDestruct != nil {
+		if *body.SelfDestruct == 0 {
+			update.ClearSelfDestruct = true
+		} else {
+			selfDestruct := time.Now().UTC().Add(time.Second * time.Duration(*body.SelfDestruct)).Format(time.RFC3339)
+			update.SelfDestruct = &selfDestruct
+		}
+	}
 
+	allowed, failed, err := authorizeBulkIds(owner, body.Ids)
+	if err == nil {
+		err = UpdateUrlsByIds(allowed, update)
+	}
 	if err != nil {
-		errorMessage := ErrorResponse{
-			Message:   "Failed to create short URL",
-			Error:     err.Error(),
-			ErrorCode: http.StatusNotFound,
-		}
-		context.JSON(http.StatusNotFound, map[string]ErrorResponse{"error": errorMessage})
-		log.Println(err)
-	} else {
-		context.JSON(http.StatusOK, map[string]URLData{"result": urlData})
+		RespondWithStorageError(context, err, "Failed to edit URLs", "")
+		log.Println("(handleRouteBulkUpdateUrls) error:", err)
+		return
 	}
+	RespondWithResult(context, http.StatusOK, BulkOperationResult{Succeeded: allowed, Failed: failed})
 }
 
-func handleRouteGetAllUrls(context *gin.Context) {
-	apiKey := context.Query("api_key")
+func handleRouteUpdateShortUrl(context *gin.Context) {
+	id := context.Param("id")
 
-	if apiKey != GetApiKey() {
-		errorMessageIncorrectToken := ErrorResponse{
-			Message:   "Incorrect API key was provided",
-			ErrorCode: http.StatusUnauthorized,
-		}
-		context.JSON(http.StatusUnauthorized, map[string]ErrorResponse{"error": errorMessageIncorrectToken})
+	owner, ok := requireScope(context, API_KEY_SCOPE_LINKS_WRITE, "A session or API key is required to edit a URL")
+	if !ok {
+		return
+	}
+
+	body, fieldErrors := bindUpdateShortUrlRequest(context)
+	validateUpdateShortUrlRequest(body, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	if body.Destination != nil && isForbiddenDestination(*body.Destination) {
+		RespondWithError(context, http.StatusForbidden, ErrorResponse{
+			Message: "URLs pointing to this site cannot be shortened",
+			Code:    ERROR_CODE_FORBIDDEN_DOMAIN,
+			Id:      id,
+		})
+		return
+	}
+
+	urlData, err := GetSingleUrl(id)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to find the URL to edit", id)
+		return
+	}
+	if !owner.canManage(urlData) {
+		RespondWithError(context, http.StatusForbidden, ErrorResponse{
+			Message: "You do not own this URL",
+			Code:    ERROR_CODE_FORBIDDEN,
+			Id:      id,
+		})
+		return
+	}
+
+	err = applyUrlUpdate(&urlData, body)
+	if err != nil {
+		RespondWithError(context, http.StatusInternalServerError, ErrorResponse{
+			Message: "Failed to hash the password",
+			Error:   err.Error(),
+			Code:    ERROR_CODE_INTERNAL,
+			Id:      id,
+		})
+		return
+	}
+
+	err = UpdateUrl(urlData, body.ResetPageHits)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to edit the URL", id)
+		log.Println("(handleRouteUpdateShortUrl) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, urlData)
+}
+
+func handleRouteGetAllUrls(context *gin.Context) {
+	options, fieldErrors := bindUrlListOptions(context)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
 		return
 	}
-	urls, err := GetUrls()
+	urls, nextCursor, err := ListUrls(options)
 	if err != nil {
+		RespondWithStorageError(context, err, "Failed to get URLs", "")
 		log.Println("(handleRouteGetAllUrls) error:", err)
+		return
 	}
-	context.JSON(http.StatusOK, map[string][]URLData{"result": urls})
+	RespondWithPage(context, urls, nextCursor)
 }
 
 func handleRouteGetAllUrlsBasedOnSessionToken(context *gin.Context) {
-	sessionToken := context.Query("session_token")
-	urlData, err := GetAllUrlsBasedOnSessionToken(sessionToken)
+	// Logged in users list the links of their account instead, or of one of their workspaces
+	owner, ok := requireScope(context, API_KEY_SCOPE_LINKS_READ, "A session or API key is required to list URLs")
+	if !ok {
+		return
+	}
+	workspaceID := context.Query("workspace_id")
+	options, fieldErrors := bindUrlListOptions(context)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+	if workspaceID != "" && !authorizeWorkspace(context, owner, workspaceID, WORKSPACE_ROLE_VIEWER, API_KEY_SCOPE_LINKS_READ) {
+		return
+	}
+	options.SessionToken, options.UserID, options.WorkspaceID = owner.SessionToken, owner.UserID, workspaceID
+	urlData, nextCursor, err := ListUrls(options)
 	if err != nil {
-		errorMessage := ErrorResponse{
-			Message:   "Cannot find urls based on session token",
-			Error:     err.Error(),
-			ErrorCode: http.StatusNotFound,
-		}
-		context.JSON(http.StatusNotFound, map[string]ErrorResponse{"error": errorMessage})
+		RespondWithStorageError(context, err, "Cannot find urls based on session token", "")
 	} else {
-		context.JSON(http.StatusOK, map[string][]URLData{"result": urlData})
+		RespondWithPage(context, urlData, nextCursor)
 	}
 }
 
+func handleRouteSearchUrls(context *gin.Context) {
+	owner, ok := requireScope(context, API_KEY_SCOPE_LINKS_READ, "A session or API key is required to search URLs")
+	if !ok {
+		return
+	}
+
+	query := strings.TrimSpace(context.Query("q"))
+	fieldErrors := FieldErrors{}
+	if len(query) < MIN_SEARCH_QUERY_LENGTH {
+		fieldErrors["q"] = fmt.Sprintf("must be at least %d characters", MIN_SEARCH_QUERY_LENGTH)
+	}
+	limit := int64(DEFAULT_LIST_LIMIT)
+	if parsedLimit := parseOptionalInt64(context.Query("limit"), "limit", fieldErrors); parsedLimit != nil {
+		if *parsedLimit < 1 || *parsedLimit > MAX_LIST_LIMIT {
+			fieldErrors["limit"] = fmt.Sprintf("must be between 1 and %d", MAX_LIST_LIMIT)
+		}
+		limit = *parsedLimit
+	}
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	workspaceID := context.Query("workspace_id")
+	if workspaceID != "" && !authorizeWorkspace(context, owner, workspaceID, WORKSPACE_ROLE_VIEWER, API_KEY_SCOPE_LINKS_READ) {
+		return
+	}
+	// Admin keys search every link
+	if owner.IsAdmin {
+		owner = Owner{}
+	}
+	urls, err := SearchUrls(owner.SessionToken, owner.UserID, workspaceID, query, int(limit))
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to search URLs", "")
+		log.Println("(handleRouteSearchUrls) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, urls)
+}
+
 func handleRouteGetAllExpiredUrls(context *gin.Context) {
 	urls, err := GetAllExpiredUrls()
 	if err != nil {
+		RespondWithStorageError(context, err, "Failed to get expired URLs", "")
 		log.Println("(handleRouteGetAllExpiredUrls) error:", err)
+		return
 	}
-	context.JSON(http.StatusOK, map[string][]URLData{"result": urls})
+	RespondWithResult(context, http.StatusOK, urls)
 }
 
 func handleRouteDeleteExpiredIds(context *gin.Context) {
 	ids, err := DeleteAllExpiredDocuments()
 	if err != nil {
+		RespondWithStorageError(context, err, "Failed to delete expired URLs", "")
 		log.Println("(handleRouteDeleteExpiredIds) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, ids)
+}
+
+func handleRouteDeleteExpiredVisits(context *gin.Context) {
+	count, err := PurgeExpiredVisits()
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to delete expired visits", "")
+		log.Println("(handleRouteDeleteExpiredVisits) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, count)
+}
+
+func handleRouteDeleteExpiredIdempotencyKeys(context *gin.Context) {
+	err := PurgeExpiredIdempotencyKeys()
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to delete expired idempotency keys", "")
+		log.Println("(handleRouteDeleteExpiredIdempotencyKeys) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, true)
+}
+
+func handleRouteDeleteIdleRateLimitBuckets(context *gin.Context) {
+	err := PurgeIdleRateLimitBuckets()
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to delete idle rate limit buckets", "")
+		log.Println("(handleRouteDeleteIdleRateLimitBuckets) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, true)
+}
+
+func handleRouteGetQuota(context *gin.Context) {
+	if _, ok := resolveOwner(context); !ok {
+		respondUnauthorizedOwner(context, "A session or API key is required to view quotas")
+		return
+	}
+	owner := quotaOwnerFromRequest(context)
+
+	status := QuotaStatus{}
+	var err error
+	for name, usage := range map[string]*QuotaUsage{
+		QUOTA_ACTIVE_LINKS:      &status.ActiveLinks,
+		QUOTA_DAILY_CREATIONS:   &status.DailyCreations,
+		QUOTA_MONTHLY_REDIRECTS: &status.MonthlyRedirects,
+	} {
+		if *usage, err = getQuotaUsage(owner, name); err != nil {
+			RespondWithStorageError(context, err, "Failed to get quota usage", "")
+			log.Println("(handleRouteGetQuota) error:", err)
+			return
+		}
 	}
-	context.JSON(http.StatusOK, map[string][]string{"result": ids})
+	RespondWithResult(context, http.StatusOK, status)
+}
+
+func handleRouteDeleteExpiredQuotaUsage(context *gin.Context) {
+	err := PurgeExpiredQuotaUsage()
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to delete expired quota usage", "")
+		log.Println("(handleRouteDeleteExpiredQuotaUsage) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, true)
 }
 
 func handleRouteDeleteId(context *gin.Context) {
 	id := context.Query("id")
-	sessionToken := context.Query("session_token")
-	result, err := DeleteFromDatabase(id, sessionToken)
+	owner, ok := requireScope(context, API_KEY_SCOPE_LINKS_WRITE, "A session or API key is required to delete a URL")
+	if !ok {
+		return
+	}
+
+	urls, err := GetUrlsByIds([]string{id})
+	if err == nil && len(urls) == 0 {
+		err = ErrNotFound
+	}
 	if err != nil {
-		errorMessage := ErrorResponse{
-			Message:   "Failed to delete from database",
-			Error:     err.Error(),
-			ErrorCode: http.StatusNotFound,
-		}
-		context.JSON(http.StatusNotFound, map[string]ErrorResponse{"error": errorMessage})
+		RespondWithStorageError(context, err, "Failed to delete from database", id)
+		return
+	}
+	if !owner.canManage(urls[0]) {
+		RespondWithError(context, http.StatusForbidden, ErrorResponse{
+			Message: "You do not own this URL",
+			Code:    ERROR_CODE_FORBIDDEN,
+			Id:      id,
+		})
+		return
+	}
+
+	if err := DeleteUrlsByIds([]string{id}); err != nil {
+		RespondWithStorageError(context, err, "Failed to delete from database", id)
 		log.Println("(handleRouteDeleteId) error: ", err)
+		return
 	}
-	context.JSON(http.StatusOK, map[string]interface{}{"result": result})
+	RespondWithResult(context, http.StatusOK, true)
 }
 
 func handleRouteIncrementPageView(context *gin.Context) {
-	apiKey := context.Query("api_key")
+	if _, ok := requireScope(context, API_KEY_SCOPE_PAGEVIEWS, "Incorrect API key was provided"); !ok {
+		return
+	}
 
-	if apiKey != GetApiKey() {
-		errorMessageIncorrectToken := ErrorResponse{
-			Message:   "Incorrect API key was provided",
-			ErrorCode: http.StatusUnauthorized,
-		}
-		context.JSON(http.StatusUnauthorized, map[string]ErrorResponse{"error": errorMessageIncorrectToken})
+	id := context.Param("id")
+	urlData, err := GetSingleUrlUnexpired(id)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to increment page view", id)
 		return
 	}
+	result, err := countPageView(urlData)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to increment page view", id)
+		log.Println("(handleRouteIncrementPageView) error: ", err)
+		return
+	}
+	if visit := newVisitFromHeaders(context.Request.Header, requestVisitorIP(context), id); visit != nil {
+		RecordVisit(*visit)
+	}
+	RespondWithResult(context, http.StatusOK, resolvedUrlData(result))
+}
 
+func handleRouteResolveUrl(context *gin.Context) {
 	id := context.Param("id")
-	result, err := IncrementSingleUrlPageHit(id)
+
+	body := ResolveUrlRequestBody{}
+	fieldErrors := FieldErrors{}
+	decodeJSONBody(context.Request, &body, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+	if body.Password != "" && !allowRequest(context, RATE_LIMIT_SCOPE_PASSWORD) {
+		return
+	}
+
+	urlData, err := ResolveUrl(id, body.Password)
+	if err != nil {
+		RespondWithStorageError(context, err, "This URL is invalid or the password is wrong", id)
+		return
+	}
+	if visit := newVisitFromHeaders(context.Request.Header, requestVisitorIP(context), id); visit != nil {
+		RecordVisit(*visit)
+	}
+	RespondWithResult(context, http.StatusOK, resolvedUrlData(urlData))
+}
+
+func handleRouteGetUrlStats(context *gin.Context) {
+	id := context.Param("id")
+
+	owner, ok := requireScope(context, API_KEY_SCOPE_LINKS_READ, "A session or API key is required to view the statistics of a URL")
+	if !ok {
+		return
+	}
+	urlData, err := GetSingleUrl(id)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to find the URL", id)
+		return
+	}
+	if !owner.canView(urlData) {
+		RespondWithError(context, http.StatusForbidden, ErrorResponse{
+			Message: "You do not own this URL",
+			Code:    ERROR_CODE_FORBIDDEN,
+			Id:      id,
+		})
+		return
+	}
+
+	stats, err := GetUrlStats(id)
 	if err != nil {
-		errorMessage := ErrorResponse{
-			Message:   "Failed to increment page view",
-			Error:     err.Error(),
-			ErrorCode: http.StatusInternalServerError,
+		RespondWithStorageError(context, err, "Failed to get the statistics of the URL", id)
+		log.Println("(handleRouteGetUrlStats) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, stats)
+}
+
+func handleRouteCreateApiKey(context *gin.Context) {
+	owner, ok := resolveOwner(context)
+	if !ok {
+		respondUnauthorizedOwner(context, "A session or admin API key is required to create API keys")
+		return
+	}
+	if !owner.canManageApiKeys() {
+		respondMissingScope(context, owner, API_KEY_SCOPE_ADMIN)
+		return
+	}
+
+	body := CreateApiKeyRequestBody{}
+	fieldErrors := FieldErrors{}
+	decodeJSONBody(context.Request, &body, fieldErrors)
+	grantableScopes := sessionApiKeyScopes
+	if owner.IsAdmin {
+		grantableScopes = apiKeyScopes
+	}
+	validateCreateApiKeyRequest(body, grantableScopes, fieldErrors)
+	if body.SessionToken != "" && !owner.IsAdmin {
+		fieldErrors["session_token"] = "can only be set with an admin key"
+	}
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	// Keys created by an admin key or a user without a session get a session of their own
+	sessionToken, userID := owner.SessionToken, owner.UserID
+	if owner.IsAdmin {
+		sessionToken, userID = body.SessionToken, ""
+	}
+	if sessionToken == "" {
+		sessionToken = ksuid.New().String()
+	}
+
+	apiKey, err := CreateApiKey(strings.TrimSpace(body.Name), body.Scopes, sessionToken, userID)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to create the API key", "")
+		log.Println("(handleRouteCreateApiKey) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, apiKey)
+}
+
+func handleRouteGetApiKeys(context *gin.Context) {
+	owner, ok := resolveOwner(context)
+	if !ok {
+		respondUnauthorizedOwner(context, "A session or admin API key is required to list API keys")
+		return
+	}
+	if !owner.canManageApiKeys() {
+		respondMissingScope(context, owner, API_KEY_SCOPE_ADMIN)
+		return
+	}
+
+	// Admin keys list every key
+	if owner.IsAdmin {
+		owner = Owner{}
+	}
+	apiKeys, err := ListApiKeys(owner.SessionToken, owner.UserID)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to get API keys", "")
+		log.Println("(handleRouteGetApiKeys) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, apiKeys)
+}
+
+func handleRouteRevokeApiKey(context *gin.Context) {
+	id := context.Param("id")
+
+	owner, ok := resolveOwner(context)
+	if !ok {
+		respondUnauthorizedOwner(context, "A session or admin API key is required to revoke API keys")
+		return
+	}
+	apiKey, err := GetApiKeyById(id)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to find the API key", id)
+		return
+	}
+	if !owner.canManageApiKey(apiKey) {
+		RespondWithError(context, http.StatusForbidden, ErrorResponse{
+			Message: "You do not own this API key",
+			Code:    ERROR_CODE_FORBIDDEN,
+			Id:      id,
+		})
+		return
+	}
+
+	revokedAt := time.Now().UTC().Format(time.RFC3339)
+	if apiKey.RevokedAt == nil {
+		if err := RevokeApiKey(id, revokedAt); err != nil {
+			RespondWithStorageError(context, err, "Failed to revoke the API key", id)
+			log.Println("(handleRouteRevokeApiKey) error:", err)
+			return
 		}
-		context.JSON(http.StatusNotFound, map[string]ErrorResponse{"error": errorMessage})
-		log.Println("(handleRouteIncrementPageView) error: ", err)
+		apiKey.RevokedAt = &revokedAt
+	}
+	RespondWithResult(context, http.StatusOK, apiKey)
+}
+
+func handleRouteDeleteExpiredUserTokens(context *gin.Context) {
+	err := PurgeExpiredUserTokens()
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to delete expired user sessions and password reset tokens", "")
+		log.Println("(handleRouteDeleteExpiredUserTokens) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, true)
+}
+
+// AuthResult is the response of registration and login. AttachedUrls counts the links of the current
+// session that were given to the account.
+type AuthResult struct {
+	User         User  `json:"user"`
+	AttachedUrls int64 `json:"attached_urls"`
+}
+
+// setUserSessionCookie sets the login cookie, or clears it when token is empty, and reissues the CSRF token for it.
+func setUserSessionCookie(context *gin.Context, token string, maxAge int) {
+	context.SetSameSite(http.SameSiteLaxMode)
+	context.SetCookie(USER_SESSION_COOKIE, token, maxAge, "/", "", true, true)
+	reissueCsrfToken(context, requestSessionToken(context), token)
+}
+
+// startUserSession attaches the links of the current session to the user and sets the login cookie.
+// It responds with the error and returns false when either fails.
+func startUserSession(context *gin.Context, user User) (AuthResult, bool) {
+	attached := int64(0)
+	if sessionToken := requestSessionToken(context); sessionToken != "" {
+		var err error
+		attached, err = AttachSessionToUser(sessionToken, user.ID)
+		if err != nil {
+			RespondWithStorageError(context, err, "Failed to attach the links of the session to the account", "")
+			log.Println("(startUserSession) AttachSessionToUser error:", err)
+			return AuthResult{}, false
+		}
+	}
+
+	token, err := CreateUserSession(user.ID)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to log in", "")
+		log.Println("(startUserSession) CreateUserSession error:", err)
+		return AuthResult{}, false
+	}
+	setUserSessionCookie(context, token, int(USER_SESSION_TTL.Seconds()))
+	return AuthResult{User: user, AttachedUrls: attached}, true
+}
+
+// logIn starts a login session and responds with the user.
+func logIn(context *gin.Context, user User) {
+	if result, ok := startUserSession(context, user); ok {
+		RespondWithResult(context, http.StatusOK, result)
+	}
+}
+
+func handleRouteRegister(context *gin.Context) {
+	body := UserCredentialsRequestBody{}
+	fieldErrors := FieldErrors{}
+	decodeJSONBody(context.Request, &body, fieldErrors)
+	validateEmail(body.Email, fieldErrors)
+	validateNewUserPassword(body.Password, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	user, err := RegisterUser(body.Email, body.Password)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to register", "")
+		return
+	}
+	logIn(context, user)
+}
+
+func handleRouteLogin(context *gin.Context) {
+	body := UserCredentialsRequestBody{}
+	fieldErrors := FieldErrors{}
+	decodeJSONBody(context.Request, &body, fieldErrors)
+	if strings.TrimSpace(body.Email) == "" {
+		fieldErrors["email"] = "is required"
+	}
+	if body.Password == "" {
+		fieldErrors["password"] = "is required"
+	}
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	user, err := AuthenticateUser(body.Email, body.Password)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to log in", "")
+		return
+	}
+	logIn(context, user)
+}
+
+func handleRouteLogout(context *gin.Context) {
+	if token, err := context.Cookie(USER_SESSION_COOKIE); err == nil && token != "" {
+		if err := DeleteUserSession(hashToken(token)); err != nil {
+			RespondWithStorageError(context, err, "Failed to log out", "")
+			log.Println("(handleRouteLogout) error:", err)
+			return
+		}
+	}
+	setUserSessionCookie(context, "", -1)
+	RespondWithResult(context, http.StatusOK, true)
+}
+
+func handleRouteGetCurrentUser(context *gin.Context) {
+	owner, _ := resolveOwner(context)
+	if owner.UserID == "" {
+		respondUnauthorizedOwner(context, "You are not logged in")
+		return
+	}
+	user, err := GetUserById(owner.UserID)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to get the user", "")
+		return
+	}
+	RespondWithResult(context, http.StatusOK, user)
+}
+
+// handleRouteRequestPasswordReset responds the same whether or not the email is registered.
+func handleRouteRequestPasswordReset(context *gin.Context) {
+	body := PasswordResetRequestBody{}
+	fieldErrors := FieldErrors{}
+	decodeJSONBody(context.Request, &body, fieldErrors)
+	validateEmail(body.Email, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	if err := RequestPasswordReset(body.Email); err != nil {
+		RespondWithStorageError(context, err, "Failed to request a password reset", "")
+		log.Println("(handleRouteRequestPasswordReset) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, true)
+}
+
+func handleRouteConfirmPasswordReset(context *gin.Context) {
+	body := PasswordResetConfirmRequestBody{}
+	fieldErrors := FieldErrors{}
+	decodeJSONBody(context.Request, &body, fieldErrors)
+	if body.Token == "" {
+		fieldErrors["token"] = "is required"
+	}
+	validateNewUserPassword(body.Password, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	user, err := ResetPassword(body.Token, body.Password)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to reset the password", "")
+		return
+	}
+	RespondWithResult(context, http.StatusOK, user)
+}
+
+func setOidcFlowCookie(context *gin.Context, value string, maxAge int) {
+	context.SetSameSite(http.SameSiteLaxMode)
+	context.SetCookie(OIDC_FLOW_COOKIE, value, maxAge, "/", "", true, true)
+}
+
+func respondSsoNotConfigured(context *gin.Context) {
+	RespondWithError(context, http.StatusNotFound, ErrorResponse{
+		Message: "Single sign-on is not configured",
+		Code:    ERROR_CODE_NOT_FOUND,
+	})
+}
+
+// handleRouteStartOidcLogin redirects the browser to the identity provider. When a user is logged in, the
+// identity is linked to that user.
+func handleRouteStartOidcLogin(context *gin.Context) {
+	config, ok := getOidcConfig()
+	if !ok {
+		respondSsoNotConfigured(context)
+		return
+	}
+	authorizationUrl, flow, err := StartOidcLogin(config)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to start single sign-on", "")
+		log.Println("(handleRouteStartOidcLogin) error:", err)
+		return
+	}
+	setOidcFlowCookie(context, flow.cookieValue(), int(OIDC_FLOW_TTL.Seconds()))
+	context.Redirect(http.StatusFound, authorizationUrl)
+}
+
+// handleRouteOidcCallback completes the login the provider redirected back from, then redirects to the site.
+func handleRouteOidcCallback(context *gin.Context) {
+	config, ok := getOidcConfig()
+	if !ok {
+		respondSsoNotConfigured(context)
+		return
+	}
+	cookie, _ := context.Cookie(OIDC_FLOW_COOKIE)
+	setOidcFlowCookie(context, "", -1)
+	flow, ok := parseOidcFlowCookie(cookie)
+	if !ok || subtle.ConstantTimeCompare([]byte(context.Query("state")), []byte(flow.State)) != 1 {
+		RespondWithError(context, http.StatusBadRequest, ErrorResponse{
+			Message: "The single sign-on has expired or was started in another browser, please try again",
+			Code:    ERROR_CODE_SSO_FAILED,
+		})
+		return
+	}
+	if providerError := context.Query("error"); providerError != "" {
+		RespondWithError(context, http.StatusUnauthorized, ErrorResponse{
+			Message: "The identity provider did not log you in",
+			Error:   strings.TrimSpace(providerError + " " + context.Query("error_description")),
+			Code:    ERROR_CODE_SSO_FAILED,
+		})
+		return
+	}
+	code := context.Query("code")
+	if code == "" {
+		respondWithValidationErrors(context, FieldErrors{"code": "is required"})
+		return
+	}
+
+	owner, _ := resolveOwner(context)
+	user, err := CompleteOidcLogin(config, flow, code, owner.UserID)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to log in with single sign-on", "")
+		return
+	}
+	if _, ok := startUserSession(context, user); ok {
+		context.Redirect(http.StatusFound, GetBaseUrl())
+	}
+}
+
+func handleRouteGetUserIdentities(context *gin.Context) {
+	owner, _ := resolveOwner(context)
+	if owner.UserID == "" {
+		respondUnauthorizedOwner(context, "You are not logged in")
+		return
+	}
+	identities, err := ListUserIdentities(owner.UserID)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to list the linked identities", "")
+		return
+	}
+	RespondWithResult(context, http.StatusOK, identities)
+}
+
+func workspaceForbiddenError(workspaceID string) ErrorResponse {
+	return ErrorResponse{
+		Message: "You do not have the required role in this workspace",
+		Code:    ERROR_CODE_FORBIDDEN,
+		Id:      workspaceID,
+	}
+}
+
+// authorizeWorkspace responds with 401 when the request has no owner and with 403 when the owner lacks scope or
+// a role of at least role in the workspace.
+func authorizeWorkspace(context *gin.Context, owner Owner, workspaceID string, role string, scope string) bool {
+	if !owner.isAuthenticated() {
+		respondUnauthorizedOwner(context, "You must be logged in to use workspaces")
+		return false
+	}
+	if !owner.can(scope) {
+		respondMissingScope(context, owner, scope)
+		return false
+	}
+	if !owner.hasWorkspaceRole(workspaceID, role) {
+		RespondWithError(context, http.StatusForbidden, workspaceForbiddenError(workspaceID))
+		return false
+	}
+	return true
+}
+
+// requireUser responds with 401 unless a user is logged in or the API key belongs to one, and with 403 when the
+// owner lacks scope.
+func requireUser(context *gin.Context, scope string) (Owner, bool) {
+	owner, _ := resolveOwner(context)
+	if owner.UserID == "" {
+		respondUnauthorizedOwner(context, "You must be logged in to use workspaces")
+		return owner, false
+	}
+	if !owner.can(scope) {
+		respondMissingScope(context, owner, scope)
+		return owner, false
+	}
+	return owner, true
+}
+
+func handleRouteCreateWorkspace(context *gin.Context) {
+	owner, ok := requireUser(context, API_KEY_SCOPE_LINKS_WRITE)
+	if !ok {
+		return
+	}
+
+	body := CreateWorkspaceRequestBody{}
+	fieldErrors := FieldErrors{}
+	decodeJSONBody(context.Request, &body, fieldErrors)
+	validateWorkspaceName(body.Name, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	workspace, err := CreateWorkspace(strings.TrimSpace(body.Name), owner.UserID)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to create the workspace", "")
+		log.Println("(handleRouteCreateWorkspace) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, workspace)
+}
+
+func handleRouteGetWorkspaces(context *gin.Context) {
+	owner, ok := requireUser(context, API_KEY_SCOPE_LINKS_READ)
+	if !ok {
+		return
+	}
+	workspaces, err := ListUserWorkspaces(owner.UserID)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to list workspaces", "")
+		log.Println("(handleRouteGetWorkspaces) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, workspaces)
+}
+
+func handleRouteGetWorkspaceMembers(context *gin.Context) {
+	id := context.Param("id")
+	owner, _ := resolveOwner(context)
+	if !authorizeWorkspace(context, owner, id, WORKSPACE_ROLE_VIEWER, API_KEY_SCOPE_LINKS_READ) {
+		return
+	}
+	members, err := ListWorkspaceMembers(id)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to list the members of the workspace", id)
+		log.Println("(handleRouteGetWorkspaceMembers) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, members)
+}
+
+// handleRouteSetWorkspaceMember adds the account with the email to the workspace, or changes its role.
+func handleRouteSetWorkspaceMember(context *gin.Context) {
+	id := context.Param("id")
+	owner, _ := resolveOwner(context)
+	if !authorizeWorkspace(context, owner, id, WORKSPACE_ROLE_OWNER, API_KEY_SCOPE_LINKS_WRITE) {
+		return
+	}
+
+	body := WorkspaceMemberRequestBody{}
+	fieldErrors := FieldErrors{}
+	decodeJSONBody(context.Request, &body, fieldErrors)
+	validateWorkspaceMemberRequest(body, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	user, _, err := GetUserByEmail(normalizeEmail(body.Email))
+	if errors.Is(err, ErrNotFound) {
+		RespondWithError(context, http.StatusNotFound, ErrorResponse{
+			Message: "No account is registered with this email",
+			Code:    ERROR_CODE_NOT_FOUND,
+			Id:      id,
+		})
+		return
+	} else if err != nil {
+		RespondWithStorageError(context, err, "Failed to find the account", id)
+		return
+	}
+
+	member := WorkspaceMember{
+		WorkspaceID: id,
+		UserID:      user.ID,
+		Email:       user.Email,
+		Role:        body.Role,
+		DateCreated: time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := SetWorkspaceMember(member); err != nil {
+		RespondWithStorageError(context, err, "Failed to set the member of the workspace", id)
+		log.Println("(handleRouteSetWorkspaceMember) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, member)
+}
+
+// handleRouteRemoveWorkspaceMember removes a member. Owners may remove anyone, and members may leave.
+func handleRouteRemoveWorkspaceMember(context *gin.Context) {
+	id := context.Param("id")
+	userID := context.Param("user_id")
+	owner, _ := resolveOwner(context)
+	role := WORKSPACE_ROLE_OWNER
+	if userID == owner.UserID {
+		role = WORKSPACE_ROLE_VIEWER
+	}
+	if !authorizeWorkspace(context, owner, id, role, API_KEY_SCOPE_LINKS_WRITE) {
+		return
+	}
+
+	if err := DeleteWorkspaceMember(id, userID); err != nil {
+		RespondWithStorageError(context, err, "Failed to remove the member of the workspace", id)
+		log.Println("(handleRouteRemoveWorkspaceMember) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, true)
+}
+
+// handleRouteIssueClaimCode issues a code for the caller's session, to be redeemed on another device.
+func handleRouteIssueClaimCode(context *gin.Context) {
+	owner, _ := resolveOwner(context)
+	if owner.ApiKeyID != "" {
+		RespondWithError(context, http.StatusForbidden, ErrorResponse{
+			Message: "Claim codes can only be issued from a browser session",
+			Code:    ERROR_CODE_FORBIDDEN,
+		})
+		return
+	}
+	if owner.SessionToken == "" {
+		respondUnauthorizedOwner(context, "A session is required to issue a claim code")
+		return
+	}
+
+	claimCode, err := IssueClaimCode(owner.SessionToken)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to issue a claim code", "")
+		log.Println("(handleRouteIssueClaimCode) error:", err)
+		return
+	}
+	RespondWithResult(context, http.StatusOK, claimCode)
+}
+
+// handleRouteRedeemClaimCode moves the links of the caller's session to the session that issued the code, and
+// switches the caller to that session so that both devices list the same links.
+func handleRouteRedeemClaimCode(context *gin.Context) {
+	body := RedeemClaimCodeRequestBody{}
+	fieldErrors := FieldErrors{}
+	decodeJSONBody(context.Request, &body, fieldErrors)
+	validateClaimCode(body.Code, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(context, fieldErrors)
+		return
+	}
+
+	owner, _ := resolveOwner(context)
+	if owner.ApiKeyID != "" {
+		RespondWithError(context, http.StatusForbidden, ErrorResponse{
+			Message: "Claim codes can only be redeemed from a browser session",
+			Code:    ERROR_CODE_FORBIDDEN,
+		})
+		return
+	}
+	if owner.SessionToken == "" {
+		respondUnauthorizedOwner(context, "A session is required to redeem a claim code")
+		return
+	}
+
+	result, err := RedeemClaimCode(body.Code, owner.SessionToken)
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to redeem the claim code", "")
+		return
+	}
+	if err := setRequestSessionToken(context, result.SessionToken); err != nil {
+		log.Println("(handleRouteRedeemClaimCode) setRequestSessionToken error:", err)
+	}
+	RespondWithResult(context, http.StatusOK, result)
+}
+
+func handleRouteDeleteExpiredClaimCodes(context *gin.Context) {
+	err := DeleteClaimCodesBefore(time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		RespondWithStorageError(context, err, "Failed to delete expired claim codes", "")
+		log.Println("(handleRouteDeleteExpiredClaimCodes) error:", err)
+		return
 	}
-	context.JSON(http.StatusOK, map[string]interface{}{"result": result})
+	RespondWithResult(context, http.StatusOK, true)
 }
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	os.Setenv(SESSION_SECRETS_VARIABLE, "test-session-secret-0123456789abcdef")
+}
+
+// newTestRouter returns the API routes as main.go registers them, with empty rate limit buckets.
+func newTestRouter() *gin.Engine {
+	SetRateLimitStore(NewMemoryRateLimitStore())
+	router := gin.New()
+	RegisterRouter(router.Group(""))
+	return router
+}
+
+// newTestRouterWithOwner is newTestRouter for requests made by owner, such as the owner of an API key,
+// which resolveOwner would otherwise look up in the database.
+func newTestRouterWithOwner(owner Owner) *gin.Engine {
+	SetRateLimitStore(NewMemoryRateLimitStore())
+	router := gin.New()
+	router.Use(func(context *gin.Context) { context.Set(ownerContextKey, owner) })
+	RegisterRouter(router.Group(""))
+	return router
+}
+
+// performRequest sends a request with the given cookies and headers to router.
+func performRequest(router http.Handler, method string, path string, body string, cookies []*http.Cookie, header map[string]string) *httptest.ResponseRecorder {
+	var bodyReader io.Reader
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+	request := httptest.NewRequest(method, path, bodyReader)
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	for key, value := range header {
+		request.Header.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// newTestContext returns a context for calling a helper directly on a request, with the session loaded as
+// RegisterRouter does.
+func newTestContext(request *http.Request) *gin.Context {
+	context, _ := gin.CreateTestContext(httptest.NewRecorder())
+	context.Request = request
+	sessions.Sessions(SESSION_TOKEN_KEY, newSessionStore())(context)
+	return context
+}
+
+// newSessionCookie returns the signed session cookie of sessionToken, as the browser would send it back.
+func newSessionCookie(t *testing.T, sessionToken string) *http.Cookie {
+	t.Helper()
+	router := gin.New()
+	router.Use(sessions.Sessions(SESSION_TOKEN_KEY, newSessionStore()))
+	router.GET("/", func(context *gin.Context) {
+		if err := setRequestSessionToken(context, sessionToken); err != nil {
+			t.Fatal(err)
+		}
+	})
+	cookie := responseCookie(performRequest(router, http.MethodGet, "/", "", nil, nil), SESSION_TOKEN_KEY)
+	if cookie == nil {
+		t.Fatal("no session cookie was set")
+	}
+	return cookie
+}
+
+// responseCookie returns the cookie the response sets, or nil.
+func responseCookie(response *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestSplitBulkIds(t *testing.T) {
+	urls := []URLData{
+		{ID: "mine", SessionToken: "session-a"},
+		{ID: "theirs", SessionToken: "session-b"},
+	}
+	allowed, failed := splitBulkIds(Owner{SessionToken: "session-a"}, []string{"mine", "theirs", "gone", "mine"}, urls)
+	if !slices.Equal(allowed, []string{"mine"}) {
+		t.Errorf("allowed = %v, want [mine]", allowed)
+	}
+	wantFailed := []ErrorResponse{
+		{Id: "theirs", Code: ERROR_CODE_FORBIDDEN, ErrorCode: http.StatusForbidden},
+		{Id: "gone", Code: ERROR_CODE_NOT_FOUND, ErrorCode: http.StatusNotFound},
+	}
+	if len(failed) != len(wantFailed) {
+		t.Fatalf("failed = %+v, want %+v", failed, wantFailed)
+	}
+	for i, want := range wantFailed {
+		if failed[i].Id != want.Id || failed[i].Code != want.Code || failed[i].ErrorCode != want.ErrorCode {
+			t.Errorf("failed[%d] = %+v, want %+v", i, failed[i], want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/gin-contrib/sessions/cookie"
+)
+
+// SESSION_SECRETS_VARIABLE lists the secrets session cookies are signed and encrypted with, comma separated and
+// newest first. Cookies are written with the first secret and read with any of them, so a secret is rotated in by
+// adding it at the front, and retired by removing it once the cookies written with it have expired.
+const SESSION_SECRETS_VARIABLE = "NOLONGR_SESSION_SECRETS"
+const MIN_SESSION_SECRET_LENGTH = 32
+
+// getSessionSecrets returns the configured secrets, newest first, or an error when one is too short to be safe.
+func getSessionSecrets() ([]string, error) {
+	secrets := []string{}
+	for _, secret := range strings.Split(GoDotEnvVariable(SESSION_SECRETS_VARIABLE), ",") {
+		secret = strings.TrimSpace(secret)
+		if secret == "" {
+			continue
+		}
+		if len(secret) < MIN_SESSION_SECRET_LENGTH {
+			return nil, fmt.Errorf("%s: secret %d is shorter than %d characters", SESSION_SECRETS_VARIABLE, len(secrets)+1, MIN_SESSION_SECRET_LENGTH)
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+func deriveSessionKey(secret string, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("nolongr session " + purpose))
+	return mac.Sum(nil)
+}
+
+// sessionKeyPairs derives an authentication key and an AES-256 encryption key from each secret, in the pairs
+// cookie.NewStore expects. The first pair writes cookies and every pair reads them.
+func sessionKeyPairs(secrets []string) [][]byte {
+	keyPairs := make([][]byte, 0, 2*len(secrets))
+	for _, secret := range secrets {
+		keyPairs = append(keyPairs, deriveSessionKey(secret, "authentication"), deriveSessionKey(secret, "encryption"))
+	}
+	return keyPairs
+}
+
+var sessionSecretsOnce sync.Once
+var sessionSecrets []string
+
+// resolveSessionSecrets returns the configured secrets. Only with APP_ENV=development are missing or invalid secrets
+// replaced by a random one, so that sessions do not survive a restart; anywhere else they are an error, as a
+// deployment that forgot them must not quietly sign sessions with a secret nobody knows.
+func resolveSessionSecrets() ([]string, error) {
+	secrets, err := getSessionSecrets()
+	if err == nil && len(secrets) == 0 {
+		err = fmt.Errorf("%s is not set", SESSION_SECRETS_VARIABLE)
+	}
+	if err == nil {
+		return secrets, nil
+	}
+	if GetEnvironment() != "development" {
+		return nil, fmt.Errorf("%w (set APP_ENV=development to use a random secret locally)", err)
+	}
+	log.Printf("(loadSessionSecrets) WARNING: %v, using a random session secret: sessions will not survive a restart", err)
+	secret, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	return []string{secret}, nil
+}
+
+// loadSessionSecrets returns the secrets of the sessions, resolved once so that session cookies and CSRF tokens
+// agree on them. The server refuses to start without them.
+func loadSessionSecrets() []string {
+	sessionSecretsOnce.Do(func() {
+		secrets, err := resolveSessionSecrets()
+		if err != nil {
+			log.Fatal("(loadSessionSecrets) ", err)
+		}
+		sessionSecrets = secrets
+	})
+	return sessionSecrets
+}
+
+// newSessionStore returns the cookie store of the sessions.
+func newSessionStore() cookie.Store {
+	return cookie.NewStore(sessionKeyPairs(loadSessionSecrets())...)
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestResolveSessionSecrets(t *testing.T) {
+	newSecret := strings.Repeat("n", MIN_SESSION_SECRET_LENGTH)
+	oldSecret := strings.Repeat("o", MIN_SESSION_SECRET_LENGTH)
+	tests := []struct {
+		name        string
+		secrets     string
+		environment string
+		want        []string
+		wantRandom  bool
+		wantErr     bool
+	}{
+		{name: "configured", secrets: newSecret, environment: "production", want: []string{newSecret}},
+		{name: "rotation", secrets: " " + newSecret + ", " + oldSecret + ",", environment: "production", want: []string{newSecret, oldSecret}},
+		{name: "missing in production", environment: "production", wantErr: true},
+		{name: "missing without APP_ENV", wantErr: true},
+		{name: "missing in preview", environment: "preview", wantErr: true},
+		{name: "too short", secrets: newSecret + ",short", environment: "production", wantErr: true},
+		{name: "missing in development", environment: "development", wantRandom: true},
+		{name: "too short in development", secrets: "short", environment: "development", wantRandom: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(SESSION_SECRETS_VARIABLE, test.secrets)
+			t.Setenv("APP_ENV", test.environment)
+			secrets, err := resolveSessionSecrets()
+			switch {
+			case test.wantErr:
+				if err == nil {
+					t.Errorf("resolveSessionSecrets() = %v, want an error", secrets)
+				}
+			case err != nil:
+				t.Errorf("resolveSessionSecrets() error = %v", err)
+			case test.wantRandom:
+				if len(secrets) != 1 || len(secrets[0]) < MIN_SESSION_SECRET_LENGTH {
+					t.Errorf("resolveSessionSecrets() = %v, want a random secret", secrets)
+				}
+			case !slices.Equal(secrets, test.want):
+				t.Errorf("resolveSessionSecrets() = %v, want %v", secrets, test.want)
+			}
+		})
+	}
+}
+
+func TestSessionKeyPairs(t *testing.T) {
+	keyPairs := sessionKeyPairs([]string{"first", "second"})
+	if len(keyPairs) != 4 {
+		t.Fatalf("len(sessionKeyPairs()) = %d, want 4", len(keyPairs))
+	}
+	for i, key := range keyPairs {
+		if len(key) != 32 {
+			t.Errorf("key %d is %d bytes, want 32 for AES-256", i, len(key))
+		}
+		for _, other := range keyPairs[:i] {
+			if string(key) == string(other) {
+				t.Errorf("key %d is reused", i)
+			}
+		}
+	}
+}
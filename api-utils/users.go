@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// USER_SESSION_COOKIE holds the login session of a user, next to the anonymous session_token cookie.
+const USER_SESSION_COOKIE = "user_session"
+const USER_SESSION_TTL = 30 * 24 * time.Hour
+const PASSWORD_RESET_TTL = time.Hour
+
+// User is a registered account. Links and API keys with its ID are owned by the account rather than a session.
+type User struct {
+	ID          string `json:"id"`
+	Email       string `json:"email"`
+	DateCreated string `json:"date_created"`
+}
+
+// PasswordResetSender delivers the link to reset a password, e.g. by email.
+type PasswordResetSender interface {
+	SendPasswordReset(user User, resetUrl string) error
+}
+
+// logPasswordResetSender is used until SetPasswordResetSender is called. It only logs the link in development,
+// as logs are not a safe place for reset tokens.
+type logPasswordResetSender struct{}
+
+func (sender logPasswordResetSender) SendPasswordReset(user User, resetUrl string) error {
+	if GetEnvironment() == "development" {
+		log.Printf("(logPasswordResetSender) password reset link for %s: %s", user.Email, resetUrl)
+	} else {
+		log.Printf("(logPasswordResetSender) no password reset sender is configured, %s was not sent a link", user.Email)
+	}
+	return nil
+}
+
+var passwordResetSender struct {
+	sync.Mutex
+	sender PasswordResetSender
+}
+
+func SetPasswordResetSender(sender PasswordResetSender) {
+	passwordResetSender.Lock()
+	defer passwordResetSender.Unlock()
+	passwordResetSender.sender = sender
+}
+
+func getPasswordResetSender() PasswordResetSender {
+	passwordResetSender.Lock()
+	defer passwordResetSender.Unlock()
+	if passwordResetSender.sender == nil {
+		return logPasswordResetSender{}
+	}
+	return passwordResetSender.sender
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// RegisterUser creates an account, returning ErrEmailTaken when the email is already registered.
+func RegisterUser(email string, password string) (User, error) {
+	passwordHash, err := HashPassword(password)
+	if err != nil {
+		log.Println("(RegisterUser) HashPassword error:", err)
+		return User{}, err
+	}
+	user := User{
+		ID:          ksuid.New().String(),
+		Email:       normalizeEmail(email),
+		DateCreated: time.Now().UTC().Format(time.RFC3339),
+	}
+	return user, InsertUser(user, passwordHash)
+}
+
+// dummyPasswordHash is compared against when the email is unknown, so that the response time does not tell
+// which emails are registered. It is hashed on first use, as hashing takes about a second.
+var dummyPasswordHash struct {
+	sync.Once
+	hash string
+}
+
+func getDummyPasswordHash() string {
+	dummyPasswordHash.Do(func() {
+		dummyPasswordHash.hash, _ = HashPassword("nolongr-dummy-password")
+	})
+	return dummyPasswordHash.hash
+}
+
+// AuthenticateUser returns ErrInvalidCredentials when the email is unknown or the password is wrong.
+func AuthenticateUser(email string, password string) (User, error) {
+	user, passwordHash, err := GetUserByEmail(normalizeEmail(email))
+	if errors.Is(err, ErrNotFound) {
+		CheckPasswordHash(password, getDummyPasswordHash())
+		return User{}, ErrInvalidCredentials
+	} else if err != nil {
+		return User{}, err
+	}
+	if !CheckPasswordHash(password, passwordHash) {
+		return User{}, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// CreateUserSession logs the user in and returns the token to store in USER_SESSION_COOKIE.
+func CreateUserSession(userID string) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		log.Println("(CreateUserSession) generateToken error:", err)
+		return "", err
+	}
+	now := time.Now().UTC()
+	err = InsertUserSession(hashToken(token), userID, now.Format(time.RFC3339), now.Add(USER_SESSION_TTL).Format(time.RFC3339))
+	return token, err
+}
+
+// authenticateUserSession returns the user logged in with token, or false when the session is unknown or expired.
+func authenticateUserSession(token string) (string, bool) {
+	userID, err := GetUserSessionUser(hashToken(token), time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Println("(authenticateUserSession) error:", err)
+		}
+		return "", false
+	}
+	return userID, true
+}
+
+// RequestPasswordReset sends a reset link to the email if it is registered. Unknown emails are not an error,
+// so that the response does not tell which emails are registered.
+func RequestPasswordReset(email string) error {
+	user, _, err := GetUserByEmail(normalizeEmail(email))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		log.Println("(RequestPasswordReset) generateToken error:", err)
+		return err
+	}
+	now := time.Now().UTC()
+	err = InsertPasswordResetToken(hashToken(token), user.ID, now.Format(time.RFC3339), now.Add(PASSWORD_RESET_TTL).Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return getPasswordResetSender().SendPasswordReset(user, GetBaseUrl()+"/reset-password?token="+token)
+}
+
+// ResetPassword sets the password of the user a reset token was issued to and logs out all of the user's
+// sessions. Each token can only be used once.
+func ResetPassword(token string, password string) (User, error) {
+	passwordHash, err := HashPassword(password)
+	if err != nil {
+		log.Println("(ResetPassword) HashPassword error:", err)
+		return User{}, err
+	}
+	userID, err := UsePasswordResetToken(hashToken(token), time.Now().UTC().Format(time.RFC3339))
+	if errors.Is(err, ErrNotFound) {
+		return User{}, ErrInvalidToken
+	} else if err != nil {
+		return User{}, err
+	}
+	if err := UpdateUserPassword(userID, passwordHash); err != nil {
+		return User{}, err
+	}
+	if err := DeleteUserSessions(userID); err != nil {
+		return User{}, err
+	}
+	return GetUserById(userID)
+}
+
+// PurgeExpiredUserTokens deletes expired login sessions and password reset tokens.
+func PurgeExpiredUserTokens() error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err := DeleteUserSessionsBefore(now); err != nil {
+		return err
+	}
+	return DeletePasswordResetTokensBefore(now)
+}
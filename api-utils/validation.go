@@ -0,0 +1,523 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+)
+
+const MAX_SELF_DESTRUCT_SECONDS = 60 * 60 * 24 * 365 * 10
+const MAX_PASSWORD_LENGTH = 72 // bcrypt ignores anything longer
+
+var destinationRegex = regexp.MustCompile("^(http:\\/\\/www\\.|https:\\/\\/www\\.|http:\\/\\/|https:\\/\\/|\\/|\\/\\/)?[A-z0-9_-]*?[:]?[A-z0-9_-]*?[@]?[A-z0-9]+([\\-\\.]{1}[a-z0-9]+)*\\.[a-z]{2,5}(:[0-9]{1,5})?(\\/.*)?$")
+
+// CreateShortUrlRequestBody is the body of POST /api/urls, sent as JSON or as a form.
+// A self_destruct (seconds from now) or max_page_hits of 0 means no limit.
+type CreateShortUrlRequestBody struct {
+	Destination  string   `json:"destination" form:"destination"`
+	MaxPageHits  *int64   `json:"max_page_hits" form:"max_page_hits"`
+	Password     string   `json:"password" form:"password"`
+	SelfDestruct *int64   `json:"self_destruct" form:"self_destruct"`
+	Title        string   `json:"title" form:"title"`
+	Tags         []string `json:"tags" form:"tags"`
+	// WorkspaceID creates the link in a workspace the caller is an editor or owner of
+	WorkspaceID string `json:"workspace_id" form:"workspace_id"`
+}
+
+// FieldErrors maps a request field to the reason it was rejected.
+type FieldErrors map[string]string
+
+// String lists the rejected fields in a stable order, e.g. "destination: is required; tags: ...".
+func (fieldErrors FieldErrors) String() string {
+	fields := make([]string, 0, len(fieldErrors))
+	for field := range fieldErrors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for i, field := range fields {
+		fields[i] = field + ": " + fieldErrors[field]
+	}
+	return strings.Join(fields, "; ")
+}
+
+func parseOptionalInt64(value string, field string, fieldErrors FieldErrors) *int64 {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	result, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		fieldErrors[field] = "must be an integer"
+		return nil
+	}
+	return &result
+}
+
+func parseOptionalBool(value string, field string, fieldErrors FieldErrors) *bool {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		fieldErrors[field] = "must be a boolean"
+		return nil
+	}
+	return &result
+}
+
+// decodeJSONBody decodes a JSON request body into target, reporting type mismatches per field.
+// An empty body is not an error.
+func decodeJSONBody(request *http.Request, target interface{}, fieldErrors FieldErrors) {
+	err := json.NewDecoder(request.Body).Decode(target)
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+	case errors.As(err, &typeError):
+		fieldErrors[typeError.Field] = fmt.Sprintf("must be of type %s", typeError.Type.String())
+	default:
+		fieldErrors["body"] = "must be valid JSON"
+	}
+}
+
+// bindCreateShortUrlRequest reads the creation request from a JSON or form body.
+// Fields missing from the body are taken from the deprecated query parameters,
+// in which case deprecated is true.
+func bindCreateShortUrlRequest(context *gin.Context) (CreateShortUrlRequestBody, bool, FieldErrors) {
+	body := CreateShortUrlRequestBody{}
+	fieldErrors := FieldErrors{}
+
+	switch context.ContentType() {
+	case gin.MIMEPOSTForm, gin.MIMEMultipartPOSTForm:
+		body.Destination = context.PostForm("destination")
+		body.Password = context.PostForm("password")
+		body.MaxPageHits = parseOptionalInt64(context.PostForm("max_page_hits"), "max_page_hits", fieldErrors)
+		body.SelfDestruct = parseOptionalInt64(context.PostForm("self_destruct"), "self_destruct", fieldErrors)
+		body.Title = context.PostForm("title")
+		body.Tags = parseTags(context.PostFormArray("tags"))
+		body.WorkspaceID = context.PostForm("workspace_id")
+	default:
+		decodeJSONBody(context.Request, &body, fieldErrors)
+	}
+
+	deprecated := false
+	if body.Destination == "" && context.Query("destination") != "" {
+		body.Destination = context.Query("destination")
+		deprecated = true
+	}
+	if body.MaxPageHits == nil && context.Query("max_page_hits") != "" {
+		body.MaxPageHits = parseOptionalInt64(context.Query("max_page_hits"), "max_page_hits", fieldErrors)
+		deprecated = true
+	}
+	if body.SelfDestruct == nil && context.Query("self_destruct") != "" {
+		body.SelfDestruct = parseOptionalInt64(context.Query("self_destruct"), "self_destruct", fieldErrors)
+		deprecated = true
+	}
+
+	return body, deprecated, fieldErrors
+}
+
+const MAX_BATCH_SIZE = 500
+
+var aliasRegex = regexp.MustCompile("^[A-Za-z0-9_~-]{2,36}$")
+
+// BatchCreateShortUrlItem is one link of POST /api/urls/batch; Alias optionally replaces the random ID.
+type BatchCreateShortUrlItem struct {
+	CreateShortUrlRequestBody
+	Alias string `json:"alias"`
+}
+
+type BatchCreateShortUrlRequestBody struct {
+	Urls []BatchCreateShortUrlItem `json:"urls"`
+}
+
+func validateAlias(alias string, fieldErrors FieldErrors) {
+	if alias != "" && !aliasRegex.MatchString(alias) {
+		fieldErrors["alias"] = "must be 2 to 36 letters, digits, '-', '_' or '~'"
+	}
+}
+
+func validateBatchCreateShortUrlRequest(body BatchCreateShortUrlRequestBody, fieldErrors FieldErrors) {
+	if len(body.Urls) == 0 {
+		fieldErrors["urls"] = "must contain at least one URL"
+	} else if len(body.Urls) > MAX_BATCH_SIZE {
+		fieldErrors["urls"] = fmt.Sprintf("must contain at most %d URLs", MAX_BATCH_SIZE)
+	}
+}
+
+// BulkIdsRequestBody is the body of POST /api/urls/batch/delete.
+type BulkIdsRequestBody struct {
+	Ids []string `json:"ids"`
+}
+
+// BulkUpdateRequestBody is the body of PATCH /api/urls/batch. A self_destruct of 0 removes the expiry.
+type BulkUpdateRequestBody struct {
+	Ids          []string `json:"ids"`
+	Paused       *bool    `json:"paused"`
+	SelfDestruct *int64   `json:"self_destruct"`
+}
+
+func validateBulkIds(ids []string, fieldErrors FieldErrors) {
+	if len(ids) == 0 {
+		fieldErrors["ids"] = "must contain at least one ID"
+	} else if len(ids) > MAX_BATCH_SIZE {
+		fieldErrors["ids"] = fmt.Sprintf("must contain at most %d IDs", MAX_BATCH_SIZE)
+	}
+}
+
+func validateBulkUpdateRequest(body BulkUpdateRequestBody, fieldErrors FieldErrors) {
+	validateBulkIds(body.Ids, fieldErrors)
+	validateSelfDestruct(body.SelfDestruct, fieldErrors)
+	if body.Paused == nil && body.SelfDestruct == nil {
+		fieldErrors["body"] = "must change paused or self_destruct"
+	}
+}
+
+// ResolveUrlRequestBody is the body of POST /api/urls/:id/resolve; it may be omitted for links without a password.
+type ResolveUrlRequestBody struct {
+	Password string `json:"password"`
+}
+
+const MAX_API_KEY_NAME_LENGTH = 255
+
+// CreateApiKeyRequestBody is the body of POST /api/api-keys. SessionToken may only be set by admin keys,
+// to create a key for an existing session; otherwise keys manage the links of the caller's session.
+type CreateApiKeyRequestBody struct {
+	Name         string   `json:"name"`
+	Scopes       []string `json:"scopes"`
+	SessionToken string   `json:"session_token"`
+}
+
+func validateCreateApiKeyRequest(body CreateApiKeyRequestBody, grantableScopes []string, fieldErrors FieldErrors) {
+	if strings.TrimSpace(body.Name) == "" {
+		fieldErrors["name"] = "is required"
+	} else if len(body.Name) > MAX_API_KEY_NAME_LENGTH {
+		fieldErrors["name"] = fmt.Sprintf("must be at most %d characters", MAX_API_KEY_NAME_LENGTH)
+	}
+	if len(body.Scopes) == 0 {
+		fieldErrors["scopes"] = "must contain at least one scope"
+	}
+	for _, scope := range body.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			fieldErrors["scopes"] = "must be one of " + strings.Join(apiKeyScopes, ", ")
+			break
+		} else if !slices.Contains(grantableScopes, scope) {
+			fieldErrors["scopes"] = "can only grant " + strings.Join(grantableScopes, ", ") + " without an admin key"
+			break
+		}
+	}
+}
+
+const MIN_USER_PASSWORD_LENGTH = 8
+const MAX_EMAIL_LENGTH = 255
+
+// UserCredentialsRequestBody is the body of POST /api/auth/register and POST /api/auth/login.
+type UserCredentialsRequestBody struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// PasswordResetRequestBody is the body of POST /api/auth/password-reset.
+type PasswordResetRequestBody struct {
+	Email string `json:"email"`
+}
+
+// PasswordResetConfirmRequestBody is the body of POST /api/auth/password-reset/confirm.
+type PasswordResetConfirmRequestBody struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func validateEmail(email string, fieldErrors FieldErrors) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		fieldErrors["email"] = "is required"
+	} else if len(email) > MAX_EMAIL_LENGTH {
+		fieldErrors["email"] = fmt.Sprintf("must be at most %d characters", MAX_EMAIL_LENGTH)
+	} else if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+		fieldErrors["email"] = "must be a valid email address"
+	}
+}
+
+// validateNewUserPassword checks a password being set; login only checks that one is given.
+func validateNewUserPassword(password string, fieldErrors FieldErrors) {
+	if len(password) < MIN_USER_PASSWORD_LENGTH {
+		fieldErrors["password"] = fmt.Sprintf("must be at least %d characters", MIN_USER_PASSWORD_LENGTH)
+	} else if len(password) > MAX_PASSWORD_LENGTH {
+		fieldErrors["password"] = fmt.Sprintf("must be at most %d characters", MAX_PASSWORD_LENGTH)
+	}
+}
+
+const MAX_WORKSPACE_NAME_LENGTH = 255
+
+// CreateWorkspaceRequestBody is the body of POST /api/workspaces.
+type CreateWorkspaceRequestBody struct {
+	Name string `json:"name"`
+}
+
+// WorkspaceMemberRequestBody is the body of PUT /api/workspaces/:id/members, which adds the account with the
+// email or changes its role.
+type WorkspaceMemberRequestBody struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+func validateWorkspaceName(name string, fieldErrors FieldErrors) {
+	if strings.TrimSpace(name) == "" {
+		fieldErrors["name"] = "is required"
+	} else if len(name) > MAX_WORKSPACE_NAME_LENGTH {
+		fieldErrors["name"] = fmt.Sprintf("must be at most %d characters", MAX_WORKSPACE_NAME_LENGTH)
+	}
+}
+
+func validateWorkspaceMemberRequest(body WorkspaceMemberRequestBody, fieldErrors FieldErrors) {
+	validateEmail(body.Email, fieldErrors)
+	if _, ok := workspaceRoleRanks[body.Role]; !ok {
+		fieldErrors["role"] = "must be one of " + strings.Join([]string{WORKSPACE_ROLE_OWNER, WORKSPACE_ROLE_EDITOR, WORKSPACE_ROLE_VIEWER}, ", ")
+	}
+}
+
+// RedeemClaimCodeRequestBody is the body of POST /api/claim-codes/redeem.
+type RedeemClaimCodeRequestBody struct {
+	Code string `json:"code"`
+}
+
+func validateClaimCode(code string, fieldErrors FieldErrors) {
+	if strings.TrimSpace(code) == "" {
+		fieldErrors["code"] = "is required"
+	} else if len(normalizeClaimCode(code)) != CLAIM_CODE_LENGTH {
+		fieldErrors["code"] = fmt.Sprintf("must be %d letters and digits", CLAIM_CODE_LENGTH)
+	}
+}
+
+const DEFAULT_LIST_LIMIT = 50
+const MAX_LIST_LIMIT = 200
+
+func parseOptionalTime(value string, field string, fieldErrors FieldErrors) string {
+	if value == "" {
+		return ""
+	}
+	parsedTime, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		fieldErrors[field] = "must be an RFC 3339 timestamp"
+		return ""
+	}
+	return parsedTime.UTC().Format(time.RFC3339)
+}
+
+// bindUrlListOptions reads the pagination, filter and sort query parameters of the link listings.
+func bindUrlListOptions(context *gin.Context) (UrlListOptions, FieldErrors) {
+	return parseUrlListOptions(context.Query)
+}
+
+// parseUrlListOptions reads the link listing options from named values, as sent in the query string.
+func parseUrlListOptions(value func(key string) string) (UrlListOptions, FieldErrors) {
+	fieldErrors := FieldErrors{}
+	options := UrlListOptions{
+		Status:        value("status"),
+		HasPassword:   parseOptionalBool(value("has_password"), "has_password", fieldErrors),
+		Domain:        strings.ToLower(strings.TrimSpace(value("domain"))),
+		CreatedAfter:  parseOptionalTime(value("created_after"), "created_after", fieldErrors),
+		CreatedBefore: parseOptionalTime(value("created_before"), "created_before", fieldErrors),
+		Sort:          value("sort"),
+		Limit:         DEFAULT_LIST_LIMIT,
+		Cursor:        value("cursor"),
+	}
+	if options.Sort == "" {
+		options.Sort = URL_SORT_CREATED_DESC
+	}
+
+	if limit := parseOptionalInt64(value("limit"), "limit", fieldErrors); limit != nil {
+		if *limit < 1 || *limit > MAX_LIST_LIMIT {
+			fieldErrors["limit"] = fmt.Sprintf("must be between 1 and %d", MAX_LIST_LIMIT)
+		}
+		options.Limit = int(*limit)
+	}
+	switch options.Status {
+	case "", URL_STATUS_ACTIVE, URL_STATUS_EXPIRED, URL_STATUS_PAUSED:
+	default:
+		fieldErrors["status"] = "must be one of active, expired, paused"
+	}
+	switch options.Sort {
+	case URL_SORT_CREATED_DESC, URL_SORT_CREATED_ASC, URL_SORT_HITS_DESC, URL_SORT_HITS_ASC:
+	default:
+		fieldErrors["sort"] = "must be one of created_desc, created_asc, hits_desc, hits_asc"
+	}
+	if options.Domain != "" {
+		if domainUrl, err := url.Parse("//" + strings.TrimPrefix(strings.TrimPrefix(options.Domain, "http://"), "https://")); err == nil && domainUrl.Hostname() != "" {
+			options.Domain = domainUrl.Hostname()
+		} else {
+			fieldErrors["domain"] = "must be a host name"
+		}
+	}
+
+	return options, fieldErrors
+}
+
+// UpdateShortUrlRequestBody is the body of PATCH /api/urls/:id. Omitted fields are left unchanged,
+// an empty password removes the password and a self_destruct of 0 removes the expiry.
+type UpdateShortUrlRequestBody struct {
+	Destination   *string   `json:"destination" form:"destination"`
+	MaxPageHits   *int64    `json:"max_page_hits" form:"max_page_hits"`
+	Password      *string   `json:"password" form:"password"`
+	SelfDestruct  *int64    `json:"self_destruct" form:"self_destruct"`
+	Paused        *bool     `json:"paused" form:"paused"`
+	Title         *string   `json:"title" form:"title"`
+	Tags          *[]string `json:"tags" form:"tags"`
+	ResetPageHits bool      `json:"reset_page_hits" form:"reset_page_hits"`
+}
+
+func bindUpdateShortUrlRequest(context *gin.Context) (UpdateShortUrlRequestBody, FieldErrors) {
+	body := UpdateShortUrlRequestBody{}
+	fieldErrors := FieldErrors{}
+
+	switch context.ContentType() {
+	case gin.MIMEPOSTForm, gin.MIMEMultipartPOSTForm:
+		if destination, ok := context.GetPostForm("destination"); ok {
+			body.Destination = &destination
+		}
+		if password, ok := context.GetPostForm("password"); ok {
+			body.Password = &password
+		}
+		body.MaxPageHits = parseOptionalInt64(context.PostForm("max_page_hits"), "max_page_hits", fieldErrors)
+		body.SelfDestruct = parseOptionalInt64(context.PostForm("self_destruct"), "self_destruct", fieldErrors)
+		body.Paused = parseOptionalBool(context.PostForm("paused"), "paused", fieldErrors)
+		if title, ok := context.GetPostForm("title"); ok {
+			body.Title = &title
+		}
+		if tags, ok := context.GetPostFormArray("tags"); ok {
+			parsedTags := parseTags(tags)
+			body.Tags = &parsedTags
+		}
+		if resetPageHits := parseOptionalBool(context.PostForm("reset_page_hits"), "reset_page_hits", fieldErrors); resetPageHits != nil {
+			body.ResetPageHits = *resetPageHits
+		}
+	default:
+		decodeJSONBody(context.Request, &body, fieldErrors)
+	}
+
+	return body, fieldErrors
+}
+
+func validateUpdateShortUrlRequest(body UpdateShortUrlRequestBody, fieldErrors FieldErrors) {
+	if body.Destination != nil {
+		validateDestination(*body.Destination, fieldErrors)
+	}
+	validateMaxPageHits(body.MaxPageHits, fieldErrors)
+	validateSelfDestruct(body.SelfDestruct, fieldErrors)
+	if body.Password != nil {
+		validatePassword(*body.Password, fieldErrors)
+	}
+	if body.Title != nil {
+		validateTitle(*body.Title, fieldErrors)
+	}
+	if body.Tags != nil {
+		validateTags(*body.Tags, fieldErrors)
+	}
+}
+
+func validateDestination(destination string, fieldErrors FieldErrors) {
+	if strings.TrimSpace(destination) == "" {
+		fieldErrors["destination"] = "is required"
+	} else if len(destination) > 2048 {
+		fieldErrors["destination"] = "must be at most 2048 characters"
+	} else if !destinationRegex.MatchString(destination) {
+		fieldErrors["destination"] = "must be a valid URL"
+	}
+}
+
+func validateMaxPageHits(maxPageHits *int64, fieldErrors FieldErrors) {
+	if maxPageHits != nil && *maxPageHits < 0 {
+		fieldErrors["max_page_hits"] = "must be 0 or greater"
+	}
+}
+
+func validateSelfDestruct(selfDestruct *int64, fieldErrors FieldErrors) {
+	if selfDestruct != nil && (*selfDestruct < 0 || *selfDestruct > MAX_SELF_DESTRUCT_SECONDS) {
+		fieldErrors["self_destruct"] = fmt.Sprintf("must be between 0 and %d seconds", MAX_SELF_DESTRUCT_SECONDS)
+	}
+}
+
+func validatePassword(password string, fieldErrors FieldErrors) {
+	if len(password) > MAX_PASSWORD_LENGTH {
+		fieldErrors["password"] = fmt.Sprintf("must be at most %d characters", MAX_PASSWORD_LENGTH)
+	}
+}
+
+const MAX_TITLE_LENGTH = 255
+const MAX_TAGS = 20
+const MAX_TAG_LENGTH = 32
+
+// parseTags splits form values, which may each hold several comma-separated tags.
+func parseTags(values []string) []string {
+	tags := []string{}
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+func validateTitle(title string, fieldErrors FieldErrors) {
+	if len(title) > MAX_TITLE_LENGTH {
+		fieldErrors["title"] = fmt.Sprintf("must be at most %d characters", MAX_TITLE_LENGTH)
+	}
+}
+
+func validateTags(tags []string, fieldErrors FieldErrors) {
+	if len(tags) > MAX_TAGS {
+		fieldErrors["tags"] = fmt.Sprintf("must contain at most %d tags", MAX_TAGS)
+		return
+	}
+	for _, tag := range tags {
+		if strings.TrimSpace(tag) == "" || len(tag) > MAX_TAG_LENGTH || strings.Contains(tag, ",") {
+			fieldErrors["tags"] = fmt.Sprintf("must be non-empty, at most %d characters and contain no commas", MAX_TAG_LENGTH)
+			return
+		}
+	}
+}
+
+func validateCreateShortUrlRequest(body CreateShortUrlRequestBody, fieldErrors FieldErrors) {
+	validateDestination(body.Destination, fieldErrors)
+	validateMaxPageHits(body.MaxPageHits, fieldErrors)
+	validateSelfDestruct(body.SelfDestruct, fieldErrors)
+	validatePassword(body.Password, fieldErrors)
+	validateTitle(body.Title, fieldErrors)
+	validateTags(body.Tags, fieldErrors)
+}
+
+// isForbiddenDestination reports whether the destination points back at this site.
+func isForbiddenDestination(destination string) bool {
+	if !strings.Contains(destination, "://") {
+		destination = "http://" + strings.TrimLeft(destination, "/")
+	}
+	destinationSiteUrled, err := url.Parse(destination)
+	if err != nil {
+		return false
+	}
+	productionSiteUrled, _ := url.Parse(PRODUCTION_SITE_URL)
+	return strings.EqualFold(destinationSiteUrled.Hostname(), productionSiteUrled.Hostname())
+}
+
+func respondWithValidationErrors(context *gin.Context, fieldErrors FieldErrors) {
+	RespondWithError(context, http.StatusBadRequest, ErrorResponse{
+		Message: "The request contains invalid fields",
+		Code:    ERROR_CODE_VALIDATION_FAILED,
+		Fields:  fieldErrors,
+	})
+}
@@ -0,0 +1,553 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func int64Pointer(value int64) *int64 {
+	return &value
+}
+
+func TestBindCreateShortUrlRequest(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		contentType    string
+		body           string
+		wantBody       CreateShortUrlRequestBody
+		wantDeprecated bool
+		wantErrors     []string
+	}{
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        `{"destination":"https://example.com","max_page_hits":5,"title":"Docs","tags":["a"],"workspace_id":"ws1"}`,
+			wantBody:    CreateShortUrlRequestBody{Destination: "https://example.com", MaxPageHits: int64Pointer(5), Title: "Docs", Tags: []string{"a"}, WorkspaceID: "ws1"},
+		},
+		{
+			name:        "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        url.Values{"destination": {"https://example.com"}, "self_destruct": {"60"}, "tags": {"a, b", "c"}, "workspace_id": {"ws1"}}.Encode(),
+			wantBody:    CreateShortUrlRequestBody{Destination: "https://example.com", SelfDestruct: int64Pointer(60), Tags: []string{"a", "b", "c"}, WorkspaceID: "ws1"},
+		},
+		{
+			name:           "deprecated query",
+			query:          "?destination=https://example.com&max_page_hits=3",
+			contentType:    "application/json",
+			wantBody:       CreateShortUrlRequestBody{Destination: "https://example.com", MaxPageHits: int64Pointer(3)},
+			wantDeprecated: true,
+		},
+		{
+			name:        "body wins over query",
+			query:       "?destination=https://example.org",
+			contentType: "application/json",
+			body:        `{"destination":"https://example.com"}`,
+			wantBody:    CreateShortUrlRequestBody{Destination: "https://example.com"},
+		},
+		{
+			name:        "json type mismatch",
+			contentType: "application/json",
+			body:        `{"destination":"https://example.com","max_page_hits":"five"}`,
+			wantErrors:  []string{"max_page_hits"},
+		},
+		{
+			name:        "invalid json",
+			contentType: "application/json",
+			body:        `{"destination":`,
+			wantErrors:  []string{"body"},
+		},
+		{
+			name:        "form integer",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "destination=https://example.com&max_page_hits=five",
+			wantErrors:  []string{"max_page_hits"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/urls"+test.query, strings.NewReader(test.body))
+			request.Header.Set("Content-Type", test.contentType)
+			body, deprecated, fieldErrors := bindCreateShortUrlRequest(newTestContext(request))
+			if test.wantErrors != nil {
+				for _, field := range test.wantErrors {
+					if _, ok := fieldErrors[field]; !ok {
+						t.Errorf("field errors = %v, want an error for %s", fieldErrors, field)
+					}
+				}
+				return
+			}
+			if len(fieldErrors) != 0 {
+				t.Fatalf("field errors = %v", fieldErrors)
+			}
+			if deprecated != test.wantDeprecated {
+				t.Errorf("deprecated = %v, want %v", deprecated, test.wantDeprecated)
+			}
+			if body.Destination != test.wantBody.Destination || body.Title != test.wantBody.Title || body.WorkspaceID != test.wantBody.WorkspaceID ||
+				!equalPointers(body.MaxPageHits, test.wantBody.MaxPageHits) || !equalPointers(body.SelfDestruct, test.wantBody.SelfDestruct) ||
+				len(body.Tags) != len(test.wantBody.Tags) || (len(body.Tags) > 0 && !slices.Equal(body.Tags, test.wantBody.Tags)) {
+				t.Errorf("body = %+v, want %+v", body, test.wantBody)
+			}
+		})
+	}
+}
+
+func stringPointer(value string) *string {
+	return &value
+}
+
+func boolPointer(value bool) *bool {
+	return &value
+}
+
+func equalPointers[T comparable](a *T, b *T) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func TestValidateCreateShortUrlRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      CreateShortUrlRequestBody
+		wantField string
+	}{
+		{name: "valid", body: CreateShortUrlRequestBody{Destination: "https://example.com/path?q=1"}},
+		{name: "no scheme", body: CreateShortUrlRequestBody{Destination: "example.com"}},
+		{name: "missing destination", body: CreateShortUrlRequestBody{Destination: "  "}, wantField: "destination"},
+		{name: "not a URL", body: CreateShortUrlRequestBody{Destination: "not a url"}, wantField: "destination"},
+		{name: "long destination", body: CreateShortUrlRequestBody{Destination: "https://example.com/" + strings.Repeat("a", 2048)}, wantField: "destination"},
+		{name: "negative max_page_hits", body: CreateShortUrlRequestBody{Destination: "https://example.com", MaxPageHits: int64Pointer(-1)}, wantField: "max_page_hits"},
+		{name: "self_destruct too far", body: CreateShortUrlRequestBody{Destination: "https://example.com", SelfDestruct: int64Pointer(MAX_SELF_DESTRUCT_SECONDS + 1)}, wantField: "self_destruct"},
+		{name: "long password", body: CreateShortUrlRequestBody{Destination: "https://example.com", Password: strings.Repeat("p", MAX_PASSWORD_LENGTH+1)}, wantField: "password"},
+		{name: "long title", body: CreateShortUrlRequestBody{Destination: "https://example.com", Title: strings.Repeat("t", MAX_TITLE_LENGTH+1)}, wantField: "title"},
+		{name: "too many tags", body: CreateShortUrlRequestBody{Destination: "https://example.com", Tags: make([]string, MAX_TAGS+1)}, wantField: "tags"},
+		{name: "tag with comma", body: CreateShortUrlRequestBody{Destination: "https://example.com", Tags: []string{"a,b"}}, wantField: "tags"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fieldErrors := FieldErrors{}
+			validateCreateShortUrlRequest(test.body, fieldErrors)
+			if test.wantField == "" && len(fieldErrors) != 0 {
+				t.Errorf("field errors = %v, want none", fieldErrors)
+			} else if _, ok := fieldErrors[test.wantField]; test.wantField != "" && (!ok || len(fieldErrors) != 1) {
+				t.Errorf("field errors = %v, want only %s", fieldErrors, test.wantField)
+			}
+		})
+	}
+}
+
+func TestIsForbiddenDestination(t *testing.T) {
+	tests := map[string]bool{
+		"https://nolongr.vercel.app/abc":  true,
+		"nolongr.vercel.app/abc":          true,
+		"//NOLONGR.vercel.app":            true,
+		"https://example.com/nolongr":     false,
+		"https://nolongr.vercel.app.evil": false,
+	}
+	for destination, want := range tests {
+		if got := isForbiddenDestination(destination); got != want {
+			t.Errorf("isForbiddenDestination(%q) = %v, want %v", destination, got, want)
+		}
+	}
+}
+
+func TestCreateShortUrlRouteValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+		wantField  string
+	}{
+		{name: "invalid json", body: `{"destination":`, wantStatus: http.StatusBadRequest, wantCode: ERROR_CODE_VALIDATION_FAILED, wantField: "body"},
+		{name: "missing destination", body: `{"max_page_hits":1}`, wantStatus: http.StatusBadRequest, wantCode: ERROR_CODE_VALIDATION_FAILED, wantField: "destination"},
+		{name: "negative max_page_hits", body: `{"destination":"https://example.com","max_page_hits":-1}`, wantStatus: http.StatusBadRequest, wantCode: ERROR_CODE_VALIDATION_FAILED, wantField: "max_page_hits"},
+		{name: "this site", body: `{"destination":"https://nolongr.vercel.app/abc"}`, wantStatus: http.StatusForbidden, wantCode: ERROR_CODE_FORBIDDEN_DOMAIN},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := performRequest(newTestRouter(), http.MethodPost, "/api/v1/urls", test.body, nil, nil)
+			var envelope struct {
+				Error ErrorResponse `json:"error"`
+			}
+			if err := json.Unmarshal(response.Body.Bytes(), &envelope); err != nil {
+				t.Fatal(err)
+			}
+			if response.Code != test.wantStatus || envelope.Error.Code != test.wantCode {
+				t.Errorf("response = %d %s, want %d %s", response.Code, response.Body.String(), test.wantStatus, test.wantCode)
+			}
+			if _, ok := envelope.Error.Fields[test.wantField]; test.wantField != "" && !ok {
+				t.Errorf("fields = %v, want an error for %s", envelope.Error.Fields, test.wantField)
+			}
+		})
+	}
+}
+
+func TestValidateBatchCreateShortUrlRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		count     int
+		wantError bool
+	}{
+		{name: "empty", count: 0, wantError: true},
+		{name: "one", count: 1},
+		{name: "largest batch", count: MAX_BATCH_SIZE},
+		{name: "too many", count: MAX_BATCH_SIZE + 1, wantError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fieldErrors := FieldErrors{}
+			validateBatchCreateShortUrlRequest(BatchCreateShortUrlRequestBody{Urls: make([]BatchCreateShortUrlItem, test.count)}, fieldErrors)
+			if _, ok := fieldErrors["urls"]; ok != test.wantError {
+				t.Errorf("field errors = %v, want an error for urls: %v", fieldErrors, test.wantError)
+			}
+		})
+	}
+}
+
+func TestValidateAlias(t *testing.T) {
+	tests := map[string]bool{
+		"":                      true,
+		"docs-2024":             true,
+		"a_b~c":                 true,
+		"a":                     false,
+		"with space":            false,
+		"slash/alias":           false,
+		strings.Repeat("a", 37): false,
+	}
+	for alias, valid := range tests {
+		fieldErrors := FieldErrors{}
+		validateAlias(alias, fieldErrors)
+		if _, rejected := fieldErrors["alias"]; rejected == valid {
+			t.Errorf("validateAlias(%q) errors = %v, want valid %v", alias, fieldErrors, valid)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []string
+	}{
+		{values: nil, want: []string{}},
+		{values: []string{"news"}, want: []string{"news"}},
+		{values: []string{" news , docs ,", "2024"}, want: []string{"news", "docs", "2024"}},
+		{values: []string{",", "  "}, want: []string{}},
+	}
+	for _, test := range tests {
+		if got := parseTags(test.values); !slices.Equal(got, test.want) {
+			t.Errorf("parseTags(%q) = %q, want %q", test.values, got, test.want)
+		}
+	}
+}
+
+func TestValidateTitleAndTags(t *testing.T) {
+	tooManyTags := make([]string, MAX_TAGS+1)
+	for i := range tooManyTags {
+		tooManyTags[i] = "tag"
+	}
+	tests := []struct {
+		name      string
+		title     string
+		tags      []string
+		wantError []string
+	}{
+		{name: "valid", title: "Launch notes", tags: []string{"news", "2024 q1"}},
+		{name: "empty", title: "", tags: []string{}},
+		{name: "title too long", title: strings.Repeat("a", MAX_TITLE_LENGTH+1), wantError: []string{"title"}},
+		{name: "too many tags", tags: tooManyTags, wantError: []string{"tags"}},
+		{name: "blank tag", tags: []string{"news", " "}, wantError: []string{"tags"}},
+		{name: "tag too long", tags: []string{strings.Repeat("a", MAX_TAG_LENGTH+1)}, wantError: []string{"tags"}},
+		{name: "tag with a comma", tags: []string{"a,b"}, wantError: []string{"tags"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fieldErrors := FieldErrors{}
+			validateTitle(test.title, fieldErrors)
+			validateTags(test.tags, fieldErrors)
+			if len(fieldErrors) != len(test.wantError) {
+				t.Errorf("field errors = %v, want %v", fieldErrors, test.wantError)
+			}
+			for _, field := range test.wantError {
+				if _, ok := fieldErrors[field]; !ok {
+					t.Errorf("field errors = %v, want an error for %s", fieldErrors, field)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchUrlsRouteValidation(t *testing.T) {
+	t.Setenv("NOLONGR_SERVER_API_KEY", "test-server-key")
+	serverKey := map[string]string{"Authorization": "Bearer test-server-key"}
+	tests := []struct {
+		name       string
+		query      string
+		header     map[string]string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "anonymous", query: "q=docs", wantStatus: http.StatusUnauthorized, wantBody: ERROR_CODE_UNAUTHORIZED},
+		{name: "query too short", query: "q=a", header: serverKey, wantStatus: http.StatusBadRequest, wantBody: `"q"`},
+		{name: "limit too low", query: "q=docs&limit=0", header: serverKey, wantStatus: http.StatusBadRequest, wantBody: `"limit"`},
+		{name: "limit too high", query: "q=docs&limit=1000", header: serverKey, wantStatus: http.StatusBadRequest, wantBody: `"limit"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := performRequest(newTestRouter(), http.MethodGet, "/api/v1/user-session-urls/search?"+test.query, "", nil, test.header)
+			if response.Code != test.wantStatus || !strings.Contains(response.Body.String(), test.wantBody) {
+				t.Errorf("response = %d %s, want %d %s", response.Code, response.Body.String(), test.wantStatus, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestValidateBulkUpdateRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       BulkUpdateRequestBody
+		wantFields []string
+	}{
+		{name: "pause", body: BulkUpdateRequestBody{Ids: []string{"a"}, Paused: boolPointer(true)}},
+		{name: "clear expiry", body: BulkUpdateRequestBody{Ids: []string{"a"}, SelfDestruct: int64Pointer(0)}},
+		{name: "nothing to change", body: BulkUpdateRequestBody{Ids: []string{"a"}}, wantFields: []string{"body"}},
+		{name: "no ids", body: BulkUpdateRequestBody{Paused: boolPointer(false)}, wantFields: []string{"ids"}},
+		{name: "too many ids", body: BulkUpdateRequestBody{Ids: make([]string, MAX_BATCH_SIZE+1), Paused: boolPointer(false)}, wantFields: []string{"ids"}},
+		{name: "negative expiry", body: BulkUpdateRequestBody{Ids: []string{"a"}, SelfDestruct: int64Pointer(-1)}, wantFields: []string{"self_destruct"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fieldErrors := FieldErrors{}
+			validateBulkUpdateRequest(test.body, fieldErrors)
+			if len(fieldErrors) != len(test.wantFields) {
+				t.Errorf("field errors = %v, want %v", fieldErrors, test.wantFields)
+			}
+			for _, field := range test.wantFields {
+				if _, ok := fieldErrors[field]; !ok {
+					t.Errorf("field errors = %v, want an error for %s", fieldErrors, field)
+				}
+			}
+		})
+	}
+}
+
+func TestBulkRoutes(t *testing.T) {
+	t.Setenv("NOLONGR_SERVER_API_KEY", "test-server-key")
+	serverKey := map[string]string{"Authorization": "Bearer test-server-key"}
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		header     map[string]string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "anonymous delete", method: http.MethodPost, path: "/api/v1/urls/batch/delete", body: `{"ids":["a"]}`, wantStatus: http.StatusUnauthorized, wantCode: ERROR_CODE_UNAUTHORIZED},
+		{name: "delete without ids", method: http.MethodPost, path: "/api/v1/urls/batch/delete", body: `{"ids":[]}`, header: serverKey, wantStatus: http.StatusBadRequest, wantCode: ERROR_CODE_VALIDATION_FAILED},
+		{name: "anonymous update", method: http.MethodPatch, path: "/api/v1/urls/batch", body: `{"ids":["a"],"paused":true}`, wantStatus: http.StatusUnauthorized, wantCode: ERROR_CODE_UNAUTHORIZED},
+		{name: "update without changes", method: http.MethodPatch, path: "/api/v1/urls/batch", body: `{"ids":["a"]}`, header: serverKey, wantStatus: http.StatusBadRequest, wantCode: ERROR_CODE_VALIDATION_FAILED},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := performRequest(newTestRouter(), test.method, test.path, test.body, nil, test.header)
+			if response.Code != test.wantStatus || !strings.Contains(response.Body.String(), test.wantCode) {
+				t.Errorf("response = %d %s, want %d %s", response.Code, response.Body.String(), test.wantStatus, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestBindUpdateShortUrlRequest(t *testing.T) {
+	tests := []struct {
+		name              string
+		contentType       string
+		body              string
+		wantDestination   *string
+		wantPassword      *string
+		wantPaused        *bool
+		wantResetPageHits bool
+		wantErrors        []string
+	}{
+		{name: "empty json", contentType: "application/json", body: `{}`},
+		{name: "json clearing the password", contentType: "application/json", body: `{"password":"","reset_page_hits":true}`, wantPassword: stringPointer(""), wantResetPageHits: true},
+		{name: "form", contentType: "application/x-www-form-urlencoded", body: "destination=https://example.com&paused=true", wantDestination: stringPointer("https://example.com"), wantPaused: boolPointer(true)},
+		{name: "form boolean", contentType: "application/x-www-form-urlencoded", body: "paused=sometimes", wantErrors: []string{"paused"}},
+		{name: "json type mismatch", contentType: "application/json", body: `{"paused":"yes"}`, wantErrors: []string{"paused"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPatch, "/api/v1/urls/abc", strings.NewReader(test.body))
+			request.Header.Set("Content-Type", test.contentType)
+			body, fieldErrors := bindUpdateShortUrlRequest(newTestContext(request))
+			if len(fieldErrors) != len(test.wantErrors) {
+				t.Fatalf("field errors = %v, want %v", fieldErrors, test.wantErrors)
+			}
+			for _, field := range test.wantErrors {
+				if _, ok := fieldErrors[field]; !ok {
+					t.Errorf("field errors = %v, want an error for %s", fieldErrors, field)
+				}
+			}
+			if test.wantErrors != nil {
+				return
+			}
+			if !equalPointers(body.Destination, test.wantDestination) || !equalPointers(body.Password, test.wantPassword) ||
+				!equalPointers(body.Paused, test.wantPaused) || body.ResetPageHits != test.wantResetPageHits || body.MaxPageHits != nil {
+				t.Errorf("body = %+v", body)
+			}
+		})
+	}
+}
+
+func TestValidateUpdateShortUrlRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      UpdateShortUrlRequestBody
+		wantField string
+	}{
+		{name: "nothing to change", body: UpdateShortUrlRequestBody{}},
+		{name: "clear password and expiry", body: UpdateShortUrlRequestBody{Password: stringPointer(""), SelfDestruct: int64Pointer(0)}},
+		{name: "empty destination", body: UpdateShortUrlRequestBody{Destination: stringPointer("")}, wantField: "destination"},
+		{name: "negative max_page_hits", body: UpdateShortUrlRequestBody{MaxPageHits: int64Pointer(-1)}, wantField: "max_page_hits"},
+		{name: "long password", body: UpdateShortUrlRequestBody{Password: stringPointer(strings.Repeat("p", MAX_PASSWORD_LENGTH+1))}, wantField: "password"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fieldErrors := FieldErrors{}
+			validateUpdateShortUrlRequest(test.body, fieldErrors)
+			if test.wantField == "" && len(fieldErrors) != 0 {
+				t.Errorf("field errors = %v, want none", fieldErrors)
+			} else if _, ok := fieldErrors[test.wantField]; test.wantField != "" && (!ok || len(fieldErrors) != 1) {
+				t.Errorf("field errors = %v, want only %s", fieldErrors, test.wantField)
+			}
+		})
+	}
+}
+
+func TestUpdateShortUrlRoute(t *testing.T) {
+	t.Setenv("NOLONGR_SERVER_API_KEY", "test-server-key")
+	serverKey := map[string]string{"Authorization": "Bearer test-server-key"}
+	tests := []struct {
+		name       string
+		body       string
+		header     map[string]string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "anonymous", body: `{"paused":true}`, wantStatus: http.StatusUnauthorized, wantCode: ERROR_CODE_UNAUTHORIZED},
+		{name: "invalid field", body: `{"max_page_hits":-1}`, header: serverKey, wantStatus: http.StatusBadRequest, wantCode: ERROR_CODE_VALIDATION_FAILED},
+		{name: "this site", body: `{"destination":"https://nolongr.vercel.app"}`, header: serverKey, wantStatus: http.StatusForbidden, wantCode: ERROR_CODE_FORBIDDEN_DOMAIN},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := performRequest(newTestRouter(), http.MethodPatch, "/api/v1/urls/abc", test.body, nil, test.header)
+			if response.Code != test.wantStatus || !strings.Contains(response.Body.String(), test.wantCode) {
+				t.Errorf("response = %d %s, want %d %s", response.Code, response.Body.String(), test.wantStatus, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestParseUrlListOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		want       UrlListOptions
+		wantErrors []string
+	}{
+		{name: "defaults", query: "", want: UrlListOptions{Sort: URL_SORT_CREATED_DESC, Limit: DEFAULT_LIST_LIMIT}},
+		{
+			name:  "filters",
+			query: "status=paused&domain=HTTPS://Example.com/path&created_after=2024-05-01T12:00:00%2B02:00&sort=hits_asc&limit=10&cursor=abc",
+			want:  UrlListOptions{Status: URL_STATUS_PAUSED, Domain: "example.com", CreatedAfter: "2024-05-01T10:00:00Z", Sort: URL_SORT_HITS_ASC, Limit: 10, Cursor: "abc"},
+		},
+		{name: "invalid values", query: "status=gone&sort=random&limit=0&has_password=maybe&created_before=yesterday", wantErrors: []string{"status", "sort", "limit", "has_password", "created_before"}},
+		{name: "limit too high", query: "limit=201", wantErrors: []string{"limit"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			options, fieldErrors := parseUrlListOptions(query.Get)
+			if test.wantErrors != nil {
+				if len(fieldErrors) != len(test.wantErrors) {
+					t.Errorf("field errors = %v, want %v", fieldErrors, test.wantErrors)
+				}
+				for _, field := range test.wantErrors {
+					if _, ok := fieldErrors[field]; !ok {
+						t.Errorf("field errors = %v, want an error for %s", fieldErrors, field)
+					}
+				}
+				return
+			}
+			if len(fieldErrors) != 0 {
+				t.Fatalf("field errors = %v", fieldErrors)
+			}
+			if options != test.want {
+				t.Errorf("options = %+v, want %+v", options, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateCreateApiKeyRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       CreateApiKeyRequestBody
+		grantable  []string
+		wantFields []string
+	}{
+		{name: "valid", body: CreateApiKeyRequestBody{Name: "ci", Scopes: []string{API_KEY_SCOPE_LINKS_READ}}, grantable: sessionApiKeyScopes},
+		{name: "admin grants admin", body: CreateApiKeyRequestBody{Name: "ci", Scopes: []string{API_KEY_SCOPE_ADMIN}}, grantable: apiKeyScopes},
+		{name: "session grants admin", body: CreateApiKeyRequestBody{Name: "ci", Scopes: []string{API_KEY_SCOPE_ADMIN}}, grantable: sessionApiKeyScopes, wantFields: []string{"scopes"}},
+		{name: "unknown scope", body: CreateApiKeyRequestBody{Name: "ci", Scopes: []string{"links:delete"}}, grantable: apiKeyScopes, wantFields: []string{"scopes"}},
+		{name: "missing name and scopes", body: CreateApiKeyRequestBody{Name: " "}, grantable: apiKeyScopes, wantFields: []string{"name", "scopes"}},
+		{name: "long name", body: CreateApiKeyRequestBody{Name: strings.Repeat("n", MAX_API_KEY_NAME_LENGTH+1), Scopes: []string{API_KEY_SCOPE_LINKS_READ}}, grantable: apiKeyScopes, wantFields: []string{"name"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fieldErrors := FieldErrors{}
+			validateCreateApiKeyRequest(test.body, test.grantable, fieldErrors)
+			if len(fieldErrors) != len(test.wantFields) {
+				t.Errorf("field errors = %v, want %v", fieldErrors, test.wantFields)
+			}
+			for _, field := range test.wantFields {
+				if _, ok := fieldErrors[field]; !ok {
+					t.Errorf("field errors = %v, want an error for %s", fieldErrors, field)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	tests := map[string]bool{
+		"ada@example.com":       true,
+		" ada@example.com ":     true,
+		"":                      false,
+		"ada":                   false,
+		"Ada <ada@example.com>": false,
+		strings.Repeat("a", 250) + "@example.com": false,
+	}
+	for email, valid := range tests {
+		fieldErrors := FieldErrors{}
+		validateEmail(email, fieldErrors)
+		if _, rejected := fieldErrors["email"]; rejected == valid {
+			t.Errorf("validateEmail(%q) errors = %v, want valid %v", email, fieldErrors, valid)
+		}
+	}
+}
+
+func TestFieldErrorsString(t *testing.T) {
+	fieldErrors := FieldErrors{"tags": "is invalid", "destination": "is required"}
+	if got, want := fieldErrors.String(), "destination: is required; tags: is invalid"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
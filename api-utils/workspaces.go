@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"log"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// Workspace roles. Viewers see the links of a workspace, editors also create, edit and delete them, and owners
+// also manage the members.
+const (
+	WORKSPACE_ROLE_OWNER  = "owner"
+	WORKSPACE_ROLE_EDITOR = "editor"
+	WORKSPACE_ROLE_VIEWER = "viewer"
+)
+
+var workspaceRoleRanks = map[string]int{
+	WORKSPACE_ROLE_VIEWER: 1,
+	WORKSPACE_ROLE_EDITOR: 2,
+	WORKSPACE_ROLE_OWNER:  3,
+}
+
+// Workspace is a group of users sharing links. Role is the role of the user it was listed for.
+type Workspace struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DateCreated string `json:"date_created"`
+	Role        string `json:"role,omitempty"`
+}
+
+type WorkspaceMember struct {
+	WorkspaceID string `json:"workspace_id"`
+	UserID      string `json:"user_id"`
+	Email       string `json:"email"`
+	Role        string `json:"role"`
+	DateCreated string `json:"date_created"`
+}
+
+// CreateWorkspace creates a workspace with userID as its owner.
+func CreateWorkspace(name string, userID string) (Workspace, error) {
+	workspace := Workspace{
+		ID:          ksuid.New().String(),
+		Name:        name,
+		DateCreated: time.Now().UTC().Format(time.RFC3339),
+		Role:        WORKSPACE_ROLE_OWNER,
+	}
+	return workspace, InsertWorkspace(workspace, userID)
+}
+
+// loadWorkspaceRoles returns the roles of a user by workspace. Errors are logged and give no roles, so that a
+// failing database denies access to workspaces rather than the whole request.
+func loadWorkspaceRoles(userID string) map[string]string {
+	roles, err := GetUserWorkspaceRoles(userID)
+	if err != nil {
+		log.Println("(loadWorkspaceRoles) error:", err)
+		return map[string]string{}
+	}
+	return roles
+}
+
+// hasWorkspaceRole reports whether the owner has at least the given role in the workspace.
+func (owner Owner) hasWorkspaceRole(workspaceID string, role string) bool {
+	if owner.IsAdmin {
+		return true
+	}
+	return workspaceID != "" && workspaceRoleRanks[owner.WorkspaceRoles[workspaceID]] >= workspaceRoleRanks[role]
+}
@@ -1,15 +1,15 @@
 package api
 
 import (
-	"fmt"
 	"net/http"
-	"strings"
 
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
 	utils "main.go/api-utils"
 )
 
 var app *gin.Engine
+var grpcServer *grpc.Server
 
 func init() {
 	app = gin.Default()
@@ -20,21 +20,28 @@ func init() {
 
 	// Handle routing errors
 	app.NoRoute(func(c *gin.Context) {
-		sb := &strings.Builder{}
-		sb.WriteString("routing err: no route, try this:\n")
-		for _, v := range app.Routes() {
-			if v.Path != "/api/new-short-id" {
-				sb.WriteString(fmt.Sprintf("%s %s\n", v.Method, v.Path))
-			}
-		}
-		c.String(http.StatusBadRequest, sb.String())
+		utils.RespondWithError(c, http.StatusNotFound, utils.ErrorResponse{
+			Message: "routing err: no route, see /api/openapi.json for the available routes",
+			Error:   c.Request.Method + " " + c.Request.URL.Path,
+			Code:    utils.ERROR_CODE_NO_ROUTE,
+		})
 	})
 
+	app.GET("/api/openapi.json", utils.OpenAPIHandler(app.Routes))
+	app.GET("/api/v1/openapi.json", utils.OpenAPIHandler(app.Routes))
+
 	r := app.Group("/")
 
 	utils.RegisterRouter(r)
+
+	grpcServer = utils.NewGrpcServer()
 }
 
+// Handler serves the REST API, and the gRPC LinkService for HTTP/2 requests with a gRPC content type.
 func Handler(w http.ResponseWriter, r *http.Request) {
+	if utils.IsGrpcRequest(r) {
+		grpcServer.ServeHTTP(w, r)
+		return
+	}
 	app.ServeHTTP(w, r)
 }
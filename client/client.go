@@ -0,0 +1,277 @@
+// Package client is a Go client of the nolongr HTTP API.
+//
+//	links := client.NewClient(client.DefaultBaseURL, os.Getenv("NOLONGR_SERVER_API_KEY"))
+//	link, err := links.Create(ctx, client.CreateRequest{Destination: "https://example.com"})
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const DefaultBaseURL = "https://nolongr.vercel.app/api/v1"
+
+const DefaultMaxRetries = 3
+
+// Client calls the API with an API key and/or on behalf of a browser session. A key replaces the session on the
+// server, so set only one of them.
+// Its fields may be changed before the first call.
+type Client struct {
+	// BaseURL is the API root, including the version prefix
+	BaseURL string
+	// APIKey is sent as an Authorization: Bearer header; its scopes decide which calls succeed
+	APIKey string
+	// SessionToken is the session_token cookie of a browser, as signed by the server; the client then acts as
+	// that session and owns the links it creates
+	SessionToken string
+	HTTPClient   *http.Client
+	// MaxRetries is the number of times a request is retried after a network error, 429 or 5xx response
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry; it doubles with each retry
+	RetryBackoff time.Duration
+}
+
+func NewClient(baseURL string, apiKey string) *Client {
+	return &Client{
+		BaseURL:      baseURL,
+		APIKey:       apiKey,
+		HTTPClient:   &http.Client{Timeout: 30 * time.Second},
+		MaxRetries:   DefaultMaxRetries,
+		RetryBackoff: 200 * time.Millisecond,
+	}
+}
+
+// IsCode reports whether err is an API error with the given code, e.g. CodeNotFound.
+func IsCode(err error, code string) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// Create creates a link. The request carries an Idempotency-Key, so retries never create it twice.
+func (client *Client) Create(ctx context.Context, request CreateRequest) (*Link, error) {
+	link := &Link{}
+	header := http.Header{}
+	header.Set("Idempotency-Key", newIdempotencyKey())
+	_, err := client.do(ctx, http.MethodPost, "/urls", nil, header, request, link)
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// Get returns a link that can still be visited. The destination of a link with a password is only returned to
+// callers who may view the link.
+func (client *Client) Get(ctx context.Context, id string) (*Link, error) {
+	link := &Link{}
+	_, err := client.do(ctx, http.MethodGet, "/urls/"+url.PathEscape(id), nil, nil, nil, link)
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// List returns a page of the session's links, or of every link when the client has no session, which needs
+// an admin key.
+func (client *Client) List(ctx context.Context, options ListOptions) (*Page, error) {
+	query := url.Values{}
+	if options.Limit > 0 {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+	if options.HasPassword != nil {
+		query.Set("has_password", strconv.FormatBool(*options.HasPassword))
+	}
+	for key, value := range map[string]string{
+		"cursor":         options.Cursor,
+		"sort":           options.Sort,
+		"status":         options.Status,
+		"domain":         options.Domain,
+		"created_after":  options.CreatedAfter,
+		"created_before": options.CreatedBefore,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+
+	path := "/urls"
+	if options.WorkspaceID != "" {
+		path = "/user-session-urls"
+		query.Set("workspace_id", options.WorkspaceID)
+	} else if client.SessionToken != "" {
+		path = "/user-session-urls"
+	}
+
+	page := &Page{Links: []Link{}}
+	envelope, err := client.do(ctx, http.MethodGet, path, query, nil, nil, &page.Links)
+	if err != nil {
+		return nil, err
+	}
+	page.NextCursor = envelope.NextCursor
+	return page, nil
+}
+
+// Delete deletes a link owned by the session, or any link with the server API key.
+func (client *Client) Delete(ctx context.Context, id string) error {
+	result := struct {
+		Succeeded []string `json:"succeeded"`
+		Failed    []Error  `json:"failed"`
+	}{}
+	body := map[string][]string{"ids": {id}}
+	_, err := client.do(ctx, http.MethodPost, "/urls/batch/delete", nil, nil, body, &result)
+	if err != nil {
+		return err
+	}
+	if len(result.Failed) > 0 {
+		return &result.Failed[0]
+	}
+	return nil
+}
+
+// Stats returns the page views of a link per day.
+func (client *Client) Stats(ctx context.Context, id string) (*Stats, error) {
+	stats := &Stats{}
+	_, err := client.do(ctx, http.MethodGet, "/urls/"+url.PathEscape(id)+"/stats", nil, nil, nil, stats)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Quota returns the usage of the client's quotas. Clients with the server API key have no limits.
+func (client *Client) Quota(ctx context.Context) (*QuotaStatus, error) {
+	quota := &QuotaStatus{}
+	_, err := client.do(ctx, http.MethodGet, "/quota", nil, nil, nil, quota)
+	if err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
+
+type responseEnvelope struct {
+	Result     json.RawMessage `json:"result"`
+	NextCursor string          `json:"next_cursor"`
+	Error      *Error          `json:"error"`
+}
+
+// do sends a request, retrying it on network errors, 429 and 5xx responses, and decodes the result into result.
+func (client *Client) do(ctx context.Context, method string, path string, query url.Values, header http.Header, body interface{}, result interface{}) (*responseEnvelope, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	requestUrl := client.BaseURL + path
+	if len(query) > 0 {
+		requestUrl += "?" + query.Encode()
+	}
+
+	backoff := client.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, method, requestUrl, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		request.Header.Set("Accept", "application/json")
+		if body != nil {
+			request.Header.Set("Content-Type", "application/json")
+		}
+		if client.APIKey != "" {
+			request.Header.Set("Authorization", "Bearer "+client.APIKey)
+		}
+		if client.SessionToken != "" {
+			request.AddCookie(&http.Cookie{Name: "session_token", Value: client.SessionToken})
+		}
+
+		envelope, retryAfter, err := client.send(request)
+		if err == nil || attempt >= client.MaxRetries || retryAfter < 0 {
+			if err != nil {
+				return nil, err
+			}
+			if result != nil && len(envelope.Result) > 0 {
+				if err := json.Unmarshal(envelope.Result, result); err != nil {
+					return nil, fmt.Errorf("nolongr: decoding the response of %s %s: %w", method, path, err)
+				}
+			}
+			return envelope, nil
+		}
+
+		wait := backoff
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// send makes one attempt. retryAfter is negative when the request must not be retried,
+// otherwise it is the wait the server asked for, if any.
+func (client *Client) send(request *http.Request) (*responseEnvelope, time.Duration, error) {
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		if request.Context().Err() != nil {
+			return nil, -1, request.Context().Err()
+		}
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	envelope := &responseEnvelope{}
+	decodeErr := json.Unmarshal(data, envelope)
+
+	if response.StatusCode < http.StatusBadRequest {
+		if decodeErr != nil {
+			return nil, -1, fmt.Errorf("nolongr: decoding the response: %w", decodeErr)
+		}
+		return envelope, 0, nil
+	}
+
+	apiErr := envelope.Error
+	if decodeErr != nil || apiErr == nil {
+		apiErr = &Error{Message: http.StatusText(response.StatusCode), Detail: string(data)}
+	}
+	apiErr.StatusCode = response.StatusCode
+
+	if response.StatusCode != http.StatusTooManyRequests && response.StatusCode < http.StatusInternalServerError {
+		return nil, -1, apiErr
+	}
+	retryAfter := time.Duration(0)
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	return nil, retryAfter, apiErr
+}
+
+func newIdempotencyKey() string {
+	key := make([]byte, 16)
+	rand.Read(key)
+	return hex.EncodeToString(key)
+}
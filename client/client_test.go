@@ -0,0 +1,292 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordedRequest is what testServer saw of a request.
+type recordedRequest struct {
+	Method         string
+	Path           string
+	RawQuery       string
+	Authorization  string
+	SessionToken   string
+	IdempotencyKey string
+	Body           string
+}
+
+// testServer answers each request with the next of responses, repeating the last one, and records the requests.
+type testServer struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	requests  []recordedRequest
+	responses []testResponse
+}
+
+type testResponse struct {
+	status     int
+	body       string
+	retryAfter string
+}
+
+func newTestServer(t *testing.T, responses ...testResponse) (*testServer, *Client) {
+	server := &testServer{responses: responses}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serve))
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL+"/api/v1", "test-key")
+	client.RetryBackoff = time.Millisecond
+	return server, client
+}
+
+func (server *testServer) serve(writer http.ResponseWriter, request *http.Request) {
+	body, _ := io.ReadAll(request.Body)
+	recorded := recordedRequest{
+		Method:         request.Method,
+		Path:           request.URL.EscapedPath(),
+		RawQuery:       request.URL.RawQuery,
+		Authorization:  request.Header.Get("Authorization"),
+		IdempotencyKey: request.Header.Get("Idempotency-Key"),
+		Body:           string(body),
+	}
+	if cookie, err := request.Cookie("session_token"); err == nil {
+		recorded.SessionToken = cookie.Value
+	}
+
+	server.mutex.Lock()
+	server.requests = append(server.requests, recorded)
+	response := server.responses[len(server.responses)-1]
+	if len(server.requests) <= len(server.responses) {
+		response = server.responses[len(server.requests)-1]
+	}
+	server.mutex.Unlock()
+
+	if response.retryAfter != "" {
+		writer.Header().Set("Retry-After", response.retryAfter)
+	}
+	writer.WriteHeader(response.status)
+	io.WriteString(writer, response.body)
+}
+
+func (server *testServer) recorded() []recordedRequest {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]recordedRequest{}, server.requests...)
+}
+
+const unavailableBody = `{"error":{"message":"Failed to connect to the database","code":"database_unavailable","errorCode":503}}`
+
+func TestCreate(t *testing.T) {
+	server, client := newTestServer(t,
+		testResponse{status: http.StatusServiceUnavailable, body: unavailableBody},
+		testResponse{status: http.StatusCreated, body: `{"result":{"id":"abc","destination":"https://example.com","tags":["news"]}}`},
+	)
+	link, err := client.Create(context.Background(), CreateRequest{Destination: "https://example.com", Tags: []string{"news"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.ID != "abc" || link.Destination != "https://example.com" || len(link.Tags) != 1 {
+		t.Errorf("link = %+v", link)
+	}
+
+	requests := server.recorded()
+	if len(requests) != 2 {
+		t.Fatalf("requests = %+v, want a retry", requests)
+	}
+	for _, request := range requests {
+		if request.Method != http.MethodPost || request.Path != "/api/v1/urls" || request.Authorization != "Bearer test-key" {
+			t.Errorf("request = %+v, want an authenticated POST /api/v1/urls", request)
+		}
+		if request.Body != `{"destination":"https://example.com","tags":["news"]}` {
+			t.Errorf("body = %s", request.Body)
+		}
+	}
+	if requests[0].IdempotencyKey == "" || requests[0].IdempotencyKey != requests[1].IdempotencyKey {
+		t.Errorf("idempotency keys = %q, %q, want the same key on each attempt", requests[0].IdempotencyKey, requests[1].IdempotencyKey)
+	}
+}
+
+func TestGetAndStats(t *testing.T) {
+	server, client := newTestServer(t, testResponse{status: http.StatusOK, body: `{"result":{"id":"a/b","has_password":true,"page_hits":3,"max_page_hits":10,"daily_visits":[{"day":"2024-05-01","visits":3}]}}`})
+	link, err := client.Get(context.Background(), "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !link.HasPassword || link.Destination != "" {
+		t.Errorf("link = %+v, want a password-protected link without its destination", link)
+	}
+	stats, err := client.Stats(context.Background(), "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.PageHits != 3 || stats.MaxPageHits != 10 || len(stats.DailyVisits) != 1 || stats.DailyVisits[0] != (DailyVisits{Day: "2024-05-01", Visits: 3}) {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	requests := server.recorded()
+	if requests[0].Path != "/api/v1/urls/a%2Fb" || requests[1].Path != "/api/v1/urls/a%2Fb/stats" {
+		t.Errorf("paths = %s, %s, want the ID escaped", requests[0].Path, requests[1].Path)
+	}
+}
+
+func TestList(t *testing.T) {
+	hasPassword := false
+	tests := []struct {
+		name         string
+		sessionToken string
+		options      ListOptions
+		wantPath     string
+		wantQuery    string
+	}{
+		{name: "every link", wantPath: "/api/v1/urls"},
+		{
+			name:      "filters",
+			options:   ListOptions{Limit: 10, Cursor: "next", Sort: SortHitsAsc, Status: StatusPaused, HasPassword: &hasPassword, Domain: "example.com"},
+			wantPath:  "/api/v1/urls",
+			wantQuery: "cursor=next&domain=example.com&has_password=false&limit=10&sort=hits_asc&status=paused",
+		},
+		{name: "session", sessionToken: "signed-session", wantPath: "/api/v1/user-session-urls"},
+		{name: "workspace", options: ListOptions{WorkspaceID: "workspace-a"}, wantPath: "/api/v1/user-session-urls", wantQuery: "workspace_id=workspace-a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client := newTestServer(t, testResponse{status: http.StatusOK, body: `{"result":[{"id":"a"},{"id":"b"}],"next_cursor":"after-b"}`})
+			client.SessionToken = test.sessionToken
+			page, err := client.List(context.Background(), test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Links) != 2 || page.Links[1].ID != "b" || page.NextCursor != "after-b" {
+				t.Errorf("page = %+v", page)
+			}
+			request := server.recorded()[0]
+			if request.Path != test.wantPath || request.RawQuery != test.wantQuery || request.SessionToken != test.sessionToken {
+				t.Errorf("request = %+v, want %s?%s with session %q", request, test.wantPath, test.wantQuery, test.sessionToken)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	server, client := newTestServer(t,
+		testResponse{status: http.StatusOK, body: `{"result":{"succeeded":["a"],"failed":[]}}`},
+		testResponse{status: http.StatusOK, body: `{"result":{"succeeded":[],"failed":[{"message":"URL not found","code":"not_found","errorCode":404,"id":"b"}]}}`},
+	)
+	if err := client.Delete(context.Background(), "a"); err != nil {
+		t.Errorf("Delete(a) = %v", err)
+	}
+	err := client.Delete(context.Background(), "b")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != CodeNotFound || apiErr.ID != "b" {
+		t.Errorf("Delete(b) = %v, want the not_found item error", err)
+	}
+	if request := server.recorded()[0]; request.Method != http.MethodPost || request.Path != "/api/v1/urls/batch/delete" || request.Body != `{"ids":["a"]}` {
+		t.Errorf("request = %+v", request)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		response       testResponse
+		wantStatusCode int
+		wantCode       string
+		wantFields     map[string]string
+		wantAttempts   int
+	}{
+		{
+			name:           "validation failed",
+			response:       testResponse{status: http.StatusBadRequest, body: `{"error":{"message":"Invalid request","code":"validation_failed","errorCode":400,"fields":{"destination":"must be a URL"}}}`},
+			wantStatusCode: http.StatusBadRequest, wantCode: CodeValidationFailed, wantFields: map[string]string{"destination": "must be a URL"}, wantAttempts: 1,
+		},
+		{
+			name:           "not found",
+			response:       testResponse{status: http.StatusNotFound, body: `{"error":{"message":"URL not found","code":"not_found","errorCode":404}}`},
+			wantStatusCode: http.StatusNotFound, wantCode: CodeNotFound, wantAttempts: 1,
+		},
+		{
+			name:           "retried until the retries run out",
+			response:       testResponse{status: http.StatusServiceUnavailable, body: unavailableBody},
+			wantStatusCode: http.StatusServiceUnavailable, wantCode: CodeUnavailable, wantAttempts: DefaultMaxRetries + 1,
+		},
+		{
+			name:           "not an envelope",
+			response:       testResponse{status: http.StatusBadGateway, body: "<html>Bad Gateway</html>"},
+			wantStatusCode: http.StatusBadGateway, wantAttempts: DefaultMaxRetries + 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client := newTestServer(t, test.response)
+			_, err := client.Get(context.Background(), "abc")
+			var apiErr *Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Get() error = %v, want an *Error", err)
+			}
+			if apiErr.StatusCode != test.wantStatusCode || apiErr.Code != test.wantCode || len(apiErr.Fields) != len(test.wantFields) {
+				t.Errorf("error = %+v, want status %d and code %q", apiErr, test.wantStatusCode, test.wantCode)
+			}
+			for field, message := range test.wantFields {
+				if apiErr.Fields[field] != message {
+					t.Errorf("fields = %v, want %v", apiErr.Fields, test.wantFields)
+				}
+			}
+			if test.wantCode != "" && !IsCode(err, test.wantCode) {
+				t.Errorf("IsCode(%v, %s) = false", err, test.wantCode)
+			}
+			if attempts := len(server.recorded()); attempts != test.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, test.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryAfterIsHonored(t *testing.T) {
+	rateLimited := testResponse{status: http.StatusTooManyRequests, body: `{"error":{"message":"Too many requests","code":"rate_limited","errorCode":429}}`, retryAfter: "1"}
+	server, client := newTestServer(t, rateLimited, testResponse{status: http.StatusOK, body: `{"result":{"id":"abc"}}`})
+	started := time.Now()
+	if _, err := client.Get(context.Background(), "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(started); waited < time.Second {
+		t.Errorf("retried after %v, want the 1s Retry-After", waited)
+	}
+	if attempts := len(server.recorded()); attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+}
+
+func TestCancelledContextStopsRetries(t *testing.T) {
+	server, client := newTestServer(t, testResponse{status: http.StatusTooManyRequests, body: `{"error":{"code":"rate_limited"}}`, retryAfter: "60"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err := client.Get(ctx, "abc")
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(started) > 10*time.Second {
+		t.Errorf("Get() = %v after %v, want the context error without waiting for Retry-After", err, time.Since(started))
+	}
+	if attempts := len(server.recorded()); attempts != 1 {
+		t.Errorf("attempts = %d, want 1", attempts)
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	err := &Error{Message: "URL not found", Detail: "sql: no rows in result set", StatusCode: http.StatusNotFound, Code: CodeNotFound}
+	if got, want := err.Error(), "nolongr: 404 not_found: URL not found: sql: no rows in result set"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	var decoded Error
+	if err := json.Unmarshal([]byte(`{"message":"m","error":"d","errorCode":409,"code":"id_conflict","id":"abc"}`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Detail != "d" || decoded.StatusCode != http.StatusConflict || decoded.Code != CodeIDConflict || decoded.ID != "abc" {
+		t.Errorf("decoded = %+v", decoded)
+	}
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"fmt"
+)
+
+// Link is a short link as returned by the API.
+type Link struct {
+	ID          string  `json:"id"`
+	DateCreated string  `json:"date_created"`
+	Destination string  `json:"destination"`
+	MaxPageHits int64   `json:"max_page_hits"`
+	PageHits    int64   `json:"page_hits"`
+	Password    *string `json:"password"`
+	// HasPassword is set instead of Password when the link is read with Get
+	HasPassword  bool     `json:"has_password"`
+	SelfDestruct *string  `json:"self_destruct"`
+	SessionToken string   `json:"session_token"`
+	URL          string   `json:"url"`
+	Paused       bool     `json:"paused"`
+	Title        string   `json:"title"`
+	Tags         []string `json:"tags"`
+	// UserID is the account owning the link, if any
+	UserID string `json:"user_id"`
+	// WorkspaceID is the workspace sharing the link, if any
+	WorkspaceID string `json:"workspace_id"`
+}
+
+// CreateRequest describes a link to create. SelfDestruct is in seconds from now.
+type CreateRequest struct {
+	Destination  string   `json:"destination"`
+	MaxPageHits  *int64   `json:"max_page_hits,omitempty"`
+	Password     string   `json:"password,omitempty"`
+	SelfDestruct *int64   `json:"self_destruct,omitempty"`
+	Title        string   `json:"title,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	// WorkspaceID creates the link in a workspace the key's account is an editor of
+	WorkspaceID string `json:"workspace_id,omitempty"`
+}
+
+// Sort orders and statuses accepted by ListOptions
+const (
+	SortCreatedDesc = "created_desc"
+	SortCreatedAsc  = "created_asc"
+	SortHitsDesc    = "hits_desc"
+	SortHitsAsc     = "hits_asc"
+
+	StatusActive  = "active"
+	StatusExpired = "expired"
+	StatusPaused  = "paused"
+)
+
+// ListOptions filters and pages a link listing. Zero values use the server defaults.
+// CreatedAfter and CreatedBefore are RFC 3339 timestamps. WorkspaceID lists the links of a workspace
+// the key's account is a member of.
+type ListOptions struct {
+	Limit         int
+	Cursor        string
+	Sort          string
+	Status        string
+	HasPassword   *bool
+	Domain        string
+	CreatedAfter  string
+	CreatedBefore string
+	WorkspaceID   string
+}
+
+// Page is one page of a link listing. NextCursor is empty on the last page.
+type Page struct {
+	Links      []Link
+	NextCursor string
+}
+
+type DailyVisits struct {
+	Day    string `json:"day"`
+	Visits int64  `json:"visits"`
+}
+
+// Stats counts the page views of a link. DailyVisits only covers visitors who did not opt out of tracking.
+type Stats struct {
+	ID          string        `json:"id"`
+	PageHits    int64         `json:"page_hits"`
+	MaxPageHits int64         `json:"max_page_hits"`
+	DailyVisits []DailyVisits `json:"daily_visits"`
+}
+
+// QuotaUsage is the usage of one quota. Limit is 0 when unlimited; ResetsAt is empty for active links.
+type QuotaUsage struct {
+	Used     int64  `json:"used"`
+	Limit    int64  `json:"limit"`
+	ResetsAt string `json:"resets_at,omitempty"`
+}
+
+type QuotaStatus struct {
+	ActiveLinks      QuotaUsage `json:"active_links"`
+	DailyCreations   QuotaUsage `json:"daily_creations"`
+	MonthlyRedirects QuotaUsage `json:"monthly_redirects"`
+}
+
+// Machine-readable error codes found in Error.Code
+const (
+	CodeBadRequest         = "bad_request"
+	CodeValidationFailed   = "validation_failed"
+	CodeForbiddenDomain    = "forbidden_domain"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeExpired            = "expired"
+	CodeMaxHitsReached     = "max_hits_reached"
+	CodePaused             = "paused"
+	CodeWrongPassword      = "wrong_password"
+	CodeIDConflict         = "id_conflict"
+	CodeRateLimited        = "rate_limited"
+	CodeQuotaExceeded      = "quota_exceeded"
+	CodeEmailTaken         = "email_taken"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeInvalidToken       = "invalid_token"
+	CodeSsoFailed          = "sso_failed"
+	CodeSsoUnavailable     = "sso_provider_unavailable"
+	CodeIdentityLinked     = "identity_linked"
+	CodeLastWorkspaceOwner = "last_workspace_owner"
+	CodeCsrfFailed         = "csrf_failed"
+	CodeInternal           = "internal_error"
+	CodeUnavailable        = "database_unavailable"
+)
+
+// Error is an error response of the API.
+type Error struct {
+	Message string `json:"message"`
+	// Detail is the underlying error reported by the server, if any
+	Detail string `json:"error"`
+	// StatusCode is the HTTP status of the response
+	StatusCode int    `json:"errorCode"`
+	Code       string `json:"code"`
+	ID         string `json:"id"`
+	// Fields lists the rejected request fields when Code is CodeValidationFailed
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+func (err *Error) Error() string {
+	message := fmt.Sprintf("nolongr: %d %s: %s", err.StatusCode, err.Code, err.Message)
+	if err.Detail != "" {
+		message += ": " + err.Detail
+	}
+	return message
+}
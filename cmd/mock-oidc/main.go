@@ -0,0 +1,32 @@
+// Command mock-oidc is an OpenID Connect provider for trying out and testing single sign-on locally. It logs
+// in anyone without asking for a password: the authorization endpoint shows a form to pick the email to log in
+// as, or logs in as login_hint right away when one is given.
+//
+//	mock-oidc [-addr :9000] [-issuer http://localhost:9000] [-client-id nolongr] [-client-secret S]
+//
+// Point the server at it with NOLONGR_OIDC_ISSUER=http://localhost:9000 and NOLONGR_OIDC_CLIENT_ID=nolongr.
+// Authorization codes are single use, expire after a minute and need the PKCE S256 verifier.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"main.go/mockoidc"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "address to listen on")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer URL, which must be where the server reaches this provider")
+	clientID := flag.String("client-id", "nolongr", "client id to accept")
+	clientSecret := flag.String("client-secret", "", "client secret to require at the token endpoint, if any")
+	flag.Parse()
+
+	mock, err := mockoidc.New(*issuer, *clientID, *clientSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("mock-oidc issuer %s listening on %s", mock.Issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, mock.Handler()))
+}
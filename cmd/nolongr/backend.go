@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	utils "main.go/api-utils"
+	"main.go/client"
+)
+
+// backend is where the CLI manages links: a server through its API, or the database directly.
+type backend interface {
+	Create(ctx context.Context, request client.CreateRequest, alias string) (*client.Link, error)
+	Get(ctx context.Context, id string) (*client.Link, error)
+	List(ctx context.Context, options client.ListOptions) (*client.Page, error)
+	Delete(ctx context.Context, id string) error
+	Stats(ctx context.Context, id string) (*client.Stats, error)
+}
+
+type apiBackend struct {
+	client *client.Client
+}
+
+func (backend apiBackend) Create(ctx context.Context, request client.CreateRequest, alias string) (*client.Link, error) {
+	if alias != "" {
+		return nil, errors.New("-alias is only supported with -db")
+	}
+	return backend.client.Create(ctx, request)
+}
+
+func (backend apiBackend) Get(ctx context.Context, id string) (*client.Link, error) {
+	return backend.client.Get(ctx, id)
+}
+
+func (backend apiBackend) List(ctx context.Context, options client.ListOptions) (*client.Page, error) {
+	return backend.client.List(ctx, options)
+}
+
+func (backend apiBackend) Delete(ctx context.Context, id string) error {
+	return backend.client.Delete(ctx, id)
+}
+
+func (backend apiBackend) Stats(ctx context.Context, id string) (*client.Stats, error) {
+	return backend.client.Stats(ctx, id)
+}
+
+// dbBackend uses the database configured by the DSN environment variable, like the server does.
+// It acts with the rights of the server API key.
+type dbBackend struct {
+	sessionToken string
+}
+
+func toClientLink(urlData utils.URLData) *client.Link {
+	return &client.Link{
+		ID:           urlData.ID,
+		DateCreated:  urlData.DateCreated,
+		Destination:  urlData.Destination,
+		MaxPageHits:  urlData.MaxPageHits,
+		PageHits:     urlData.PageHits,
+		Password:     urlData.Password,
+		HasPassword:  urlData.Password != nil && *urlData.Password != "",
+		SelfDestruct: urlData.SelfDestruct,
+		SessionToken: urlData.SessionToken,
+		URL:          urlData.URL,
+		Paused:       urlData.Paused,
+		Title:        urlData.Title,
+		Tags:         urlData.Tags,
+		UserID:       urlData.UserID,
+		WorkspaceID:  urlData.WorkspaceID,
+	}
+}
+
+func (backend dbBackend) Create(ctx context.Context, request client.CreateRequest, alias string) (*client.Link, error) {
+	urlData, err := utils.CreateLink(utils.CreateShortUrlRequestBody{
+		Destination:  request.Destination,
+		MaxPageHits:  request.MaxPageHits,
+		Password:     request.Password,
+		SelfDestruct: request.SelfDestruct,
+		Title:        request.Title,
+		Tags:         request.Tags,
+	}, alias, backend.sessionToken)
+	if err != nil {
+		return nil, err
+	}
+	return toClientLink(urlData), nil
+}
+
+// Get also returns expired and paused links, unlike the API.
+func (backend dbBackend) Get(ctx context.Context, id string) (*client.Link, error) {
+	urlData, err := utils.GetSingleUrl(id)
+	if err != nil {
+		return nil, err
+	}
+	return toClientLink(urlData), nil
+}
+
+func (backend dbBackend) List(ctx context.Context, options client.ListOptions) (*client.Page, error) {
+	listOptions := utils.UrlListOptions{
+		SessionToken:  backend.sessionToken,
+		Status:        options.Status,
+		HasPassword:   options.HasPassword,
+		Domain:        options.Domain,
+		CreatedAfter:  options.CreatedAfter,
+		CreatedBefore: options.CreatedBefore,
+		Sort:          options.Sort,
+		Limit:         options.Limit,
+		Cursor:        options.Cursor,
+	}
+	if listOptions.Sort == "" {
+		listOptions.Sort = utils.URL_SORT_CREATED_DESC
+	}
+	if listOptions.Limit == 0 {
+		listOptions.Limit = utils.DEFAULT_LIST_LIMIT
+	}
+
+	urls, nextCursor, err := utils.ListUrls(listOptions)
+	if err != nil {
+		return nil, err
+	}
+	page := &client.Page{Links: []client.Link{}, NextCursor: nextCursor}
+	for _, urlData := range urls {
+		page.Links = append(page.Links, *toClientLink(urlData))
+	}
+	return page, nil
+}
+
+func (backend dbBackend) Delete(ctx context.Context, id string) error {
+	urlData, err := utils.GetSingleUrl(id)
+	if err != nil {
+		return err
+	}
+	if backend.sessionToken != "" && urlData.SessionToken != backend.sessionToken {
+		return errors.New("the link belongs to another session")
+	}
+	return utils.DeleteUrlsByIds([]string{id})
+}
+
+func (backend dbBackend) Stats(ctx context.Context, id string) (*client.Stats, error) {
+	stats, err := utils.GetUrlStats(id)
+	if err != nil {
+		return nil, err
+	}
+	result := &client.Stats{ID: stats.ID, PageHits: stats.PageHits, MaxPageHits: stats.MaxPageHits, DailyVisits: []client.DailyVisits{}}
+	for _, dailyVisits := range stats.DailyVisits {
+		result.DailyVisits = append(result.DailyVisits, client.DailyVisits{Day: dailyVisits.Day, Visits: dailyVisits.Visits})
+	}
+	return result, nil
+}
@@ -0,0 +1,297 @@
+// Command nolongr manages short links from a terminal or CI job, either against a server with an API key
+// or directly against the database configured by the DSN environment variable.
+//
+//	nolongr [-server URL] [-api-key KEY] [-db] [-session TOKEN] [-o table|json] <command> [flags]
+//
+// Commands: create, list, inspect, delete, export. Run "nolongr <command> -h" for the flags of a command.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"main.go/client"
+)
+
+const usage = `Usage: nolongr [global flags] <command> [flags]
+
+Commands:
+  create   -destination URL [-title T] [-tags a,b] [-password P] [-max-hits N] [-expires 24h] [-alias ID]
+  list     [-limit N] [-all] [-status S] [-sort S] [-domain D] [-cursor C]
+  inspect  ID...
+  delete   ID...
+  export   [-format json|csv] [-status S] [-file PATH]
+
+Global flags:
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	global := flag.NewFlagSet("nolongr", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		global.PrintDefaults()
+	}
+	server := global.String("server", envOrDefault("NOLONGR_SERVER_URL", client.DefaultBaseURL), "API root of the server (NOLONGR_SERVER_URL)")
+	apiKey := global.String("api-key", envOrDefault("NOLONGR_API_KEY", os.Getenv("NOLONGR_SERVER_API_KEY")), "API key (NOLONGR_API_KEY, or the legacy NOLONGR_SERVER_API_KEY)")
+	useDatabase := global.Bool("db", false, "use the database in DSN instead of a server")
+	sessionToken := global.String("session", "", "act as this browser session, the session_token cookie of the browser (or the bare token with -db): own created links and only list and delete its links")
+	output := global.String("o", OUTPUT_TABLE, "output format: table or json")
+	timeout := global.Duration("timeout", time.Minute, "time limit of the command")
+	if err := global.Parse(args); err != nil {
+		return 2
+	}
+	if *output != OUTPUT_TABLE && *output != OUTPUT_JSON {
+		fmt.Fprintln(stderr, "-o must be table or json")
+		return 2
+	}
+	if global.NArg() == 0 {
+		global.Usage()
+		return 2
+	}
+
+	var links backend
+	if *useDatabase {
+		links = dbBackend{sessionToken: *sessionToken}
+	} else {
+		apiClient := client.NewClient(strings.TrimSuffix(*server, "/"), *apiKey)
+		apiClient.SessionToken = *sessionToken
+		links = apiBackend{client: apiClient}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	command, commandArgs := global.Arg(0), global.Args()[1:]
+	var err error
+	switch command {
+	case "create":
+		err = runCreate(ctx, links, commandArgs, *output, stdout, stderr)
+	case "list":
+		err = runList(ctx, links, commandArgs, *output, stdout, stderr)
+	case "inspect":
+		err = runInspect(ctx, links, commandArgs, *output, stdout)
+	case "delete":
+		err = runDelete(ctx, links, commandArgs, stdout)
+	case "export":
+		err = runExport(ctx, links, commandArgs, stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n", command)
+		global.Usage()
+		return 2
+	}
+
+	if errors.Is(err, flag.ErrHelp) || errors.Is(err, errUsage) {
+		return 2
+	} else if err != nil {
+		fmt.Fprintln(stderr, "nolongr:", err)
+		return 1
+	}
+	return 0
+}
+
+var errUsage = errors.New("usage")
+
+func envOrDefault(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	return flags
+}
+
+func runCreate(ctx context.Context, links backend, args []string, output string, stdout io.Writer, stderr io.Writer) error {
+	flags := newFlagSet("create", stderr)
+	destination := flags.String("destination", "", "URL to shorten (required)")
+	title := flags.String("title", "", "title of the link")
+	tags := flags.String("tags", "", "comma-separated tags")
+	password := flags.String("password", "", "password visitors must enter")
+	maxHits := flags.Int64("max-hits", 0, "page views after which the link expires, 0 for no limit")
+	expires := flags.Duration("expires", 0, "lifetime of the link, e.g. 24h, 0 for no expiry")
+	alias := flags.String("alias", "", "custom ID (with -db only)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *destination == "" && flags.NArg() == 1 {
+		*destination = flags.Arg(0)
+	}
+	if *destination == "" {
+		fmt.Fprintln(stderr, "create: -destination is required")
+		flags.Usage()
+		return errUsage
+	}
+
+	request := client.CreateRequest{Destination: *destination, Title: *title, Password: *password}
+	if *tags != "" {
+		for _, tag := range strings.Split(*tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				request.Tags = append(request.Tags, tag)
+			}
+		}
+	}
+	if *maxHits > 0 {
+		request.MaxPageHits = maxHits
+	}
+	if *expires > 0 {
+		seconds := int64(expires.Seconds())
+		request.SelfDestruct = &seconds
+	}
+
+	link, err := links.Create(ctx, request, *alias)
+	if err != nil {
+		return err
+	}
+	if output == OUTPUT_JSON {
+		return writeJSON(stdout, link)
+	}
+	fmt.Fprintln(stdout, link.URL)
+	return nil
+}
+
+// addListFlags registers the listing filters shared by list and export.
+func addListFlags(flags *flag.FlagSet, options *client.ListOptions) {
+	flags.StringVar(&options.Status, "status", "", "active, expired or paused")
+	flags.StringVar(&options.Sort, "sort", "", "created_desc (default), created_asc, hits_desc or hits_asc")
+	flags.StringVar(&options.Domain, "domain", "", "only links whose destination is on this host")
+	flags.StringVar(&options.CreatedAfter, "created-after", "", "RFC 3339 timestamp, inclusive")
+	flags.StringVar(&options.CreatedBefore, "created-before", "", "RFC 3339 timestamp, exclusive")
+}
+
+// listAll follows the cursors until the last page.
+func listAll(ctx context.Context, links backend, options client.ListOptions) ([]client.Link, error) {
+	all := []client.Link{}
+	for {
+		page, err := links.List(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page.Links...)
+		if page.NextCursor == "" {
+			return all, nil
+		}
+		options.Cursor = page.NextCursor
+	}
+}
+
+func runList(ctx context.Context, links backend, args []string, output string, stdout io.Writer, stderr io.Writer) error {
+	flags := newFlagSet("list", stderr)
+	options := client.ListOptions{}
+	addListFlags(flags, &options)
+	flags.IntVar(&options.Limit, "limit", 0, "page size, up to 200")
+	flags.StringVar(&options.Cursor, "cursor", "", "next cursor printed by the previous page")
+	all := flags.Bool("all", false, "list every page")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *all {
+		result, err := listAll(ctx, links, options)
+		if err != nil {
+			return err
+		}
+		return writeLinks(stdout, output, result)
+	}
+
+	page, err := links.List(ctx, options)
+	if err != nil {
+		return err
+	}
+	if output == OUTPUT_JSON {
+		return writeJSON(stdout, map[string]interface{}{"links": page.Links, "next_cursor": page.NextCursor})
+	}
+	err = writeLinksTable(stdout, page.Links)
+	if err == nil && page.NextCursor != "" {
+		fmt.Fprintf(stdout, "\nMore links: -cursor %s\n", page.NextCursor)
+	}
+	return err
+}
+
+func runInspect(ctx context.Context, links backend, ids []string, output string, stdout io.Writer) error {
+	if len(ids) == 0 {
+		return errors.New("inspect: at least one ID is required")
+	}
+	for i, id := range ids {
+		link, err := links.Get(ctx, id)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		stats, err := links.Stats(ctx, id)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		if i > 0 && output == OUTPUT_TABLE {
+			fmt.Fprintln(stdout)
+		}
+		if err := writeLinkDetails(stdout, output, linkDetails{Link: link, Stats: stats}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runDelete(ctx context.Context, links backend, ids []string, stdout io.Writer) error {
+	if len(ids) == 0 {
+		return errors.New("delete: at least one ID is required")
+	}
+	failed := 0
+	for _, id := range ids {
+		if err := links.Delete(ctx, id); err != nil {
+			fmt.Fprintf(stdout, "%s: %v\n", id, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: deleted\n", id)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d links could not be deleted", failed, len(ids))
+	}
+	return nil
+}
+
+func runExport(ctx context.Context, links backend, args []string, stdout io.Writer, stderr io.Writer) error {
+	flags := newFlagSet("export", stderr)
+	options := client.ListOptions{Limit: 200}
+	addListFlags(flags, &options)
+	format := flags.String("format", OUTPUT_JSON, "json or csv")
+	file := flags.String("file", "", "write to this file instead of the standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != OUTPUT_JSON && *format != OUTPUT_CSV {
+		return errors.New("export: -format must be json or csv")
+	}
+
+	result, err := listAll(ctx, links, options)
+	if err != nil {
+		return err
+	}
+
+	out := stdout
+	if *file != "" {
+		outFile, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer outFile.Close()
+		out = outFile
+	}
+	if *format == OUTPUT_CSV {
+		return writeLinksCSV(out, result)
+	}
+	return writeJSON(out, result)
+}
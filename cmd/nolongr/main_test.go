@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"main.go/client"
+)
+
+// fakeBackend serves links from memory, a page of pageSize links at a time.
+type fakeBackend struct {
+	links    []client.Link
+	pageSize int
+	created  []client.CreateRequest
+	listed   []client.ListOptions
+	deleted  []string
+}
+
+var errFakeNotFound = errors.New("not found")
+
+func (backend *fakeBackend) Create(ctx context.Context, request client.CreateRequest, alias string) (*client.Link, error) {
+	backend.created = append(backend.created, request)
+	id := alias
+	if id == "" {
+		id = "new"
+	}
+	return &client.Link{ID: id, URL: "https://nolongr.test/" + id, Destination: request.Destination}, nil
+}
+
+func (backend *fakeBackend) Get(ctx context.Context, id string) (*client.Link, error) {
+	for _, link := range backend.links {
+		if link.ID == id {
+			return &link, nil
+		}
+	}
+	return nil, errFakeNotFound
+}
+
+func (backend *fakeBackend) List(ctx context.Context, options client.ListOptions) (*client.Page, error) {
+	backend.listed = append(backend.listed, options)
+	start := 0
+	if options.Cursor != "" {
+		for i, link := range backend.links {
+			if link.ID == options.Cursor {
+				start = i + 1
+			}
+		}
+	}
+	end := start + backend.pageSize
+	if end >= len(backend.links) {
+		return &client.Page{Links: backend.links[start:]}, nil
+	}
+	return &client.Page{Links: backend.links[start:end], NextCursor: backend.links[end-1].ID}, nil
+}
+
+func (backend *fakeBackend) Delete(ctx context.Context, id string) error {
+	if _, err := backend.Get(ctx, id); err != nil {
+		return err
+	}
+	backend.deleted = append(backend.deleted, id)
+	return nil
+}
+
+func (backend *fakeBackend) Stats(ctx context.Context, id string) (*client.Stats, error) {
+	link, err := backend.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &client.Stats{ID: id, PageHits: link.PageHits, DailyVisits: []client.DailyVisits{{Day: "2024-05-01", Visits: link.PageHits}}}, nil
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		pageSize: 2,
+		links: []client.Link{
+			{ID: "a", URL: "https://nolongr.test/a", Destination: "https://example.com/a", PageHits: 1},
+			{ID: "b", URL: "https://nolongr.test/b", Destination: "https://example.com/b", PageHits: 2, MaxPageHits: 5},
+			{ID: "c", URL: "https://nolongr.test/c", HasPassword: true, Tags: []string{"x", "y"}},
+		},
+	}
+}
+
+func TestRunCreate(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantErr     error
+		wantRequest client.CreateRequest
+	}{
+		{name: "destination argument", args: []string{"https://example.com"}, wantRequest: client.CreateRequest{Destination: "https://example.com"}},
+		{
+			name:        "every flag",
+			args:        []string{"-destination", "https://example.com", "-title", "Docs", "-tags", " a, ,b", "-password", "secret", "-max-hits", "10", "-expires", "2h"},
+			wantRequest: client.CreateRequest{Destination: "https://example.com", Title: "Docs", Tags: []string{"a", "b"}, Password: "secret", MaxPageHits: int64Pointer(10), SelfDestruct: int64Pointer(7200)},
+		},
+		{name: "no destination", args: []string{"-title", "Docs"}, wantErr: errUsage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			links := newFakeBackend()
+			stdout := &bytes.Buffer{}
+			err := runCreate(context.Background(), links, test.args, OUTPUT_TABLE, stdout, io.Discard)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("runCreate() = %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr != nil {
+				return
+			}
+			if len(links.created) != 1 {
+				t.Fatalf("created = %+v", links.created)
+			}
+			got, want := links.created[0], test.wantRequest
+			if got.Destination != want.Destination || got.Title != want.Title || got.Password != want.Password ||
+				strings.Join(got.Tags, ",") != strings.Join(want.Tags, ",") ||
+				!equalInt64Pointers(got.MaxPageHits, want.MaxPageHits) || !equalInt64Pointers(got.SelfDestruct, want.SelfDestruct) {
+				t.Errorf("request = %+v, want %+v", got, want)
+			}
+			if stdout.String() != "https://nolongr.test/new\n" {
+				t.Errorf("output = %q, want the short URL", stdout.String())
+			}
+		})
+	}
+}
+
+func int64Pointer(value int64) *int64 {
+	return &value
+}
+
+func equalInt64Pointers(a *int64, b *int64) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func TestRunList(t *testing.T) {
+	links := newFakeBackend()
+	stdout := &bytes.Buffer{}
+	if err := runList(context.Background(), links, []string{"-status", "active", "-limit", "2"}, OUTPUT_TABLE, stdout, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "https://example.com/b") || strings.Contains(stdout.String(), "nolongr.test/c") || !strings.HasSuffix(stdout.String(), "More links: -cursor b\n") {
+		t.Errorf("output = %s, want the first page and the next cursor", stdout.String())
+	}
+	if options := links.listed[0]; options.Status != client.StatusActive || options.Limit != 2 {
+		t.Errorf("options = %+v", options)
+	}
+
+	stdout.Reset()
+	if err := runList(context.Background(), links, []string{"-all"}, OUTPUT_JSON, stdout, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var all []client.Link
+	if err := json.Unmarshal(stdout.Bytes(), &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 || all[2].ID != "c" {
+		t.Errorf("links = %+v, want every page", all)
+	}
+}
+
+func TestRunInspect(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	if err := runInspect(context.Background(), newFakeBackend(), []string{"b"}, OUTPUT_TABLE, stdout); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Destination  https://example.com/b", "Hits         2/5", "2024-05-01  2"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("output = %s, want %q", stdout.String(), want)
+		}
+	}
+	if err := runInspect(context.Background(), newFakeBackend(), []string{"missing"}, OUTPUT_TABLE, io.Discard); !errors.Is(err, errFakeNotFound) {
+		t.Errorf("runInspect(missing) = %v, want %v", err, errFakeNotFound)
+	}
+}
+
+func TestRunDelete(t *testing.T) {
+	links := newFakeBackend()
+	stdout := &bytes.Buffer{}
+	err := runDelete(context.Background(), links, []string{"a", "missing", "c"}, stdout)
+	if err == nil || err.Error() != "1 of 3 links could not be deleted" {
+		t.Errorf("runDelete() = %v", err)
+	}
+	if strings.Join(links.deleted, ",") != "a,c" || stdout.String() != "a: deleted\nmissing: not found\nc: deleted\n" {
+		t.Errorf("deleted = %v, output = %q", links.deleted, stdout.String())
+	}
+}
+
+func TestRunExport(t *testing.T) {
+	links := newFakeBackend()
+	file := filepath.Join(t.TempDir(), "links.csv")
+	if err := runExport(context.Background(), links, []string{"-format", "csv", "-file", file}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 4 {
+		t.Errorf("export = %s, want a header and every link", data)
+	}
+	if options := links.listed[0]; options.Limit != 200 {
+		t.Errorf("options = %+v, want the largest page", options)
+	}
+	if err := runExport(context.Background(), links, []string{"-format", "xml"}, io.Discard, io.Discard); err == nil {
+		t.Error("runExport(-format xml) succeeded")
+	}
+}
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Bearer test-key" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(writer, `{"error":{"message":"An API key is required","code":"unauthorized","errorCode":401}}`)
+			return
+		}
+		io.WriteString(writer, `{"result":[{"id":"a","destination":"https://example.com/a"}]}`)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+		wantStderr string
+	}{
+		{name: "list", args: []string{"-server", server.URL + "/", "-api-key", "test-key", "-o", "json", "list"}, wantCode: 0, wantStdout: `"next_cursor": ""`},
+		{name: "api error", args: []string{"-server", server.URL, "-api-key", "wrong", "list"}, wantCode: 1, wantStderr: "401 unauthorized"},
+		{name: "no command", args: []string{}, wantCode: 2, wantStderr: "Usage: nolongr"},
+		{name: "unknown command", args: []string{"rename"}, wantCode: 2, wantStderr: `unknown command "rename"`},
+		{name: "unknown output", args: []string{"-o", "yaml", "list"}, wantCode: 2, wantStderr: "-o must be table or json"},
+		{name: "alias without -db", args: []string{"-server", server.URL, "create", "-alias", "a", "https://example.com"}, wantCode: 1, wantStderr: "-alias is only supported with -db"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			code := run(test.args, stdout, stderr)
+			if code != test.wantCode || !strings.Contains(stdout.String(), test.wantStdout) || !strings.Contains(stderr.String(), test.wantStderr) {
+				t.Errorf("run() = %d, stdout %q, stderr %q, want %d, %q, %q", code, stdout.String(), stderr.String(), test.wantCode, test.wantStdout, test.wantStderr)
+			}
+		})
+	}
+}
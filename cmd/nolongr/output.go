@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"main.go/client"
+)
+
+const (
+	OUTPUT_TABLE = "table"
+	OUTPUT_JSON  = "json"
+	OUTPUT_CSV   = "csv"
+)
+
+func writeJSON(out io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func valueOrDash(value *string) string {
+	if value == nil || *value == "" {
+		return "-"
+	}
+	return *value
+}
+
+func hitsColumn(link client.Link) string {
+	if link.MaxPageHits == 0 {
+		return strconv.FormatInt(link.PageHits, 10)
+	}
+	return fmt.Sprintf("%d/%d", link.PageHits, link.MaxPageHits)
+}
+
+// hasPassword reads HasPassword, which replaces the password hash when the API hides it.
+func hasPassword(link client.Link) bool {
+	return link.HasPassword || (link.Password != nil && *link.Password != "")
+}
+
+func writeLinksTable(out io.Writer, links []client.Link) error {
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tDESTINATION\tHITS\tEXPIRES\tPAUSED\tPASSWORD\tTITLE\tTAGS")
+	for _, link := range links {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%t\t%t\t%s\t%s\n",
+			link.ID,
+			link.Destination,
+			hitsColumn(link),
+			valueOrDash(link.SelfDestruct),
+			link.Paused,
+			hasPassword(link),
+			link.Title,
+			strings.Join(link.Tags, ","),
+		)
+	}
+	return writer.Flush()
+}
+
+func writeLinks(out io.Writer, output string, links []client.Link) error {
+	if output == OUTPUT_JSON {
+		return writeJSON(out, links)
+	}
+	return writeLinksTable(out, links)
+}
+
+// linkDetails is what inspect prints: the link and its page views.
+type linkDetails struct {
+	Link  *client.Link  `json:"link"`
+	Stats *client.Stats `json:"stats"`
+}
+
+func writeLinkDetails(out io.Writer, output string, details linkDetails) error {
+	if output == OUTPUT_JSON {
+		return writeJSON(out, details)
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	link := details.Link
+	fmt.Fprintf(writer, "ID\t%s\n", link.ID)
+	fmt.Fprintf(writer, "URL\t%s\n", link.URL)
+	fmt.Fprintf(writer, "Destination\t%s\n", link.Destination)
+	fmt.Fprintf(writer, "Created\t%s\n", link.DateCreated)
+	fmt.Fprintf(writer, "Expires\t%s\n", valueOrDash(link.SelfDestruct))
+	fmt.Fprintf(writer, "Hits\t%s\n", hitsColumn(*link))
+	fmt.Fprintf(writer, "Paused\t%t\n", link.Paused)
+	fmt.Fprintf(writer, "Password\t%t\n", hasPassword(*link))
+	fmt.Fprintf(writer, "Title\t%s\n", link.Title)
+	fmt.Fprintf(writer, "Tags\t%s\n", strings.Join(link.Tags, ","))
+	if details.Stats != nil && len(details.Stats.DailyVisits) > 0 {
+		fmt.Fprintln(writer, "\nDAY\tVISITS")
+		for _, dailyVisits := range details.Stats.DailyVisits {
+			fmt.Fprintf(writer, "%s\t%d\n", dailyVisits.Day, dailyVisits.Visits)
+		}
+	}
+	return writer.Flush()
+}
+
+// writeLinksCSV writes the links with a header row. has_password replaces the password hash.
+func writeLinksCSV(out io.Writer, links []client.Link) error {
+	writer := csv.NewWriter(out)
+	writer.Write([]string{"id", "url", "destination", "date_created", "self_destruct", "page_hits", "max_page_hits", "paused", "has_password", "title", "tags"})
+	for _, link := range links {
+		selfDestruct := ""
+		if link.SelfDestruct != nil {
+			selfDestruct = *link.SelfDestruct
+		}
+		writer.Write([]string{
+			link.ID,
+			link.URL,
+			link.Destination,
+			link.DateCreated,
+			selfDestruct,
+			strconv.FormatInt(link.PageHits, 10),
+			strconv.FormatInt(link.MaxPageHits, 10),
+			strconv.FormatBool(link.Paused),
+			strconv.FormatBool(hasPassword(link)),
+			link.Title,
+			strings.Join(link.Tags, ","),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+
+	"main.go/client"
+)
+
+func TestWriteLinksTable(t *testing.T) {
+	selfDestruct := "2024-06-01T00:00:00Z"
+	out := &bytes.Buffer{}
+	err := writeLinksTable(out, []client.Link{
+		{ID: "a", Destination: "https://example.com", PageHits: 3, MaxPageHits: 10, SelfDestruct: &selfDestruct, Tags: []string{"x", "y"}},
+		{ID: "bb", HasPassword: true, PageHits: 7, Paused: true, Title: "Docs"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "" +
+		"ID  DESTINATION          HITS  EXPIRES               PAUSED  PASSWORD  TITLE  TAGS\n" +
+		"a   https://example.com  3/10  2024-06-01T00:00:00Z  false   false            x,y\n" +
+		"bb                       7     -                     true    true      Docs   \n"
+	if out.String() != want {
+		t.Errorf("table =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestHasPassword(t *testing.T) {
+	hash, empty := "$2a$10$hash", ""
+	tests := []struct {
+		link client.Link
+		want bool
+	}{
+		{link: client.Link{}, want: false},
+		{link: client.Link{Password: &empty}, want: false},
+		{link: client.Link{Password: &hash}, want: true},
+		{link: client.Link{HasPassword: true}, want: true},
+	}
+	for _, test := range tests {
+		if got := hasPassword(test.link); got != test.want {
+			t.Errorf("hasPassword(%+v) = %v, want %v", test.link, got, test.want)
+		}
+	}
+}
+
+func TestWriteLinksCSV(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := writeLinksCSV(out, []client.Link{
+		{ID: "a", URL: "https://nolongr.test/a", Destination: "https://example.com/?q=a,b", PageHits: 3, HasPassword: true, Title: `Say "hi"`, Tags: []string{"x", "y"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(out.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"id", "url", "destination", "date_created", "self_destruct", "page_hits", "max_page_hits", "paused", "has_password", "title", "tags"},
+		{"a", "https://nolongr.test/a", "https://example.com/?q=a,b", "", "", "3", "0", "false", "true", `Say "hi"`, "x,y"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("records = %q, want %q", records, want)
+	}
+	for i := range want {
+		if strings.Join(records[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("record %d = %q, want %q", i, records[i], want[i])
+		}
+	}
+}
+
+func TestWriteLinkDetailsJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	details := linkDetails{Link: &client.Link{ID: "a"}, Stats: &client.Stats{ID: "a", PageHits: 1}}
+	if err := writeLinkDetails(out, OUTPUT_JSON, details); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"link": {`) || !strings.Contains(out.String(), `"stats": {`) {
+		t.Errorf("output = %s, want the link and its stats", out.String())
+	}
+}
@@ -1,25 +1,34 @@
 import { NextRequest, NextResponse } from "next/server";
 import { BASE_URL } from "./src/constants";
 
+// A ksuid, as set by the API before session cookies were signed
+const LEGACY_SESSION_TOKEN_REGEX = /^[0-9A-Za-z]{27}$/;
+
 export const middleware = async (req: NextRequest) => {
   const res = NextResponse.next();
 
-  const currentSessionToken = req.headers.get("cookie");
-  const splitCurrentSessionToken =
-    currentSessionToken && currentSessionToken?.split("=");
+  // Other cookies, such as csrf_token, are sent along, so the session cookie is looked up by name
+  const currentSessionToken = req.cookies.get("session_token")?.value;
 
-  if (splitCurrentSessionToken) {
-    const key: string = splitCurrentSessionToken[0];
-    const value: string = splitCurrentSessionToken[1];
-    res.cookies.set(key, value);
-  } else {
+  // Sessions from before the cookie was signed hold the bare token, which the API no longer accepts
+  if (
+    !currentSessionToken ||
+    LEGACY_SESSION_TOKEN_REGEX.test(currentSessionToken)
+  ) {
     const url = `${BASE_URL}/set-cookie`;
     const cookieRequest = await fetch(url);
-    const cookieResponse = await cookieRequest.json();
-    if (cookieResponse?.result) {
-      const key: string = cookieResponse?.result?.key;
-      const value: string = cookieResponse?.result?.value;
-      res.cookies.set(key, value);
+    // The signed session is in the cookie the API sets, not in the result
+    const signedSessionToken = cookieRequest.headers
+      .get("set-cookie")
+      ?.match(/session_token=([^;]+)/)?.[1];
+    if (signedSessionToken) {
+      res.cookies.set("session_token", signedSessionToken, {
+        path: "/",
+        maxAge: 60 * 60 * 1440,
+        httpOnly: true,
+        secure: true,
+        sameSite: "lax",
+      });
     }
   }
 
@@ -0,0 +1,290 @@
+// Package mockoidc is an OpenID Connect provider for trying out and testing single sign-on. It logs in anyone
+// without asking for a password: the authorization endpoint shows a form to pick the email to log in as, or logs
+// in as login_hint right away when one is given. Authorization codes are single use, expire after a minute and
+// need the PKCE S256 verifier.
+package mockoidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const codeTTL = time.Minute
+const idTokenTTL = 5 * time.Minute
+
+// KeyID is the kid of the key ID tokens are signed with.
+const KeyID = "mock-oidc"
+
+// authorization is what a code was issued for.
+type authorization struct {
+	clientID      string
+	redirectUri   string
+	codeChallenge string
+	nonce         string
+	email         string
+	expiresAt     time.Time
+}
+
+// Provider serves the discovery document, authorization, token and JWKS endpoints of Issuer to ClientID.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// EditIdToken, when set, may change the header and claims of the ID tokens the token endpoint issues, to see
+	// how clients handle bad tokens.
+	EditIdToken func(header map[string]interface{}, claims map[string]interface{})
+
+	key   *rsa.PrivateKey
+	mutex sync.Mutex
+	codes map[string]authorization
+}
+
+var loginForm = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<title>mock-oidc</title>
+<form method="get" action="/authorize">
+	{{range $name, $values := .}}{{if ne $name "login_hint"}}<input type="hidden" name="{{$name}}" value="{{index $values 0}}">
+	{{end}}{{end}}<label>Log in as <input type="email" name="login_hint" required autofocus></label>
+	<button type="submit">Log in</button>
+</form>
+`))
+
+// New returns a provider with a new signing key. The issuer must be the URL clients reach the provider at.
+func New(issuer string, clientID string, clientSecret string) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &Provider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		codes:        map[string]authorization{},
+	}, nil
+}
+
+// Handler serves the endpoints of the provider.
+func (mock *Provider) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", mock.handleDiscovery)
+	mux.HandleFunc("/authorize", mock.handleAuthorize)
+	mux.HandleFunc("/token", mock.handleToken)
+	mux.HandleFunc("/jwks", mock.handleJwks)
+	return mux
+}
+
+func writeJson(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(value)
+}
+
+func writeTokenError(writer http.ResponseWriter, code string, description string) {
+	writeJson(writer, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func randomString() (string, error) {
+	value := make([]byte, 24)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(value), nil
+}
+
+func (mock *Provider) handleDiscovery(writer http.ResponseWriter, request *http.Request) {
+	writeJson(writer, http.StatusOK, map[string]interface{}{
+		"issuer":                                mock.Issuer,
+		"authorization_endpoint":                mock.Issuer + "/authorize",
+		"token_endpoint":                        mock.Issuer + "/token",
+		"jwks_uri":                              mock.Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+	})
+}
+
+func (mock *Provider) handleJwks(writer http.ResponseWriter, request *http.Request) {
+	publicKey := mock.key.PublicKey
+	writeJson(writer, http.StatusOK, map[string]interface{}{
+		"keys": []interface{}{map[string]string{
+			"kid": KeyID,
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		}},
+	})
+}
+
+// handleAuthorize issues a code for login_hint, or shows the form to enter one. Errors about the client are
+// shown instead of redirected, as the redirect URI cannot be trusted then.
+func (mock *Provider) handleAuthorize(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	redirectUri, err := url.Parse(query.Get("redirect_uri"))
+	switch {
+	case query.Get("client_id") != mock.ClientID:
+		http.Error(writer, "unknown client_id", http.StatusBadRequest)
+		return
+	case err != nil || !redirectUri.IsAbs():
+		http.Error(writer, "redirect_uri must be an absolute URL", http.StatusBadRequest)
+		return
+	}
+
+	redirect := func(values url.Values) {
+		values.Set("state", query.Get("state"))
+		target := *redirectUri
+		target.RawQuery = values.Encode()
+		http.Redirect(writer, request, target.String(), http.StatusFound)
+	}
+	switch {
+	case query.Get("response_type") != "code":
+		redirect(url.Values{"error": {"unsupported_response_type"}})
+		return
+	case !strings.Contains(" "+query.Get("scope")+" ", " openid "):
+		redirect(url.Values{"error": {"invalid_scope"}, "error_description": {"the openid scope is required"}})
+		return
+	case query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256":
+		redirect(url.Values{"error": {"invalid_request"}, "error_description": {"PKCE with S256 is required"}})
+		return
+	}
+
+	email := strings.TrimSpace(query.Get("login_hint"))
+	if email == "" {
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginForm.Execute(writer, query)
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		redirect(url.Values{"error": {"server_error"}})
+		return
+	}
+	mock.mutex.Lock()
+	mock.codes[code] = authorization{
+		clientID:      mock.ClientID,
+		redirectUri:   redirectUri.String(),
+		codeChallenge: query.Get("code_challenge"),
+		nonce:         query.Get("nonce"),
+		email:         strings.ToLower(email),
+		expiresAt:     time.Now().Add(codeTTL),
+	}
+	mock.mutex.Unlock()
+	redirect(url.Values{"code": {code}})
+}
+
+// handleToken exchanges a code for an ID token, checking the client, redirect URI and PKCE verifier.
+func (mock *Provider) handleToken(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := request.ParseForm(); err != nil {
+		writeTokenError(writer, "invalid_request", err.Error())
+		return
+	}
+	clientID, clientSecret, hasBasicAuth := request.BasicAuth()
+	if hasBasicAuth {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = request.PostForm.Get("client_id"), request.PostForm.Get("client_secret")
+	}
+	if clientID != mock.ClientID || clientSecret != mock.ClientSecret {
+		writeJson(writer, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if request.PostForm.Get("grant_type") != "authorization_code" {
+		writeTokenError(writer, "unsupported_grant_type", "")
+		return
+	}
+
+	code := request.PostForm.Get("code")
+	mock.mutex.Lock()
+	auth, ok := mock.codes[code]
+	delete(mock.codes, code)
+	mock.mutex.Unlock()
+	verifierHash := sha256.Sum256([]byte(request.PostForm.Get("code_verifier")))
+	switch {
+	case !ok || time.Now().After(auth.expiresAt):
+		writeTokenError(writer, "invalid_grant", "unknown or expired code")
+		return
+	case auth.clientID != clientID || auth.redirectUri != request.PostForm.Get("redirect_uri"):
+		writeTokenError(writer, "invalid_grant", "the code was issued to another client or redirect_uri")
+		return
+	case base64.RawURLEncoding.EncodeToString(verifierHash[:]) != auth.codeChallenge:
+		writeTokenError(writer, "invalid_grant", "code_verifier does not match code_challenge")
+		return
+	}
+
+	idToken, err := mock.signIdToken(auth)
+	accessToken, tokenErr := randomString()
+	if err != nil || tokenErr != nil {
+		writeJson(writer, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJson(writer, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(idTokenTTL.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+// signIdToken returns an RS256 ID token for the email. The subject is derived from the email, so that logging in
+// as the same email again is the same account.
+func (mock *Provider) signIdToken(auth authorization) (string, error) {
+	subject := sha256.Sum256([]byte(auth.email))
+	now := time.Now()
+	header := map[string]interface{}{"alg": "RS256", "typ": "JWT", "kid": KeyID}
+	claims := map[string]interface{}{
+		"iss":            mock.Issuer,
+		"sub":            base64.RawURLEncoding.EncodeToString(subject[:12]),
+		"aud":            auth.clientID,
+		"exp":            now.Add(idTokenTTL).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          auth.nonce,
+		"email":          auth.email,
+		"email_verified": true,
+	}
+	if mock.EditIdToken != nil {
+		mock.EditIdToken(header, claims)
+	}
+	return mock.Sign(header, claims)
+}
+
+// Sign returns a JWT of the header and claims with an RS256 signature by the provider's key, whatever alg the
+// header names.
+func (mock *Provider) Sign(header map[string]interface{}, claims map[string]interface{}) (string, error) {
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	encodedClaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." + base64.RawURLEncoding.EncodeToString(encodedClaims)
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, mock.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -1,21 +1,17 @@
 import { useState } from "react";
-import bcrypt from "bcryptjs";
 import { GetServerSideProps } from "next/types";
 
 import { BASE_URL } from "@/src/constants";
 import { URLDataResponse } from "@/src/interfaces";
+import { CSRF_HEADER, getCsrfToken } from "@/src/utils";
 import ErrorBoundary from "@/src/components/ErrorBoundary";
 import LoadingIcon from "@/src/components/Icons/LoadingIcon";
 
 interface RedirectPageProps {
-  hashedPassword: string;
-  redirectionUrl: string;
+  id: string;
 }
 
-export const RedirectPage: React.FC<RedirectPageProps> = ({
-  hashedPassword,
-  redirectionUrl,
-}) => {
+export const RedirectPage: React.FC<RedirectPageProps> = ({ id }) => {
   const [password, setPassword] = useState<string>("");
   const [error, setError] = useState<string | null>(null);
   const [isLoading, setIsLoading] = useState(false);
@@ -25,17 +21,37 @@ export const RedirectPage: React.FC<RedirectPageProps> = ({
     setPassword(value);
   };
 
+  // The API checks the password, so the destination never reaches the browser before it is right
   const handleCheckPassword = async () => {
+    if (!password.trim()) return;
     setIsLoading(true);
-    if (redirectionUrl && password.trim()) {
-      const isSame = await bcrypt.compare(password, hashedPassword);
-      if (isSame) {
-        window.location.href = redirectionUrl;
-      } else {
+    setError(null);
+    try {
+      const response = await fetch(`/api/urls/${id}/resolve`, {
+        method: "POST",
+        credentials: "include",
+        headers: {
+          "Content-Type": "application/json",
+          [CSRF_HEADER]: await getCsrfToken(),
+        },
+        body: JSON.stringify({ password }),
+      });
+      const result: URLDataResponse = await response.json();
+      if (result.result?.destination) {
+        window.location.href = result.result.destination;
+        return;
+      }
+      if (result.error?.code === "wrong_password") {
         setError("Wrong password");
-        setIsLoading(false);
+      } else if (result.error?.code === "rate_limited") {
+        setError("Too many attempts, please try again later");
+      } else {
+        setError(result.error?.message || "Something went wrong");
       }
+    } catch (err) {
+      setError("Something went wrong");
     }
+    setIsLoading(false);
   };
 
   const handleClickCheckPassword = (e: React.MouseEvent<HTMLButtonElement>) => {
@@ -53,7 +69,7 @@ export const RedirectPage: React.FC<RedirectPageProps> = ({
 
   return (
     <main className="relative min-h-screen flex flex-col items-center p-2 bg-brand-green-200 pt-32">
-      {password && (
+      {id && (
         <>
           <h1 className="mb-2 text-3xl font-bold text-white">Password</h1>
           <form className="flex flex-col items-center justify-center">
@@ -95,12 +111,27 @@ export const RedirectPage: React.FC<RedirectPageProps> = ({
   );
 };
 
-export const getServerSideProps: GetServerSideProps = async ({ query }) => {
+export const getServerSideProps: GetServerSideProps = async ({ query, req }) => {
   const shortId = query["id"];
 
   try {
+    const apiKey = process.env.NOLONGR_SERVER_API_KEY;
+    // Rate limits of requests sent with the API key apply to the visitor IP
+    const visitorHeaders: Record<string, string> = {
+      Authorization: `Bearer ${apiKey}`,
+    };
+    const forwardedFor = req.headers["x-forwarded-for"];
+    const visitorIp = Array.isArray(forwardedFor)
+      ? forwardedFor[0]
+      : forwardedFor?.split(",")[0] || req.socket.remoteAddress;
+    if (visitorIp) visitorHeaders["X-Visitor-Ip"] = visitorIp.trim();
+    ["user-agent", "referer", "dnt", "sec-gpc"].forEach((header) => {
+      const value = req.headers[header];
+      if (typeof value === "string") visitorHeaders[header] = value;
+    });
+
     const url = `${BASE_URL}/urls/${shortId}`;
-    const response = await fetch(url);
+    const response = await fetch(url, { headers: visitorHeaders });
     const result = await response.json();
     const data: URLDataResponse | null = result || null;
 
@@ -113,10 +144,13 @@ export const getServerSideProps: GetServerSideProps = async ({ query }) => {
       };
       console.error(`SERVERSIDE [ID] PAGE ERROR: ${shortId}`, error);
       return { notFound: true };
+    } else if (data && data.result && data.result.has_password) {
+      // Visitors send the password to the API, which counts the page view once it is right
+      return { props: { id: data.result.id } };
     } else if (data && data.result && data.result.destination) {
-      const apiKey = process.env.NOLONGR_SERVER_API_KEY;
       const urlDataAfterPageHitResponse = await fetch(
-        `${BASE_URL}/urls/page-views/${shortId}?api_key=${apiKey}`
+        `${BASE_URL}/urls/page-views/${shortId}`,
+        { headers: visitorHeaders }
       );
       const urlDataAfterPageHitResult =
         await urlDataAfterPageHitResponse.json();
@@ -139,16 +173,6 @@ export const getServerSideProps: GetServerSideProps = async ({ query }) => {
         return { notFound: true };
       }
 
-      const hashedPassword = data.result?.password?.trim() || null;
-      if (hashedPassword) {
-        return {
-          props: {
-            hashedPassword,
-            redirectionUrl: data.result.destination,
-          },
-        };
-      }
-
       return {
         redirect: {
           destination: data.result.destination,
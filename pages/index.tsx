@@ -12,12 +12,12 @@ import {
   selfDestructDurations,
 } from "@/src/constants";
 import { URLData, URLDataNextAPI } from "@/src/interfaces";
+import { CSRF_HEADER, getCsrfToken } from "@/src/utils";
 
 import LoadingIcon from "@/src/components/Icons/LoadingIcon";
 import GitHubLink from "@/src/components/Icons/GitHubLink";
 import ChevronIcon from "@/src/components/Icons/ChevronIcon";
 import { UrlItem } from "@/src/components/Home/UrlItem";
-import { encodeObjectToQueryParams } from "@/src/utils";
 
 interface HomeProps {
   userUrls: URLData[];
@@ -67,21 +67,19 @@ export const Home: React.FC<HomeProps> = ({ userUrls }) => {
     if (isLoading) return;
     setIsLoading(true);
 
-    const urlParams = encodeObjectToQueryParams({
-      destination: destinationUrl,
-      self_destruct: selectedDuration,
-      max_page_hits: maxPageHits,
-    });
-
-    const url = `/api/urls?${urlParams}`;
+    const url = `/api/urls`;
     const response = await fetch(url, {
       credentials: "include",
       headers: {
         Accept: "application/json",
         "Content-Type": "application/json",
+        [CSRF_HEADER]: await getCsrfToken(),
       },
       method: "POST",
       body: JSON.stringify({
+        destination: destinationUrl,
+        self_destruct: selectedDuration,
+        max_page_hits: maxPageHits,
         password,
       }),
     });
@@ -280,13 +278,15 @@ export const getServerSideProps: GetServerSideProps = async ({ req }) => {
 
   try {
     if (sessionToken) {
-      const url = `${BASE_URL}/user-session-urls?session_token=${sessionToken}`;
+      const url = `${BASE_URL}/user-session-urls`;
 
+      // The API reads the session from the signed cookie, so the browser's cookies are passed on
       const urlDataRequest = await fetch(url, {
         credentials: "include",
         headers: {
           Accept: "application/json",
           "Content-Type": "application/json",
+          Cookie: req.headers.cookie ?? "",
         },
         method: "GET",
       });
@@ -1,14 +1,18 @@
 import React from "react";
 import { useQRCode } from "next-qrcode";
 import Countdown from "react-countdown";
-import { getCookie } from "cookies-next";
 import { saveAs } from "file-saver";
 import html2canvas from "html2canvas";
 
 import { useToast } from "@/src/context/ToastContext";
 import { useModal } from "@/src/context/ModalContext";
 import { useCopyToClipboard } from "@/src/hooks";
-import { encodeObjectToQueryParams, truncateText } from "@/src/utils";
+import {
+  CSRF_HEADER,
+  encodeObjectToQueryParams,
+  getCsrfToken,
+  truncateText,
+} from "@/src/utils";
 import { URLData, URLDataNextAPI } from "@/src/interfaces";
 
 import ClipboardIcon from "@/src/components/Icons/ClipboardIcon";
@@ -105,10 +109,9 @@ export const UrlItem: React.FC<{
         newUrlInDeletionProgress,
       ]);
 
-      const sessionToken = getCookie("session_token");
+      // The API deletes the link only if the signed session cookie owns it
       const urlParams = encodeObjectToQueryParams({
         id: selectedUrlItem.id,
-        session_token: sessionToken,
       });
 
       const url = `/api/delete-url?${urlParams}`;
@@ -117,6 +120,7 @@ export const UrlItem: React.FC<{
         headers: {
           Accept: "application/json",
           "Content-Type": "application/json",
+          [CSRF_HEADER]: await getCsrfToken(),
         },
         method: "DELETE",
       });
@@ -4,16 +4,21 @@ export interface URLData {
   destination: string;
   max_page_hits: number;
   page_hits: number;
-  password?: string | null;
+  has_password?: boolean;
   self_destruct: string | null;
   session_token?: string | null;
   url: string;
+  paused?: boolean;
+  title?: string;
+  tags?: string[];
 }
 
 export interface URLError {
   error: string;
   message: string;
   errorCode: number;
+  code: string;
+  id?: string;
 }
 
 export type URLDataResponse =
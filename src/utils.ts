@@ -1,3 +1,5 @@
+import { getCookie } from "cookies-next";
+
 export const getIdFromPathname = (pathname: string): string | null => {
   if (pathname && pathname.slice(0, 5) === "/urls") {
     const numberOfSlashes = pathname.split("/").filter((item) => item).length;
@@ -27,3 +29,15 @@ export const encodeObjectToQueryParams = (obj: Record<string, any>): string => {
     .join("&");
   return queryParams;
 };
+
+export const CSRF_HEADER = "X-CSRF-Token";
+
+// Requests changing state send the csrf_token cookie back in the X-CSRF-Token header.
+// The API sets the cookie the first time the token is fetched.
+export const getCsrfToken = async (): Promise<string> => {
+  const token = getCookie("csrf_token");
+  if (typeof token === "string" && token) return token;
+  const response = await fetch("/api/csrf-token", { credentials: "include" });
+  const result = await response.json();
+  return result?.result?.token ?? "";
+};